@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requeueTasks resets matching failed tasks back to pending and re-notifies
+// the task worker for each of them.
+func requeueTasks(store TaskStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var filter taskFilter
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+				http.Error(w, "failed to decode request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		requeued, err := store.RequeueTasks(withActor(r.Context(), "admin", ""), filter)
+		if err != nil {
+			log.Printf("Error requeueing tasks: %v\n", err)
+			http.Error(w, "failed to requeue tasks", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, map[string]int64{"requeued": requeued})
+	}
+}
+
+// requeueNotifications resets matching failed notifications back to pending
+// and re-notifies the notification worker, which retries the subscriptions
+// each of them failed to reach.
+func requeueNotifications(store NotificationStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var filter notificationFilter
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+				http.Error(w, "failed to decode request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		requeued, err := store.RequeueNotifications(withActor(r.Context(), "admin", ""), filter)
+		if err != nil {
+			log.Printf("Error requeueing notifications: %v\n", err)
+			http.Error(w, "failed to requeue notifications", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, map[string]int64{"requeued": requeued})
+	}
+}
+
+// purgeRequest selects which completed rows are purged.
+type purgeRequest struct {
+	Entity    string `json:"entity"`
+	OlderThan string `json:"older_than"`
+}
+
+// purge deletes completed rows of an entity that were last updated before the
+// requested age and reports how many were deleted.
+func purge(store Store) http.HandlerFunc {
+	purgers := map[string]func(ctx context.Context, before time.Time) (int64, error){
+		"tasks":         store.PurgeTasks,
+		"notifications": store.PurgeNotifications,
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req purgeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			return
+		}
+
+		purger, ok := purgers[req.Entity]
+		if !ok {
+			http.Error(w, "entity must be one of tasks, notifications", http.StatusBadRequest)
+			return
+		}
+
+		olderThan, err := time.ParseDuration(req.OlderThan)
+		if err != nil || olderThan <= 0 {
+			http.Error(w, "older_than must be a positive duration", http.StatusBadRequest)
+			return
+		}
+
+		deleted, err := purger(r.Context(), time.Now().Add(-olderThan))
+		if err != nil {
+			log.Printf("Error purging %s: %v\n", req.Entity, err)
+			http.Error(w, "failed to purge rows", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, map[string]int64{"deleted": deleted})
+	}
+}
+
+// testPushPayload is the canned notification sent by testSubscription.
+const testPushPayload = `{"body":"Test notification"}`
+
+// testSubscription sends a canned push to a single subscription and returns
+// the push service's response so delivery problems can be debugged.
+func testSubscription(cfg config, store SubscriptionStore, client *http.Client, keys *vapidKeyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid subscription id", http.StatusBadRequest)
+			return
+		}
+
+		sub, err := store.GetSubscription(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "subscription not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to read subscription", http.StatusInternalServerError)
+			return
+		}
+
+		key, err := keys.signingKey(r.Context(), sub.VAPIDPublicKey)
+		if err != nil {
+			http.Error(w, "failed to read vapid keys", http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := pushContext(r.Context(), cfg)
+		defer cancel()
+		response, err := deliverPush(ctx, cfg, client, key, []byte(testPushPayload), sub)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to send push: %s", err), http.StatusBadGateway)
+			return
+		}
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			http.Error(w, "failed to read push service response", http.StatusBadGateway)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, map[string]any{
+			"status_code": response.StatusCode,
+			"body":        string(body),
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// scaleConfig controls how many processor goroutines a worker may run.
+type scaleConfig struct {
+	Min           int
+	Max           int
+	Interval      time.Duration
+	TargetLatency time.Duration
+}
+
+// autoscaler dispatches notifications to a set of processor goroutines whose
+// size moves between min and max. It grows while notifications are queued or
+// processing is slower than the target latency, and shrinks back toward min
+// once the backlog has drained.
+type autoscaler struct {
+	cfg       scaleConfig
+	logger    *slog.Logger
+	channel   string
+	processor NotificationProcessor
+
+	jobs chan batchJob
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	workers int
+	seq     int
+	latency time.Duration
+}
+
+// newAutoscaler creates an autoscaler for the specified channel. Processors
+// are not started until run is called.
+func newAutoscaler(cfg scaleConfig, logger *slog.Logger, channel string, processor NotificationProcessor) *autoscaler {
+	if cfg.Min < 1 {
+		cfg.Min = 1
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	return &autoscaler{
+		cfg:       cfg,
+		logger:    logger,
+		channel:   channel,
+		processor: processor,
+		jobs:      make(chan batchJob, cfg.Max*4),
+		stop:      make(chan struct{}),
+	}
+}
+
+// run starts the minimum number of processors and adjusts the pool size until
+// the context is cancelled, then stops the processors, which finish the
+// notification they are processing but take no new ones. Processors run
+// with the work context, so cancelling it interrupts them too. It returns
+// once every processor has exited.
+func (a *autoscaler) run(ctx, work context.Context) {
+	for i := 0; i < a.cfg.Min; i++ {
+		a.grow(work)
+	}
+
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			close(a.stop)
+			a.wg.Wait()
+			return
+		case <-ticker.C:
+			a.scale(work)
+		}
+	}
+}
+
+// submit queues each notification in a batch for a processor of its own.
+// It blocks while the queue is full and returns false if the context is
+// cancelled first.
+func (a *autoscaler) submit(ctx context.Context, batch []*pgconn.Notification) bool {
+	for _, job := range batchJobs(batch) {
+		select {
+		case a.jobs <- job:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// scale adds or removes a single processor based on queue depth and the
+// average processing latency.
+func (a *autoscaler) scale(ctx context.Context) {
+	depth := len(a.jobs)
+
+	a.mu.Lock()
+	workers := a.workers
+	slow := a.cfg.TargetLatency > 0 && a.latency > a.cfg.TargetLatency
+	a.mu.Unlock()
+
+	switch {
+	case workers < a.cfg.Max && (depth > workers || (depth > 0 && slow)):
+		a.grow(ctx)
+		a.logger.InfoContext(ctx, "Worker scaled up",
+			slog.String("channel", a.channel), slog.Int("workers", workers+1), slog.Int("depth", depth))
+	case workers > a.cfg.Min && depth == 0:
+		select {
+		case a.stop <- struct{}{}:
+			a.logger.InfoContext(ctx, "Worker scaled down",
+				slog.String("channel", a.channel), slog.Int("workers", workers-1))
+		default:
+			// Every processor is busy, try again on the next tick
+		}
+	}
+}
+
+// grow starts a new processor goroutine. Each processor is numbered and
+// attributes its work to the worker id "hostname/channel/n".
+func (a *autoscaler) grow(ctx context.Context) {
+	a.mu.Lock()
+	a.workers++
+	a.seq++
+	n := a.seq
+	a.mu.Unlock()
+
+	parent := actorFromContext(ctx)
+	id := fmt.Sprintf("%s/%d", parent.WorkerID, n)
+	if parent.WorkerID == "" {
+		id = fmt.Sprintf("%s/%d", a.channel, n)
+	}
+	ctx = withActor(ctx, parent.Name, id)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.logger.InfoContext(ctx, "Worker started", slog.String("channel", a.channel))
+		defer func() {
+			a.mu.Lock()
+			a.workers--
+			a.mu.Unlock()
+			a.logger.InfoContext(ctx, "Worker stopped", slog.String("channel", a.channel))
+		}()
+
+		for {
+			// Stopping takes precedence over the notifications still queued
+			select {
+			case <-a.stop:
+				return
+			default:
+			}
+			select {
+			case <-a.stop:
+				return
+			case job := <-a.jobs:
+				a.process(ctx, job)
+			}
+		}
+	}()
+}
+
+// process runs the processor for a notification and records how long it
+// took. Logging its errors and recovering its panics are left to the
+// processor's middleware.
+func (a *autoscaler) process(ctx context.Context, job batchJob) {
+	start := time.Now()
+	processJob(ctx, a.processor, job)
+	elapsed := time.Since(start)
+
+	// Exponentially weighted moving average keeps the signal stable across
+	// bursts of very fast or very slow items.
+	a.mu.Lock()
+	if a.latency == 0 {
+		a.latency = elapsed
+	} else {
+		a.latency = (a.latency*4 + elapsed) / 5
+	}
+	a.mu.Unlock()
+}
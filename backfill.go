@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// backfillOptions are the flags of the backfill command.
+type backfillOptions struct {
+	channel string
+	filter  backfillFilter
+	direct  bool
+	dryRun  bool
+}
+
+// parseBackfillOptions parses the backfill command's flags.
+func parseBackfillOptions(args []string) (backfillOptions, error) {
+	var opts backfillOptions
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.StringVar(&opts.channel, "channel", tasksChannel, "channel whose work to backfill, "+tasksChannel+" or "+notificationsChannel)
+	fs.StringVar(&opts.filter.Status, "status", "pending", "status of the work to backfill")
+	fs.StringVar(&opts.filter.Type, "type", "", "only backfill tasks of this type")
+	fs.Func("since", "only backfill work created at or after this RFC 3339 time", func(s string) error {
+		t, err := time.Parse(time.RFC3339, s)
+		opts.filter.Since = &t
+		return err
+	})
+	fs.Func("until", "only backfill work created before this RFC 3339 time", func(s string) error {
+		t, err := time.Parse(time.RFC3339, s)
+		opts.filter.Until = &t
+		return err
+	})
+	fs.BoolVar(&opts.direct, "direct", false, "process the work in this process instead of notifying the workers")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "only report how much work matches")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.channel != tasksChannel && opts.channel != notificationsChannel {
+		return opts, fmt.Errorf("backfill: channel must be %s or %s", tasksChannel, notificationsChannel)
+	}
+	if opts.filter.Type != "" && opts.channel != tasksChannel {
+		return opts, fmt.Errorf("backfill: type only applies to %s", tasksChannel)
+	}
+	if opts.filter.Status == "" {
+		return opts, fmt.Errorf("backfill: status must not be empty")
+	}
+	return opts, nil
+}
+
+// backfill recovers work the workers never heard about, after a trigger
+// misconfiguration or an outage longer than the backlog catch-up covers. By
+// default the matching work is moved back to pending and the workers are
+// notified about it again. With -direct it is processed in this process
+// instead, one item at a time, the way the workers would.
+func backfill(ctx context.Context, cfg config, logger *slog.Logger, store Store, cipher *bodyCipher, wait connectWait, args []string) error {
+	opts, err := parseBackfillOptions(args)
+	if err != nil {
+		return err
+	}
+	if err := waitForConnection(ctx, store, wait); err != nil {
+		return fmt.Errorf("backfill failed to connect to database: %w", err)
+	}
+	ctx = withActor(ctx, "backfill", "")
+
+	if opts.dryRun || opts.direct {
+		payloads, err := store.Backfill(ctx, opts.channel, opts.filter)
+		if err != nil {
+			return fmt.Errorf("failed to read work to backfill: %w", err)
+		}
+		if opts.dryRun {
+			logger.InfoContext(ctx, "Backfill dry run",
+				slog.String("channel", opts.channel), slog.String("status", opts.filter.Status), slog.Int("matched", len(payloads)))
+			return nil
+		}
+		return backfillDirect(ctx, cfg, logger, store, cipher, opts.channel, payloads)
+	}
+
+	renotified, err := store.Renotify(ctx, opts.channel, opts.filter)
+	if err != nil {
+		return fmt.Errorf("failed to renotify: %w", err)
+	}
+	logger.InfoContext(ctx, "Backfill renotified",
+		slog.String("channel", opts.channel), slog.String("status", opts.filter.Status), slog.Int64("renotified", renotified))
+	return nil
+}
+
+// backfillDirect runs the payloads through the channel's processor, logging
+// and counting failures rather than stopping at them.
+func backfillDirect(ctx context.Context, cfg config, logger *slog.Logger, store Store, cipher *bodyCipher, channel string, payloads []string) error {
+	limiter := newRateLimiter(store)
+	opts, err := cfg.worker(channel, limiter)
+	if err != nil {
+		return err
+	}
+
+	var process NotificationProcessor
+	switch channel {
+	case tasksChannel:
+		flags, err := newFlagCache(ctx, store, cfg.FlagCacheTTL)
+		if err != nil {
+			return fmt.Errorf("failed to load feature flags: %w", err)
+		}
+		process = processTask(logger, store, taskHandlers(logger, opts.retry, cfg.TaskLogUnregistered), cfg.TaskTimeout, cfg.TaskLease, cfg.TaskCancelCheckInterval, cfg.taskCallback(), flags)
+	case notificationsChannel:
+		if err := validateContentEncoding(cfg.PushContentEncoding); err != nil {
+			return fmt.Errorf("error loading configuration: %w", err)
+		}
+		client, err := newPushClient(cfg, nil)
+		if err != nil {
+			return err
+		}
+		keys, err := newVAPIDKeyring(ctx, store, cfg)
+		if err != nil {
+			return err
+		}
+		process = processNotification(cfg, logger, store, client, keys, newBulkhead(cfg.PushOriginConcurrency),
+			rateLimit{limiter: limiter, key: "push", rate: cfg.RateLimitPush, burst: cfg.RateLimitPushBurst}, opts.retry, cipher)
+	}
+
+	// Errors are logged below, along with whether the backfill carries on
+	process = chainProcessor(process, traceProcessor, recoverProcessor(logger, channel))
+
+	var failed int
+	for _, payload := range payloads {
+		if err := process(ctx, &pgconn.Notification{Channel: channel, Payload: payload}); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failed++
+			logger.ErrorContext(ctx, "Error backfilling", slog.String("channel", channel), slog.Any("error", err))
+		}
+	}
+	logger.InfoContext(ctx, "Backfill processed",
+		slog.String("channel", channel), slog.Int("processed", len(payloads)-failed), slog.Int("failed", failed))
+	if failed > 0 {
+		return fmt.Errorf("failed to backfill %d of %d item(s)", failed, len(payloads))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Backoff decides how long to wait before retrying an operation.
+type Backoff interface {
+	// Delay returns the wait before the given retry attempt, starting at 1.
+	Delay(attempt int) time.Duration
+}
+
+// BackoffFunc adapts a function to a Backoff for custom strategies.
+type BackoffFunc func(attempt int) time.Duration
+
+func (f BackoffFunc) Delay(attempt int) time.Duration { return f(attempt) }
+
+// fixedBackoff waits the same duration before every attempt.
+type fixedBackoff time.Duration
+
+func (b fixedBackoff) Delay(attempt int) time.Duration { return time.Duration(b) }
+
+// exponentialBackoff doubles the delay on every attempt up to Max.
+type exponentialBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b exponentialBackoff) Delay(attempt int) time.Duration {
+	d := b.Base
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	return min(d, b.Max)
+}
+
+// jitterBackoff picks a random delay up to the wrapped strategy's delay, so
+// many clients retrying at once spread out instead of arriving together.
+type jitterBackoff struct {
+	Backoff
+}
+
+func (b jitterBackoff) Delay(attempt int) time.Duration {
+	d := b.Backoff.Delay(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d + 1)
+}
+
+// parseBackoff parses a backoff strategy from its configuration form:
+// fixed/<delay>, exponential/<base>/<max>, or exponential-jitter/<base>/<max>.
+func parseBackoff(spec string) (Backoff, error) {
+	parts := strings.Split(spec, "/")
+	durations := make([]time.Duration, len(parts)-1)
+	for i, part := range parts[1:] {
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backoff %q: %w", spec, err)
+		}
+		durations[i] = d
+	}
+
+	switch {
+	case parts[0] == "fixed" && len(durations) == 1:
+		return fixedBackoff(durations[0]), nil
+	case parts[0] == "exponential" && len(durations) == 2:
+		return exponentialBackoff{Base: durations[0], Max: durations[1]}, nil
+	case parts[0] == "exponential-jitter" && len(durations) == 2:
+		return jitterBackoff{exponentialBackoff{Base: durations[0], Max: durations[1]}}, nil
+	default:
+		return nil, fmt.Errorf("invalid backoff %q", spec)
+	}
+}
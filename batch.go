@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// batchConfig controls how a worker gathers notifications arriving in a
+// burst into batches.
+type batchConfig struct {
+	// Window is how long to wait for more notifications once one arrives.
+	// Zero only batches those already queued.
+	Window time.Duration
+	// Size caps the notifications in a batch, 1 or less to not batch
+	Size int
+}
+
+var batchSizes = metrics.histogram("worker_batch_size",
+	"Notifications dispatched to a processor together, by channel.",
+	[]float64{1, 2, 5, 10, 25, 50, 100, 250, 500}, "channel")
+
+// notificationBatch is shared by the notifications processed together, so
+// the subscriptions they fan out to are only read once for all of them.
+type notificationBatch struct {
+	once          sync.Once
+	subscriptions []subscription
+	err           error
+}
+
+type batchKey struct{}
+
+// withBatch returns a context whose notifications are processed as part of
+// the batch.
+func withBatch(ctx context.Context, batch *notificationBatch) context.Context {
+	return context.WithValue(ctx, batchKey{}, batch)
+}
+
+// batchSubscriptions returns every subscription, read once for the whole
+// batch when the context is processing one. The subscriptions returned are
+// shared, so they mustn't be modified.
+func batchSubscriptions(ctx context.Context, store SubscriptionStore) ([]subscription, error) {
+	batch, ok := ctx.Value(batchKey{}).(*notificationBatch)
+	if !ok {
+		return store.ListSubscriptions(ctx)
+	}
+	batch.once.Do(func() {
+		batch.subscriptions, batch.err = store.ListSubscriptions(ctx)
+	})
+	return batch.subscriptions, batch.err
+}
+
+// gatherBatch takes the next notification off the queue, waiting for one,
+// along with any more that arrive within the window, up to the batch size.
+// It returns false if the context is cancelled before there is one.
+func gatherBatch(ctx context.Context, queue *fairQueue, cfg batchConfig) ([]*pgconn.Notification, bool) {
+	notification, ok := queue.pop(ctx)
+	if !ok {
+		return nil, false
+	}
+	batch := []*pgconn.Notification{notification}
+	if cfg.Size <= 1 {
+		return batch, true
+	}
+
+	windowCtx, cancel := context.WithTimeout(ctx, cfg.Window)
+	defer cancel()
+	for len(batch) < cfg.Size {
+		notification, ok := queue.pop(windowCtx)
+		if !ok {
+			break
+		}
+		batch = append(batch, notification)
+	}
+	return batch, true
+}
+
+// batchJob is a notification queued for a processor, along with the batch
+// it arrived in, if any.
+type batchJob struct {
+	notification *pgconn.Notification
+	batch        *notificationBatch
+}
+
+// batchJobs returns a job for each notification in the batch, sharing a
+// single read of the subscriptions. The jobs are processed separately, so
+// they spread across the processors like notifications that arrive alone.
+func batchJobs(batch []*pgconn.Notification) []batchJob {
+	var shared *notificationBatch
+	if len(batch) > 1 {
+		shared = &notificationBatch{}
+	}
+	jobs := make([]batchJob, len(batch))
+	for i, notification := range batch {
+		jobs[i] = batchJob{notification: notification, batch: shared}
+	}
+	return jobs
+}
+
+// processJob runs the processor for the job's notification, as part of its
+// batch.
+func processJob(ctx context.Context, processor NotificationProcessor, job batchJob) {
+	if job.batch != nil {
+		ctx = withBatch(ctx, job.batch)
+	}
+	processor(ctx, job.notification)
+}
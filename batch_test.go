@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// countingSubscriptionStore counts the reads of the subscriptions.
+type countingSubscriptionStore struct {
+	*memoryStore
+	reads atomic.Int64
+}
+
+func (s *countingSubscriptionStore) ListSubscriptions(ctx context.Context) ([]subscription, error) {
+	s.reads.Add(1)
+	return s.memoryStore.ListSubscriptions(ctx)
+}
+
+func TestBatchJobsShareSubscriptions(t *testing.T) {
+	store := &countingSubscriptionStore{memoryStore: newMemoryStore()}
+	processor := func(ctx context.Context, notification *pgconn.Notification) error {
+		_, err := batchSubscriptions(ctx, store)
+		return err
+	}
+
+	batch := []*pgconn.Notification{{Payload: "1"}, {Payload: "2"}, {Payload: "3"}}
+	var wg sync.WaitGroup
+	for _, job := range batchJobs(batch) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			processJob(context.Background(), processor, job)
+		}()
+	}
+	wg.Wait()
+	if reads := store.reads.Load(); reads != 1 {
+		t.Errorf("subscriptions read %d time(s) for a batch, want 1", reads)
+	}
+
+	for _, job := range batchJobs(batch[:1]) {
+		processJob(context.Background(), processor, job)
+	}
+	if reads := store.reads.Load(); reads != 2 {
+		t.Errorf("subscriptions read %d time(s) after a lone notification, want 2", reads)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// benchTaskType is the type of the tasks the benchmarks enqueue.
+const benchTaskType = "bench"
+
+// Defaults for the claim and fan-out benchmarks, shared by the bench command
+// and go test -bench.
+const (
+	benchWorkers       = 8
+	benchSubscriptions = 100
+)
+
+// benchOptions are the flags of the bench command.
+type benchOptions struct {
+	run           *regexp.Regexp
+	benchtime     string
+	workers       int
+	subscriptions int
+}
+
+// benchmark is a queue core benchmark run by the bench command.
+type benchmark struct {
+	name string
+	fn   func(b *testing.B)
+}
+
+// bench runs the queue core benchmarks against the configured store and
+// prints the results in the format of go test -bench, so runs can be
+// compared with benchstat. The benchmarks are the same ones bench_test.go
+// runs under go test -bench. Run it against a scratch database: the
+// benchmarks insert tasks and claim whatever is pending.
+func bench(ctx context.Context, logger *slog.Logger, store Store, wait connectWait, args []string) error {
+	var opts benchOptions
+	var run string
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.StringVar(&run, "run", ".", "regular expression selecting the benchmarks to run")
+	fs.StringVar(&opts.benchtime, "benchtime", "1s", "run each benchmark for this long, or Nx times")
+	fs.IntVar(&opts.workers, "workers", benchWorkers, "concurrent claimers in the claim benchmark")
+	fs.IntVar(&opts.subscriptions, "subscriptions", benchSubscriptions, "subscriptions each notification fans out to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var err error
+	if opts.run, err = regexp.Compile(run); err != nil {
+		return fmt.Errorf("invalid -run: %w", err)
+	}
+
+	testing.Init()
+	if err := flag.Set("test.benchtime", opts.benchtime); err != nil {
+		return fmt.Errorf("invalid -benchtime: %w", err)
+	}
+
+	if err := waitForConnection(ctx, store, wait); err != nil {
+		return fmt.Errorf("bench failed to connect to database: %w", err)
+	}
+	ctx = withActor(ctx, "bench", "")
+
+	benchmarks := []benchmark{
+		{name: "Enqueue", fn: benchmarkEnqueue(ctx, store)},
+		{name: "EnqueueParallel", fn: benchmarkEnqueueParallel(ctx, store)},
+		{name: "ClaimSkipLocked", fn: benchmarkClaim(ctx, store, opts.workers)},
+		{name: "NotificationFanOut", fn: benchmarkFanOut(ctx, opts.subscriptions)},
+	}
+	for _, bm := range benchmarks {
+		if !opts.run.MatchString(bm.name) {
+			continue
+		}
+		result := testing.Benchmark(bm.fn)
+		if result.N == 0 {
+			logger.WarnContext(ctx, "Benchmark skipped", slog.String("benchmark", bm.name))
+			continue
+		}
+		fmt.Printf("Benchmark%s\t%s\t%s\n", bm.name, result.String(), result.MemString())
+	}
+	return nil
+}
+
+// benchTaskIDs generates unique task ids across concurrent enqueuers.
+var benchTaskIDs atomic.Int64
+
+// newBenchTask returns a pending bench task with a unique id.
+func newBenchTask() task {
+	now := time.Now()
+	return task{
+		ID:      fmt.Sprintf("bench-%d-%d", now.UnixNano(), benchTaskIDs.Add(1)),
+		Type:    benchTaskType,
+		Payload: json.RawMessage(`{}`),
+		Status:  "pending",
+		Created: now,
+		Updated: now,
+	}
+}
+
+// benchmarkEnqueue measures inserting one task at a time.
+func benchmarkEnqueue(ctx context.Context, store TaskStore) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := store.CreateTask(ctx, newBenchTask()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchmarkEnqueueParallel measures inserting tasks from GOMAXPROCS
+// goroutines at once.
+func benchmarkEnqueueParallel(ctx context.Context, store TaskStore) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := store.CreateTask(ctx, newBenchTask()); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+}
+
+// benchmarkClaim measures claiming tasks from workers goroutines contending
+// for the same queue. It is skipped for stores without claiming.
+func benchmarkClaim(ctx context.Context, store Store, workers int) func(b *testing.B) {
+	return func(b *testing.B) {
+		claimer, ok := unwrapStore(store).(taskClaimer)
+		if !ok {
+			b.Skip("store does not support claiming")
+		}
+
+		b.StopTimer()
+		for i := 0; i < b.N; i++ {
+			if err := store.CreateTask(ctx, newBenchTask()); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+
+		b.ReportAllocs()
+		procs := runtime.GOMAXPROCS(0)
+		b.SetParallelism(max(1, (workers+procs-1)/procs))
+		var claimed atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, _, err := claimer.ClaimTask(ctx, time.Now(), time.Now().Add(time.Minute)); err != nil {
+					b.Error(err)
+					return
+				}
+				claimed.Add(1)
+			}
+		})
+		b.ReportMetric(float64(claimed.Load())/b.Elapsed().Seconds(), "claims/s")
+	}
+}
+
+// benchmarkFanOut measures broadcasting a notification to subscriptions
+// subscriptions of a local push service. It runs on an in-memory store so
+// it measures the delivery pipeline rather than the database.
+func benchmarkFanOut(ctx context.Context, subscriptions int) func(b *testing.B) {
+	return func(b *testing.B) {
+		pushService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer pushService.Close()
+
+		privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
+		if err != nil {
+			b.Fatal(err)
+		}
+		cfg := config{VapidPublicKey: publicKey, VapidPrivateKey: privateKey, PushTimeout: 10 * time.Second}
+
+		store := newMemoryStore()
+		for i := 0; i < subscriptions; i++ {
+			sub, err := newBenchSubscription(fmt.Sprintf("%s/%d", pushService.URL, i))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := store.CreateSubscription(ctx, sub); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		keys, err := newVAPIDKeyring(ctx, store, cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+		process := processNotification(cfg, logger, store, pushService.Client(), keys, newBulkhead(16),
+			rateLimit{}, RetryPolicy{MaxAttempts: 1}, nil)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			now := time.Now()
+			if _, err := store.CreateNotification(ctx, notification{Body: "bench", Created: now, Updated: now}); err != nil {
+				b.Fatal(err)
+			}
+			notifications, err := store.ListNotifications(ctx, notificationListFilter{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			payload, err := json.Marshal(notifications[len(notifications)-1])
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+
+			if err := process(ctx, &pgconn.Notification{Channel: notificationsChannel, Payload: string(payload)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*subscriptions)/b.Elapsed().Seconds(), "pushes/s")
+	}
+}
+
+// newBenchSubscription returns a subscription with freshly generated keys.
+func newBenchSubscription(endpoint string) (subscription, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return subscription{}, err
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		return subscription{}, err
+	}
+
+	var sub subscription
+	sub.Endpoint = endpoint
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	return sub, nil
+}
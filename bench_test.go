@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// benchStore returns the store the benchmarks run against: Postgres at
+// BENCH_DATABASE_URL, applying the schema if it is missing, or an in-memory
+// store when it isn't set. As with the bench command, only ever point it at
+// a scratch database.
+func benchStore(b *testing.B) Store {
+	url := os.Getenv("BENCH_DATABASE_URL")
+	if url == "" {
+		return newMemoryStore()
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(pool.Close)
+	store := newPostgresStore(pool, "")
+	if err := prepareSchema(ctx, slog.New(slog.NewJSONHandler(io.Discard, nil)), store, true); err != nil {
+		b.Fatal(err)
+	}
+	return store
+}
+
+// benchContext returns the context the benchmarks enqueue with.
+func benchContext() context.Context {
+	return withActor(context.Background(), "bench", "")
+}
+
+func BenchmarkEnqueue(b *testing.B) {
+	benchmarkEnqueue(benchContext(), benchStore(b))(b)
+}
+
+func BenchmarkEnqueueParallel(b *testing.B) {
+	benchmarkEnqueueParallel(benchContext(), benchStore(b))(b)
+}
+
+func BenchmarkClaimSkipLocked(b *testing.B) {
+	benchmarkClaim(benchContext(), benchStore(b), benchWorkers)(b)
+}
+
+func BenchmarkNotificationFanOut(b *testing.B) {
+	benchmarkFanOut(benchContext(), benchSubscriptions)(b)
+}
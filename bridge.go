@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/nats-io/nats.go"
+)
+
+// brokerMessage is a message pulled from an external broker.
+type brokerMessage struct {
+	// Type is the task type the message becomes, or empty to use the
+	// bridge's default.
+	Type string
+	Body []byte
+}
+
+// brokerSource pulls messages from an external broker. Implementations call
+// handle for each message and only acknowledge it once handle succeeds.
+type brokerSource interface {
+	consume(ctx context.Context, handle func(ctx context.Context, msg brokerMessage) error) error
+}
+
+// bridge inserts every message from the source as a pending task so this
+// service can act as the Postgres-backed sink for existing event pipelines.
+func bridge(ctx context.Context, logger *slog.Logger, store TaskStore, source brokerSource, defaultType string) error {
+	ctx = withActor(ctx, "bridge", "")
+	return source.consume(ctx, func(ctx context.Context, msg brokerMessage) error {
+		payload := json.RawMessage(msg.Body)
+		if !json.Valid(msg.Body) {
+			// Wrap non-JSON messages so they still fit the JSONB payload column
+			quoted, _ := json.Marshal(map[string]string{"message": string(msg.Body)})
+			payload = quoted
+		}
+
+		taskType := msg.Type
+		if taskType == "" {
+			taskType = defaultType
+		}
+
+		now := time.Now()
+		t := task{
+			ID:      fmt.Sprintf("%d", now.UnixNano()),
+			Type:    taskType,
+			Payload: payload,
+			Status:  "pending",
+			Created: now,
+			Updated: now,
+		}
+		if err := store.CreateTask(ctx, t); err != nil {
+			logger.ErrorContext(ctx, "Error inserting bridged task", slog.Any("error", err))
+			return err
+		}
+		return nil
+	})
+}
+
+// newBrokerSource creates the broker source selected by the configuration.
+func newBrokerSource(ctx context.Context, cfg config) (brokerSource, error) {
+	switch cfg.BridgeSource {
+	case "nats":
+		return &natsSource{url: cfg.BridgeNatsURL, subject: cfg.BridgeNatsSubject, queue: cfg.BridgeNatsQueue}, nil
+	case "sqs":
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load aws configuration: %w", err)
+		}
+		return &sqsSource{client: sqs.NewFromConfig(awsCfg), queueURL: cfg.BridgeSQSQueueURL}, nil
+	default:
+		return nil, fmt.Errorf("unknown bridge source %q", cfg.BridgeSource)
+	}
+}
+
+// natsSource consumes a NATS subject. Using a queue group spreads messages
+// across every instance instead of delivering each message to all of them.
+// Task types are taken from the message subject.
+type natsSource struct {
+	url     string
+	subject string
+	queue   string
+}
+
+func (s *natsSource) consume(ctx context.Context, handle func(ctx context.Context, msg brokerMessage) error) error {
+	nc, err := nats.Connect(s.url)
+	if err != nil {
+		return fmt.Errorf("unable to connect to nats: %w", err)
+	}
+	defer nc.Close()
+
+	sub, err := nc.QueueSubscribeSync(s.subject, s.queue)
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to %s: %w", s.subject, err)
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to receive nats message: %w", err)
+		}
+
+		// Core NATS has no redelivery, so failures are only logged by handle
+		handle(ctx, brokerMessage{Type: msg.Subject, Body: msg.Data})
+	}
+}
+
+// sqsSource long-polls an SQS queue. Messages are deleted only after they
+// have been inserted, so failures are redelivered once the visibility timeout
+// expires. The task type is read from the "type" message attribute.
+type sqsSource struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+func (s *sqsSource) consume(ctx context.Context, handle func(ctx context.Context, msg brokerMessage) error) error {
+	for {
+		out, err := s.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(s.queueURL),
+			MaxNumberOfMessages:   10,
+			WaitTimeSeconds:       20,
+			MessageAttributeNames: []string{"type"},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to receive sqs messages: %w", err)
+		}
+
+		for _, m := range out.Messages {
+			msg := brokerMessage{Body: []byte(aws.ToString(m.Body))}
+			if attr, ok := m.MessageAttributes["type"]; ok {
+				msg.Type = aws.ToString(attr.StringValue)
+			}
+			if err := handle(ctx, msg); err != nil {
+				continue
+			}
+			if _, err := s.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(s.queueURL),
+				ReceiptHandle: m.ReceiptHandle,
+			}); err != nil && ctx.Err() == nil {
+				return fmt.Errorf("failed to delete sqs message: %w", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// canaryTaskType is the type of the no-op tasks the canary enqueues.
+const canaryTaskType = "canary"
+
+// canaryStats is the most recent end-to-end latency observed by the canary.
+var canaryStats struct {
+	latency   atomic.Int64 // nanoseconds
+	processed atomic.Int64 // unix nanoseconds
+}
+
+var (
+	canaryEnqueued = metrics.counter("canary_tasks_enqueued_total",
+		"Canary tasks enqueued.")
+	canaryFailed = metrics.counter("canary_enqueue_failures_total",
+		"Canary tasks that could not be enqueued.")
+	canaryCompleted = metrics.counter("canary_tasks_processed_total",
+		"Canary tasks processed.")
+)
+
+func init() {
+	metrics.gauge("canary_latency_seconds",
+		"End-to-end latency of the last canary task, from insert through NOTIFY to processing.",
+		func() float64 { return time.Duration(canaryStats.latency.Load()).Seconds() })
+	metrics.gauge("canary_last_processed_timestamp_seconds",
+		"Unix time the last canary task was processed, 0 if none has been.",
+		func() float64 { return float64(canaryStats.processed.Load()) / float64(time.Second) })
+}
+
+// runCanary enqueues a no-op canary task every interval until the context is
+// cancelled. A pipeline that stops processing canaries shows up as a stale
+// canary_last_processed_timestamp_seconds.
+func runCanary(ctx context.Context, logger *slog.Logger, store TaskStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ctx = withActor(ctx, "canary", "")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		t := task{
+			ID:      fmt.Sprintf("%d", now.UnixNano()),
+			Type:    canaryTaskType,
+			Payload: json.RawMessage(`{}`),
+			Status:  "pending",
+			Created: now,
+			Updated: now,
+		}
+		if err := store.CreateTask(ctx, t); err != nil {
+			canaryFailed.inc()
+			logger.ErrorContext(ctx, "Error enqueueing canary task", slog.Any("error", err))
+			continue
+		}
+		canaryEnqueued.inc()
+	}
+}
+
+// handleCanary records how long a canary task took to reach a processor.
+func handleCanary(logger *slog.Logger) TaskHandler {
+	return func(ctx context.Context, t task) error {
+		now := time.Now()
+		latency := now.Sub(t.Created)
+		canaryStats.latency.Store(int64(latency))
+		canaryStats.processed.Store(now.UnixNano())
+		canaryCompleted.inc()
+		logger.DebugContext(ctx, "Processed canary task", slog.String("task", t.ID), slog.Duration("latency", latency))
+		return nil
+	}
+}
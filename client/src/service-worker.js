@@ -7,8 +7,18 @@ self.addEventListener('pushsubscriptionchange', (event) => {
 	console.log({ type: 'pushsubscriptionchange', version, event });
 });
 
+// Reads a push payload in either schema version, the nested version 2 shape
+// this worker subscribes with or the legacy flat one
+function readPayload(data) {
+	const payload = JSON.parse(data);
+	if (payload.schema_version >= 2) {
+		return payload.notification;
+	}
+	return payload;
+}
+
 self.addEventListener('push', (event) => {
-	const { body } = JSON.parse(event.data.text());
+	const { body } = readPayload(event.data.text());
 	console.log({ type: 'push', version, event, body });
 	self.registration.showNotification(body, {
 		body
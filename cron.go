@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// tickClaimer runs a periodic job's tick at most once. Stores that are
+// shared between instances implement it so each tick runs exactly once
+// cluster-wide.
+type tickClaimer interface {
+	// ClaimTick runs fn unless the job's tick has already run or is running
+	// elsewhere, reporting whether fn was called.
+	ClaimTick(ctx context.Context, job string, tick time.Time, fn func(ctx context.Context) error) (bool, error)
+}
+
+// newTickClaimer returns the store's claimer when it has one and an
+// in-process claimer otherwise.
+func newTickClaimer(store Store) tickClaimer {
+	if claimer, ok := unwrapStore(store).(tickClaimer); ok {
+		return claimer
+	}
+	return &localTickClaimer{last: map[string]time.Time{}}
+}
+
+// periodicJob is a job run once per interval.
+type periodicJob struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+// runPeriodic runs the job at every interval boundary until the context is
+// cancelled. Ticks are aligned to the wall clock so every instance agrees on
+// which tick is which.
+func runPeriodic(ctx context.Context, logger *slog.Logger, claimer tickClaimer, job periodicJob) {
+	for {
+		next := time.Now().Truncate(job.interval).Add(job.interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		ran, err := claimer.ClaimTick(ctx, job.name, next, job.run)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error running periodic job", slog.String("job", job.name), slog.Any("error", err))
+			continue
+		}
+		if ran {
+			logger.DebugContext(ctx, "Ran periodic job", slog.String("job", job.name), slog.Time("tick", next))
+		}
+	}
+}
+
+// localTickClaimer claims ticks within a single process.
+type localTickClaimer struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func (c *localTickClaimer) ClaimTick(ctx context.Context, job string, tick time.Time, fn func(ctx context.Context) error) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.last[job].Before(tick) {
+		return false, nil
+	}
+	if err := fn(ctx); err != nil {
+		return true, err
+	}
+	c.last[job] = tick
+	return true, nil
+}
+
+// retentionJob purges completed tasks and notifications older than the
+// retention period.
+func retentionJob(logger *slog.Logger, store Store, period time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		before := time.Now().Add(-period)
+		tasks, err := store.PurgeTasks(ctx, before)
+		if err != nil {
+			return err
+		}
+		notifications, err := store.PurgeNotifications(ctx, before)
+		if err != nil {
+			return err
+		}
+		logger.InfoContext(ctx, "Purged completed rows",
+			slog.Int64("tasks", tasks), slog.Int64("notifications", notifications))
+		return nil
+	}
+}
+
+// reaperJob returns tasks stuck in processing for longer than the timeout to
+// pending so a worker picks them up again.
+func reaperJob(logger *slog.Logger, store TaskStore, timeout time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		reaped, err := store.ReapTasks(withActor(ctx, "reaper", ""), time.Now().Add(-timeout))
+		if err != nil {
+			return err
+		}
+		if reaped > 0 {
+			logger.InfoContext(ctx, "Reaped stuck tasks", slog.Int64("tasks", reaped))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are the shorthands accepted in place of a cron expression.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronField is the range and names of a cron expression field.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12,
+		names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}}
+	// Day of week 7 is Sunday as well as 0
+	cronDow = cronField{name: "day of week", min: 0, max: 7,
+		names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}}
+)
+
+// cronSearchLimit is how far ahead After looks for an occurrence before
+// deciding there are none, such as for February 30th.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// cronSpec is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week, each a set of values.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// anyDom and anyDow are set when the field is *. When neither is, a day
+	// matching either one matches, as in cron.
+	anyDom, anyDow bool
+	loc            *time.Location
+}
+
+// isCronRule reports whether a schedule rule is a cron expression rather
+// than an iCalendar recurrence, which always spans lines or has an RRULE.
+func isCronRule(rule string) bool {
+	return !strings.Contains(rule, "\n") && !strings.Contains(rule, "RRULE:")
+}
+
+// parseCron parses a cron expression such as "0 */5 * * *", or a macro
+// such as "@daily". Values may be lists, ranges, steps and, for months and
+// days of the week, three letter names. Occurrences are in UTC unless the
+// expression starts with CRON_TZ= and a timezone.
+func parseCron(expr string) (*cronSpec, error) {
+	spec := &cronSpec{loc: time.UTC}
+	expr = strings.TrimSpace(expr)
+	if tz, rest, ok := strings.Cut(expr, " "); ok && strings.HasPrefix(tz, "CRON_TZ=") {
+		loc, err := time.LoadLocation(strings.TrimPrefix(tz, "CRON_TZ="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q", strings.TrimPrefix(tz, "CRON_TZ="))
+		}
+		spec.loc, expr = loc, strings.TrimSpace(rest)
+	}
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression must have 5 fields: minute, hour, day of month, month and day of week")
+	}
+	var err error
+	if spec.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if spec.hour, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if spec.dom, err = cronDom.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if spec.month, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if spec.dow, err = cronDow.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.anyDom, spec.anyDow = fields[2] == "*", fields[4] == "*"
+	return spec, nil
+}
+
+// parse returns the set of values a comma separated list of *, values,
+// ranges and steps selects.
+func (f cronField) parse(field string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		span, step, hasStep := strings.Cut(part, "/")
+		lo, hi := f.min, f.max
+		if span != "*" {
+			from, to, isRange := strings.Cut(span, "-")
+			var err error
+			if lo, err = f.value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid %s range %q", f.name, span)
+			}
+		}
+		every := 1
+		if hasStep {
+			n, err := strconv.Atoi(step)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid %s step %q", f.name, step)
+			}
+			every = n
+		}
+		for v := lo; v <= hi; v += every {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// value parses a single value of the field, by number or by name.
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q", f.name, s)
+	}
+	return v, nil
+}
+
+// dayMatches reports whether the expression runs on t's day.
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<t.Weekday()) != 0
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// After returns the first occurrence after t, or at t when inc is set, or
+// the zero time when there is none.
+func (c *cronSpec) After(t time.Time, inc bool) time.Time {
+	t = t.In(c.loc)
+	next := t.Truncate(time.Minute)
+	if next.Before(t) || (!inc && next.Equal(t)) {
+		next = next.Add(time.Minute)
+	}
+
+	for limit := t.Add(cronSearchLimit); next.Before(limit); {
+		y, m, d := next.Date()
+		switch {
+		case c.month&(1<<m) == 0:
+			next = time.Date(y, m+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(next):
+			next = time.Date(y, m, d+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<next.Hour()) == 0:
+			// Moving by elapsed time keeps hours skipped or repeated by
+			// daylight saving from stalling the search
+			next = next.Add(time.Duration(60-next.Minute()) * time.Minute)
+		case c.minute&(1<<next.Minute()) == 0:
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// cronSet returns the set of the values.
+func cronSet(values ...int) uint64 {
+	var set uint64
+	for _, v := range values {
+		set |= 1 << v
+	}
+	return set
+}
+
+// cronRange returns the set of the values from lo to hi, every step.
+func cronRange(lo, hi, step int) uint64 {
+	var set uint64
+	for v := lo; v <= hi; v += step {
+		set |= 1 << v
+	}
+	return set
+}
+
+func TestCronFieldParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		field cronField
+		spec  string
+		want  uint64
+	}{
+		{name: "star", field: cronMinute, spec: "*", want: cronRange(0, 59, 1)},
+		{name: "value", field: cronHour, spec: "7", want: cronSet(7)},
+		{name: "range", field: cronHour, spec: "9-17", want: cronRange(9, 17, 1)},
+		{name: "list", field: cronMinute, spec: "0,15,45", want: cronSet(0, 15, 45)},
+		{name: "every n", field: cronMinute, spec: "*/5", want: cronRange(0, 59, 5)},
+		{name: "range step", field: cronHour, spec: "8-18/4", want: cronSet(8, 12, 16)},
+		{name: "value step", field: cronMinute, spec: "10/20", want: cronSet(10, 30, 50)},
+		{name: "list of ranges", field: cronDom, spec: "1-3,10-11,31", want: cronSet(1, 2, 3, 10, 11, 31)},
+		{name: "month names", field: cronMonth, spec: "JAN,jun-Aug", want: cronSet(1, 6, 7, 8)},
+		{name: "day names", field: cronDow, spec: "MON-FRI", want: cronRange(1, 5, 1)},
+		{name: "day of week 7", field: cronDow, spec: "7", want: cronSet(7)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.field.parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parse(%q) = %b, want %b", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1-x * * * *",
+		"* * * FOO *",
+		"a * * * *",
+		"@fortnightly",
+		"CRON_TZ=Nowhere/Special * * * * *",
+	}
+	for _, expr := range tests {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronSpecAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string
+	}{
+		{name: "every five minutes", expr: "*/5 * * * *", from: "2026-03-10T10:02:30Z", want: "2026-03-10T10:05:00Z"},
+		{name: "exclusive of from", expr: "*/5 * * * *", from: "2026-03-10T10:05:00Z", want: "2026-03-10T10:10:00Z"},
+		{name: "next hour", expr: "0 * * * *", from: "2026-03-10T10:00:00Z", want: "2026-03-10T11:00:00Z"},
+		{name: "next day", expr: "30 9 * * *", from: "2026-03-10T10:00:00Z", want: "2026-03-11T09:30:00Z"},
+		{name: "across a month", expr: "0 0 1 * *", from: "2026-01-15T12:00:00Z", want: "2026-02-01T00:00:00Z"},
+		{name: "across a year", expr: "0 0 * * *", from: "2026-12-31T23:59:00Z", want: "2027-01-01T00:00:00Z"},
+		{name: "yearly", expr: "@yearly", from: "2026-06-01T00:00:00Z", want: "2027-01-01T00:00:00Z"},
+		{name: "skips short months", expr: "0 0 31 * *", from: "2026-04-01T00:00:00Z", want: "2026-05-31T00:00:00Z"},
+		{name: "leap day", expr: "0 0 29 2 *", from: "2026-03-01T00:00:00Z", want: "2028-02-29T00:00:00Z"},
+		{name: "named days", expr: "0 9 * * MON-FRI", from: "2026-10-16T10:00:00Z", want: "2026-10-19T09:00:00Z"},
+		{name: "sunday as 7", expr: "0 0 * * 7", from: "2026-10-16T00:00:00Z", want: "2026-10-18T00:00:00Z"},
+		{name: "named months", expr: "0 0 1 JUN,DEC *", from: "2026-07-01T00:00:00Z", want: "2026-12-01T00:00:00Z"},
+		// With both restricted, a day matching either field matches
+		{name: "day of month or week", expr: "0 0 13 * FRI", from: "2026-10-10T00:00:00Z", want: "2026-10-13T00:00:00Z"},
+		{name: "day of week or month", expr: "0 0 13 * FRI", from: "2026-10-13T00:00:00Z", want: "2026-10-16T00:00:00Z"},
+		// With one of them *, only the other restricts the day
+		{name: "day of month only", expr: "0 0 13 * *", from: "2026-10-13T00:00:00Z", want: "2026-11-13T00:00:00Z"},
+		{name: "day of week only", expr: "0 0 * * FRI", from: "2026-10-16T00:00:00Z", want: "2026-10-23T00:00:00Z"},
+		{name: "timezone", expr: "CRON_TZ=America/Denver 0 9 * * *", from: "2026-10-16T00:00:00Z", want: "2026-10-16T15:00:00Z"},
+		{name: "never", expr: "0 0 30 2 *", from: "2026-01-01T00:00:00Z", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, err := time.Parse(time.RFC3339, tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := spec.After(from, false)
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("After(%s) = %s, want none", tt.from, got)
+				}
+				return
+			}
+			want, err := time.Parse(time.RFC3339, tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("After(%s) = %s, want %s", tt.from, got.UTC().Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestCronSpecAfterInclusive(t *testing.T) {
+	spec, err := parseCron("*/5 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 3, 10, 10, 5, 0, 0, time.UTC)
+	if got := spec.After(from, true); !got.Equal(from) {
+		t.Errorf("After(%s, true) = %s, want %s", from, got, from)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// encryptedPrefix marks a value encrypted at rest. It is followed by the
+// version and, from v2 on, the id of the key that sealed it.
+const encryptedPrefix = "enc:"
+
+// Prefixes of the encrypted value formats: v1 values don't name their key,
+// v2 values are enc:v2:<key id>:<base64>.
+const (
+	encryptedPrefixV1 = encryptedPrefix + "v1:"
+	encryptedPrefixV2 = encryptedPrefix + "v2:"
+)
+
+// bodyCipher encrypts notification content and other secrets at rest with
+// AES-256-GCM. Values are sealed with the current key and opened with
+// whichever configured key sealed them, so keys can be rotated while older
+// values are re-encrypted. A nil cipher leaves content as plaintext.
+type bodyCipher struct {
+	current string
+	aeads   map[string]cipher.AEAD
+	// ids lists the key ids current first, the order v1 values, which don't
+	// name their key, are tried in.
+	ids []string
+}
+
+// newBodyCipher creates a cipher from base64 encoded 32 byte keys, sealing
+// with key and opening with it or any of the previous keys. It returns nil
+// when no key is configured.
+func newBodyCipher(key string, previous []string) (*bodyCipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	c := &bodyCipher{aeads: map[string]cipher.AEAD{}}
+	for _, k := range append([]string{key}, previous...) {
+		if k == "" {
+			continue
+		}
+		id, aead, err := newKeyAEAD(k)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.aeads[id]; ok {
+			continue
+		}
+		if c.current == "" {
+			c.current = id
+		}
+		c.aeads[id] = aead
+		c.ids = append(c.ids, id)
+	}
+	return c, nil
+}
+
+// newKeyAEAD creates the AEAD for a base64 encoded 32 byte key, along with
+// the key's id: the first 8 hex digits of its SHA-256, which identifies it
+// without revealing it.
+func newKeyAEAD(key string) (string, cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	if len(raw) != 32 {
+		return "", nil, errors.New("invalid encryption key: must be 32 bytes")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:4]), aead, nil
+}
+
+// seal encrypts a value with the current key. Values that are already
+// encrypted are returned as is, so content copied between notifications
+// isn't encrypted twice.
+func (c *bodyCipher) seal(plaintext string) (string, error) {
+	if c == nil || strings.HasPrefix(plaintext, encryptedPrefix) {
+		return plaintext, nil
+	}
+	aead := c.aeads[c.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefixV2 + c.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value. Plaintext values are returned as is.
+func (c *bodyCipher) open(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("value is encrypted but no encryption key is configured")
+	}
+
+	var ids []string
+	var encoded string
+	switch {
+	case strings.HasPrefix(value, encryptedPrefixV1):
+		ids, encoded = c.ids, strings.TrimPrefix(value, encryptedPrefixV1)
+	case strings.HasPrefix(value, encryptedPrefixV2):
+		id, rest, ok := strings.Cut(strings.TrimPrefix(value, encryptedPrefixV2), ":")
+		if !ok {
+			return "", errors.New("invalid encrypted value: missing key id")
+		}
+		if _, ok := c.aeads[id]; !ok {
+			return "", fmt.Errorf("value is encrypted with unknown key %s", id)
+		}
+		ids, encoded = []string{id}, rest
+	default:
+		return "", errors.New("invalid encrypted value: unknown version")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	for _, id := range ids {
+		aead := c.aeads[id]
+		size := aead.NonceSize()
+		if len(sealed) < size {
+			return "", errors.New("invalid encrypted value: too short")
+		}
+		if plaintext, err := aead.Open(nil, sealed[:size], sealed[size:], nil); err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", errors.New("failed to decrypt value")
+}
+
+// reseal re-encrypts a value sealed by any key but the current one with the
+// current key, reporting whether it changed. Plaintext values and values
+// already sealed with the current key are returned as is.
+func (c *bodyCipher) reseal(value string) (string, bool, error) {
+	if c == nil || !strings.HasPrefix(value, encryptedPrefix) || strings.HasPrefix(value, encryptedPrefixV2+c.current+":") {
+		return value, false, nil
+	}
+	plaintext, err := c.open(value)
+	if err != nil {
+		return value, false, err
+	}
+	sealed, err := c.seal(plaintext)
+	return sealed, err == nil, err
+}
+
+// transformContent applies fn to every piece of content in a notification: its
+// body, title, localized bodies, and variant bodies.
+func transformContent(n notification, fn func(string) (string, error)) (notification, error) {
+	var err error
+	if n.Body, err = fn(n.Body); err != nil {
+		return n, err
+	}
+	if n.Content.Title != "" {
+		if n.Content.Title, err = fn(n.Content.Title); err != nil {
+			return n, err
+		}
+	}
+	if len(n.Bodies) > 0 {
+		bodies := make(map[string]string, len(n.Bodies))
+		for locale, body := range n.Bodies {
+			if bodies[locale], err = fn(body); err != nil {
+				return n, err
+			}
+		}
+		n.Bodies = bodies
+	}
+	if len(n.Variants) > 0 {
+		variants := make([]variant, len(n.Variants))
+		for i, v := range n.Variants {
+			if v.Body, err = fn(v.Body); err != nil {
+				return n, err
+			}
+			variants[i] = v
+		}
+		n.Variants = variants
+	}
+	return n, nil
+}
+
+// encrypt encrypts a notification's content.
+func (c *bodyCipher) encrypt(n notification) (notification, error) {
+	if c == nil {
+		return n, nil
+	}
+	return transformContent(n, c.seal)
+}
+
+// decrypt decrypts a notification's content.
+func (c *bodyCipher) decrypt(n notification) (notification, error) {
+	return transformContent(n, c.open)
+}
+
+// encryptingStore wraps a Store and encrypts notification content,
+// subscription keys, and VAPID private keys before they are stored.
+// Notification content is only decrypted by the notification worker, while
+// keys are decrypted as they are read.
+type encryptingStore struct {
+	Store
+	cipher *bodyCipher
+}
+
+// Unwrap returns the wrapped store.
+func (s *encryptingStore) Unwrap() Store {
+	return s.Store
+}
+
+func (s *encryptingStore) CreateNotification(ctx context.Context, n notification) (int, error) {
+	n, err := s.cipher.encrypt(n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt notification: %w", err)
+	}
+	return s.Store.CreateNotification(ctx, n)
+}
+
+func (s *encryptingStore) ExpandNotification(ctx context.Context, id int, waves []notification) error {
+	for i := range waves {
+		n, err := s.cipher.encrypt(waves[i])
+		if err != nil {
+			return fmt.Errorf("failed to encrypt notification: %w", err)
+		}
+		waves[i] = n
+	}
+	return s.Store.ExpandNotification(ctx, id, waves)
+}
+
+func (s *encryptingStore) CreateSubscription(ctx context.Context, sub subscription) (subscription, error) {
+	var err error
+	if sub.Keys.Auth, err = s.cipher.seal(sub.Keys.Auth); err != nil {
+		return sub, fmt.Errorf("failed to encrypt subscription: %w", err)
+	}
+	if sub.Keys.P256dh, err = s.cipher.seal(sub.Keys.P256dh); err != nil {
+		return sub, fmt.Errorf("failed to encrypt subscription: %w", err)
+	}
+	if sub, err = s.Store.CreateSubscription(ctx, sub); err != nil {
+		return sub, err
+	}
+	return s.openSubscription(sub)
+}
+
+func (s *encryptingStore) ListSubscriptions(ctx context.Context) ([]subscription, error) {
+	subs, err := s.Store.ListSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subs {
+		if subs[i], err = s.openSubscription(subs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return subs, nil
+}
+
+func (s *encryptingStore) FindSubscriptions(ctx context.Context, filter subscriptionFilter) ([]subscription, error) {
+	subs, err := s.Store.FindSubscriptions(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subs {
+		if subs[i], err = s.openSubscription(subs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return subs, nil
+}
+
+func (s *encryptingStore) GetSubscription(ctx context.Context, id int) (subscription, error) {
+	sub, err := s.Store.GetSubscription(ctx, id)
+	if err != nil {
+		return sub, err
+	}
+	return s.openSubscription(sub)
+}
+
+func (s *encryptingStore) SnoozeSubscription(ctx context.Context, id int, until *time.Time) (subscription, error) {
+	sub, err := s.Store.SnoozeSubscription(ctx, id, until)
+	if err != nil {
+		return sub, err
+	}
+	return s.openSubscription(sub)
+}
+
+// openSubscription decrypts a subscription's keys.
+func (s *encryptingStore) openSubscription(sub subscription) (subscription, error) {
+	var err error
+	if sub.Keys.Auth, err = s.cipher.open(sub.Keys.Auth); err != nil {
+		return sub, fmt.Errorf("failed to decrypt subscription: %w", err)
+	}
+	if sub.Keys.P256dh, err = s.cipher.open(sub.Keys.P256dh); err != nil {
+		return sub, fmt.Errorf("failed to decrypt subscription: %w", err)
+	}
+	return sub, nil
+}
+
+func (s *encryptingStore) CreateVAPIDKey(ctx context.Context, k vapidKey) error {
+	var err error
+	if k.PrivateKey, err = s.cipher.seal(k.PrivateKey); err != nil {
+		return fmt.Errorf("failed to encrypt vapid key: %w", err)
+	}
+	return s.Store.CreateVAPIDKey(ctx, k)
+}
+
+func (s *encryptingStore) ListVAPIDKeys(ctx context.Context) ([]vapidKey, error) {
+	keys, err := s.Store.ListVAPIDKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if keys[i].PrivateKey, err = s.cipher.open(keys[i].PrivateKey); err != nil {
+			return nil, fmt.Errorf("failed to decrypt vapid key: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+func (s *encryptingStore) CreateSchedule(ctx context.Context, sc schedule) (schedule, error) {
+	if sc.Notification != nil {
+		n, err := s.cipher.encrypt(*sc.Notification)
+		if err != nil {
+			return sc, fmt.Errorf("failed to encrypt notification: %w", err)
+		}
+		sc.Notification = &n
+	}
+	return s.Store.CreateSchedule(ctx, sc)
+}
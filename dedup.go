@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jsmithdenverdev/poc-pg-worker/queue"
+)
+
+// duplicateTaskError is returned by stores creating a task whose dedup key
+// belongs to another task still within its dedup window.
+type duplicateTaskError struct {
+	// ID is the task already enqueued.
+	ID string
+}
+
+func (e *duplicateTaskError) Error() string {
+	return fmt.Sprintf("duplicate of task %s", e.ID)
+}
+
+// dedupTask marks a task as a duplicate of any task with the same dedup key
+// created within the window: the explicit key when one is given, or a hash
+// of the task's tenant, type and payload. A window of zero or less leaves
+// the task alone.
+func dedupTask(t *task, key string, window time.Duration) error {
+	if window <= 0 {
+		return nil
+	}
+	if key == "" {
+		var err error
+		if key, err = queue.DedupKey(t.Tenant, t.Type, t.Payload); err != nil {
+			return fmt.Errorf("failed to hash payload: %w", err)
+		}
+	}
+	until := t.Created.Add(window)
+	t.DedupKey, t.DedupUntil = key, &until
+	return nil
+}
+
+// duplicateTaskResponse answers a request whose task was suppressed as a
+// duplicate, pointing at the task already enqueued.
+type duplicateTaskResponse struct {
+	ID        string `json:"id"`
+	DedupKey  string `json:"dedup_key"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+// writeDuplicateTask responds with the task a duplicate was suppressed in
+// favor of and reports true, or reports false when err isn't a duplicate.
+// Upstream retries see the status they would for a new task, so they stop.
+func writeDuplicateTask(w http.ResponseWriter, r *http.Request, status int, t task, err error) bool {
+	var duplicate *duplicateTaskError
+	if !errors.As(err, &duplicate) {
+		return false
+	}
+	tasksDeduplicated.inc(t.Type)
+	writeJSON(w, r, status, duplicateTaskResponse{ID: duplicate.ID, DedupKey: t.DedupKey, Duplicate: true})
+	return true
+}
+
+var tasksDeduplicated = metrics.counter("tasks_deduplicated_total",
+	"Tasks not enqueued because a duplicate was enqueued within the dedup window, by type.", "type")
+
+// debounceTask schedules a task whose type has a quiet period configured,
+// keyed by the explicit key or else its type, and reports whether it did.
+// Enqueues of the same key collapse into one task that runs once the quiet
+// period passes without another.
+func debounceTask(t *task, key string, debounce map[string]time.Duration) bool {
+	quiet := debounce[t.Type]
+	if quiet <= 0 {
+		return false
+	}
+	if key == "" {
+		key = t.Type
+	}
+	runAt := t.Created.Add(quiet).UTC()
+	t.Status, t.DebounceKey, t.RunAt = "scheduled", key, &runAt
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// degradedWorkers is how many workers are waiting out a database outage.
+var degradedWorkers atomic.Int64
+
+var workerOutages = metrics.counter("worker_degraded_total",
+	"Times a worker lost the database and entered degraded mode, by channel.", "channel")
+
+func init() {
+	metrics.gauge("workers_degraded",
+		"Workers currently waiting out a database outage.",
+		func() float64 { return float64(degradedWorkers.Load()) })
+}
+
+// relisten waits out a database outage that broke a worker's listener. The
+// worker reports itself degraded, which fails readiness, and retries with
+// its backoff until it can listen again. It then returns the new listener
+// along with the backlog queued during the outage. It only fails once the
+// context is cancelled.
+func relisten(ctx context.Context, logger *slog.Logger, store Store, channel string, opts workerOptions, cause error) (Listener, []string, error) {
+	started := time.Now()
+	logger.ErrorContext(ctx, "Worker degraded, lost the database", slog.String("channel", channel), slog.Any("error", cause))
+	workerOutages.inc(channel)
+	degradedWorkers.Add(1)
+	defer degradedWorkers.Add(-1)
+	if opts.health != nil {
+		opts.health.setDegraded("worker:"+channel, true)
+		defer opts.health.setDegraded("worker:"+channel, false)
+	}
+
+	for attempt := 1; ; attempt++ {
+		delay := opts.backoff.Delay(attempt)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		listener, backlog, err := listenWithBacklog(ctx, store, channel)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			logger.WarnContext(ctx, "Worker still degraded",
+				slog.String("channel", channel), slog.Int("attempt", attempt), slog.Any("error", err))
+			continue
+		}
+		logger.InfoContext(ctx, "Worker recovered",
+			slog.String("channel", channel), slog.Duration("outage", time.Since(started)), slog.Int("backlog", len(backlog)))
+		return listener, backlog, nil
+	}
+}
+
+// listenWithBacklog starts listening on the channel and reads the work still
+// pending on it. Anything queued between the two may be delivered twice.
+func listenWithBacklog(ctx context.Context, store Store, channel string) (Listener, []string, error) {
+	if err := store.Ping(ctx); err != nil {
+		return nil, nil, err
+	}
+	listener, err := store.Listen(ctx, channel)
+	if err != nil {
+		return nil, nil, err
+	}
+	backlog, err := store.Backlog(ctx, channel)
+	if err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+	return listener, backlog, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed demo
+var demoFiles embed.FS
+
+// demoContentSecurityPolicy lets the demo page run its own scripts and
+// service worker and call the API, in place of the API's default policy
+// which allows nothing.
+const demoContentSecurityPolicy = "default-src 'self'; frame-ancestors 'none'"
+
+// demoPage serves the push demo under /demo/: a page that registers a
+// service worker, subscribes with the VAPID public key, stores the
+// subscription and sends it a test push, checking push works end to end.
+func demoPage() http.Handler {
+	files, _ := fs.Sub(demoFiles, "demo")
+	server := http.StripPrefix("/demo/", http.FileServerFS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", demoContentSecurityPolicy)
+		w.Header().Set("Cache-Control", "no-cache")
+		server.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,146 @@
+// The demo page: subscribes the browser to push with the server's VAPID
+// public key, stores the subscription and sends it a test push.
+
+const logEl = document.getElementById("log");
+const subscriptionEl = document.getElementById("subscription");
+const subscribeButton = document.getElementById("subscribe");
+const testButton = document.getElementById("test");
+const unsubscribeButton = document.getElementById("unsubscribe");
+
+// The id of the stored subscription, once subscribed.
+let subscriptionId = null;
+
+function log(message, error) {
+  const line = document.createElement("div");
+  line.textContent = `${new Date().toLocaleTimeString()} ${message}`;
+  if (error) {
+    line.className = "error";
+  }
+  logEl.appendChild(line);
+}
+
+// urlBase64ToUint8Array decodes the base64url encoded VAPID public key into
+// the bytes pushManager.subscribe expects.
+function urlBase64ToUint8Array(value) {
+  const padded = (value + "=".repeat((4 - (value.length % 4)) % 4))
+    .replace(/-/g, "+")
+    .replace(/_/g, "/");
+  return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0));
+}
+
+// request sends a JSON request, failing with the server's message on any
+// non-2xx response.
+async function request(method, url, body, headers) {
+  const response = await fetch(url, {
+    method,
+    headers: { "Content-Type": "application/json", ...headers },
+    body: body === undefined ? undefined : JSON.stringify(body),
+    credentials: "same-origin",
+  });
+  const text = await response.text();
+  if (!response.ok) {
+    throw new Error(`${method} ${url}: ${response.status} ${text.trim()}`);
+  }
+  return text ? JSON.parse(text) : null;
+}
+
+// contentEncoding picks the push content encoding to record for the
+// subscription, preferring aes128gcm.
+function contentEncoding() {
+  const supported = PushManager.supportedContentEncodings || ["aesgcm"];
+  return supported.includes("aes128gcm") ? "aes128gcm" : "aesgcm";
+}
+
+async function subscribe() {
+  if (!("serviceWorker" in navigator) || !("PushManager" in window)) {
+    throw new Error("this browser does not support push; it needs HTTPS or localhost");
+  }
+
+  const permission = await Notification.requestPermission();
+  log(`notification permission: ${permission}`);
+  if (permission !== "granted") {
+    throw new Error("notifications were not allowed");
+  }
+
+  const registration = await navigator.serviceWorker.register("sw.js", { scope: "./" });
+  await navigator.serviceWorker.ready;
+  log("service worker registered");
+
+  const keys = await request("GET", "/vapid/keys");
+  log(`vapid public key: ${keys.public_key}`);
+
+  // A subscription made with another key, such as one rotated out, can't
+  // be reused
+  let sub = await registration.pushManager.getSubscription();
+  if (sub) {
+    await sub.unsubscribe();
+  }
+  sub = await registration.pushManager.subscribe({
+    userVisibleOnly: true,
+    applicationServerKey: urlBase64ToUint8Array(keys.public_key),
+  });
+  log(`push service endpoint: ${sub.endpoint}`);
+
+  const stored = await request("POST", "/subscriptions", {
+    ...sub.toJSON(),
+    vapid_public_key: keys.public_key,
+    content_encoding: contentEncoding(),
+    schema_version: 2,
+    timezone: Intl.DateTimeFormat().resolvedOptions().timeZone,
+    locale: navigator.language,
+    tags: ["demo"],
+  });
+  subscriptionId = stored.id;
+  subscriptionEl.textContent = String(stored.id);
+  testButton.disabled = false;
+  unsubscribeButton.disabled = false;
+  log(`subscription ${stored.id} stored`);
+}
+
+// csrfHeaders returns the CSRF token header admin requests need when the
+// browser has an admin session, or none when it doesn't.
+async function csrfHeaders() {
+  try {
+    const { token } = await request("GET", "/admin/csrf-token");
+    return { "X-CSRF-Token": token };
+  } catch {
+    return {};
+  }
+}
+
+async function sendTest() {
+  const result = await request("POST", `/admin/subscriptions/${subscriptionId}/test`, undefined, await csrfHeaders());
+  log(`push service answered ${result.status_code} ${result.body}`.trim(), result.status_code >= 300);
+}
+
+async function unsubscribe() {
+  const registration = await navigator.serviceWorker.getRegistration("./");
+  const sub = registration && (await registration.pushManager.getSubscription());
+  if (sub) {
+    await sub.unsubscribe();
+  }
+  subscriptionId = null;
+  subscriptionEl.textContent = "none";
+  testButton.disabled = true;
+  unsubscribeButton.disabled = true;
+  log("unsubscribed; the push service now refuses pushes to the stored subscription");
+}
+
+// run runs a step, logging its failure.
+function run(step) {
+  return async () => {
+    try {
+      await step();
+    } catch (err) {
+      log(err.message, true);
+    }
+  };
+}
+
+subscribeButton.addEventListener("click", run(subscribe));
+testButton.addEventListener("click", run(sendTest));
+unsubscribeButton.addEventListener("click", run(unsubscribe));
+
+navigator.serviceWorker?.addEventListener("message", (event) => {
+  log(`push received: ${JSON.stringify(event.data)}`);
+});
@@ -0,0 +1,52 @@
+// The demo service worker: shows the pushes it receives and tells the demo
+// page about them.
+
+// notificationFrom reads the notification to show from a push payload, in
+// either the version 2 shape or the legacy flat one.
+function notificationFrom(payload) {
+  if (payload.schema_version >= 2) {
+    return payload.notification;
+  }
+  const content = payload.content || {};
+  return {
+    title: content.title,
+    body: payload.body,
+    icon: content.icon,
+    url: content.url,
+  };
+}
+
+self.addEventListener("install", () => self.skipWaiting());
+self.addEventListener("activate", (event) => event.waitUntil(self.clients.claim()));
+
+self.addEventListener("push", (event) => {
+  let payload;
+  try {
+    payload = event.data ? event.data.json() : {};
+  } catch {
+    payload = { body: event.data.text() };
+  }
+  const n = notificationFrom(payload);
+
+  event.waitUntil(
+    (async () => {
+      const pages = await self.clients.matchAll({ type: "window" });
+      for (const page of pages) {
+        page.postMessage(payload);
+      }
+      await self.registration.showNotification(n.title || "Push demo", {
+        body: n.body,
+        icon: n.icon,
+        data: { url: n.url },
+      });
+    })(),
+  );
+});
+
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+  const url = event.notification.data && event.notification.data.url;
+  if (url) {
+    event.waitUntil(self.clients.openWindow(url));
+  }
+});
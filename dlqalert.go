@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dlqAlerts counts alerts fired about dead-letter growth.
+var dlqAlerts = metrics.counter("dlq_alerts_total",
+	"Alerts fired because too many items were dead-lettered.")
+
+// maxAlertTaskTypes bounds how many failing task types an alert lists.
+const maxAlertTaskTypes = 5
+
+// dlqAlert describes dead-letter growth over a window. Failed tasks and
+// notifications are the dead letters: they stay failed until requeued.
+type dlqAlert struct {
+	Since         time.Time         `json:"since"`
+	Threshold     int64             `json:"threshold"`
+	Tasks         int64             `json:"tasks"`
+	Notifications int64             `json:"notifications"`
+	TopTaskTypes  []failedTaskCount `json:"top_task_types"`
+}
+
+// failedTaskCount is the number of failed tasks of a type.
+type failedTaskCount struct {
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+}
+
+// total returns the number of items dead-lettered in the window.
+func (a dlqAlert) total() int64 {
+	return a.Tasks + a.Notifications
+}
+
+// summary describes the alert in a sentence or two for chat and email.
+func (a dlqAlert) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d items dead-lettered since %s (threshold %d): %d tasks, %d notifications.",
+		a.total(), a.Since.UTC().Format(time.RFC3339), a.Threshold, a.Tasks, a.Notifications)
+	if len(a.TopTaskTypes) > 0 {
+		types := make([]string, len(a.TopTaskTypes))
+		for i, t := range a.TopTaskTypes {
+			types[i] = fmt.Sprintf("%s (%d)", t.Type, t.Count)
+		}
+		fmt.Fprintf(&b, " Top failing task types: %s.", strings.Join(types, ", "))
+	}
+	return b.String()
+}
+
+// alertNotifier delivers an alert to a destination.
+type alertNotifier interface {
+	notify(ctx context.Context, alert dlqAlert) error
+}
+
+// webhookNotifier delivers alerts to an outbound webhook as dlq.alert
+// events.
+type webhookNotifier struct {
+	webhook webhook
+}
+
+func (n webhookNotifier) notify(ctx context.Context, alert dlqAlert) error {
+	return n.webhook.send(ctx, "dlq.alert", alert)
+}
+
+// slackNotifier posts alerts to a Slack incoming webhook.
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n slackNotifier) notify(ctx context.Context, alert dlqAlert) error {
+	body, err := json.Marshal(map[string]string{"text": ":rotating_light: " + alert.summary()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal slack message: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create slack request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := n.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post to slack: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("slack responded with status %s", response.Status)
+	}
+	return nil
+}
+
+// emailNotifier emails alerts through an SMTP server.
+type emailNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (n emailNotifier) notify(ctx context.Context, alert dlqAlert) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		host, _, _ := strings.Cut(n.addr, ":")
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Dead-letter alert: %d items\r\n\r\n%s\r\n",
+		n.from, strings.Join(n.to, ", "), alert.total(), alert.summary())
+	if err := smtp.SendMail(n.addr, auth, n.from, n.to, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send alert email: %w", err)
+	}
+	return nil
+}
+
+// dlqAlertNotifiers returns a notifier for every alert destination
+// configured.
+func (c config) dlqAlertNotifiers() []alertNotifier {
+	var notifiers []alertNotifier
+	if c.DLQAlertWebhookURL != "" {
+		notifiers = append(notifiers, webhookNotifier{webhook: webhook{URL: c.DLQAlertWebhookURL, Secrets: c.DLQAlertWebhookSecrets}})
+	}
+	if c.DLQAlertSlackURL != "" {
+		notifiers = append(notifiers, slackNotifier{url: c.DLQAlertSlackURL})
+	}
+	if len(c.DLQAlertEmailTo) > 0 {
+		notifiers = append(notifiers, emailNotifier{
+			addr:     c.SMTPAddr,
+			from:     c.SMTPFrom,
+			to:       c.DLQAlertEmailTo,
+			username: c.SMTPUsername,
+			password: c.SMTPPassword,
+		})
+	}
+	return notifiers
+}
+
+// dlqAlertJob counts the tasks and notifications dead-lettered during the
+// last interval and alerts every notifier when there are at least threshold
+// of them.
+func dlqAlertJob(logger *slog.Logger, store Store, interval time.Duration, threshold int64, notifiers []alertNotifier) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		since := time.Now().Add(-interval)
+		types, err := store.CountFailedTasks(ctx, since)
+		if err != nil {
+			return fmt.Errorf("failed to count failed tasks: %w", err)
+		}
+		notifications, err := store.CountFailedNotifications(ctx, since)
+		if err != nil {
+			return fmt.Errorf("failed to count failed notifications: %w", err)
+		}
+
+		alert := dlqAlert{Since: since, Threshold: threshold, Notifications: notifications}
+		for taskType, count := range types {
+			alert.Tasks += count
+			alert.TopTaskTypes = append(alert.TopTaskTypes, failedTaskCount{Type: taskType, Count: count})
+		}
+		if alert.total() < threshold {
+			return nil
+		}
+		sort.Slice(alert.TopTaskTypes, func(i, j int) bool {
+			a, b := alert.TopTaskTypes[i], alert.TopTaskTypes[j]
+			return a.Count > b.Count || (a.Count == b.Count && a.Type < b.Type)
+		})
+		if len(alert.TopTaskTypes) > maxAlertTaskTypes {
+			alert.TopTaskTypes = alert.TopTaskTypes[:maxAlertTaskTypes]
+		}
+
+		dlqAlerts.inc()
+		logger.WarnContext(ctx, "Dead-letter growth",
+			slog.Int64("tasks", alert.Tasks),
+			slog.Int64("notifications", alert.Notifications),
+			slog.Int64("threshold", threshold),
+			slog.Any("top_task_types", alert.TopTaskTypes))
+
+		var errs []error
+		for _, n := range notifiers {
+			if err := n.notify(ctx, alert); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+var tasksReleased = metrics.counter("scheduled_tasks_released_total",
+	"Scheduled tasks queued once their run_at passed.")
+
+// runDueTaskPoller queues scheduled tasks as their run_at passes until the
+// context is cancelled. Between releases it sleeps until the next task is
+// due, but never longer than maxWait, which bounds how late a task scheduled
+// sooner than the one it was waiting for can run. Scheduled tasks never
+// notify workers themselves, so workers only wake for work they can start.
+func runDueTaskPoller(ctx context.Context, logger *slog.Logger, store TaskStore, maxWait time.Duration) {
+	ctx = withActor(ctx, "scheduler", "")
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		timer.Reset(maxWait)
+		released, err := store.ReleaseTasks(ctx, time.Now())
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.ErrorContext(ctx, "Error releasing scheduled tasks", slog.Any("error", err))
+			}
+			continue
+		}
+		if released > 0 {
+			tasksReleased.add(float64(released))
+			logger.InfoContext(ctx, "Queued scheduled tasks", slog.Int64("tasks", released))
+		}
+
+		next, err := store.NextTaskDue(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.ErrorContext(ctx, "Error reading next scheduled task", slog.Any("error", err))
+			}
+			continue
+		}
+		if next != nil && time.Until(*next) < maxWait {
+			timer.Reset(max(time.Until(*next), 0))
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// payloadFetcher is implemented by stores whose NOTIFY payloads are limited
+// in size, which can fetch the full payload of a row instead.
+type payloadFetcher interface {
+	// FetchPayload returns the payload of the row with the id on the
+	// channel, as the backlog would, or errNotFound when it's gone.
+	FetchPayload(ctx context.Context, channel, id string) (string, error)
+}
+
+var payloadsRefetched = metrics.counter("notify_payloads_refetched_total",
+	"NOTIFY payloads too large to send or that arrived damaged, whose rows were fetched instead, by channel and reason.",
+	"channel", "reason")
+
+// envelopeLength matches the length notify_envelope appends to a payload.
+var envelopeLength = regexp.MustCompile(`, "length" : (\d+)}$`)
+
+// envelopeID matches the id a payload starts with, even when the rest of it
+// is cut off.
+var envelopeID = regexp.MustCompile(`^\{\s*"id"\s*:\s*"?([^",}\s]+)`)
+
+// openEnvelope returns the payload notify_envelope sent, without its length,
+// or why it has to be fetched instead: "oversized" when it was too large to
+// send, "truncated" when it doesn't match its length or isn't valid JSON.
+// Payloads sent without a length are returned as they are.
+func openEnvelope(payload string) (string, string) {
+	if m := envelopeLength.FindStringSubmatchIndex(payload); m != nil {
+		length, _ := strconv.Atoi(payload[m[2]:m[3]])
+		payload = payload[:m[0]] + "}"
+		if len(payload) != length {
+			return payload, "truncated"
+		}
+	}
+
+	var envelope struct {
+		Oversized bool `json:"oversized"`
+	}
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		return payload, "truncated"
+	}
+	if envelope.Oversized {
+		return payload, "oversized"
+	}
+	return payload, ""
+}
+
+// resolveNotification returns the notification with the payload it was sent
+// with, fetching the row it announces when the payload was too large to send
+// or arrived damaged.
+func resolveNotification(ctx context.Context, store Store, notification *pgconn.Notification) (*pgconn.Notification, error) {
+	payload, reason := openEnvelope(notification.Payload)
+	if reason == "" {
+		return &pgconn.Notification{PID: notification.PID, Channel: notification.Channel, Payload: payload}, nil
+	}
+
+	m := envelopeID.FindStringSubmatch(payload)
+	if m == nil {
+		return nil, fmt.Errorf("%s payload on %s has no id", reason, notification.Channel)
+	}
+	fetcher, ok := unwrapStore(store).(payloadFetcher)
+	if !ok {
+		return nil, fmt.Errorf("%s payload on %s can't be fetched", reason, notification.Channel)
+	}
+	payloadsRefetched.inc(notification.Channel, reason)
+
+	payload, err := fetcher.FetchPayload(ctx, notification.Channel, m[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s payload of %s on %s: %w", reason, m[1], notification.Channel, err)
+	}
+	return &pgconn.Notification{PID: notification.PID, Channel: notification.Channel, Payload: payload}, nil
+}
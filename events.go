@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// actor identifies who changed a task's status. It travels in the context so
+// stores can attribute each transition without widening every signature.
+type actor struct {
+	Name     string
+	WorkerID string
+}
+
+type actorKey struct{}
+
+// withActor returns a context attributing status changes to the named actor
+// and, for workers, the worker id.
+func withActor(ctx context.Context, name, workerID string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor{Name: name, WorkerID: workerID})
+}
+
+// actorFromContext returns the actor attached to the context, defaulting to
+// "system" when none was set.
+func actorFromContext(ctx context.Context) actor {
+	if a, ok := ctx.Value(actorKey{}).(actor); ok {
+		return a
+	}
+	return actor{Name: "system"}
+}
+
+// actorHandler is a slog.Handler adding the worker id from the context to
+// every record, so log lines from several instances can be attributed to the
+// processor that wrote them.
+type actorHandler struct {
+	slog.Handler
+}
+
+// newActorHandler wraps a handler with worker attribution.
+func newActorHandler(h slog.Handler) slog.Handler {
+	return &actorHandler{Handler: h}
+}
+
+func (h *actorHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := actorFromContext(ctx).WorkerID; id != "" {
+		record = record.Clone()
+		record.AddAttrs(slog.String("worker_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *actorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &actorHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *actorHandler) WithGroup(name string) slog.Handler {
+	return &actorHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// listTaskEvents lists the status transitions recorded for a task.
+func listTaskEvents(store TaskStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		events, err := store.ListTaskEvents(r.Context(), r.PathValue("id"))
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "task not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to read task events", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, events)
+	}
+}
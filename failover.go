@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Worker roles. Active instances always process work. A standby instance
+// listens like any other but only processes work while no active instance
+// is heartbeating.
+const (
+	roleActive  = "active"
+	roleStandby = "standby"
+)
+
+// heartbeatStore is implemented by stores shared between instances, which
+// can record heartbeats every instance sees.
+type heartbeatStore interface {
+	// Heartbeat records that the instance is alive in the role.
+	Heartbeat(ctx context.Context, instance, role string) error
+	// HeartbeatAge returns how long ago any instance in the role last
+	// heartbeated, and false when none ever has.
+	HeartbeatAge(ctx context.Context, role string) (time.Duration, bool, error)
+	// ReleaseZombies moves tasks and notifications claimed more than timeout
+	// ago by instances that haven't heartbeated within it back to pending,
+	// and returns how many of each it released.
+	ReleaseZombies(ctx context.Context, timeout time.Duration) (tasks, notifications int64, err error)
+}
+
+var failovers = metrics.counter("worker_failovers_total",
+	"Times a standby took over processing or handed it back, by direction.", "direction")
+
+// instanceID identifies this instance among those sharing a database.
+var instanceID = sync.OnceValue(func() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return fmt.Sprintf("pid-%d", os.Getpid())
+	}
+	return hostname
+})
+
+// failover tracks whether a standby instance is processing work. A nil
+// failover is always active.
+type failover struct {
+	mu      sync.Mutex
+	active  bool
+	changed chan struct{}
+}
+
+// newFailover creates a standby's failover, passive until its first check.
+func newFailover() *failover {
+	f := &failover{changed: make(chan struct{})}
+	metrics.gauge("worker_standby_active",
+		"1 while this standby has taken over processing, 0 while it is passive.",
+		func() float64 {
+			if f.isActive() {
+				return 1
+			}
+			return 0
+		})
+	return f
+}
+
+// state reports whether the instance is processing work, along with a
+// channel closed once that changes.
+func (f *failover) state() (bool, <-chan struct{}) {
+	if f == nil {
+		return true, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active, f.changed
+}
+
+// isActive reports whether the instance is processing work.
+func (f *failover) isActive() bool {
+	active, _ := f.state()
+	return active
+}
+
+// set makes the instance active or passive, reporting whether that changed
+// anything.
+func (f *failover) set(active bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active == active {
+		return false
+	}
+	f.active = active
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return true
+}
+
+// runHeartbeat heartbeats in the role every interval until the context is
+// cancelled. A standby, given its failover, also checks the active
+// instances' heartbeats, taking over processing once the latest is older
+// than timeout and handing it back as soon as one heartbeats again.
+func runHeartbeat(ctx context.Context, logger *slog.Logger, store heartbeatStore, role string, interval, timeout time.Duration, f *failover) {
+	instance := instanceID()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := store.Heartbeat(ctx, instance, role); err != nil && ctx.Err() == nil {
+			logger.ErrorContext(ctx, "Error recording heartbeat", slog.Any("error", err))
+		}
+
+		if f != nil {
+			// Stay put while the database can't tell us anything: nobody can
+			// process work without it anyway
+			age, ok, err := store.HeartbeatAge(ctx, roleActive)
+			switch {
+			case err != nil:
+				if ctx.Err() == nil {
+					logger.ErrorContext(ctx, "Error reading primary heartbeat", slog.Any("error", err))
+				}
+			case !ok || age > timeout:
+				if f.set(true) {
+					failovers.inc("takeover")
+					logger.WarnContext(ctx, "Standby taking over, primary heartbeat is stale",
+						slog.Bool("seen", ok), slog.Duration("age", age))
+				}
+			default:
+				if f.set(false) {
+					failovers.inc("handback")
+					logger.InfoContext(ctx, "Standby handing back, primary is heartbeating", slog.Duration("age", age))
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fairQueue buffers notifications per tenant and hands them out in weighted
+// round-robin order, so one tenant enqueueing a large backlog can't starve
+// the others. A tenant with weight n is served up to n notifications per
+// turn; tenants without a configured weight get 1. Within a tenant, higher
+// priority payloads are handed out first, and equal ones in arrival order.
+type fairQueue struct {
+	weights map[string]int
+
+	mu      sync.Mutex
+	queues  map[string][]queuedNotification
+	ring    []string
+	next    int
+	credit  int
+	pending chan struct{}
+}
+
+// newFairQueue creates an empty queue using the specified tenant weights.
+func newFairQueue(weights map[string]int) *fairQueue {
+	return &fairQueue{
+		weights: weights,
+		queues:  map[string][]queuedNotification{},
+		pending: make(chan struct{}, 1),
+	}
+}
+
+// queuedNotification is a buffered notification and its payload's priority.
+type queuedNotification struct {
+	notification *pgconn.Notification
+	priority     int
+}
+
+// push queues a notification for the tenant named in its payload, behind
+// the tenant's notifications of the same or a higher priority.
+func (q *fairQueue) push(notification *pgconn.Notification) {
+	tenant, priority := routeOf(notification.Payload)
+
+	q.mu.Lock()
+	queue := q.queues[tenant]
+	if len(queue) == 0 {
+		q.ring = append(q.ring, tenant)
+	}
+	i := len(queue)
+	for i > 0 && queue[i-1].priority < priority {
+		i--
+	}
+	q.queues[tenant] = slices.Insert(queue, i, queuedNotification{notification: notification, priority: priority})
+	q.mu.Unlock()
+
+	select {
+	case q.pending <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the next notification, blocking until one is queued. It
+// returns false if the context is cancelled first.
+func (q *fairQueue) pop(ctx context.Context) (*pgconn.Notification, bool) {
+	for {
+		if notification := q.take(); notification != nil {
+			return notification, true
+		}
+		select {
+		case <-q.pending:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// take removes the next notification in round-robin order, or returns nil
+// if the queue is empty.
+func (q *fairQueue) take() *pgconn.Notification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.ring) == 0 {
+		return nil
+	}
+	if q.next >= len(q.ring) {
+		q.next = 0
+	}
+
+	tenant := q.ring[q.next]
+	if q.credit == 0 {
+		q.credit = max(q.weights[tenant], 1)
+	}
+	notification := q.queues[tenant][0].notification
+	q.queues[tenant] = q.queues[tenant][1:]
+	q.credit--
+
+	switch {
+	case len(q.queues[tenant]) == 0:
+		// Drop the drained tenant, leaving next on whoever follows it
+		delete(q.queues, tenant)
+		q.ring = append(q.ring[:q.next], q.ring[q.next+1:]...)
+		q.credit = 0
+	case q.credit == 0:
+		q.next++
+	}
+
+	// Wake another popper if work remains
+	if len(q.ring) > 0 {
+		select {
+		case q.pending <- struct{}{}:
+		default:
+		}
+	}
+	return notification
+}
+
+// routeOf returns the tenant and priority named in a notification payload.
+// Payloads without a tenant share the default tenant, and those without a
+// numeric priority, such as notifications, have priority 0.
+func routeOf(payload string) (string, int) {
+	var v struct {
+		Tenant   string `json:"tenant"`
+		Priority any    `json:"priority"`
+	}
+	json.Unmarshal([]byte(payload), &v)
+	priority, _ := v.Priority.(float64)
+	return v.Tenant, int(priority)
+}
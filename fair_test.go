@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// queuedTask returns a task notification routed to the tenant at the
+// priority.
+func queuedTask(id, tenant string, priority int) *pgconn.Notification {
+	return &pgconn.Notification{
+		Channel: tasksChannel,
+		Payload: fmt.Sprintf(`{"id":%q,"tenant":%q,"priority":%d}`, id, tenant, priority),
+	}
+}
+
+// drain takes every notification off the queue, returning the ids of their
+// tasks in the order they were handed out.
+func drain(t *testing.T, q *fairQueue) []string {
+	t.Helper()
+	var ids []string
+	for notification := q.take(); notification != nil; notification = q.take() {
+		var v struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(notification.Payload), &v); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+func TestFairQueueOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		pushed  []*pgconn.Notification
+		want    []string
+	}{
+		{
+			name: "round robin",
+			pushed: []*pgconn.Notification{
+				queuedTask("a1", "a", 0), queuedTask("a2", "a", 0), queuedTask("a3", "a", 0),
+				queuedTask("b1", "b", 0), queuedTask("c1", "c", 0), queuedTask("b2", "b", 0),
+			},
+			want: []string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+		{
+			name:    "weighted",
+			weights: map[string]int{"a": 2},
+			pushed: []*pgconn.Notification{
+				queuedTask("a1", "a", 0), queuedTask("a2", "a", 0), queuedTask("a3", "a", 0),
+				queuedTask("b1", "b", 0), queuedTask("b2", "b", 0),
+			},
+			want: []string{"a1", "a2", "b1", "a3", "b2"},
+		},
+		{
+			name: "priority within a tenant",
+			pushed: []*pgconn.Notification{
+				queuedTask("low", "a", 0), queuedTask("high", "a", 5), queuedTask("high2", "a", 5),
+				queuedTask("mid", "a", 1),
+			},
+			want: []string{"high", "high2", "mid", "low"},
+		},
+		{
+			name: "priority doesn't jump tenants",
+			pushed: []*pgconn.Notification{
+				queuedTask("a1", "a", 0), queuedTask("a2", "a", 0), queuedTask("b1", "b", 9),
+			},
+			want: []string{"a1", "b1", "a2"},
+		},
+		{
+			name: "default tenant",
+			pushed: []*pgconn.Notification{
+				{Channel: tasksChannel, Payload: `{"id":"x"}`}, queuedTask("a1", "a", 0),
+			},
+			want: []string{"x", "a1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newFairQueue(tt.weights)
+			for _, notification := range tt.pushed {
+				q.push(notification)
+			}
+			if got := drain(t, q); !slices.Equal(got, tt.want) {
+				t.Errorf("order = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFairQueuePopCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if notification, ok := newFairQueue(nil).pop(ctx); ok {
+		t.Fatalf("pop = %v, want nothing once the context is cancelled", notification)
+	}
+}
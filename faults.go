@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+)
+
+// faultsInjected counts the failures injected by FAULT_INJECTION.
+var faultsInjected = metrics.counter("faults_injected_total",
+	"Failures injected into task handlers and push sends.", "target")
+
+// errInjectedFault is the error injected in place of a real failure.
+var errInjectedFault = errors.New("injected fault")
+
+// faultInjector fails a fraction of task handler executions and push sends
+// so retry, dead-letter, and alerting paths can be exercised in staging. A
+// nil injector never fails anything.
+type faultInjector struct {
+	rate float64
+}
+
+// newFaultInjector returns an injector failing percent of operations, or nil
+// when percent is 0.
+func newFaultInjector(percent float64) (*faultInjector, error) {
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("fault injection percentage %v is not between 0 and 100", percent)
+	}
+	if percent == 0 {
+		return nil, nil
+	}
+	return &faultInjector{rate: percent / 100}, nil
+}
+
+// fail returns errInjectedFault for the configured fraction of calls.
+func (f *faultInjector) fail(target string) error {
+	if f == nil || rand.Float64() >= f.rate {
+		return nil
+	}
+	faultsInjected.inc(target)
+	return fmt.Errorf("%s: %w", target, errInjectedFault)
+}
+
+// handler wraps a task handler so it fails before running for the
+// configured fraction of executions.
+func (f *faultInjector) handler(h TaskHandler) TaskHandler {
+	if f == nil {
+		return h
+	}
+	return func(ctx context.Context, t task) error {
+		if err := f.fail("handler"); err != nil {
+			return err
+		}
+		return h(ctx, t)
+	}
+}
+
+// transport wraps a push transport so the configured fraction of requests
+// fail without being sent.
+func (f *faultInjector) transport(base http.RoundTripper) http.RoundTripper {
+	if f == nil {
+		return base
+	}
+	return faultTransport{base: base, faults: f}
+}
+
+type faultTransport struct {
+	base   http.RoundTripper
+	faults *faultInjector
+}
+
+func (t faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.faults.fail("push"); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Feature flags consulted by the API and the workers, each defaulting to
+// on until a stored flag says otherwise.
+const (
+	// flagIngest accepts deliveries on POST /ingest/{source}.
+	flagIngest = "ingest"
+	// flagTaskCallbacks tells the task callback webhook about finished
+	// tasks.
+	flagTaskCallbacks = "task_callbacks"
+)
+
+// flagDefaults are whether each flag is on while it isn't stored. Flags not
+// listed default to off, so new features can be rolled out by storing them.
+var flagDefaults = map[string]bool{
+	flagIngest:        true,
+	flagTaskCallbacks: true,
+}
+
+// flagName is what a flag may be called.
+var flagName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// on reports whether the flag is on for the tenant: its override for the
+// tenant if it has one, otherwise whether it is enabled.
+func (f featureFlag) on(tenant string) bool {
+	if on, ok := f.Tenants[tenant]; ok && tenant != "" {
+		return on
+	}
+	return f.Enabled
+}
+
+// flagCache holds the stored feature flags in memory, reloading them once
+// they are older than its TTL so a change on one instance reaches the
+// others within it. A nil cache uses the defaults.
+type flagCache struct {
+	store FlagStore
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	flags  map[string]featureFlag
+	loaded time.Time
+}
+
+// newFlagCache creates a cache over the store, loading the flags.
+func newFlagCache(ctx context.Context, store FlagStore, ttl time.Duration) (*flagCache, error) {
+	c := &flagCache{store: store, ttl: ttl}
+	if err := c.reload(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the flags from the store.
+func (c *flagCache) reload(ctx context.Context) error {
+	stored, err := c.store.ListFlags(ctx)
+	if err != nil {
+		return err
+	}
+	flags := make(map[string]featureFlag, len(stored))
+	for _, f := range stored {
+		flags[f.Name] = f
+	}
+	c.mu.Lock()
+	c.flags, c.loaded = flags, time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// enabled reports whether the flag is on for the tenant. When the flags
+// can't be reloaded the ones already loaded are used.
+func (c *flagCache) enabled(ctx context.Context, name, tenant string) bool {
+	if c == nil {
+		return flagDefaults[name]
+	}
+	c.mu.Lock()
+	stale := time.Since(c.loaded) > c.ttl
+	c.mu.Unlock()
+	if stale {
+		if err := c.reload(ctx); err != nil {
+			log.Printf("Error reloading feature flags: %v\n", err)
+			// Retry after another TTL rather than on every check
+			c.mu.Lock()
+			c.loaded = time.Now()
+			c.mu.Unlock()
+		}
+	}
+
+	c.mu.Lock()
+	f, ok := c.flags[name]
+	c.mu.Unlock()
+	if !ok {
+		return flagDefaults[name]
+	}
+	return f.on(tenant)
+}
+
+// flagView is a flag as listed by the admin API: stored, or at its default.
+type flagView struct {
+	featureFlag
+	Stored bool `json:"stored"`
+}
+
+// listFlags lists the stored flags along with the defaults of the ones that
+// aren't stored.
+func listFlags(store FlagStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stored, err := store.ListFlags(r.Context())
+		if err != nil {
+			http.Error(w, "failed to read flags", http.StatusInternalServerError)
+			return
+		}
+
+		views := make([]flagView, 0, len(stored)+len(flagDefaults))
+		seen := map[string]bool{}
+		for _, f := range stored {
+			views = append(views, flagView{featureFlag: f, Stored: true})
+			seen[f.Name] = true
+		}
+		for name, enabled := range flagDefaults {
+			if !seen[name] {
+				views = append(views, flagView{featureFlag: featureFlag{Name: name, Enabled: enabled}})
+			}
+		}
+		sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+		writeJSON(w, r, http.StatusOK, views)
+	}
+}
+
+// setFlag stores a flag, replacing it if it exists. The instance's cache is
+// refreshed at once; other instances pick the change up within the TTL.
+func setFlag(store FlagStore, flags *flagCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var f featureFlag
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			return
+		}
+		f.Name = r.PathValue("name")
+		if !flagName.MatchString(f.Name) {
+			http.Error(w, "flag names must be lowercase letters, digits, _, . and -", http.StatusBadRequest)
+			return
+		}
+		if f.Tenants == nil {
+			f.Tenants = map[string]bool{}
+		}
+
+		f, err := store.SetFlag(r.Context(), f)
+		if err != nil {
+			log.Printf("Error setting flag: %v\n", err)
+			http.Error(w, "failed to set flag", http.StatusInternalServerError)
+			return
+		}
+		if err := flags.reload(r.Context()); err != nil {
+			log.Printf("Error reloading feature flags: %v\n", err)
+		}
+
+		writeJSON(w, r, http.StatusOK, f)
+	}
+}
+
+// deleteFlag removes a stored flag, returning it to its default.
+func deleteFlag(store FlagStore, flags *flagCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := store.DeleteFlag(r.Context(), r.PathValue("name")); err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "flag not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to delete flag", http.StatusInternalServerError)
+			return
+		}
+		if err := flags.reload(r.Context()); err != nil {
+			log.Printf("Error reloading feature flags: %v\n", err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
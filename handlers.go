@@ -2,191 +2,602 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/SherClockHolmes/webpush-go"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// taskRequest sets the optional fields of a created task. The request body
+// may be left empty.
+type taskRequest struct {
+	// Priority orders the task ahead of pending tasks with a lower one.
+	Priority int `json:"priority"`
+	// MaxAttempts overrides the retry policy of the task's type.
+	MaxAttempts int `json:"max_attempts"`
+	// TimeoutSeconds overrides TASK_TIMEOUT.
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// RunAt delays the task until then, when it is in the future.
+	RunAt *time.Time `json:"run_at"`
+}
+
 // createTask creates a new task.
-func createTask(pool *pgxpool.Pool) http.HandlerFunc {
+func createTask(cfg config, store TaskStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		var req taskRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			return
+		}
+		if req.MaxAttempts < 0 {
+			http.Error(w, "max_attempts must not be negative", http.StatusBadRequest)
+			return
+		}
+		if req.TimeoutSeconds < 0 {
+			http.Error(w, "timeout_seconds must not be negative", http.StatusBadRequest)
+			return
+		}
+
 		now := time.Now()
 		task := task{
-			ID:      fmt.Sprintf("%d", now.UnixNano()),
-			Type:    "default",
-			Payload: json.RawMessage(`{"message":"New task created"}`),
-			Status:  "pending",
-			Created: now,
-			Updated: now,
+			ID:       fmt.Sprintf("%d", now.UnixNano()),
+			Type:     "default",
+			Tenant:   r.Header.Get("X-Tenant"),
+			Priority: req.Priority,
+			Payload:  json.RawMessage(`{"message":"New task created"}`),
+			Status:   "pending",
+			Created:  now,
+			Updated:  now,
+
+			MaxAttempts:    req.MaxAttempts,
+			TimeoutSeconds: req.TimeoutSeconds,
+			Traceparent:    traceparentFromContext(r.Context()),
+		}
+		if req.RunAt != nil && req.RunAt.After(now) {
+			runAt := req.RunAt.UTC()
+			task.Status, task.RunAt = "scheduled", &runAt
 		}
 
-		// Insert task into database (notification will be triggered automatically)
-		_, err := pool.Exec(r.Context(),
-			"INSERT INTO tasks (id, type, payload, status, created, updated) VALUES ($1, $2, $3, $4, $5, $6)",
-			task.ID, task.Type, task.Payload, task.Status, task.Created, task.Updated)
-		if err != nil {
+		// Bursts of a debounced type collapse into one task run after a quiet
+		// period
+		ctx := withActor(r.Context(), "api", "")
+		if debounceTask(&task, r.Header.Get("Debounce-Key"), cfg.TaskDebounce) {
+			id, err := store.DebounceTask(ctx, task)
+			if err != nil {
+				log.Printf("Error debouncing task: %v\n", err)
+				http.Error(w, "Failed to create task", http.StatusInternalServerError)
+				return
+			}
+			task.ID = id
+			writeJSON(w, r, http.StatusOK, task)
+			return
+		}
+
+		// Retries and double submits within the window enqueue nothing new
+		if err := dedupTask(&task, r.Header.Get("Idempotency-Key"), cfg.TaskDedupWindow); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Insert task into the store (notification will be triggered automatically)
+		if err := store.CreateTask(ctx, task); err != nil {
+			if writeDuplicateTask(w, r, http.StatusOK, task, err) {
+				return
+			}
 			log.Printf("Error inserting task: %v\n", err)
 			http.Error(w, "Failed to create task", http.StatusInternalServerError)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(task)
+		writeJSON(w, r, http.StatusOK, task)
 	}
 }
 
 // listTasks lists all tasks.
-func listTasks(pool *pgxpool.Pool) http.HandlerFunc {
+func listTasks(store TaskStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tasks, err := store.ListTasks(r.Context())
+		if err != nil {
+			http.Error(w, "failed to read tasks", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, tasks)
+	}
+}
+
+// getTask returns a task, along with the progress its handler reported.
+func getTask(store TaskStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var tasks []task
-		// Query tasks from database
-		results, err := pool.Query(r.Context(),
-			"SELECT id, type, payload, status, created, updated FROM tasks")
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				// No tasks found
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode([]task{})
+		t, err := store.GetTask(r.Context(), r.PathValue("id"))
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "task not found", http.StatusNotFound)
 				return
 			}
-			http.Error(w, "failed to read tasks", http.StatusInternalServerError)
+			http.Error(w, "failed to read task", http.StatusInternalServerError)
 			return
 		}
 
-		for results.Next() {
-			var task task
-			err := results.Scan(&task.ID, &task.Type, &task.Payload, &task.Status, &task.Created, &task.Updated)
-			if err != nil {
-				http.Error(w, "failed to read tasks", http.StatusInternalServerError)
+		writeJSON(w, r, http.StatusOK, t)
+	}
+}
+
+// cancelTask cancels a task that hasn't finished. A pending or scheduled
+// task never runs, and the worker running a processing task abandons it
+// once it notices.
+func cancelTask(store TaskStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := store.CancelTask(withActor(r.Context(), "api", ""), id); err != nil {
+			switch {
+			case errors.Is(err, errNotFound):
+				http.Error(w, "task not found", http.StatusNotFound)
+			case errors.Is(err, errTaskFinished):
+				http.Error(w, "task already finished", http.StatusConflict)
+			default:
+				log.Printf("Error cancelling task: %v\n", err)
+				http.Error(w, "failed to cancel task", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		t, err := store.GetTask(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "task not found", http.StatusNotFound)
 				return
 			}
-			tasks = append(tasks, task)
+			http.Error(w, "failed to read task", http.StatusInternalServerError)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(tasks)
+		writeJSON(w, r, http.StatusOK, t)
 	}
 }
 
 // createSubscription creates a new subscription.
-func createSubscription(pool *pgxpool.Pool) http.HandlerFunc {
+func createSubscription(cfg config, store SubscriptionStore, keys *vapidKeyring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var sub webpush.Subscription
+		var sub subscription
 		err := json.NewDecoder(r.Body).Decode(&sub)
 		if err != nil {
 			http.Error(w, "failed to decode request", http.StatusBadRequest)
 			return
 		}
 
-		// Store the subscription endpoint in the database
-		_, err = pool.Exec(r.Context(),
-			"INSERT INTO subscriptions (endpoint, auth, p256dh, created, updated) VALUES ($1, $2, $3, $4, $5)",
-			sub.Endpoint, sub.Keys.Auth, sub.Keys.P256dh, time.Now(), time.Now())
+		if sub.Timezone != "" {
+			if _, err := time.LoadLocation(sub.Timezone); err != nil {
+				http.Error(w, "invalid timezone", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := validateTags(sub.Tags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Browsers send the frontend's origin, which wins over one supplied
+		// by a server registering the subscription on a frontend's behalf
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+			sub.Origin = origin
+		}
+		if sub.Origin != "" {
+			if sub.Origin, err = normalizeOrigin(sub.Origin); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Subscriptions that don't say which key they were created with are
+		// assumed to use the current one
+		if sub.VAPIDPublicKey == "" {
+			current, _, err := keys.active(r.Context())
+			if err != nil {
+				http.Error(w, "failed to read vapid keys", http.StatusInternalServerError)
+				return
+			}
+			sub.VAPIDPublicKey = current.PublicKey
+		}
+
+		// Browsers that only support the legacy encoding say so, otherwise
+		// the configured default is recorded
+		if err := validateContentEncoding(sub.ContentEncoding); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sub.ContentEncoding == "" {
+			sub.ContentEncoding = cfg.PushContentEncoding
+		}
+
+		// Service workers that don't say which payload shape they understand
+		// get the legacy one
+		if sub.SchemaVersion, err = negotiateSchemaVersion(sub.SchemaVersion); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Store the subscription endpoint
+		sub, err = store.CreateSubscription(r.Context(), sub)
 		if err != nil {
 			http.Error(w, "failed to store subscription", http.StatusInternalServerError)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(sub)
+		writeJSON(w, r, http.StatusOK, newSubscriptionView(sub, showSubscriptionKeys(cfg, r)))
 	}
 }
 
-// listSubscriptions lists all subscriptions.
-func listSubscriptions(pool *pgxpool.Pool) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var subs []webpush.Subscription
-		// Query subscriptions from database
-		results, err := pool.Query(r.Context(),
-			"SELECT endpoint, auth, p256dh FROM subscriptions")
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				// No subscriptions found
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode([]webpush.Subscription{})
-				return
+// maxNotificationRequest is the largest notification request accepted,
+// leaving room for long target lists.
+const maxNotificationRequest = 1 << 20
+
+// maxNotificationBody is the longest notification body, localized body or
+// variant body accepted. Push services reject payloads much over 4KB.
+const maxNotificationBody = 4096
+
+// notificationRequest is a notification whose body may instead be rendered
+// from a stored template.
+type notificationRequest struct {
+	notification
+	TemplateID int            `json:"template_id,omitempty"`
+	Variables  map[string]any `json:"variables,omitempty"`
+}
+
+// decodeNotificationRequest decodes a notification request of at most
+// maxNotificationRequest bytes. On failure it writes the error response and
+// returns false.
+func decodeNotificationRequest(w http.ResponseWriter, r *http.Request) (notificationRequest, bool) {
+	var req notificationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNotificationRequest)).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return req, false
+		}
+		http.Error(w, "failed to decode request", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// validateContent requires a notification to have something to send to
+// every subscription, a body or variants, no body or title over
+// maxNotificationBody, and a valid icon and click URL.
+func validateContent(not notification) error {
+	if strings.TrimSpace(not.Body) == "" && len(not.Variants) == 0 {
+		return errors.New("body is required")
+	}
+	if len(not.Body) > maxNotificationBody {
+		return fmt.Errorf("body must be at most %d bytes", maxNotificationBody)
+	}
+	if len(not.Content.Title) > maxNotificationBody {
+		return fmt.Errorf("title must be at most %d bytes", maxNotificationBody)
+	}
+	if _, err := url.Parse(not.Content.Icon); err != nil {
+		return errors.New("icon must be a URL")
+	}
+	if _, err := url.Parse(not.Content.URL); err != nil {
+		return errors.New("url must be a URL")
+	}
+	for locale, body := range not.Bodies {
+		if strings.TrimSpace(body) == "" {
+			return fmt.Errorf("body for locale %q is empty", locale)
+		}
+		if len(body) > maxNotificationBody {
+			return fmt.Errorf("body for locale %q must be at most %d bytes", locale, maxNotificationBody)
+		}
+	}
+	for _, v := range not.Variants {
+		if len(v.Body) > maxNotificationBody {
+			return fmt.Errorf("variant %q body must be at most %d bytes", v.Name, maxNotificationBody)
+		}
+	}
+	return nil
+}
+
+// prepareNotification renders a notification request's template, when it
+// references one, and validates the notification. On failure it writes the
+// error response and returns false.
+func prepareNotification(w http.ResponseWriter, r *http.Request, store TemplateStore, req notificationRequest) (notification, bool) {
+	// Only the content and delivery options come from the client; the id,
+	// processing state and timestamps are the store's and the worker's
+	not := req.notification
+	not.ID, not.Status, not.Targeted, not.ProcessedBy, not.ClaimedBy, not.ClaimedAt = 0, "", false, "", "", nil
+	not.LastError, not.FailedAt, not.Created, not.Updated = nil, nil, time.Time{}, time.Time{}
+
+	// Render the body from a template when one is referenced
+	if req.TemplateID != 0 {
+		t, err := store.GetTemplate(r.Context(), req.TemplateID)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "template not found", http.StatusBadRequest)
+				return not, false
 			}
-			http.Error(w, "failed to read subscriptions", http.StatusInternalServerError)
+			http.Error(w, "failed to read template", http.StatusInternalServerError)
+			return not, false
+		}
+		if not.Body, err = renderTemplate(t.Body, req.Variables); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return not, false
+		}
+	}
+
+	if err := validateContent(not); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return not, false
+	}
+
+	if err := validatePriority(not.Priority); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return not, false
+	}
+
+	if err := validateSchedule(not); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return not, false
+	}
+
+	if err := validateVariants(not.Variants); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return not, false
+	}
+
+	if err := validateTargets(not); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return not, false
+	}
+
+	if not.Origin != "" {
+		var err error
+		if not.Origin, err = normalizeOrigin(not.Origin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return not, false
+		}
+	}
+	return not, true
+}
+
+// createNotification creates a new notification. A notification that would
+// reach more than BROADCAST_CONFIRM_THRESHOLD subscriptions is refused
+// unless the request confirms it with confirm=true, so a test script can't
+// push to everyone by accident.
+func createNotification(cfg config, store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeNotificationRequest(w, r)
+		if !ok {
+			return
+		}
+		not, ok := prepareNotification(w, r, store, req)
+		if !ok {
 			return
 		}
 
-		for results.Next() {
-			var sub webpush.Subscription
-			err := results.Scan(&sub.Endpoint, &sub.Keys.Auth, &sub.Keys.P256dh)
+		if cfg.BroadcastConfirmThreshold > 0 && !not.DryRun && r.URL.Query().Get("confirm") != "true" {
+			recipients, err := countRecipients(r.Context(), store, not)
 			if err != nil {
 				http.Error(w, "failed to read subscriptions", http.StatusInternalServerError)
 				return
 			}
-			subs = append(subs, sub)
+			if recipients > cfg.BroadcastConfirmThreshold {
+				http.Error(w, fmt.Sprintf("notification would reach %d subscriptions, over the broadcast threshold of %d; resend with confirm=true to send it",
+					recipients, cfg.BroadcastConfirmThreshold), http.StatusConflict)
+				return
+			}
+		}
+
+		now := time.Now()
+		not.Created = now
+		not.Updated = now
+		not.Traceparent = traceparentFromContext(r.Context())
+		if not.SendAt != nil {
+			sendAt := not.SendAt.UTC()
+			not.SendAt = &sendAt
+		}
+
+		// Store the notification
+		id, err := store.CreateNotification(r.Context(), not)
+		if err != nil {
+			http.Error(w, "failed to store notification", http.StatusInternalServerError)
+			return
 		}
+		// Respond with the status the notification was stored with, which
+		// the store doesn't hand back
+		not.ID, not.Status = id, initialStatus(not)
+
+		writeJSON(w, r, http.StatusOK, not)
+	}
+}
+
+// notificationStatuses are the statuses a notification moves through.
+var notificationStatuses = []string{"scheduled", "pending", "processing", "completed", "failed", "expanded"}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(subs)
+// parseCreatedRange reads the created_after and created_before query
+// parameters, RFC 3339 times bounding when something was created.
+func parseCreatedRange(query url.Values) (after, before *time.Time, err error) {
+	for name, bound := range map[string]**time.Time{"created_after": &after, "created_before": &before} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*bound = &t
+		}
 	}
+	return after, before, nil
 }
 
-// createNotification creates a new notification.
-func createNotification(pool *pgxpool.Pool) http.HandlerFunc {
+// listNotifications lists notifications, optionally filtered by status and
+// creation time.
+func listNotifications(store NotificationStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var not notification
-		err := json.NewDecoder(r.Body).Decode(&not)
+		query := r.URL.Query()
+		filter := notificationListFilter{Status: query.Get("status")}
+		if filter.Status != "" && !slices.Contains(notificationStatuses, filter.Status) {
+			http.Error(w, "status must be one of "+strings.Join(notificationStatuses, ", "), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if filter.CreatedAfter, filter.CreatedBefore, err = parseCreatedRange(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		nots, err := store.ListNotifications(r.Context(), filter)
 		if err != nil {
-			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			http.Error(w, "failed to read notifications", http.StatusInternalServerError)
 			return
 		}
 
-		now := time.Now()
-		not.Created = now
-		not.Updated = now
+		writeJSON(w, r, http.StatusOK, nots)
+	}
+}
+
+// notificationDetail is a notification along with the outcome of its
+// deliveries so far.
+type notificationDetail struct {
+	notification
+	Deliveries deliverySummary `json:"deliveries"`
+	// Subscriptions has the outcome for each subscription the notification
+	// was pushed to, empty until the worker records receipts or failures.
+	Subscriptions []deliveryOutcome `json:"subscriptions"`
+}
+
+// deliverySummary counts a notification's delivery outcomes.
+type deliverySummary struct {
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+	// Variants counts the deliveries of each variant.
+	Variants map[string]int `json:"variants,omitempty"`
+}
+
+// deliveryOutcome is what happened when a notification was pushed to a
+// subscription: delivered, with the variant it received, or failed, with
+// the attempts made and the last error.
+type deliveryOutcome struct {
+	Endpoint string    `json:"endpoint"`
+	Outcome  string    `json:"outcome"`
+	Variant  string    `json:"variant,omitempty"`
+	Attempts int       `json:"attempts,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// newNotificationDetail combines a notification with its receipts and
+// delivery failures. A subscription with a receipt was delivered to even if
+// an earlier attempt failed.
+func newNotificationDetail(n notification, deliveries []delivery, failures []deliveryFailure) notificationDetail {
+	detail := notificationDetail{notification: n, Subscriptions: []deliveryOutcome{}}
+	delivered := map[string]bool{}
+	for _, d := range deliveries {
+		delivered[d.Endpoint] = true
+		detail.Deliveries.Delivered++
+		if d.Variant != "" {
+			if detail.Deliveries.Variants == nil {
+				detail.Deliveries.Variants = map[string]int{}
+			}
+			detail.Deliveries.Variants[d.Variant]++
+		}
+		detail.Subscriptions = append(detail.Subscriptions, deliveryOutcome{
+			Endpoint: d.Endpoint, Outcome: "delivered", Variant: d.Variant, At: d.Created,
+		})
+	}
+	for _, f := range failures {
+		if delivered[f.Endpoint] {
+			continue
+		}
+		detail.Deliveries.Failed++
+		detail.Subscriptions = append(detail.Subscriptions, deliveryOutcome{
+			Endpoint: f.Endpoint, Outcome: "failed", Attempts: f.Attempts, Error: f.Error, At: f.Created,
+		})
+	}
+	return detail
+}
 
-		// Store the notification in the database
-		_, err = pool.Exec(r.Context(),
-			"INSERT INTO notifications (body, status, created, updated) VALUES ($1, $2, $3, $4)",
-			not.Body, "pending", not.Created, not.Updated)
+// getNotification returns a notification with its status and the outcome
+// of its deliveries.
+func getNotification(store NotificationStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
 		if err != nil {
-			http.Error(w, "failed to store notification", http.StatusInternalServerError)
+			http.Error(w, "invalid notification id", http.StatusBadRequest)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(not)
+		n, err := store.GetNotification(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "notification not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to read notification", http.StatusInternalServerError)
+			return
+		}
+		deliveries, err := store.ListDeliveries(r.Context(), id)
+		if err != nil {
+			http.Error(w, "failed to read deliveries", http.StatusInternalServerError)
+			return
+		}
+		failures, err := store.ListDeliveryFailures(r.Context(), id)
+		if err != nil {
+			http.Error(w, "failed to read delivery failures", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, newNotificationDetail(n, deliveries, failures))
 	}
 }
 
-// listNotifications lists all notifications.
-func listNotifications(pool *pgxpool.Pool) http.HandlerFunc {
+// listDeliveryFailures lists the subscriptions a notification failed to
+// reach.
+func listDeliveryFailures(store NotificationStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var nots []notification
-		// Query notifications from database
-		results, err := pool.Query(r.Context(),
-			"SELECT id, body, created, updated FROM notifications")
-		if err != nil {
-			if err == pgx.ErrNoRows {
-				// No notifications found
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode([]notification{})
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid notification id", http.StatusBadRequest)
+			return
+		}
+
+		failures, err := store.ListDeliveryFailures(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "notification not found", http.StatusNotFound)
 				return
 			}
-			http.Error(w, "failed to read notifications", http.StatusInternalServerError)
+			http.Error(w, "failed to read delivery failures", http.StatusInternalServerError)
 			return
 		}
 
-		for results.Next() {
-			var not notification
-			err := results.Scan(&not.ID, &not.Body, &not.Created, &not.Updated)
-			if err != nil {
-				http.Error(w, "failed to read notifications", http.StatusInternalServerError)
+		writeJSON(w, r, http.StatusOK, failures)
+	}
+}
+
+// listDeliveries lists the receipts recorded for a notification, including
+// the variant each subscription received.
+func listDeliveries(store NotificationStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid notification id", http.StatusBadRequest)
+			return
+		}
+
+		deliveries, err := store.ListDeliveries(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "notification not found", http.StatusNotFound)
 				return
 			}
-			nots = append(nots, not)
+			http.Error(w, "failed to read deliveries", http.StatusInternalServerError)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(nots)
+		writeJSON(w, r, http.StatusOK, deliveries)
 	}
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateNotificationStatus(t *testing.T) {
+	sendAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "immediate", body: `{"body":"hello"}`, want: "pending"},
+		{name: "send at", body: `{"body":"hello","send_at":"` + sendAt + `"}`, want: "scheduled"},
+		{name: "client status", body: `{"body":"hello","status":"completed"}`, want: "pending"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/notifications", strings.NewReader(tt.body))
+			createNotification(config{}, store)(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status code = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			var got notification
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID == 0 || got.Status != tt.want {
+				t.Errorf("notification %d is %q, want a generated id and %q", got.ID, got.Status, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// health tracks whether the service should receive new traffic. Liveness is
+// implied by the process answering at all; readiness is toggled during
+// startup and shutdown, and lost while any component is degraded.
+type health struct {
+	ready atomic.Bool
+
+	mu       sync.Mutex
+	degraded map[string]bool
+}
+
+// setReady marks the service as ready or not ready to receive traffic.
+func (h *health) setReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+// setDegraded marks a component, such as a worker that lost the database,
+// as degraded or recovered.
+func (h *health) setDegraded(component string, degraded bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.degraded == nil {
+		h.degraded = map[string]bool{}
+	}
+	if degraded {
+		h.degraded[component] = true
+	} else {
+		delete(h.degraded, component)
+	}
+}
+
+// degradedComponents lists the degraded components in name order.
+func (h *health) degradedComponents() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	components := make([]string, 0, len(h.degraded))
+	for c := range h.degraded {
+		components = append(components, c)
+	}
+	sort.Strings(components)
+	return components
+}
+
+// healthz reports that the process is alive.
+func healthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// readyz reports whether the service is ready to receive traffic. It returns
+// 503 once shutdown has begun so load balancers stop routing requests here
+// before the listener closes, and while a component is degraded.
+func readyz(h *health) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.ready.Load() {
+			writeJSON(w, r, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+			return
+		}
+		if degraded := h.degradedComponents(); len(degraded) > 0 {
+			writeJSON(w, r, http.StatusServiceUnavailable, map[string]any{"status": "degraded", "degraded": degraded})
+			return
+		}
+		writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
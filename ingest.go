@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxIngestBody is the largest inbound webhook body accepted.
+const maxIngestBody = 1 << 20
+
+// signatureTolerance is how far a signed timestamp may drift from now before
+// the delivery is rejected as a possible replay.
+const signatureTolerance = 5 * time.Minute
+
+// ingestSource verifies deliveries from an external system and names the task
+// type each event becomes.
+type ingestSource struct {
+	verify   func(r *http.Request, body []byte, secret string) error
+	taskType func(r *http.Request, body []byte) (string, error)
+}
+
+// ingestSources are the external systems that can enqueue tasks through
+// POST /ingest/{source}.
+var ingestSources = map[string]ingestSource{
+	// GitHub signs the body with X-Hub-Signature-256 and names the event in
+	// X-GitHub-Event.
+	"github": {
+		verify: func(r *http.Request, body []byte, secret string) error {
+			signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+			if !ok {
+				return errors.New("missing X-Hub-Signature-256 header")
+			}
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+				return errors.New("signature mismatch")
+			}
+			return nil
+		},
+		taskType: func(r *http.Request, body []byte) (string, error) {
+			event := r.Header.Get("X-GitHub-Event")
+			if event == "" {
+				return "", errors.New("missing X-GitHub-Event header")
+			}
+			return "github." + event, nil
+		},
+	},
+	// Stripe signs "<timestamp>.<body>" in the Stripe-Signature header and
+	// names the event in the body's type field.
+	"stripe": {
+		verify: func(r *http.Request, body []byte, secret string) error {
+			return verifyTimestampedSignature(r.Header.Get("Stripe-Signature"), body, secret)
+		},
+		taskType: func(r *http.Request, body []byte) (string, error) {
+			var event struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(body, &event); err != nil || event.Type == "" {
+				return "", errors.New("missing event type")
+			}
+			return "stripe." + event.Type, nil
+		},
+	},
+	// Other instances of this service, or anything signing the same way as
+	// our outbound webhooks.
+	"webhook": {
+		verify: func(r *http.Request, body []byte, secret string) error {
+			return verifyTimestampedSignature(r.Header.Get("X-Signature"), body, secret)
+		},
+		taskType: func(r *http.Request, body []byte) (string, error) {
+			var event webhookEvent
+			if err := json.Unmarshal(body, &event); err != nil || event.Event == "" {
+				return "", errors.New("missing event name")
+			}
+			return "webhook." + event.Event, nil
+		},
+	},
+}
+
+// verifyTimestampedSignature checks a "t=<unix>,v1=<hex>[,v1=<hex>...]"
+// signature header, as produced by signWebhook, against the secret.
+func verifyTimestampedSignature(header string, body []byte, secret string) error {
+	if header == "" {
+		return errors.New("missing signature header")
+	}
+
+	var timestamp int64
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == 0 {
+		return errors.New("missing signature timestamp")
+	}
+	if drift := time.Since(time.Unix(timestamp, 0)); drift > signatureTolerance || drift < -signatureTolerance {
+		return errors.New("signature timestamp outside tolerance")
+	}
+
+	expected := signWebhook([]string{secret}, timestamp, body)
+	_, want, _ := strings.Cut(expected, ",v1=")
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(want)) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// ingest verifies an inbound webhook from a known source and enqueues it as a
+// task whose payload is the delivered body.
+func ingest(cfg config, store TaskStore, flags *flagCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant, _ := tenantFromContext(r.Context())
+		if !flags.enabled(r.Context(), flagIngest, tenant) {
+			http.Error(w, "ingest is disabled", http.StatusNotFound)
+			return
+		}
+
+		name := r.PathValue("source")
+		source, ok := ingestSources[name]
+		secret := cfg.IngestSecrets[name]
+		if !ok || secret == "" {
+			http.Error(w, "unknown source", http.StatusNotFound)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBody))
+		if err != nil {
+			http.Error(w, "failed to read request", http.StatusBadRequest)
+			return
+		}
+
+		if err := source.verify(r, body, secret); err != nil {
+			http.Error(w, fmt.Sprintf("invalid signature: %s", err), http.StatusUnauthorized)
+			return
+		}
+
+		taskType, err := source.taskType(r, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !json.Valid(body) {
+			http.Error(w, "body must be JSON", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		task := task{
+			ID:      fmt.Sprintf("%d", now.UnixNano()),
+			Type:    taskType,
+			Payload: json.RawMessage(body),
+			Status:  "pending",
+			Created: now,
+			Updated: now,
+
+			Traceparent: traceparentFromContext(r.Context()),
+		}
+
+		// Bursts of a debounced type collapse into one task run after a quiet
+		// period
+		ctx := withActor(r.Context(), "ingest", "")
+		if debounceTask(&task, r.Header.Get("Debounce-Key"), cfg.TaskDebounce) {
+			id, err := store.DebounceTask(ctx, task)
+			if err != nil {
+				log.Printf("Error debouncing ingested task: %v\n", err)
+				http.Error(w, "failed to create task", http.StatusInternalServerError)
+				return
+			}
+			task.ID = id
+			writeJSON(w, r, http.StatusAccepted, task)
+			return
+		}
+
+		// Sources redeliver on timeouts, enqueue each delivery once
+		if err := dedupTask(&task, r.Header.Get("Idempotency-Key"), cfg.TaskDedupWindow); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := store.CreateTask(ctx, task); err != nil {
+			if writeDuplicateTask(w, r, http.StatusAccepted, task, err) {
+				return
+			}
+			log.Printf("Error inserting ingested task: %v\n", err)
+			http.Error(w, "failed to create task", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusAccepted, task)
+	}
+}
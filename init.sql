@@ -4,25 +4,148 @@ CREATE TABLE IF NOT EXISTS subscriptions (
     endpoint TEXT NOT NULL,
     auth TEXT NOT NULL,
     p256dh TEXT NOT NULL,
+    locale TEXT NOT NULL DEFAULT '',
+    timezone TEXT NOT NULL DEFAULT '',
+    user_id TEXT NOT NULL DEFAULT '',
+    origin TEXT NOT NULL DEFAULT '',
+    snoozed_until TIMESTAMP WITH TIME ZONE,
+    vapid_public_key TEXT NOT NULL DEFAULT '',
+    content_encoding TEXT NOT NULL DEFAULT '',
+    schema_version INTEGER NOT NULL DEFAULT 1,
+    tags JSONB NOT NULL DEFAULT '[]',
     created TIMESTAMP WITH TIME ZONE NOT NULL,
     updated TIMESTAMP WITH TIME ZONE NOT NULL
 );
 
+-- Create index serving lookups of a user's subscriptions
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user_id ON subscriptions(user_id);
+
+-- Create VAPID keys table holding every keypair pushes have been signed
+-- with, the newest being current
+CREATE TABLE IF NOT EXISTS vapid_keys (
+    id SERIAL PRIMARY KEY,
+    public_key TEXT NOT NULL UNIQUE,
+    private_key TEXT NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Create feature flags table turning features on or off, for everyone or
+-- per tenant
+CREATE TABLE IF NOT EXISTS feature_flags (
+    name TEXT PRIMARY KEY,
+    enabled BOOLEAN NOT NULL,
+    tenants JSONB NOT NULL DEFAULT '{}',
+    updated TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Create templates table
+CREATE TABLE IF NOT EXISTS templates (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Create schedules table holding the recurring tasks and notifications
+CREATE TABLE IF NOT EXISTS schedules (
+    id SERIAL PRIMARY KEY,
+    rule TEXT NOT NULL,
+    task JSONB,
+    notification JSONB,
+    next_run TIMESTAMP WITH TIME ZONE,
+    created TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_schedules_next_run ON schedules(next_run);
+
 -- Create notifications table
 CREATE TABLE IF NOT EXISTS notifications (
     id SERIAL PRIMARY KEY,
     body TEXT NOT NULL,
     status VARCHAR(50) NOT NULL,
+    bodies JSONB NOT NULL DEFAULT '{}',
+    variants JSONB NOT NULL DEFAULT '[]',
+    content JSONB NOT NULL DEFAULT '{}',
+    dry_run BOOLEAN NOT NULL DEFAULT FALSE,
+    priority TEXT NOT NULL DEFAULT '',
+    endpoint TEXT NOT NULL DEFAULT '',
+    targeted BOOLEAN NOT NULL DEFAULT FALSE,
+    local_time TEXT NOT NULL DEFAULT '',
+    timezone TEXT NOT NULL DEFAULT '',
+    origin TEXT NOT NULL DEFAULT '',
+    send_at TIMESTAMP WITH TIME ZONE,
+    processed_by TEXT NOT NULL DEFAULT '',
+    claimed_by TEXT NOT NULL DEFAULT '',
+    claimed_at TIMESTAMP WITH TIME ZONE,
+    traceparent TEXT NOT NULL DEFAULT '',
+    last_error TEXT,
+    failed_at TIMESTAMP WITH TIME ZONE,
     created TIMESTAMP WITH TIME ZONE NOT NULL,
     updated TIMESTAMP WITH TIME ZONE NOT NULL
 );
 
+-- Create index serving the scheduler's scans for due notifications
+CREATE INDEX IF NOT EXISTS idx_notifications_scheduled ON notifications(status, send_at);
+
+-- Create notification targets table holding the explicit target list of
+-- targeted notifications
+CREATE TABLE IF NOT EXISTS notification_targets (
+    notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL,
+    PRIMARY KEY (notification_id, endpoint)
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_targets_endpoint ON notification_targets(endpoint);
+
+-- Create notification failures table holding the subscriptions each
+-- notification has yet to reach
+CREATE TABLE IF NOT EXISTS notification_failures (
+    notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (notification_id, endpoint)
+);
+
+-- Create notification deliveries table holding a receipt for every
+-- subscription a notification reached
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL,
+    variant TEXT NOT NULL DEFAULT '',
+    created TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (notification_id, endpoint)
+);
+
 -- Create tasks table
 CREATE TABLE IF NOT EXISTS tasks (
     id VARCHAR(255) PRIMARY KEY,
     type TEXT NOT NULL,
+    tenant TEXT NOT NULL DEFAULT '',
+    priority INTEGER NOT NULL DEFAULT 0,
     payload JSONB NOT NULL,
     status VARCHAR(50) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 0,
+    timeout_seconds INTEGER NOT NULL DEFAULT 0,
+    processed_by TEXT NOT NULL DEFAULT '',
+    claimed_by TEXT NOT NULL DEFAULT '',
+    claimed_at TIMESTAMP WITH TIME ZONE,
+    locked_by TEXT NOT NULL DEFAULT '',
+    locked_until TIMESTAMP WITH TIME ZONE,
+    progress INTEGER NOT NULL DEFAULT 0,
+    progress_message TEXT NOT NULL DEFAULT '',
+    traceparent TEXT NOT NULL DEFAULT '',
+    dedup_key TEXT NOT NULL DEFAULT '',
+    dedup_until TIMESTAMP WITH TIME ZONE,
+    debounce_key TEXT NOT NULL DEFAULT '',
+    run_at TIMESTAMP WITH TIME ZONE,
+    last_error TEXT,
+    failed_at TIMESTAMP WITH TIME ZONE,
+    sla_breached_at TIMESTAMP WITH TIME ZONE,
     created TIMESTAMP WITH TIME ZONE NOT NULL,
     updated TIMESTAMP WITH TIME ZONE NOT NULL
 );
@@ -30,20 +153,142 @@ CREATE TABLE IF NOT EXISTS tasks (
 -- Create index on status for better query performance
 CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status);
 
+-- Create index serving backlog scans, most urgent first
+CREATE INDEX IF NOT EXISTS idx_tasks_backlog ON tasks(status, priority DESC, created);
+
+-- Create index serving duplicate checks within the dedup window
+CREATE INDEX IF NOT EXISTS idx_tasks_dedup ON tasks(dedup_key, dedup_until) WHERE dedup_key <> '';
+
+-- Create index serving the due task poller
+CREATE INDEX IF NOT EXISTS idx_tasks_due ON tasks(run_at) WHERE status = 'scheduled';
+
+-- Create index serving takeovers of expired leases
+CREATE INDEX IF NOT EXISTS idx_tasks_lease ON tasks(locked_until) WHERE status = 'processing';
+
+-- Create index serving the SLA monitor
+CREATE INDEX IF NOT EXISTS idx_tasks_sla ON tasks(type, created)
+    WHERE sla_breached_at IS NULL AND status IN ('pending', 'scheduled', 'processing');
+
+-- Create task events table recording every status transition
+CREATE TABLE IF NOT EXISTS task_events (
+    id BIGSERIAL PRIMARY KEY,
+    task_id VARCHAR(255) NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    actor TEXT NOT NULL,
+    worker_id TEXT,
+    created TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_events_task_id ON task_events(task_id);
+
+-- Create the role tenant-scoped queries switch to (RLS_ROLE). Row-level
+-- security doesn't apply to table owners, so queries made on behalf of a
+-- tenant assume this role and set app.tenant for the policies below
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'tenant_scoped') THEN
+        CREATE ROLE tenant_scoped NOLOGIN;
+    END IF;
+END
+$$;
+
+GRANT tenant_scoped TO CURRENT_USER;
+GRANT SELECT, INSERT ON tasks, task_events TO tenant_scoped;
+GRANT UPDATE ON tasks TO tenant_scoped;
+GRANT USAGE ON SEQUENCE task_events_id_seq TO tenant_scoped;
+
+-- Restrict tasks to the tenant set in app.tenant
+ALTER TABLE tasks ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON tasks;
+CREATE POLICY tenant_isolation ON tasks
+    USING (tenant = current_setting('app.tenant', true))
+    WITH CHECK (tenant = current_setting('app.tenant', true));
+
+-- Restrict task events to those of visible tasks, both reading them and
+-- recording them. Events are inserted after their task, in a statement of
+-- their own, so the task is already visible
+ALTER TABLE task_events ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON task_events;
+CREATE POLICY tenant_isolation ON task_events FOR SELECT
+    USING (EXISTS (SELECT 1 FROM tasks WHERE tasks.id = task_events.task_id));
+DROP POLICY IF EXISTS tenant_insert ON task_events;
+CREATE POLICY tenant_insert ON task_events FOR INSERT
+    WITH CHECK (EXISTS (SELECT 1 FROM tasks WHERE tasks.id = task_events.task_id));
+
+-- Create rate limits table holding token buckets shared by every instance
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Create cron runs table recording the last tick each periodic job ran
+CREATE TABLE IF NOT EXISTS cron_runs (
+    name TEXT PRIMARY KEY,
+    last_tick TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Create worker heartbeats table recording when each instance was last alive
+CREATE TABLE IF NOT EXISTS worker_heartbeats (
+    instance TEXT PRIMARY KEY,
+    role TEXT NOT NULL,
+    started TIMESTAMP WITH TIME ZONE NOT NULL,
+    heartbeat TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Create maintenance table holding the single row of maintenance mode every
+-- instance follows
+CREATE TABLE IF NOT EXISTS maintenance (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    enabled BOOLEAN NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    updated TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Send a NOTIFY payload with its length in bytes appended as a final
+-- "length" field, so listeners can tell it arrived whole. Payloads too large
+-- for NOTIFY's 8000 byte limit are replaced with the row's id and an
+-- "oversized" flag, and listeners fetch the row instead
+CREATE OR REPLACE FUNCTION notify_envelope(channel TEXT, payload TEXT)
+    RETURNS VOID AS $$
+BEGIN
+    IF octet_length(payload) > 7900 THEN
+        payload := json_build_object('id', payload::json->'id', 'oversized', TRUE)::text;
+    END IF;
+    PERFORM pg_notify(channel, left(payload, -1) || ', "length" : ' || octet_length(payload) || '}');
+END;
+$$ LANGUAGE plpgsql;
+
 -- Create notification function
 CREATE OR REPLACE FUNCTION notify_task_created()
     RETURNS trigger AS $$
 BEGIN
-    PERFORM pg_notify('tasks_channel', 
-        json_build_object(
-            'id', NEW.id,
-            'type', NEW.type,
-            'payload', NEW.payload,
-            'status', NEW.status,
-            'created', NEW.created,
-            'updated', NEW.updated
-        )::text
-    );
+    -- Tasks inserted pending but dated in the future wait to be released
+    IF NEW.status = 'pending' AND NEW.run_at > NOW() THEN
+        NEW.status := 'scheduled';
+    END IF;
+
+    -- Scheduled tasks are announced when the due task poller releases them
+    IF NEW.status = 'pending' THEN
+        PERFORM notify_envelope('tasks_channel',
+            json_build_object(
+                'id', NEW.id,
+                'type', NEW.type,
+                'tenant', NEW.tenant,
+                'priority', NEW.priority,
+                'payload', NEW.payload,
+                'status', NEW.status,
+                'attempts', NEW.attempts,
+                'max_attempts', NEW.max_attempts,
+                'timeout_seconds', NEW.timeout_seconds,
+                'traceparent', NEW.traceparent,
+                'run_at', NEW.run_at,
+                'created', NEW.created,
+                'updated', NEW.updated
+            )::text
+        );
+    END IF;
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -52,15 +297,28 @@ $$ LANGUAGE plpgsql;
 CREATE OR REPLACE FUNCTION notify_notification_created()
     RETURNS trigger AS $$
 BEGIN
-    PERFORM pg_notify('notifications_channel', 
-        json_build_object(
-            'id', NEW.id,
-            'body', NEW.body,
-            'status', NEW.status,
-            'created', NEW.created,
-            'updated', NEW.updated
-        )::text
-    );
+    -- Scheduled notifications are announced when the scheduler releases them
+    IF NEW.status = 'pending' THEN
+        PERFORM notify_envelope('notifications_channel',
+            json_build_object(
+                'id', NEW.id,
+                'body', NEW.body,
+                'bodies', NEW.bodies,
+                'variants', NEW.variants,
+                'content', NEW.content,
+                'status', NEW.status,
+                'dry_run', NEW.dry_run,
+                'priority', NEW.priority,
+                'endpoint', NEW.endpoint,
+                'targeted', NEW.targeted,
+                'timezone', NEW.timezone,
+                'origin', NEW.origin,
+                'traceparent', NEW.traceparent,
+                'created', NEW.created,
+                'updated', NEW.updated
+            )::text
+        );
+    END IF;
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -68,7 +326,7 @@ $$ LANGUAGE plpgsql;
 -- Create trigger
 DROP TRIGGER IF EXISTS task_created_trigger ON tasks;
 CREATE TRIGGER task_created_trigger
-    AFTER INSERT ON tasks
+    BEFORE INSERT ON tasks
     FOR EACH ROW
     EXECUTE FUNCTION notify_task_created();
 
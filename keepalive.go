@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var keepaliveFailures = metrics.counter("worker_keepalive_failures_total",
+	"Listener connections a keepalive found dead, by channel.", "channel")
+
+// waitWithKeepalive waits for a notification on the listener. Whenever none
+// arrives for the keepalive interval the listener's connection is pinged, so
+// a connection silently dropped by a NAT or load balancer fails here instead
+// of leaving the worker waiting on it forever. An interval of zero disables
+// the keepalive.
+func waitWithKeepalive(ctx context.Context, listener Listener, channel string, interval, timeout time.Duration) (*pgconn.Notification, error) {
+	if interval <= 0 {
+		return listener.WaitForNotification(ctx)
+	}
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, interval)
+		notification, err := listener.WaitForNotification(waitCtx)
+		idle := waitCtx.Err() != nil
+		cancel()
+		if err == nil || ctx.Err() != nil || !idle {
+			return notification, err
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = listener.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			keepaliveFailures.inc(channel)
+			return nil, fmt.Errorf("listener keepalive failed: %w", err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the task latency
+// histograms, from queue hops well under the poll interval up to backlogs
+// of several minutes.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+var (
+	taskStartLatency = metrics.histogram("task_start_latency_seconds",
+		"Time from a task being enqueued, or coming due, to a worker starting it, by type.", latencyBuckets, "type")
+	taskCompleteLatency = metrics.histogram("task_complete_latency_seconds",
+		"Time from a task being enqueued, or coming due, to it completing, by type.", latencyBuckets, "type")
+)
+
+// taskReady returns when a task became ready to run: when it was enqueued,
+// or when it came due if it was scheduled for later.
+func taskReady(t task) time.Time {
+	if t.RunAt != nil && t.RunAt.After(t.Created) {
+		return *t.RunAt
+	}
+	return t.Created
+}
+
+// latencyQuantiles are the quantiles /stats/latency reports.
+var latencyQuantiles = []struct {
+	name string
+	q    float64
+}{{"p50", .5}, {"p95", .95}, {"p99", .99}}
+
+// latencySummary is the distribution of one latency of a task type, in
+// seconds, estimated from its histogram.
+type latencySummary struct {
+	Count     uint64             `json:"count"`
+	Quantiles map[string]float64 `json:"quantiles"`
+}
+
+// taskLatency is the latency of the tasks of one type.
+type taskLatency struct {
+	Type     string         `json:"type"`
+	Start    latencySummary `json:"start"`
+	Complete latencySummary `json:"complete"`
+}
+
+// summarizeLatency estimates the latency quantiles of a task type.
+func summarizeLatency(h *histogramVec, taskType string) latencySummary {
+	summary := latencySummary{Quantiles: map[string]float64{}}
+	for _, q := range latencyQuantiles {
+		summary.Quantiles[q.name], summary.Count = h.quantile(q.q, taskType)
+	}
+	return summary
+}
+
+// getLatencyStats reports the enqueue-to-start and enqueue-to-complete
+// latency of every task type this instance has processed since it started.
+func getLatencyStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Every completed task was started, so the types started cover all
+		stats := []taskLatency{}
+		for _, values := range taskStartLatency.labelValues() {
+			stats = append(stats, taskLatency{
+				Type:     values[0],
+				Start:    summarizeLatency(taskStartLatency, values[0]),
+				Complete: summarizeLatency(taskCompleteLatency, values[0]),
+			})
+		}
+		writeJSON(w, r, http.StatusOK, stats)
+	}
+}
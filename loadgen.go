@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// loadgenTaskType is the type of the tasks loadgen enqueues. Workers run a
+// no-op handler for it.
+const loadgenTaskType = "loadgen"
+
+// loadgenOptions are the flags of the loadgen command.
+type loadgenOptions struct {
+	rate     float64
+	duration time.Duration
+	size     int
+	wait     time.Duration
+	poll     time.Duration
+}
+
+// parseLoadgenOptions parses the loadgen command's flags.
+func parseLoadgenOptions(args []string) (loadgenOptions, error) {
+	var opts loadgenOptions
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	fs.Float64Var(&opts.rate, "rate", 50, "tasks enqueued per second")
+	fs.DurationVar(&opts.duration, "duration", 30*time.Second, "how long to enqueue for")
+	fs.IntVar(&opts.size, "size", 256, "payload size in bytes")
+	fs.DurationVar(&opts.wait, "wait", time.Minute, "how long to wait for enqueued tasks to be processed")
+	fs.DurationVar(&opts.poll, "poll", 500*time.Millisecond, "how often to check for processed tasks")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.rate <= 0 || opts.duration <= 0 || opts.size < 0 || opts.poll <= 0 {
+		return opts, fmt.Errorf("loadgen: rate, duration, and poll must be positive and size not negative")
+	}
+	return opts, nil
+}
+
+// loadgen enqueues tasks at a fixed rate through the configured store, so
+// against the database of a running instance, waits for its workers to
+// process them, and reports the throughput achieved and the percentiles of
+// the time from insert to completion.
+func loadgen(ctx context.Context, logger *slog.Logger, store Store, wait connectWait, args []string) error {
+	opts, err := parseLoadgenOptions(args)
+	if err != nil {
+		return err
+	}
+	if err := waitForConnection(ctx, store, wait); err != nil {
+		return fmt.Errorf("loadgen failed to connect to database: %w", err)
+	}
+
+	payload, err := json.Marshal(map[string]string{"padding": strings.Repeat("x", opts.size)})
+	if err != nil {
+		return err
+	}
+
+	ctx = withActor(ctx, "loadgen", "")
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.rate))
+	defer ticker.Stop()
+
+	ids := map[string]bool{}
+	start := time.Now()
+	deadline := start.Add(opts.duration)
+	var failed int
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		t := task{
+			ID:      fmt.Sprintf("%d", now.UnixNano()),
+			Type:    loadgenTaskType,
+			Payload: json.RawMessage(payload),
+			Status:  "pending",
+			Created: now,
+			Updated: now,
+		}
+		if err := store.CreateTask(ctx, t); err != nil {
+			failed++
+			logger.ErrorContext(ctx, "Error enqueueing task", slog.Any("error", err))
+			continue
+		}
+		ids[t.ID] = true
+	}
+	enqueueElapsed := time.Since(start)
+
+	// Wait for the workers to finish every task that was enqueued
+	var done []task
+	waitUntil := time.Now().Add(opts.wait)
+	for {
+		tasks, err := store.ListTasks(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list tasks: %w", err)
+		}
+		done = done[:0]
+		for _, t := range tasks {
+			if ids[t.ID] && (t.Status == "completed" || t.Status == "failed" || t.Status == "timed_out" || t.Status == "cancelled") {
+				done = append(done, t)
+			}
+		}
+		if len(done) == len(ids) || time.Now().After(waitUntil) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(opts.poll):
+		}
+	}
+
+	latencies := make([]time.Duration, len(done))
+	var last time.Time
+	for i, t := range done {
+		latencies[i] = t.Updated.Sub(t.Created)
+		if t.Updated.After(last) {
+			last = t.Updated
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var processedPerSecond float64
+	if len(done) > 0 {
+		processedPerSecond = float64(len(done)) / last.Sub(start).Seconds()
+	}
+	logger.InfoContext(ctx, "Load generation finished",
+		slog.Int("enqueued", len(ids)),
+		slog.Int("enqueue_errors", failed),
+		slog.Int("processed", len(done)),
+		slog.Int("unfinished", len(ids)-len(done)),
+		slog.Float64("target_per_second", opts.rate),
+		slog.Float64("enqueued_per_second", float64(len(ids))/enqueueElapsed.Seconds()),
+		slog.Float64("processed_per_second", processedPerSecond),
+		slog.Duration("latency_p50", percentile(latencies, 50)),
+		slog.Duration("latency_p90", percentile(latencies, 90)),
+		slog.Duration("latency_p99", percentile(latencies, 99)),
+		slog.Duration("latency_max", percentile(latencies, 100)))
+	return nil
+}
+
+// percentile returns the pth percentile of sorted durations using the
+// nearest-rank method, or 0 when there are none.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
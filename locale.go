@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// bodiesOrEmpty returns the localized bodies, or an empty map instead of nil
+// so they are stored as a JSON object.
+func bodiesOrEmpty(bodies map[string]string) map[string]string {
+	if bodies == nil {
+		return map[string]string{}
+	}
+	return bodies
+}
+
+// localizedBody returns the notification body best matching the locale: an
+// exact match, then the locale's language, then any body in the same
+// language, and finally the default body.
+func localizedBody(n notification, locale string) string {
+	if len(n.Bodies) == 0 || locale == "" {
+		return n.Body
+	}
+
+	bodies := map[string]string{}
+	for l, body := range n.Bodies {
+		bodies[normalizeLocale(l)] = body
+	}
+
+	locale = normalizeLocale(locale)
+	if body, ok := bodies[locale]; ok {
+		return body
+	}
+	language, _, _ := strings.Cut(locale, "-")
+	if body, ok := bodies[language]; ok {
+		return body
+	}
+
+	// Sorted so the same regional body is always chosen
+	locales := make([]string, 0, len(bodies))
+	for l := range bodies {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	for _, l := range locales {
+		if strings.HasPrefix(l, language+"-") {
+			return bodies[l]
+		}
+	}
+	return n.Body
+}
+
+// normalizeLocale lowercases a locale and uses hyphens as separators, so
+// "pt_BR" and "pt-br" match.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
+
+// personalizedPayload builds the push payload of a notification for a single
+// subscription: its assigned variant's body when the notification has
+// variants, otherwise the body for its locale, in the subscription's payload
+// schema version. It is built from n, which the worker has decrypted, rather
+// than from the payload the notification was queued with.
+func personalizedPayload(n notification, sub subscription) ([]byte, error) {
+	body, variantName := localizedBody(n, sub.Locale), ""
+	if v := pickVariant(n, sub.Endpoint); v != nil {
+		body, variantName = v.Body, v.Name
+	}
+	return encodePayload(n, body, variantName, sub.SchemaVersion)
+}
@@ -8,7 +8,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v10"
@@ -16,24 +18,254 @@ import (
 )
 
 type config struct {
+	Driver          string `env:"DRIVER" envDefault:"postgres"`
 	DatabaseURL     string `env:"DATABASE_URL"`
+	RLSRole         string `env:"RLS_ROLE"`
+	AutoMigrate     bool   `env:"AUTO_MIGRATE"`
 	ServerPort      string `env:"SERVER_PORT"`
 	VapidPublicKey  string `env:"VAPID_PUBLIC_KEY"`
 	VapidPrivateKey string `env:"VAPID_PRIVATE_KEY"`
+
+	VapidPreviousPublicKey  string        `env:"VAPID_PREVIOUS_PUBLIC_KEY"`
+	VapidPreviousPrivateKey string        `env:"VAPID_PREVIOUS_PRIVATE_KEY"`
+	VapidTransition         time.Duration `env:"VAPID_TRANSITION" envDefault:"720h"`
+
+	DBConnectAttempts int    `env:"DB_CONNECT_ATTEMPTS" envDefault:"5"`
+	DBConnectBackoff  string `env:"DB_CONNECT_BACKOFF" envDefault:"fixed/5s"`
+
+	SQLitePollInterval time.Duration `env:"SQLITE_POLL_INTERVAL" envDefault:"500ms"`
+	SlowQueryThreshold time.Duration `env:"SLOW_QUERY_THRESHOLD" envDefault:"500ms"`
+
+	NotificationsDryRun  bool          `env:"NOTIFICATIONS_DRY_RUN"`
+	NotificationDeadline time.Duration `env:"NOTIFICATION_DEADLINE" envDefault:"2m"`
+	PushTimeout          time.Duration `env:"PUSH_TIMEOUT" envDefault:"10s"`
+	PushDialTimeout      time.Duration `env:"PUSH_DIAL_TIMEOUT" envDefault:"5s"`
+	PushMaxIdleConns     int           `env:"PUSH_MAX_IDLE_CONNS" envDefault:"256"`
+	PushMaxConnsPerHost  int           `env:"PUSH_MAX_CONNS_PER_HOST" envDefault:"64"`
+	PushProxyURL         string        `env:"PUSH_PROXY_URL"`
+	PushContentEncoding  string        `env:"PUSH_CONTENT_ENCODING" envDefault:"aes128gcm"`
+
+	BroadcastConfirmThreshold int `env:"BROADCAST_CONFIRM_THRESHOLD"`
+
+	NotificationBatchWindow time.Duration `env:"NOTIFICATION_BATCH_WINDOW" envDefault:"10ms"`
+	NotificationBatchSize   int           `env:"NOTIFICATION_BATCH_SIZE" envDefault:"50"`
+
+	PushOriginConcurrency int           `env:"PUSH_ORIGIN_CONCURRENCY" envDefault:"16"`
+	PushOverflowDelay     time.Duration `env:"PUSH_OVERFLOW_DELAY" envDefault:"1m"`
+
+	NotificationEncryptionKey          string        `env:"NOTIFICATION_ENCRYPTION_KEY"`
+	NotificationEncryptionPreviousKeys []string      `env:"NOTIFICATION_ENCRYPTION_PREVIOUS_KEYS" envSeparator:","`
+	ReencryptInterval                  time.Duration `env:"REENCRYPT_INTERVAL" envDefault:"1h"`
+	ReencryptBatchSize                 int           `env:"REENCRYPT_BATCH_SIZE" envDefault:"500"`
+
+	IngestSecrets map[string]string `env:"INGEST_SECRETS"`
+
+	TaskDedupWindow time.Duration            `env:"TASK_DEDUP_WINDOW" envDefault:"5m"`
+	TaskDebounce    map[string]time.Duration `env:"TASK_DEBOUNCE"`
+	TaskPollMaxWait time.Duration            `env:"TASK_POLL_MAX_WAIT" envDefault:"1s"`
+
+	TaskLogUnregistered bool `env:"TASK_LOG_UNREGISTERED"`
+
+	TaskTimeout time.Duration `env:"TASK_TIMEOUT" envDefault:"10m"`
+	TaskLease   time.Duration `env:"TASK_LEASE" envDefault:"15m"`
+
+	TaskCancelCheckInterval time.Duration `env:"TASK_CANCEL_CHECK_INTERVAL" envDefault:"2s"`
+
+	TaskSLA               map[string]time.Duration `env:"TASK_SLA"`
+	TaskSLAInterval       time.Duration            `env:"TASK_SLA_INTERVAL" envDefault:"1m"`
+	TaskSLAPriorityBump   int                      `env:"TASK_SLA_PRIORITY_BUMP"`
+	TaskSLAWebhookURL     string                   `env:"TASK_SLA_WEBHOOK_URL"`
+	TaskSLAWebhookSecrets []string                 `env:"TASK_SLA_WEBHOOK_SECRETS" envSeparator:","`
+
+	BridgeSource      string `env:"BRIDGE_SOURCE"`
+	BridgeTaskType    string `env:"BRIDGE_TASK_TYPE" envDefault:"bridge"`
+	BridgeNatsURL     string `env:"BRIDGE_NATS_URL" envDefault:"nats://localhost:4222"`
+	BridgeNatsSubject string `env:"BRIDGE_NATS_SUBJECT" envDefault:"tasks.>"`
+	BridgeNatsQueue   string `env:"BRIDGE_NATS_QUEUE" envDefault:"poc-pg-worker"`
+	BridgeSQSQueueURL string `env:"BRIDGE_SQS_QUEUE_URL"`
+
+	EventSink              string `env:"EVENT_SINK"`
+	EventSinkNatsURL       string `env:"EVENT_SINK_NATS_URL" envDefault:"nats://localhost:4222"`
+	EventSinkSubjectPrefix string `env:"EVENT_SINK_SUBJECT_PREFIX" envDefault:"poc.events"`
+
+	RateLimitAPI         float64 `env:"RATE_LIMIT_API"`
+	RateLimitAPIBurst    int     `env:"RATE_LIMIT_API_BURST" envDefault:"20"`
+	RateLimitPush        float64 `env:"RATE_LIMIT_PUSH"`
+	RateLimitPushBurst   int     `env:"RATE_LIMIT_PUSH_BURST" envDefault:"50"`
+	RateLimitWorker      float64 `env:"RATE_LIMIT_WORKER"`
+	RateLimitWorkerBurst int     `env:"RATE_LIMIT_WORKER_BURST" envDefault:"10"`
+
+	RetentionPeriod   time.Duration `env:"RETENTION_PERIOD"`
+	RetentionInterval time.Duration `env:"RETENTION_INTERVAL" envDefault:"1h"`
+	ReaperTimeout     time.Duration `env:"REAPER_TIMEOUT"`
+	ReaperInterval    time.Duration `env:"REAPER_INTERVAL" envDefault:"1m"`
+	SchedulerInterval time.Duration `env:"SCHEDULER_INTERVAL" envDefault:"30s"`
+
+	DLQAlertThreshold      int64         `env:"DLQ_ALERT_THRESHOLD"`
+	DLQAlertInterval       time.Duration `env:"DLQ_ALERT_INTERVAL" envDefault:"5m"`
+	DLQAlertWebhookURL     string        `env:"DLQ_ALERT_WEBHOOK_URL"`
+	DLQAlertWebhookSecrets []string      `env:"DLQ_ALERT_WEBHOOK_SECRETS" envSeparator:","`
+	DLQAlertSlackURL       string        `env:"DLQ_ALERT_SLACK_URL"`
+	DLQAlertEmailTo        []string      `env:"DLQ_ALERT_EMAIL_TO" envSeparator:","`
+	SMTPAddr               string        `env:"SMTP_ADDR" envDefault:"localhost:25"`
+	SMTPFrom               string        `env:"SMTP_FROM"`
+	SMTPUsername           string        `env:"SMTP_USERNAME"`
+	SMTPPassword           string        `env:"SMTP_PASSWORD"`
+
+	TaskCallbackURL     string   `env:"TASK_CALLBACK_URL"`
+	TaskCallbackSecrets []string `env:"TASK_CALLBACK_SECRETS" envSeparator:","`
+
+	ShutdownDrainDelay time.Duration `env:"SHUTDOWN_DRAIN_DELAY" envDefault:"5s"`
+	WorkerDrainTimeout time.Duration `env:"WORKER_DRAIN_TIMEOUT" envDefault:"30s"`
+
+	ContentSecurityPolicy string        `env:"CONTENT_SECURITY_POLICY" envDefault:"default-src 'none'; frame-ancestors 'none'"`
+	ReferrerPolicy        string        `env:"REFERRER_POLICY" envDefault:"no-referrer"`
+	FrameOptions          string        `env:"FRAME_OPTIONS" envDefault:"DENY"`
+	HSTSMaxAge            time.Duration `env:"HSTS_MAX_AGE" envDefault:"8760h"`
+
+	AdminSessionCookie string `env:"ADMIN_SESSION_COOKIE" envDefault:"admin_session"`
+	CSRFSecret         string `env:"CSRF_SECRET"`
+
+	SubscriptionKeysToken string `env:"SUBSCRIPTION_KEYS_TOKEN"`
+
+	RequestTimeout  time.Duration            `env:"REQUEST_TIMEOUT" envDefault:"10s"`
+	RequestTimeouts map[string]time.Duration `env:"REQUEST_TIMEOUTS" envDefault:"POST /ingest/{source}:30s,DELETE /users/{id}/data:1m,POST /admin/tasks/requeue:1m,POST /admin/notifications/requeue:1m,POST /admin/purge:1m"`
+
+	CanaryInterval  time.Duration `env:"CANARY_INTERVAL"`
+	SelftestTimeout time.Duration `env:"SELFTEST_TIMEOUT" envDefault:"5s"`
+	FaultInjection  float64       `env:"FAULT_INJECTION"`
+
+	WorkerMinConcurrency int           `env:"WORKER_MIN_CONCURRENCY" envDefault:"1"`
+	WorkerMaxConcurrency int           `env:"WORKER_MAX_CONCURRENCY" envDefault:"8"`
+	WorkerScaleInterval  time.Duration `env:"WORKER_SCALE_INTERVAL" envDefault:"1s"`
+	WorkerTargetLatency  time.Duration `env:"WORKER_TARGET_LATENCY" envDefault:"500ms"`
+
+	WorkerConcurrency map[string]int `env:"WORKER_CONCURRENCY"`
+
+	WorkerKeepalive        time.Duration `env:"WORKER_KEEPALIVE" envDefault:"30s"`
+	WorkerKeepaliveTimeout time.Duration `env:"WORKER_KEEPALIVE_TIMEOUT" envDefault:"5s"`
+
+	WorkerPollInterval time.Duration `env:"WORKER_POLL_INTERVAL" envDefault:"30s"`
+
+	WorkerReconnectBackoff string `env:"WORKER_RECONNECT_BACKOFF" envDefault:"exponential-jitter/1s/1m"`
+
+	WorkerRole              string        `env:"WORKER_ROLE" envDefault:"active"`
+	WorkerHeartbeatInterval time.Duration `env:"WORKER_HEARTBEAT_INTERVAL" envDefault:"5s"`
+	WorkerFailoverTimeout   time.Duration `env:"WORKER_FAILOVER_TIMEOUT" envDefault:"15s"`
+	ZombieTimeout           time.Duration `env:"ZOMBIE_TIMEOUT" envDefault:"30s"`
+	ZombieInterval          time.Duration `env:"ZOMBIE_INTERVAL" envDefault:"30s"`
+
+	FlagCacheTTL time.Duration `env:"FLAG_CACHE_TTL" envDefault:"30s"`
+
+	MaintenancePollInterval time.Duration `env:"MAINTENANCE_POLL_INTERVAL" envDefault:"5s"`
+	MaintenanceRetryAfter   time.Duration `env:"MAINTENANCE_RETRY_AFTER" envDefault:"1m"`
+
+	RedactFields []string `env:"REDACT_FIELDS" envSeparator:"," envDefault:"*email*,*token*,*password*,*secret*,authorization,auth,p256dh,user_id"`
+
+	TenantWeights map[string]int    `env:"TENANT_WEIGHTS"`
+	WorkerBackoff map[string]string `env:"WORKER_BACKOFF"`
+}
+
+// taskCallback returns the webhook notified when tasks complete or fail.
+func (c config) taskCallback() webhook {
+	return webhook{URL: c.TaskCallbackURL, Secrets: c.TaskCallbackSecrets}
+}
+
+// requestTimeouts returns the API request deadlines from the configuration.
+func (c config) requestTimeouts() requestTimeouts {
+	return requestTimeouts{Default: c.RequestTimeout, Routes: c.RequestTimeouts}
+}
+
+// securityHeaders returns the response security headers from the
+// configuration.
+func (c config) securityHeaders() securityHeaders {
+	return securityHeaders{
+		ContentSecurityPolicy: c.ContentSecurityPolicy,
+		ReferrerPolicy:        c.ReferrerPolicy,
+		FrameOptions:          c.FrameOptions,
+		HSTSMaxAge:            c.HSTSMaxAge,
+	}
+}
+
+// connectWait returns how long to wait for the database from the
+// configuration.
+func (c config) connectWait() (connectWait, error) {
+	backoff, err := parseBackoff(c.DBConnectBackoff)
+	if err != nil {
+		return connectWait{}, fmt.Errorf("error loading configuration: %w", err)
+	}
+	return connectWait{attempts: c.DBConnectAttempts, backoff: backoff}, nil
+}
+
+// worker returns the options for the worker on the specified channel.
+func (c config) worker(channel string, limiter rateLimiter) (workerOptions, error) {
+	connect, err := c.connectWait()
+	if err != nil {
+		return workerOptions{}, err
+	}
+	reconnect, err := parseBackoff(c.WorkerReconnectBackoff)
+	if err != nil {
+		return workerOptions{}, fmt.Errorf("error loading configuration: %w", err)
+	}
+	opts := workerOptions{
+		scaling: c.scaling(channel),
+		limit:   rateLimit{limiter: limiter, key: "worker:" + channel, rate: c.RateLimitWorker, burst: c.RateLimitWorkerBurst},
+		connect: connect,
+		backoff: reconnect,
+		retry:   defaultRetryPolicy,
+
+		keepalive:        c.WorkerKeepalive,
+		keepaliveTimeout: c.WorkerKeepaliveTimeout,
+
+		drain: c.WorkerDrainTimeout,
+	}
+	if channel == tasksChannel {
+		opts.poll = c.WorkerPollInterval
+		opts.lease = c.TaskLease
+	}
+	if channel == notificationsChannel {
+		opts.batch = batchConfig{Window: c.NotificationBatchWindow, Size: c.NotificationBatchSize}
+	}
+	if spec, ok := c.WorkerBackoff[channel]; ok {
+		backoff, err := parseBackoff(spec)
+		if err != nil {
+			return opts, fmt.Errorf("error loading configuration: %w", err)
+		}
+		opts.connect.backoff = backoff
+		opts.backoff = backoff
+		opts.retry.Backoff = backoff
+	}
+	return opts, nil
+}
+
+// scaling returns the autoscaling settings of the worker on the specified
+// channel from the configuration. A channel's WORKER_CONCURRENCY caps its
+// processors in place of WORKER_MAX_CONCURRENCY.
+func (c config) scaling(channel string) scaleConfig {
+	cfg := scaleConfig{
+		Min:           c.WorkerMinConcurrency,
+		Max:           c.WorkerMaxConcurrency,
+		Interval:      c.WorkerScaleInterval,
+		TargetLatency: c.WorkerTargetLatency,
+	}
+	if n, ok := c.WorkerConcurrency[channel]; ok {
+		cfg.Max = n
+		cfg.Min = min(cfg.Min, n)
+	}
+	return cfg
 }
 
 func main() {
-	if err := run(); err != nil {
+	if err := run(os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run() error {
-	// Setup logger
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
-
+// run sets up shared dependencies and runs the requested command. With no
+// command it serves the API and runs the workers.
+func run(args []string) error {
 	// Context for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	// Load configuration from environment
@@ -41,21 +273,180 @@ func run() error {
 	if err := env.Parse(&cfg); err != nil {
 		return fmt.Errorf("error loading configuration: %w", err)
 	}
+	wait, err := cfg.connectWait()
+	if err != nil {
+		return err
+	}
+
+	// Setup logger, redacting sensitive fields before anything is written
+	redactor := newRedactor(cfg.RedactFields)
+	logger := slog.New(newTraceHandler(newActorHandler(newRedactingHandler(slog.NewJSONHandler(os.Stdout, nil), redactor))))
+
+	// Create the store for the configured driver
+	var store Store
+	switch cfg.Driver {
+	case "postgres":
+		poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("unable to parse database URL: %w", err)
+		}
+		poolConfig.ConnConfig.Tracer = &slowQueryTracer{logger: logger, threshold: cfg.SlowQueryThreshold}
+		connects := &poolConnects{}
+		connects.instrument(poolConfig)
+		pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+		if err != nil {
+			return fmt.Errorf("unable to create connection pool: %w", err)
+		}
+		defer pool.Close()
+		registerPoolMetrics(metrics, pool, connects)
+		pg := newPostgresStore(pool, cfg.RLSRole)
+
+		// Refuse to run against a schema whose triggers would never fire
+		if err := waitForConnection(ctx, pg, wait); err != nil {
+			return err
+		}
+		if err := prepareSchema(ctx, logger, pg, cfg.AutoMigrate); err != nil {
+			return err
+		}
+		store = pg
+	case "sqlite":
+		db, err := newSQLiteStore(ctx, cfg.DatabaseURL, cfg.SQLitePollInterval)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		store = db
+	case "memory":
+		store = newMemoryStore()
+	default:
+		return fmt.Errorf("unknown driver %q", cfg.Driver)
+	}
+
+	// Mirror lifecycle events to the configured sink
+	if cfg.EventSink != "" {
+		sink, err := newEventSink(cfg)
+		if err != nil {
+			return err
+		}
+		defer sink.close()
+		store = &publishingStore{Store: store, sink: sink, prefix: cfg.EventSinkSubjectPrefix, logger: logger}
+	}
+
+	// Encrypt notification content before it is stored
+	cipher, err := newBodyCipher(cfg.NotificationEncryptionKey, cfg.NotificationEncryptionPreviousKeys)
+	if err != nil {
+		return fmt.Errorf("error loading configuration: %w", err)
+	}
+	if cipher != nil {
+		store = &encryptingStore{Store: store, cipher: cipher}
+	}
+
+	// Redact error records before they are stored or published
+	if redactor.enabled() {
+		store = &redactingStore{Store: store, redactor: redactor}
+	}
+
+	command := "serve"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "serve":
+		return serve(ctx, cfg, logger, store, cipher)
+	case "seed":
+		return seed(ctx, logger, store, wait)
+	case "loadgen":
+		return loadgen(ctx, logger, store, wait, args[1:])
+	case "bench":
+		return bench(ctx, logger, store, wait, args[1:])
+	case "backfill":
+		return backfill(ctx, cfg, logger, store, cipher, wait, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// serve runs the HTTP server and workers until the context is cancelled.
+func serve(ctx context.Context, cfg config, logger *slog.Logger, store Store, cipher *bodyCipher) error {
+	// Rate limits are shared through the store when it supports them
+	limiter := newRateLimiter(store)
 
-	// Create connection pool
-	pool, err := pgxpool.New(ctx, cfg.DatabaseURL)
+	// Fail a fraction of handler runs and pushes on purpose when asked to
+	faults, err := newFaultInjector(cfg.FaultInjection)
 	if err != nil {
-		return fmt.Errorf("unable to create connection pool: %w", err)
+		return fmt.Errorf("error loading configuration: %w", err)
+	}
+	if faults != nil {
+		logger.WarnContext(ctx, "Fault injection enabled", slog.Float64("percent", cfg.FaultInjection))
+	}
+
+	// Pushes share one tuned client across the API and the worker
+	pushClient, err := newPushClient(cfg, faults)
+	if err != nil {
+		return err
+	}
+	if err := validateContentEncoding(cfg.PushContentEncoding); err != nil {
+		return fmt.Errorf("error loading configuration: %w", err)
+	}
+	keys, err := newVAPIDKeyring(ctx, store, cfg)
+	if err != nil {
+		return err
+	}
+
+	taskOpts, err := cfg.worker(tasksChannel, limiter)
+	if err != nil {
+		return err
+	}
+	taskOpts.weights = cfg.TenantWeights
+	notificationOpts, err := cfg.worker(notificationsChannel, limiter)
+	if err != nil {
+		return err
+	}
+
+	// Workers that lose the database fail readiness until they recover
+	h := &health{}
+	taskOpts.health, notificationOpts.health = h, h
+
+	// A standby only processes work while the primary is gone
+	heartbeats, shared := unwrapStore(store).(heartbeatStore)
+	var standby *failover
+	switch cfg.WorkerRole {
+	case roleActive:
+	case roleStandby:
+		if !shared {
+			return fmt.Errorf("error loading configuration: worker role %s needs a store shared between instances", roleStandby)
+		}
+		standby = newFailover()
+		taskOpts.failover, notificationOpts.failover = standby, standby
+	default:
+		return fmt.Errorf("error loading configuration: worker role must be %s or %s", roleActive, roleStandby)
+	}
+
+	// During maintenance the API refuses new work and workers pause
+	maint, err := newMaintenance(ctx, store)
+	if err != nil {
+		return err
+	}
+	taskOpts.maintenance, notificationOpts.maintenance = maint, maint
+
+	flags, err := newFlagCache(ctx, store, cfg.FlagCacheTTL)
+	if err != nil {
+		return fmt.Errorf("failed to load feature flags: %w", err)
 	}
-	defer pool.Close()
 
 	// Set up routes
-	svr := newServer(pool)
+	csrf, err := newCSRFProtection(cfg.AdminSessionCookie, cfg.CSRFSecret)
+	if err != nil {
+		return err
+	}
+	svr := newServer(cfg, logger, store, h, limiter, pushClient, keys, csrf, maint, flags)
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort("0.0.0.0", cfg.ServerPort),
 		Handler: svr,
 	}
 
+	h.setReady(true)
 	go func() {
 		log.Printf("listening on %s\n", httpServer.Addr)
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -70,6 +461,12 @@ func run() error {
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
+
+		// Report not ready and give load balancers a moment to notice before
+		// the listener closes
+		h.setReady(false)
+		time.Sleep(cfg.ShutdownDrainDelay)
+
 		shutdownCtx := context.Background()
 		shutdownCtx, cancel := context.WithTimeout(shutdownCtx, 10*time.Second)
 		defer cancel()
@@ -79,25 +476,115 @@ func run() error {
 	}()
 
 	// Start the task worker
-	taskWorker := worker(pool, logger, "tasks_channel")
+	taskWorker := worker(store, logger, tasksChannel, taskOpts)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := taskWorker(ctx, processTask(logger, pool)); err != nil {
+		handlers := taskHandlers(logger, taskOpts.retry, cfg.TaskLogUnregistered)
+		handlers.wrap(faults.handler)
+		process := chainProcessor(processTask(logger, store, handlers, cfg.TaskTimeout, cfg.TaskLease, cfg.TaskCancelCheckInterval, cfg.taskCallback(), flags),
+			traceProcessor, measureProcessor(tasksChannel), logProcessor(logger, tasksChannel), recoverProcessor(logger, tasksChannel))
+		if err := taskWorker(ctx, process); err != nil {
 			fmt.Fprintf(os.Stderr, "worker error: %s\n", err)
 		}
+		returnUnfinishedTasks(ctx, logger, store)
 	}()
 
 	// Start the notification worker
-	notificationWorker := worker(pool, logger, "notifications_channel")
+	notificationWorker := worker(store, logger, notificationsChannel, notificationOpts)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := notificationWorker(ctx, processNotification(cfg, logger, pool, http.DefaultClient)); err != nil {
+		process := chainProcessor(processNotification(cfg, logger, store, pushClient, keys, newBulkhead(cfg.PushOriginConcurrency),
+			rateLimit{limiter: limiter, key: "push", rate: cfg.RateLimitPush, burst: cfg.RateLimitPushBurst}, notificationOpts.retry, cipher),
+			traceProcessor, measureProcessor(notificationsChannel), logProcessor(logger, notificationsChannel), recoverProcessor(logger, notificationsChannel))
+		if err := notificationWorker(ctx, process); err != nil {
 			fmt.Fprintf(os.Stderr, "worker error: %s\n", err)
 		}
 	}()
 
+	// Heartbeat so standbys know this instance is alive, or watch the
+	// primary's heartbeat when this is the standby
+	if shared {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runHeartbeat(ctx, logger, heartbeats, cfg.WorkerRole, max(cfg.WorkerHeartbeatInterval, 100*time.Millisecond), cfg.WorkerFailoverTimeout, standby)
+		}()
+	}
+
+	// Follow maintenance mode changes made on other instances
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runMaintenanceWatch(ctx, logger, maint, max(cfg.MaintenancePollInterval, 100*time.Millisecond))
+	}()
+
+	// Start queueing scheduled tasks as they come due
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runDueTaskPoller(ctx, logger, store, max(cfg.TaskPollMaxWait, 10*time.Millisecond))
+	}()
+
+	// Start the canary probing the pipeline end to end
+	if cfg.CanaryInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runCanary(ctx, logger, store, cfg.CanaryInterval)
+		}()
+	}
+
+	// Start the periodic jobs, each tick running once across the cluster
+	claimer := newTickClaimer(store)
+	jobs := []periodicJob{{name: "scheduler", interval: cfg.SchedulerInterval, run: schedulerJob(logger, store)}}
+	if cfg.RetentionPeriod > 0 {
+		jobs = append(jobs, periodicJob{name: "retention", interval: cfg.RetentionInterval, run: retentionJob(logger, store, cfg.RetentionPeriod)})
+	}
+	if cfg.ReaperTimeout > 0 {
+		jobs = append(jobs, periodicJob{name: "reaper", interval: cfg.ReaperInterval, run: reaperJob(logger, store, cfg.ReaperTimeout)})
+	}
+	if shared && cfg.ZombieTimeout > 0 {
+		jobs = append(jobs, periodicJob{name: "zombies", interval: cfg.ZombieInterval, run: zombieJob(logger, heartbeats, cfg.ZombieTimeout)})
+	}
+	if cfg.DLQAlertThreshold > 0 {
+		jobs = append(jobs, periodicJob{name: "dlq-alert", interval: cfg.DLQAlertInterval,
+			run: dlqAlertJob(logger, store, cfg.DLQAlertInterval, cfg.DLQAlertThreshold, cfg.dlqAlertNotifiers())})
+	}
+	if len(cfg.TaskSLA) > 0 {
+		jobs = append(jobs, periodicJob{name: "sla", interval: cfg.TaskSLAInterval,
+			run: slaJob(logger, store, cfg.TaskSLA, cfg.TaskSLAPriorityBump, webhook{URL: cfg.TaskSLAWebhookURL, Secrets: cfg.TaskSLAWebhookSecrets})})
+	}
+	if cipher != nil && cfg.ReencryptInterval > 0 {
+		if rewriter, ok := unwrapStore(store).(columnRewriter); ok {
+			jobs = append(jobs, periodicJob{name: "reencrypt", interval: cfg.ReencryptInterval,
+				run: reencryptJob(logger, rewriter, cipher, max(cfg.ReencryptBatchSize, 1))})
+		}
+	}
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runPeriodic(ctx, logger, claimer, job)
+		}()
+	}
+
+	// Start the broker bridge
+	if cfg.BridgeSource != "" {
+		source, err := newBrokerSource(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := bridge(ctx, logger, store, source, cfg.BridgeTaskType); err != nil {
+				fmt.Fprintf(os.Stderr, "bridge error: %s\n", err)
+			}
+		}()
+	}
+
 	wg.Wait()
 	return nil
 }
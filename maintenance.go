@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maintenanceStore is implemented by stores shared between instances, which
+// can hold a maintenance mode every instance sees.
+type maintenanceStore interface {
+	// GetMaintenance returns the maintenance mode, off when it was never set.
+	GetMaintenance(ctx context.Context) (maintenanceState, error)
+	// SetMaintenance turns maintenance mode on or off and returns it.
+	SetMaintenance(ctx context.Context, enabled bool, reason string) (maintenanceState, error)
+}
+
+// maintenanceRoutes are the routes refused during maintenance: everything
+// that queues new work. Reads keep working.
+var maintenanceRoutes = map[string]bool{
+	"POST /tasks":                       true,
+	"POST /notifications":               true,
+	"POST /schedules":                   true,
+	"POST /ingest/{source}":             true,
+	"POST /admin/tasks/requeue":         true,
+	"POST /admin/notifications/requeue": true,
+}
+
+// maintenance tracks whether the service is in maintenance mode. While it
+// is, the API refuses new work and workers finish what they are running but
+// start nothing new. A nil maintenance is never on.
+type maintenance struct {
+	store maintenanceStore
+
+	mu      sync.Mutex
+	current maintenanceState
+	changed chan struct{}
+}
+
+// newMaintenance creates the maintenance mode, loading it from the store
+// when the store is shared between instances, or off otherwise.
+func newMaintenance(ctx context.Context, store Store) (*maintenance, error) {
+	m := &maintenance{changed: make(chan struct{})}
+	if shared, ok := unwrapStore(store).(maintenanceStore); ok {
+		m.store = shared
+		current, err := shared.GetMaintenance(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read maintenance mode: %w", err)
+		}
+		m.current = current
+	}
+	metrics.gauge("maintenance_mode",
+		"1 while the service is in maintenance mode, 0 otherwise.",
+		func() float64 {
+			if m.isEnabled() {
+				return 1
+			}
+			return 0
+		})
+	return m, nil
+}
+
+// state returns the maintenance mode, along with a channel closed once it
+// is turned on or off.
+func (m *maintenance) state() (maintenanceState, <-chan struct{}) {
+	if m == nil {
+		return maintenanceState{}, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current, m.changed
+}
+
+// isEnabled reports whether the service is in maintenance mode.
+func (m *maintenance) isEnabled() bool {
+	current, _ := m.state()
+	return current.Enabled
+}
+
+// apply records the maintenance mode, reporting whether it was turned on or
+// off.
+func (m *maintenance) apply(state maintenanceState) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	toggled := m.current.Enabled != state.Enabled
+	m.current = state
+	if toggled {
+		close(m.changed)
+		m.changed = make(chan struct{})
+	}
+	return toggled
+}
+
+// set turns maintenance mode on or off, for every instance when the store
+// is shared.
+func (m *maintenance) set(ctx context.Context, enabled bool, reason string) (maintenanceState, error) {
+	now := time.Now()
+	state := maintenanceState{Enabled: enabled, Reason: reason, Updated: &now}
+	if m.store != nil {
+		var err error
+		if state, err = m.store.SetMaintenance(ctx, enabled, reason); err != nil {
+			return state, err
+		}
+	}
+	m.apply(state)
+	return state, nil
+}
+
+// runMaintenanceWatch picks up maintenance mode changes made on other
+// instances every interval until the context is cancelled.
+func runMaintenanceWatch(ctx context.Context, logger *slog.Logger, m *maintenance, interval time.Duration) {
+	if m.store == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		state, err := m.store.GetMaintenance(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.ErrorContext(ctx, "Error reading maintenance mode", slog.Any("error", err))
+			}
+			continue
+		}
+		if m.apply(state) {
+			logger.WarnContext(ctx, "Maintenance mode changed", slog.Bool("enabled", state.Enabled), slog.String("reason", state.Reason))
+		}
+	}
+}
+
+// maintenanceMiddleware refuses requests to the maintenanceRoutes in mux
+// with 503 while the service is in maintenance mode, telling clients to
+// retry after retryAfter.
+func maintenanceMiddleware(mux *http.ServeMux, m *maintenance, retryAfter time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); maintenanceRoutes[pattern] && m.isEnabled() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			http.Error(w, "service is in maintenance mode", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceRequest turns maintenance mode on or off.
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason"`
+}
+
+// getMaintenance reports whether the service is in maintenance mode.
+func getMaintenance(m *maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, _ := m.state()
+		writeJSON(w, r, http.StatusOK, state)
+	}
+}
+
+// setMaintenance turns maintenance mode on or off.
+func setMaintenance(m *maintenance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			return
+		}
+
+		state, err := m.set(r.Context(), req.Enabled, req.Reason)
+		if err != nil {
+			log.Printf("Error setting maintenance mode: %v\n", err)
+			http.Error(w, "failed to set maintenance mode", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Maintenance mode set to %t: %s\n", state.Enabled, state.Reason)
+
+		writeJSON(w, r, http.StatusOK, state)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metrics is the registry exported at /metrics.
+var metrics = newMetricsRegistry()
+
+// metricsRegistry holds counters and gauges and writes them in the
+// Prometheus text exposition format.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   []*counterVec
+	histograms []*histogramVec
+	sampled    []*sampledMetric
+}
+
+// newMetricsRegistry creates an empty registry.
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+// counter registers a counter partitioned by the named labels.
+func (r *metricsRegistry) counter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	r.mu.Lock()
+	r.counters = append(r.counters, c)
+	r.mu.Unlock()
+	return c
+}
+
+// histogram registers a histogram with the upper bucket bounds, partitioned
+// by the named labels.
+func (r *metricsRegistry) histogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, buckets: buckets, labels: labels, values: map[string]*histogram{}}
+	r.mu.Lock()
+	r.histograms = append(r.histograms, h)
+	r.mu.Unlock()
+	return h
+}
+
+// gauge registers a gauge whose value is read from fn at scrape time.
+func (r *metricsRegistry) gauge(name, help string, fn func() float64) {
+	r.sample("gauge", name, help, fn)
+}
+
+// counterFunc registers a counter kept elsewhere, read from fn at scrape
+// time.
+func (r *metricsRegistry) counterFunc(name, help string, fn func() float64) {
+	r.sample("counter", name, help, fn)
+}
+
+func (r *metricsRegistry) sample(kind, name, help string, fn func() float64) {
+	r.mu.Lock()
+	r.sampled = append(r.sampled, &sampledMetric{kind: kind, name: name, help: help, fn: fn})
+	r.mu.Unlock()
+}
+
+// write writes every registered metric to w.
+func (r *metricsRegistry) write(w io.Writer) {
+	r.mu.Lock()
+	counters := append([]*counterVec(nil), r.counters...)
+	histograms := append([]*histogramVec(nil), r.histograms...)
+	sampled := append([]*sampledMetric(nil), r.sampled...)
+	r.mu.Unlock()
+
+	for _, c := range counters {
+		c.write(w)
+	}
+	for _, h := range histograms {
+		h.write(w)
+	}
+	for _, m := range sampled {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.fn())
+	}
+}
+
+// counterVec is a monotonically increasing count per label combination.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// inc adds one to the count for the label values, given in the order the
+// labels were registered.
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+// add adds v to the count for the label values.
+func (c *counterVec) add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, strings.Split(key, "\xff")), c.values[key])
+	}
+}
+
+// histogramVec is a distribution of observations per label combination.
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// histogram counts the observations falling in each bucket, the last count
+// being those above every bound.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe records v for the label values.
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	hist.counts[sort.SearchFloat64s(h.buckets, v)]++
+	hist.count++
+	hist.sum += v
+}
+
+// labelValues returns every label combination observed so far.
+func (h *histogramVec) labelValues() [][]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([][]string, len(keys))
+	for i, key := range keys {
+		values[i] = strings.Split(key, "\xff")
+	}
+	return values
+}
+
+// quantile estimates the q-quantile of the observations for the label
+// values, interpolating linearly within the bucket it falls in the way
+// Prometheus' histogram_quantile does. Observations above the last bound
+// are reported as the last bound. It returns the number of observations,
+// with an estimate of 0 when there are none.
+func (h *histogramVec) quantile(q float64, values ...string) (float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[strings.Join(values, "\xff")]
+	if !ok || hist.count == 0 {
+		return 0, 0
+	}
+
+	rank := q * float64(hist.count)
+	var cumulative uint64
+	for i, n := range hist.counts {
+		if float64(cumulative+n) < rank || n == 0 {
+			cumulative += n
+			continue
+		}
+		if i == len(h.buckets) {
+			break
+		}
+		var lower float64
+		if i > 0 {
+			lower = h.buckets[i-1]
+		}
+		return lower + (h.buckets[i]-lower)*(rank-float64(cumulative))/float64(n), hist.count
+	}
+	return h.buckets[len(h.buckets)-1], hist.count
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		hist := h.values[key]
+		values := strings.Split(key, "\xff")
+		var cumulative uint64
+		for i, n := range hist.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(values, le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, values), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), hist.count)
+	}
+}
+
+// sampledMetric is a gauge or counter sampled when metrics are scraped.
+type sampledMetric struct {
+	kind string
+	name string
+	help string
+	fn   func() float64
+}
+
+// formatLabels renders label pairs as {name="value",...}.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricsHandler serves the registry in the Prometheus text format.
+func metricsHandler(r *metricsRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.write(w)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ProcessorMiddleware wraps a NotificationProcessor with a cross-cutting
+// concern, such as logging or tracing, returning the wrapped processor.
+type ProcessorMiddleware func(next NotificationProcessor) NotificationProcessor
+
+var (
+	processorPanics = metrics.counter("worker_processor_panics_total",
+		"Processors that panicked and were recovered, by channel.", "channel")
+	processed = metrics.counter("worker_processed_total",
+		"Notifications processed by workers, by channel and outcome.", "channel", "outcome")
+	processingSeconds = metrics.histogram("worker_processing_seconds",
+		"Time workers took to process a notification, by channel.", latencyBuckets, "channel")
+)
+
+// chainProcessor wraps the processor in the middleware, the first being
+// outermost, so it sees every notification first and every result last.
+func chainProcessor(processor NotificationProcessor, middleware ...ProcessorMiddleware) NotificationProcessor {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		processor = middleware[i](processor)
+	}
+	return processor
+}
+
+// traceProcessor continues the trace recorded in each payload's traceparent
+// in a new span, or starts one.
+func traceProcessor(next NotificationProcessor) NotificationProcessor {
+	return func(ctx context.Context, notification *pgconn.Notification) error {
+		var v struct {
+			Traceparent string `json:"traceparent"`
+		}
+		json.Unmarshal([]byte(notification.Payload), &v)
+		return next(resumeTrace(ctx, v.Traceparent), notification)
+	}
+}
+
+// logProcessor logs the errors processing the channel's notifications.
+func logProcessor(logger *slog.Logger, channel string) ProcessorMiddleware {
+	return func(next NotificationProcessor) NotificationProcessor {
+		return func(ctx context.Context, notification *pgconn.Notification) error {
+			err := next(ctx, notification)
+			if err != nil {
+				logger.ErrorContext(ctx, "Error processing notification",
+					slog.String("channel", channel), slog.Any("error", err))
+			}
+			return err
+		}
+	}
+}
+
+// recoverProcessor turns a panicking processor into an error, logging the
+// panic with its stack, so the processor goroutine carries on with the next
+// notification.
+func recoverProcessor(logger *slog.Logger, channel string) ProcessorMiddleware {
+	return func(next NotificationProcessor) NotificationProcessor {
+		return func(ctx context.Context, notification *pgconn.Notification) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					processorPanics.inc(channel)
+					logger.ErrorContext(ctx, "Processor panicked",
+						slog.String("channel", channel), slog.Any("panic", v), slog.String("stack", string(debug.Stack())))
+					err = fmt.Errorf("processor panicked: %v", v)
+				}
+			}()
+			return next(ctx, notification)
+		}
+	}
+}
+
+// measureProcessor counts the channel's notifications by outcome and
+// records how long each took.
+func measureProcessor(channel string) ProcessorMiddleware {
+	return func(next NotificationProcessor) NotificationProcessor {
+		return func(ctx context.Context, notification *pgconn.Notification) error {
+			start := time.Now()
+			err := next(ctx, notification)
+			processingSeconds.observe(time.Since(start).Seconds(), channel)
+			outcome := "ok"
+			if err != nil {
+				outcome = "error"
+			}
+			processed.inc(channel, outcome)
+			return err
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestRecoverProcessor(t *testing.T) {
+	calls := 0
+	process := chainProcessor(func(ctx context.Context, notification *pgconn.Notification) error {
+		calls++
+		if notification.Payload == "panic" {
+			panic("boom")
+		}
+		return nil
+	}, recoverProcessor(discardLogger(), tasksChannel))
+
+	err := process(context.Background(), &pgconn.Notification{Channel: tasksChannel, Payload: "panic"})
+	if err == nil || !strings.Contains(err.Error(), "processor panicked: boom") {
+		t.Fatalf("process = %v, want the panic as an error", err)
+	}
+
+	// The processor carries on with the next notification
+	if err := process(context.Background(), &pgconn.Notification{Channel: tasksChannel, Payload: "{}"}); err != nil {
+		t.Fatalf("process after a panic = %v, want nil", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
@@ -2,20 +2,221 @@ package main
 
 import (
 	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
 )
 
 type task struct {
-	ID      string    `json:"id"`
-	Type    string    `json:"type"`
-	Payload any       `json:"payload"`
-	Status  string    `json:"status"`
-	Created time.Time `json:"created"`
-	Updated time.Time `json:"updated"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Tenant   string `json:"tenant,omitempty"`
+	Priority int    `json:"priority"`
+	Payload  any    `json:"payload"`
+	Status   string `json:"status"`
+	// Attempts is how many times a worker has picked the task up.
+	Attempts int `json:"attempts"`
+	// MaxAttempts is how many times the task runs before it fails, 0 to
+	// follow its type's retry policy.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// TimeoutSeconds is how long the handler may run before the task times
+	// out, 0 to use TASK_TIMEOUT.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// ProcessedBy is the worker that last picked the task up.
+	ProcessedBy string `json:"processed_by,omitempty"`
+	// ClaimedBy is the instance that last claimed the task, at ClaimedAt.
+	ClaimedBy string     `json:"claimed_by,omitempty"`
+	ClaimedAt *time.Time `json:"claimed_at,omitempty"`
+	// LockedBy is the instance holding the task's lease while it is
+	// processing, until LockedUntil, after which another may take it over.
+	LockedBy    string     `json:"locked_by,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// Progress is how far the handler reported the current attempt had
+	// got, from 0 to 100 percent, described by ProgressMessage.
+	Progress        int    `json:"progress"`
+	ProgressMessage string `json:"progress_message,omitempty"`
+	// Traceparent is the W3C trace context of the request that enqueued it.
+	Traceparent string `json:"traceparent,omitempty"`
+	// DedupKey identifies duplicates of the task, which are not enqueued
+	// until DedupUntil.
+	DedupKey   string     `json:"dedup_key,omitempty"`
+	DedupUntil *time.Time `json:"dedup_until,omitempty"`
+	// DebounceKey collapses rapid enqueues of the task's type into the one
+	// scheduled task, which runs once nothing new arrives before RunAt.
+	DebounceKey string     `json:"debounce_key,omitempty"`
+	RunAt       *time.Time `json:"run_at,omitempty"`
+	LastError   *string    `json:"last_error,omitempty"`
+	FailedAt    *time.Time `json:"failed_at,omitempty"`
+	// SLABreachedAt is when the task was found not to have completed within
+	// its type's SLA.
+	SLABreachedAt *time.Time `json:"sla_breached_at,omitempty"`
+	Created       time.Time  `json:"created"`
+	Updated       time.Time  `json:"updated"`
 }
 
-type notification struct {
+type taskEvent struct {
+	ID       int64     `json:"id"`
+	TaskID   string    `json:"task_id"`
+	From     *string   `json:"from"`
+	To       string    `json:"to"`
+	Actor    string    `json:"actor"`
+	WorkerID *string   `json:"worker_id,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// deliveryFailure records a subscription a notification could not be
+// delivered to.
+type deliveryFailure struct {
+	Endpoint string    `json:"endpoint"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Created  time.Time `json:"created"`
+}
+
+// notificationTemplate is reusable notification content whose body is a Go
+// text/template rendered with variables supplied per notification.
+type notificationTemplate struct {
 	ID      int       `json:"id"`
+	Name    string    `json:"name"`
 	Body    string    `json:"body"`
 	Created time.Time `json:"created"`
 	Updated time.Time `json:"updated"`
 }
+
+// schedule creates a task or notification at every occurrence of its rule,
+// either a cron expression such as "0 */5 * * *" or an iCalendar recurrence
+// rule.
+type schedule struct {
+	ID           int           `json:"id"`
+	Rule         string        `json:"rule"`
+	Task         *task         `json:"task,omitempty"`
+	Notification *notification `json:"notification,omitempty"`
+	NextRun      *time.Time    `json:"next_run,omitempty"`
+	Created      time.Time     `json:"created"`
+	Updated      time.Time     `json:"updated"`
+}
+
+// userDataReport summarizes what was erased for a user.
+type userDataReport struct {
+	UserID        string    `json:"user_id"`
+	Subscriptions int64     `json:"subscriptions"`
+	Deliveries    int64     `json:"deliveries"`
+	Failures      int64     `json:"failures"`
+	Notifications int64     `json:"notifications"`
+	Targets       int64     `json:"targets"`
+	Tasks         int64     `json:"tasks"`
+	Completed     time.Time `json:"completed"`
+}
+
+// subscription is a web push subscription along with what is known about
+// its recipient.
+type subscription struct {
+	ID int `json:"id"`
+	webpush.Subscription
+	Locale   string `json:"locale,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	// Origin is the frontend origin the subscription was created from.
+	Origin       string     `json:"origin,omitempty"`
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty"`
+	// VAPIDPublicKey is the application server key the subscription was
+	// created with. Pushes to it must be signed with the matching private
+	// key.
+	VAPIDPublicKey string `json:"vapid_public_key,omitempty"`
+	// ContentEncoding is the push content encoding the subscription's
+	// browser supports, aes128gcm or the legacy aesgcm.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	// SchemaVersion is the payload schema version the subscription's service
+	// worker understands.
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// Tags are free-form labels subscriptions can be listed by.
+	Tags    []string  `json:"tags,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// featureFlag turns a feature on or off, for everyone or per tenant.
+type featureFlag struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Tenants overrides Enabled for the tenants listed.
+	Tenants map[string]bool `json:"tenants,omitempty"`
+	Updated *time.Time      `json:"updated,omitempty"`
+}
+
+// maintenanceState is whether the service is in maintenance mode, why, and
+// when that was last changed.
+type maintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+// vapidKey is a VAPID keypair pushes are signed with.
+type vapidKey struct {
+	ID         int       `json:"id"`
+	PublicKey  string    `json:"public_key"`
+	PrivateKey string    `json:"-"`
+	Created    time.Time `json:"created"`
+}
+
+// delivery is a receipt for a notification pushed to a subscription,
+// recording which variant it received.
+type delivery struct {
+	Endpoint string    `json:"endpoint"`
+	Variant  string    `json:"variant,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// variant is an alternative body for a notification, sent to a share of
+// subscriptions proportional to its weight.
+type variant struct {
+	Name   string `json:"name"`
+	Body   string `json:"body"`
+	Weight int    `json:"weight"`
+}
+
+// notificationContent is what a notification displays besides its body,
+// stored as one JSON document. The body is kept apart because localized
+// bodies and variants are alternatives to it.
+type notificationContent struct {
+	Title string `json:"title,omitempty"`
+	// Icon is the URL of the image shown with the notification.
+	Icon string `json:"icon,omitempty"`
+	// URL is opened when the notification is clicked.
+	URL string `json:"url,omitempty"`
+	// Data is passed through to the service worker as is.
+	Data map[string]any `json:"data,omitempty"`
+}
+
+type notification struct {
+	ID      int                 `json:"id"`
+	Body    string              `json:"body"`
+	Content notificationContent `json:"content"`
+	// Status is where the notification is in its lifecycle. It is set by
+	// the store and ignored on create.
+	Status    string            `json:"status,omitempty"`
+	Bodies    map[string]string `json:"bodies,omitempty"`
+	Variants  []variant         `json:"variants,omitempty"`
+	DryRun    bool              `json:"dry_run"`
+	Priority  string            `json:"priority,omitempty"`
+	Endpoint  string            `json:"endpoint,omitempty"`
+	Targets   []string          `json:"targets,omitempty"`
+	Targeted  bool              `json:"targeted,omitempty"`
+	LocalTime string            `json:"local_time,omitempty"`
+	Timezone  string            `json:"timezone,omitempty"`
+	// Origin limits the notification to subscriptions created from that
+	// frontend origin.
+	Origin string     `json:"origin,omitempty"`
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// ProcessedBy is the worker that last picked the notification up.
+	ProcessedBy string `json:"processed_by,omitempty"`
+	// ClaimedBy is the instance that last claimed the notification, at
+	// ClaimedAt.
+	ClaimedBy string     `json:"claimed_by,omitempty"`
+	ClaimedAt *time.Time `json:"claimed_at,omitempty"`
+	// Traceparent is the W3C trace context of the request that enqueued it.
+	Traceparent string     `json:"traceparent,omitempty"`
+	LastError   *string    `json:"last_error,omitempty"`
+	FailedAt    *time.Time `json:"failed_at,omitempty"`
+	Created     time.Time  `json:"created"`
+	Updated     time.Time  `json:"updated"`
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Payload schema versions. Service workers tell the server which payload
+// shape they understand when they subscribe, so new shapes only reach
+// updated service workers while old ones keep receiving the legacy shape.
+const (
+	// payloadSchemaLegacy is the flat notification row, sent to
+	// subscriptions that don't name a version.
+	payloadSchemaLegacy = 1
+	// payloadSchemaLatest nests the notification's content under
+	// "notification" and leaves out the server's bookkeeping.
+	payloadSchemaLatest = 2
+)
+
+// negotiateSchemaVersion returns the payload schema version to record for a
+// subscription asking for the requested one: the legacy version when it
+// doesn't ask, and at most the latest version the server can send.
+func negotiateSchemaVersion(requested int) (int, error) {
+	switch {
+	case requested < 0:
+		return 0, fmt.Errorf("schema_version must be between %d and %d", payloadSchemaLegacy, payloadSchemaLatest)
+	case requested == 0:
+		return payloadSchemaLegacy, nil
+	}
+	return min(requested, payloadSchemaLatest), nil
+}
+
+// payloadV2 is the version 2 payload shape.
+type payloadV2 struct {
+	SchemaVersion int                 `json:"schema_version"`
+	Notification  payloadNotification `json:"notification"`
+}
+
+// payloadNotification is the content of a notification a service worker
+// displays.
+type payloadNotification struct {
+	ID       int            `json:"id"`
+	Title    string         `json:"title,omitempty"`
+	Body     string         `json:"body"`
+	Icon     string         `json:"icon,omitempty"`
+	URL      string         `json:"url,omitempty"`
+	Data     map[string]any `json:"data,omitempty"`
+	Variant  string         `json:"variant,omitempty"`
+	Priority string         `json:"priority,omitempty"`
+	Origin   string         `json:"origin,omitempty"`
+}
+
+// encodePayload encodes a notification with the body chosen for a
+// subscription, and the variant it was chosen from if any, in the
+// subscription's payload schema version. The legacy version is the queued
+// notification payload without the alternative bodies.
+func encodePayload(n notification, body, variantName string, version int) ([]byte, error) {
+	if version < payloadSchemaLatest {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(notifyPayload(n)), &fields); err != nil {
+			return nil, err
+		}
+		delete(fields, "variants")
+		delete(fields, "bodies")
+		fields["body"] = body
+		if variantName != "" {
+			fields["variant"] = variantName
+		}
+		return json.Marshal(fields)
+	}
+	return json.Marshal(payloadV2{SchemaVersion: version, Notification: payloadNotification{
+		ID:       n.ID,
+		Title:    n.Content.Title,
+		Body:     body,
+		Icon:     n.Content.Icon,
+		URL:      n.Content.URL,
+		Data:     n.Content.Data,
+		Variant:  variantName,
+		Priority: n.Priority,
+		Origin:   n.Origin,
+	}})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// pollBatch is the most tasks a single poll claims.
+const pollBatch = 100
+
+var tasksPolled = metrics.counter("tasks_claimed_by_poll_total",
+	"Tasks left pending whose notification was missed, or whose lease expired, claimed by polling.")
+
+// pollTasks claims the tasks left pending for longer than interval, and
+// those whose lease expired, every interval until the context is cancelled,
+// leasing them for lease and queueing them for the processors already
+// claimed. Claiming skips rows locked by other instances' pollers, so each
+// stranded task is claimed once, and leaves alone tasks whose notification
+// is still on its way. Nothing is claimed while paused.
+func pollTasks(ctx context.Context, logger *slog.Logger, claimer taskClaimer, channel string, interval, lease time.Duration, paused func() bool, queue *fairQueue) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		before := time.Now().Add(-interval)
+		var claimed int
+		for claimed < pollBatch && !paused() {
+			t, ok, err := claimer.ClaimTask(ctx, before, time.Now().Add(lease))
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.ErrorContext(ctx, "Error polling for tasks", slog.String("channel", channel), slog.Any("error", err))
+				}
+				break
+			}
+			if !ok {
+				break
+			}
+			payload, err := json.Marshal(t)
+			if err != nil {
+				logger.ErrorContext(ctx, "Error encoding polled task", slog.String("task", t.ID), slog.Any("error", err))
+				continue
+			}
+			queue.push(&pgconn.Notification{Channel: channel, Payload: string(payload)})
+			claimed++
+		}
+		if claimed > 0 {
+			tasksPolled.add(float64(claimed))
+			logger.WarnContext(ctx, "Claimed tasks whose notification was missed or lease expired", slog.String("channel", channel), slog.Int("tasks", claimed))
+		}
+	}
+}
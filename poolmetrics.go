@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// poolConnects counts the connections a pool tries to establish. pgxpool
+// only counts the ones that succeed, so this is what failed attempts are
+// derived from.
+type poolConnects struct {
+	attempts    atomic.Int64
+	established atomic.Int64
+}
+
+// instrument hooks the counters into the pool configuration, keeping any
+// hooks already set.
+func (c *poolConnects) instrument(cfg *pgxpool.Config) {
+	before, after := cfg.BeforeConnect, cfg.AfterConnect
+	cfg.BeforeConnect = func(ctx context.Context, connConfig *pgx.ConnConfig) error {
+		c.attempts.Add(1)
+		if before != nil {
+			return before(ctx, connConfig)
+		}
+		return nil
+	}
+	cfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		if after != nil {
+			if err := after(ctx, conn); err != nil {
+				return err
+			}
+		}
+		c.established.Add(1)
+		return nil
+	}
+}
+
+// registerPoolMetrics exports the pool's statistics. The LISTEN connections
+// each worker holds for its lifetime count as acquired, so acquired nearing
+// max alongside a growing wait time means HTTP handlers are being starved
+// of connections.
+func registerPoolMetrics(reg *metricsRegistry, pool *pgxpool.Pool, connects *poolConnects) {
+	reg.gauge("pg_pool_acquired_conns", "Connections currently checked out of the pool.",
+		func() float64 { return float64(pool.Stat().AcquiredConns()) })
+	reg.gauge("pg_pool_idle_conns", "Connections idle in the pool.",
+		func() float64 { return float64(pool.Stat().IdleConns()) })
+	reg.gauge("pg_pool_constructing_conns", "Connections currently being established.",
+		func() float64 { return float64(pool.Stat().ConstructingConns()) })
+	reg.gauge("pg_pool_total_conns", "Connections owned by the pool.",
+		func() float64 { return float64(pool.Stat().TotalConns()) })
+	reg.gauge("pg_pool_max_conns", "Maximum size of the pool.",
+		func() float64 { return float64(pool.Stat().MaxConns()) })
+	reg.counterFunc("pg_pool_acquires_total", "Connections acquired from the pool.",
+		func() float64 { return float64(pool.Stat().AcquireCount()) })
+	reg.counterFunc("pg_pool_empty_acquires_total", "Acquires that had to wait for a connection.",
+		func() float64 { return float64(pool.Stat().EmptyAcquireCount()) })
+	reg.counterFunc("pg_pool_canceled_acquires_total", "Acquires canceled before a connection was available.",
+		func() float64 { return float64(pool.Stat().CanceledAcquireCount()) })
+	reg.counterFunc("pg_pool_acquire_wait_seconds_total", "Time spent acquiring connections.",
+		func() float64 { return pool.Stat().AcquireDuration().Seconds() })
+	reg.counterFunc("pg_pool_connect_errors_total", "Connection attempts that failed.",
+		func() float64 {
+			failed := connects.attempts.Load() - connects.established.Load() - int64(pool.Stat().ConstructingConns())
+			return float64(max(failed, 0))
+		})
+}
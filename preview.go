@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// notificationPreview is what sending a notification would do.
+type notificationPreview struct {
+	// Notification is the notification as it would be stored.
+	Notification notification `json:"notification"`
+	// Subscriptions is how many subscriptions would be pushed to now.
+	Subscriptions int `json:"subscriptions"`
+	// Snoozed is how many targeted subscriptions are snoozed, so would have
+	// their delivery deferred or dropped.
+	Snoozed int `json:"snoozed"`
+	// Payloads are the distinct payloads that would be pushed, each with how
+	// many subscriptions would receive it.
+	Payloads []payloadPreview `json:"payloads"`
+}
+
+// payloadPreview is a payload along with how many subscriptions would
+// receive it.
+type payloadPreview struct {
+	Payload       json.RawMessage `json:"payload"`
+	Subscriptions int             `json:"subscriptions"`
+}
+
+// previewNotification runs a notification request through template
+// rendering, validation and targeting, and returns the payloads that would
+// be pushed and to how many subscriptions, without storing or sending
+// anything.
+func previewNotification(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeNotificationRequest(w, r)
+		if !ok {
+			return
+		}
+		not, ok := prepareNotification(w, r, store, req)
+		if !ok {
+			return
+		}
+		now := time.Now()
+		not.Created = now
+		not.Updated = now
+		not.Traceparent = traceparentFromContext(r.Context())
+		not.Targeted = len(not.Targets) > 0
+
+		subscriptions, err := store.ListSubscriptions(r.Context())
+		if err != nil {
+			http.Error(w, "failed to read subscriptions", http.StatusInternalServerError)
+			return
+		}
+
+		preview := notificationPreview{Notification: not, Payloads: []payloadPreview{}}
+		index := map[string]int{}
+		for _, sub := range subscriptions {
+			// A notification at a local time reaches every subscription, in
+			// the wave for its timezone
+			wave := not
+			if not.LocalTime != "" {
+				wave.Timezone = subscriptionTimezone(sub)
+			}
+			if len(targetSubscriptions(wave, []subscription{sub}, not.Targets)) == 0 {
+				continue
+			}
+			if not.Priority != priorityHigh && sub.SnoozedUntil != nil && sub.SnoozedUntil.After(now) {
+				preview.Snoozed++
+				continue
+			}
+
+			payload, err := personalizedPayload(wave, sub)
+			if err != nil {
+				http.Error(w, "failed to build payload", http.StatusInternalServerError)
+				return
+			}
+			preview.Subscriptions++
+			i, ok := index[string(payload)]
+			if !ok {
+				i = len(preview.Payloads)
+				index[string(payload)] = i
+				preview.Payloads = append(preview.Payloads, payloadPreview{Payload: payload})
+			}
+			preview.Payloads[i].Subscriptions++
+		}
+
+		writeJSON(w, r, http.StatusOK, preview)
+	}
+}
+
+// notifyPayload is the payload a notification is queued with, as built by
+// the stores when they notify workers of it.
+func notifyPayload(n notification) string {
+	b, _ := json.Marshal(map[string]any{
+		"id":          n.ID,
+		"body":        n.Body,
+		"bodies":      bodiesOrEmpty(n.Bodies),
+		"variants":    n.Variants,
+		"content":     n.Content,
+		"status":      "pending",
+		"dry_run":     n.DryRun,
+		"priority":    n.Priority,
+		"endpoint":    n.Endpoint,
+		"targeted":    n.Targeted,
+		"timezone":    n.Timezone,
+		"origin":      n.Origin,
+		"traceparent": n.Traceparent,
+		"created":     n.Created,
+		"updated":     n.Updated,
+	})
+	return string(b)
+}
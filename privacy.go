@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// deleteUserData erases everything stored about a user and reports what was
+// deleted, so data subject erasure requests can be honored and evidenced.
+// The user is logged as user_id, which is redacted by default.
+func deleteUserData(logger *slog.Logger, store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("id")
+		if userID == "" {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+
+		ctx := withActor(r.Context(), "api", "")
+		report, err := store.DeleteUserData(ctx, userID)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error deleting user data",
+				slog.String("user_id", userID), slog.Any("error", err))
+			http.Error(w, "failed to delete user data", http.StatusInternalServerError)
+			return
+		}
+		logger.InfoContext(ctx, "Deleted user data", slog.String("user_id", userID),
+			slog.Int64("subscriptions", report.Subscriptions), slog.Int64("tasks", report.Tasks))
+
+		writeJSON(w, r, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "context"
+
+// taskProgress records the progress of the task a handler is running.
+type taskProgress struct {
+	store TaskStore
+	id    string
+}
+
+type progressKey struct{}
+
+// withProgress returns a context in which reportProgress records the
+// progress of the task with the id.
+func withProgress(ctx context.Context, store TaskStore, id string) context.Context {
+	return context.WithValue(ctx, progressKey{}, taskProgress{store: store, id: id})
+}
+
+// reportProgress records how far the task the handler is running has got,
+// from 0 to 100 percent, and a message describing it, for GET /tasks/{id}
+// to show. Percentages outside that range are clamped to it. It does nothing
+// outside a task handler.
+func reportProgress(ctx context.Context, percent int, message string) error {
+	p, ok := ctx.Value(progressKey{}).(taskProgress)
+	if !ok {
+		return nil
+	}
+	return p.store.SetTaskProgress(ctx, p.id, min(max(percent, 0), 100), message)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+// newPushClient creates the HTTP client used to deliver pushes. Idle
+// connections are kept per push service so a broadcast fanning out to many
+// subscriptions reuses them, and HTTP/2 is negotiated where the service
+// supports it. Faults, when set, fail a fraction of pushes before they are
+// sent.
+func newPushClient(cfg config, faults *faultInjector) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.PushDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.PushMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.PushMaxConnsPerHost,
+		MaxConnsPerHost:       cfg.PushMaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   cfg.PushDialTimeout,
+		ResponseHeaderTimeout: cfg.PushTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if cfg.PushProxyURL != "" {
+		proxy, err := url.Parse(cfg.PushProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid push proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{Transport: tracingTransport{base: faults.transport(transport)}, Timeout: cfg.PushTimeout}, nil
+}
+
+// sendPush delivers a payload to a single subscription, giving up after the
+// push timeout. Push services rejecting the message are reported as errors.
+func sendPush(ctx context.Context, cfg config, logger *slog.Logger, client *http.Client, keys *vapidKeyring, payload []byte, sub subscription) error {
+	key, err := keys.signingKey(ctx, sub.VAPIDPublicKey)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := pushContext(ctx, cfg)
+	defer cancel()
+
+	response, err := deliverPush(ctx, cfg, client, key, payload, sub)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read vapid response body: %w", err)
+	}
+	switch {
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		// The subscription has expired, retrying won't help
+		return permanent(fmt.Errorf("push service responded %s: %s", response.Status, body))
+	case response.StatusCode >= 400:
+		return fmt.Errorf("push service responded %s: %s", response.Status, body)
+	}
+	logger.InfoContext(ctx, "Notification sent", slog.Any("status", response.Status), slog.Any("body", string(body)))
+	return nil
+}
+
+// pushContext bounds a single push by the configured push timeout.
+func pushContext(ctx context.Context, cfg config) (context.Context, context.CancelFunc) {
+	if cfg.PushTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, cfg.PushTimeout)
+}
+
+// pushOptions returns the web push options used to sign pushes with the
+// keypair and send them with the specified client.
+func pushOptions(key vapidKey, client *http.Client) *webpush.Options {
+	return &webpush.Options{
+		HTTPClient:      client,
+		Subscriber:      "https://pager.com",
+		VAPIDPublicKey:  key.PublicKey,
+		VAPIDPrivateKey: key.PrivateKey,
+	}
+}
+
+// bulkhead caps concurrent pushes per push service origin, so an outage at
+// one provider only ties up that provider's delivery slots.
+type bulkhead struct {
+	size int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// newBulkhead creates a bulkhead allowing size concurrent pushes per origin.
+func newBulkhead(size int) *bulkhead {
+	return &bulkhead{size: max(size, 1), slots: map[string]chan struct{}{}}
+}
+
+// acquire takes a delivery slot for the origin, blocking until one is free.
+// The returned function releases the slot.
+func (b *bulkhead) acquire(ctx context.Context, origin string) (func(), error) {
+	b.mu.Lock()
+	slots, ok := b.slots[origin]
+	if !ok {
+		slots = make(chan struct{}, b.size)
+		b.slots[origin] = slots
+	}
+	b.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// broadcast sends to every subscription concurrently, each holding a slot
+// for its origin, and returns the error for each subscription in order.
+func (b *bulkhead) broadcast(ctx context.Context, subs []subscription, send func(ctx context.Context, sub subscription) error) []error {
+	errs := make([]error, len(subs))
+	var wg sync.WaitGroup
+	for i, sub := range subs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := b.acquire(ctx, pushOrigin(sub.Endpoint))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer release()
+			errs[i] = send(ctx, sub)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// pushOrigin returns the scheme and host of a push endpoint, identifying the
+// push service it belongs to.
+func pushOrigin(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	return u.Scheme + "://" + u.Host
+}
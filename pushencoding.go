@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+// Push content encodings. aes128gcm (RFC 8291) is the standard; aesgcm is
+// the draft encoding some older browsers still require.
+const (
+	encodingAES128GCM = "aes128gcm"
+	encodingAESGCM    = "aesgcm"
+)
+
+// validateContentEncoding rejects content encodings pushes can't be sent
+// with.
+func validateContentEncoding(encoding string) error {
+	switch encoding {
+	case "", encodingAES128GCM, encodingAESGCM:
+		return nil
+	}
+	return fmt.Errorf("content encoding must be %s or %s", encodingAES128GCM, encodingAESGCM)
+}
+
+// contentEncoding returns the encoding pushes to the subscription use: the
+// one recorded with it, or the configured default.
+func contentEncoding(cfg config, sub subscription) string {
+	if sub.ContentEncoding != "" {
+		return sub.ContentEncoding
+	}
+	return cfg.PushContentEncoding
+}
+
+// deliverPush encrypts a payload for a subscription with its content
+// encoding, signs it with the VAPID keypair, and posts it to the push
+// service.
+func deliverPush(ctx context.Context, cfg config, client *http.Client, key vapidKey, payload []byte, sub subscription) (*http.Response, error) {
+	if contentEncoding(cfg, sub) == encodingAESGCM {
+		return sendAESGCM(ctx, client, key, payload, sub)
+	}
+	return webpush.SendNotificationWithContext(ctx, payload, &sub.Subscription, pushOptions(key, client))
+}
+
+// sendAESGCM sends a push with the legacy aesgcm content encoding
+// (draft-ietf-webpush-encryption-04), which carries the salt and the
+// server's public key in the Encryption and Crypto-Key headers rather than
+// in the body, and authenticates with the matching WebPush VAPID scheme.
+func sendAESGCM(ctx context.Context, client *http.Client, key vapidKey, payload []byte, sub subscription) (*http.Response, error) {
+	authSecret, err := decodeBase64Key(sub.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription auth: %w", err)
+	}
+	receiverKey, err := decodeBase64Key(sub.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription p256dh: %w", err)
+	}
+	receiver, err := ecdh.P256().NewPublicKey(receiverKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription p256dh: %w", err)
+	}
+
+	// Single use server keypair and salt
+	local, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := local.ECDH(receiver)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// Derive the content encryption key and nonce
+	localKey := local.PublicKey().Bytes()
+	keyContext := []byte("P-256\x00")
+	keyContext = binary.BigEndian.AppendUint16(keyContext, uint16(len(receiverKey)))
+	keyContext = append(keyContext, receiverKey...)
+	keyContext = binary.BigEndian.AppendUint16(keyContext, uint16(len(localKey)))
+	keyContext = append(keyContext, localKey...)
+
+	ikm := hkdf(authSecret, sharedSecret, []byte("Content-Encoding: auth\x00"), 32)
+	cek := hkdf(salt, ikm, append([]byte("Content-Encoding: aesgcm\x00"), keyContext...), 16)
+	nonce := hkdf(salt, ikm, append([]byte("Content-Encoding: nonce\x00"), keyContext...), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// A single record with a two byte padding length and no padding
+	body := gcm.Seal(nil, nonce, append([]byte{0, 0}, payload...), nil)
+
+	authorization, err := vapidJWT(sub.Endpoint, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign vapid token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", encodingAESGCM)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", "0")
+	req.Header.Set("Encryption", "salt="+base64.RawURLEncoding.EncodeToString(salt))
+	req.Header.Set("Crypto-Key", "dh="+base64.RawURLEncoding.EncodeToString(localKey)+";p256ecdsa="+strings.TrimRight(key.PublicKey, "="))
+	req.Header.Set("Authorization", "WebPush "+authorization)
+	return client.Do(req)
+}
+
+// vapidJWT signs the ES256 VAPID token for the push service of an endpoint.
+func vapidJWT(endpoint string, key vapidKey) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	d, err := decodeBase64Key(key.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid vapid private key: %w", err)
+	}
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(d)
+	private := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y}, D: new(big.Int).SetBytes(d)}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": "https://pager.com",
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// hkdf derives length bytes, at most one SHA-256 block, from the input key
+// material with HKDF (RFC 5869).
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// decodeBase64Key decodes a key in any of the base64 alphabets browsers and
+// key generators use, padded or not.
+func decodeBase64Key(key string) ([]byte, error) {
+	key = strings.TrimRight(key, "=")
+	if strings.ContainsAny(key, "+/") {
+		return base64.RawStdEncoding.DecodeString(key)
+	}
+	return base64.RawURLEncoding.DecodeString(key)
+}
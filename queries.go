@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// rowScanner is a single result row, from either pgx or database/sql.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// rowIterator is a result set, from either pgx or database/sql.
+type rowIterator interface {
+	rowScanner
+	Next() bool
+	Err() error
+}
+
+// column pairs a column name with the field of T it is read into, so the
+// select list and the scan destinations are declared together and can't
+// drift apart.
+type column[T any] struct {
+	name  string
+	field func(v *T) any
+
+	// json marks columns holding JSON, which Postgres decodes from JSONB
+	// but SQLite returns as text.
+	json bool
+}
+
+// rowMapper reads rows of T. Stores select mapper.columns() and read the
+// results with scan or collect rather than listing fields by hand.
+type rowMapper[T any] struct {
+	cols []column[T]
+
+	// text decodes JSON columns from text, for drivers without a JSON type.
+	text bool
+}
+
+// columns returns the mapper's select list.
+func (m rowMapper[T]) columns() string {
+	names := make([]string, len(m.cols))
+	for i, c := range m.cols {
+		names[i] = c.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// withTextJSON returns a copy of the mapper decoding JSON columns from text.
+func (m rowMapper[T]) withTextJSON() rowMapper[T] {
+	m.text = true
+	return m
+}
+
+// scan reads a single row.
+func (m rowMapper[T]) scan(row rowScanner) (T, error) {
+	var v T
+	dest := make([]any, len(m.cols))
+	for i, c := range m.cols {
+		dest[i] = c.field(&v)
+		if c.json && m.text {
+			dest[i] = jsonText{dest[i]}
+		}
+	}
+	err := row.Scan(dest...)
+	return v, err
+}
+
+// collect reads every remaining row. It doesn't close rows.
+func (m rowMapper[T]) collect(rows rowIterator) ([]T, error) {
+	vs := []T{}
+	for rows.Next() {
+		v, err := m.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, rows.Err()
+}
+
+// jsonText decodes a JSON text column into dest, leaving it untouched when
+// the column is NULL.
+type jsonText struct {
+	dest any
+}
+
+func (j jsonText) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), j.dest)
+	case []byte:
+		return json.Unmarshal(src, j.dest)
+	default:
+		return fmt.Errorf("cannot decode %T as JSON", src)
+	}
+}
+
+var taskRow = rowMapper[task]{cols: []column[task]{
+	{name: "id", field: func(t *task) any { return &t.ID }},
+	{name: "type", field: func(t *task) any { return &t.Type }},
+	{name: "tenant", field: func(t *task) any { return &t.Tenant }},
+	{name: "priority", field: func(t *task) any { return &t.Priority }},
+	{name: "payload", field: func(t *task) any { return &t.Payload }, json: true},
+	{name: "status", field: func(t *task) any { return &t.Status }},
+	{name: "attempts", field: func(t *task) any { return &t.Attempts }},
+	{name: "max_attempts", field: func(t *task) any { return &t.MaxAttempts }},
+	{name: "timeout_seconds", field: func(t *task) any { return &t.TimeoutSeconds }},
+	{name: "processed_by", field: func(t *task) any { return &t.ProcessedBy }},
+	{name: "claimed_by", field: func(t *task) any { return &t.ClaimedBy }},
+	{name: "claimed_at", field: func(t *task) any { return &t.ClaimedAt }},
+	{name: "locked_by", field: func(t *task) any { return &t.LockedBy }},
+	{name: "locked_until", field: func(t *task) any { return &t.LockedUntil }},
+	{name: "progress", field: func(t *task) any { return &t.Progress }},
+	{name: "progress_message", field: func(t *task) any { return &t.ProgressMessage }},
+	{name: "traceparent", field: func(t *task) any { return &t.Traceparent }},
+	{name: "dedup_key", field: func(t *task) any { return &t.DedupKey }},
+	{name: "dedup_until", field: func(t *task) any { return &t.DedupUntil }},
+	{name: "debounce_key", field: func(t *task) any { return &t.DebounceKey }},
+	{name: "run_at", field: func(t *task) any { return &t.RunAt }},
+	{name: "last_error", field: func(t *task) any { return &t.LastError }},
+	{name: "failed_at", field: func(t *task) any { return &t.FailedAt }},
+	{name: "sla_breached_at", field: func(t *task) any { return &t.SLABreachedAt }},
+	{name: "created", field: func(t *task) any { return &t.Created }},
+	{name: "updated", field: func(t *task) any { return &t.Updated }},
+}}
+
+var taskEventRow = rowMapper[taskEvent]{cols: []column[taskEvent]{
+	{name: "id", field: func(e *taskEvent) any { return &e.ID }},
+	{name: "task_id", field: func(e *taskEvent) any { return &e.TaskID }},
+	{name: "from_status", field: func(e *taskEvent) any { return &e.From }},
+	{name: "to_status", field: func(e *taskEvent) any { return &e.To }},
+	{name: "actor", field: func(e *taskEvent) any { return &e.Actor }},
+	{name: "worker_id", field: func(e *taskEvent) any { return &e.WorkerID }},
+	{name: "created", field: func(e *taskEvent) any { return &e.Created }},
+}}
+
+var subscriptionRow = rowMapper[subscription]{cols: []column[subscription]{
+	{name: "id", field: func(s *subscription) any { return &s.ID }},
+	{name: "endpoint", field: func(s *subscription) any { return &s.Endpoint }},
+	{name: "auth", field: func(s *subscription) any { return &s.Keys.Auth }},
+	{name: "p256dh", field: func(s *subscription) any { return &s.Keys.P256dh }},
+	{name: "locale", field: func(s *subscription) any { return &s.Locale }},
+	{name: "timezone", field: func(s *subscription) any { return &s.Timezone }},
+	{name: "user_id", field: func(s *subscription) any { return &s.UserID }},
+	{name: "origin", field: func(s *subscription) any { return &s.Origin }},
+	{name: "snoozed_until", field: func(s *subscription) any { return &s.SnoozedUntil }},
+	{name: "vapid_public_key", field: func(s *subscription) any { return &s.VAPIDPublicKey }},
+	{name: "content_encoding", field: func(s *subscription) any { return &s.ContentEncoding }},
+	{name: "schema_version", field: func(s *subscription) any { return &s.SchemaVersion }},
+	{name: "tags", field: func(s *subscription) any { return &s.Tags }, json: true},
+	{name: "created", field: func(s *subscription) any { return &s.Created }},
+}}
+
+var vapidKeyRow = rowMapper[vapidKey]{cols: []column[vapidKey]{
+	{name: "id", field: func(k *vapidKey) any { return &k.ID }},
+	{name: "public_key", field: func(k *vapidKey) any { return &k.PublicKey }},
+	{name: "private_key", field: func(k *vapidKey) any { return &k.PrivateKey }},
+	{name: "created", field: func(k *vapidKey) any { return &k.Created }},
+}}
+
+var flagRow = rowMapper[featureFlag]{cols: []column[featureFlag]{
+	{name: "name", field: func(f *featureFlag) any { return &f.Name }},
+	{name: "enabled", field: func(f *featureFlag) any { return &f.Enabled }},
+	{name: "tenants", field: func(f *featureFlag) any { return &f.Tenants }, json: true},
+	{name: "updated", field: func(f *featureFlag) any { return &f.Updated }},
+}}
+
+var templateRow = rowMapper[notificationTemplate]{cols: []column[notificationTemplate]{
+	{name: "id", field: func(t *notificationTemplate) any { return &t.ID }},
+	{name: "name", field: func(t *notificationTemplate) any { return &t.Name }},
+	{name: "body", field: func(t *notificationTemplate) any { return &t.Body }},
+	{name: "created", field: func(t *notificationTemplate) any { return &t.Created }},
+	{name: "updated", field: func(t *notificationTemplate) any { return &t.Updated }},
+}}
+
+var scheduleRow = rowMapper[schedule]{cols: []column[schedule]{
+	{name: "id", field: func(s *schedule) any { return &s.ID }},
+	{name: "rule", field: func(s *schedule) any { return &s.Rule }},
+	{name: "task", field: func(s *schedule) any { return &s.Task }, json: true},
+	{name: "notification", field: func(s *schedule) any { return &s.Notification }, json: true},
+	{name: "next_run", field: func(s *schedule) any { return &s.NextRun }},
+	{name: "created", field: func(s *schedule) any { return &s.Created }},
+	{name: "updated", field: func(s *schedule) any { return &s.Updated }},
+}}
+
+var notificationRow = rowMapper[notification]{cols: []column[notification]{
+	{name: "id", field: func(n *notification) any { return &n.ID }},
+	{name: "body", field: func(n *notification) any { return &n.Body }},
+	{name: "bodies", field: func(n *notification) any { return &n.Bodies }, json: true},
+	{name: "status", field: func(n *notification) any { return &n.Status }},
+	{name: "variants", field: func(n *notification) any { return &n.Variants }, json: true},
+	{name: "content", field: func(n *notification) any { return &n.Content }, json: true},
+	{name: "dry_run", field: func(n *notification) any { return &n.DryRun }},
+	{name: "priority", field: func(n *notification) any { return &n.Priority }},
+	{name: "endpoint", field: func(n *notification) any { return &n.Endpoint }},
+	{name: "targeted", field: func(n *notification) any { return &n.Targeted }},
+	{name: "local_time", field: func(n *notification) any { return &n.LocalTime }},
+	{name: "timezone", field: func(n *notification) any { return &n.Timezone }},
+	{name: "origin", field: func(n *notification) any { return &n.Origin }},
+	{name: "send_at", field: func(n *notification) any { return &n.SendAt }},
+	{name: "processed_by", field: func(n *notification) any { return &n.ProcessedBy }},
+	{name: "claimed_by", field: func(n *notification) any { return &n.ClaimedBy }},
+	{name: "claimed_at", field: func(n *notification) any { return &n.ClaimedAt }},
+	{name: "traceparent", field: func(n *notification) any { return &n.Traceparent }},
+	{name: "last_error", field: func(n *notification) any { return &n.LastError }},
+	{name: "failed_at", field: func(n *notification) any { return &n.FailedAt }},
+	{name: "created", field: func(n *notification) any { return &n.Created }},
+	{name: "updated", field: func(n *notification) any { return &n.Updated }},
+}}
+
+var deliveryFailureRow = rowMapper[deliveryFailure]{cols: []column[deliveryFailure]{
+	{name: "endpoint", field: func(f *deliveryFailure) any { return &f.Endpoint }},
+	{name: "attempts", field: func(f *deliveryFailure) any { return &f.Attempts }},
+	{name: "last_error", field: func(f *deliveryFailure) any { return &f.Error }},
+	{name: "created", field: func(f *deliveryFailure) any { return &f.Created }},
+}}
+
+var deliveryRow = rowMapper[delivery]{cols: []column[delivery]{
+	{name: "endpoint", field: func(d *delivery) any { return &d.Endpoint }},
+	{name: "variant", field: func(d *delivery) any { return &d.Variant }},
+	{name: "created", field: func(d *delivery) any { return &d.Created }},
+}}
@@ -0,0 +1,151 @@
+// Package queue lets applications enqueue tasks for poc-pg-worker directly
+// in Postgres.
+//
+// Tasks enqueued with EnqueueTx are written in the caller's transaction, so
+// they exist if and only if the surrounding business writes commit. Workers
+// are notified by the tasks table trigger once the transaction commits.
+package queue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Task is a unit of work to enqueue.
+type Task struct {
+	// ID identifies the task. It is generated when empty.
+	ID string `json:"id"`
+
+	// Type selects the handler that processes the task. It defaults to
+	// "default".
+	Type string `json:"type"`
+
+	// Tenant is the tenant the task is dispatched and isolated under.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Priority orders backlog processing, highest first.
+	Priority int `json:"priority"`
+
+	// Payload is encoded as JSON and handed to the task's handler.
+	Payload any `json:"payload"`
+
+	// Actor is recorded as the author of the task's first event. It
+	// defaults to "app".
+	Actor string `json:"-"`
+
+	// Traceparent is the W3C trace context the worker resumes when it
+	// processes the task, typically the incoming request's traceparent
+	// header.
+	Traceparent string `json:"traceparent,omitempty"`
+
+	// DedupWindow, when set, suppresses the task if another with the same
+	// dedup key was enqueued within the window. EnqueueTx then returns
+	// ErrDuplicate along with the task already enqueued.
+	DedupWindow time.Duration `json:"-"`
+
+	// DedupKey identifies duplicates. It defaults to a hash of the tenant,
+	// type and payload.
+	DedupKey   string     `json:"dedup_key,omitempty"`
+	DedupUntil *time.Time `json:"dedup_until,omitempty"`
+
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// ErrDuplicate is returned by EnqueueTx when a task with the same dedup key
+// was enqueued within its dedup window.
+var ErrDuplicate = errors.New("queue: duplicate task")
+
+// DedupKey returns the dedup key of a task without an explicit one, a hash
+// of its tenant, type and payload. Payloads that differ only in key order or
+// whitespace hash the same.
+func DedupKey(tenant, taskType string, payload any) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	var canonical any
+	if err := json.Unmarshal(b, &canonical); err != nil {
+		return "", err
+	}
+	if b, err = json.Marshal(canonical); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(tenant + "\x00" + taskType + "\x00"))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// EnqueueTx inserts a pending task using tx and returns it with its
+// generated fields set. Nothing is visible to workers until tx commits, and
+// nothing is enqueued if it rolls back.
+func EnqueueTx(ctx context.Context, tx pgx.Tx, t Task) (Task, error) {
+	if tx == nil {
+		return t, errors.New("queue: nil transaction")
+	}
+
+	now := time.Now()
+	if t.ID == "" {
+		t.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	if t.Type == "" {
+		t.Type = "default"
+	}
+	if t.Actor == "" {
+		t.Actor = "app"
+	}
+	t.Status, t.Created, t.Updated = "pending", now, now
+
+	payload, err := json.Marshal(t.Payload)
+	if err != nil {
+		return t, fmt.Errorf("queue: failed to encode payload: %w", err)
+	}
+
+	if t.DedupWindow > 0 {
+		if t.DedupKey == "" {
+			if t.DedupKey, err = DedupKey(t.Tenant, t.Type, t.Payload); err != nil {
+				return t, fmt.Errorf("queue: failed to hash payload: %w", err)
+			}
+		}
+		until := now.Add(t.DedupWindow)
+		t.DedupUntil = &until
+
+		// Serialize enqueuers of the same key so only one wins the window
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", t.DedupKey); err != nil {
+			return t, fmt.Errorf("queue: failed to lock dedup key: %w", err)
+		}
+		var existing string
+		err := tx.QueryRow(ctx, "SELECT id FROM tasks WHERE dedup_key = $1 AND dedup_until > $2 ORDER BY created DESC LIMIT 1",
+			t.DedupKey, now).Scan(&existing)
+		if err == nil {
+			t.ID = existing
+			return t, ErrDuplicate
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return t, fmt.Errorf("queue: failed to check for duplicates: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		WITH created AS (
+			INSERT INTO tasks (id, type, tenant, priority, payload, status, traceparent, dedup_key, dedup_until, created, updated)
+			VALUES ($1, $2, $3, $4, $5, $6, $10, $11, $12, $7, $8)
+			RETURNING id, status, created
+		)
+		INSERT INTO task_events (task_id, to_status, actor, created)
+		SELECT id, status, $9, created FROM created`,
+		t.ID, t.Type, t.Tenant, t.Priority, payload, t.Status, t.Created, t.Updated, t.Actor, t.Traceparent, t.DedupKey, t.DedupUntil)
+	if err != nil {
+		return t, fmt.Errorf("queue: failed to enqueue task: %w", err)
+	}
+	return t, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errThrottled reports that a push couldn't get a token from the push rate
+// limit before its broadcast ran out of time.
+var errThrottled = errors.New("push throttled")
+
+// rateLimiter takes tokens from named token buckets. Buckets refill at rate
+// tokens per second up to burst.
+type rateLimiter interface {
+	TakeToken(ctx context.Context, key string, rate float64, burst int) (bool, error)
+}
+
+// newRateLimiter returns a limiter shared through the store when it supports
+// one, so limits hold across instances, and an in-process limiter otherwise.
+func newRateLimiter(store Store) rateLimiter {
+	if limiter, ok := unwrapStore(store).(rateLimiter); ok {
+		return limiter
+	}
+	return newLocalRateLimiter()
+}
+
+// rateLimit applies a token bucket to a single key. A zero rate disables it.
+type rateLimit struct {
+	limiter rateLimiter
+	key     string
+	rate    float64
+	burst   int
+}
+
+// enabled reports whether the limit restricts anything.
+func (l rateLimit) enabled() bool {
+	return l.limiter != nil && l.rate > 0
+}
+
+// wait blocks until a token is available or the context is cancelled. If the
+// limiter fails the call is allowed through rather than stalling work.
+func (l rateLimit) wait(ctx context.Context, logger *slog.Logger) error {
+	if !l.enabled() {
+		return nil
+	}
+
+	interval := time.Duration(float64(time.Second) / l.rate)
+	for {
+		ok, err := l.limiter.TakeToken(ctx, l.key, l.rate, l.burst)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error taking rate limit token", slog.String("key", l.key), slog.Any("error", err))
+			return nil
+		}
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// rateLimitMiddleware rejects requests with 429 once a client exceeds the
+// rate. Clients are identified by remote IP.
+func rateLimitMiddleware(limiter rateLimiter, rate float64, burst int, next http.Handler) http.Handler {
+	if rate <= 0 {
+		return next
+	}
+
+	retryAfter := strconv.Itoa(int(math.Ceil(1 / rate)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		ok, err := limiter.TakeToken(r.Context(), "api:"+ip, rate, burst)
+		if err == nil && !ok {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localRateLimiter keeps token buckets in process memory. Limits only apply
+// to this instance.
+type localRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*localBucket
+}
+
+type localBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newLocalRateLimiter creates an in-process rate limiter.
+func newLocalRateLimiter() *localRateLimiter {
+	return &localRateLimiter{buckets: map[string]*localBucket{}}
+}
+
+func (l *localRateLimiter) TakeToken(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &localBucket{tokens: float64(burst), updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
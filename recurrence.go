@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teambition/rrule-go"
+)
+
+// recurrence is the parsed rule of a schedule.
+type recurrence interface {
+	// After returns the first occurrence after t, or at t when inc is set,
+	// or the zero time when there is none.
+	After(t time.Time, inc bool) time.Time
+}
+
+// parseRule parses a cron expression, or an iCalendar recurrence made of
+// DTSTART, RRULE, RDATE, and EXDATE lines. A recurrence without a DTSTART
+// starts at start, which is prepended so later parses agree on the
+// occurrences.
+func parseRule(rule string, start time.Time) (string, recurrence, error) {
+	rule = strings.TrimSpace(strings.ReplaceAll(rule, "\r\n", "\n"))
+	if isCronRule(rule) {
+		spec, err := parseCron(rule)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid rule: %w", err)
+		}
+		return rule, spec, nil
+	}
+	if !strings.Contains(rule, "RRULE:") {
+		return "", nil, errors.New("rule must contain an RRULE")
+	}
+	if !strings.HasPrefix(rule, "DTSTART") {
+		rule = "DTSTART:" + start.UTC().Format("20060102T150405Z") + "\n" + rule
+	}
+
+	set, err := rrule.StrToRRuleSet(rule)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid rule: %w", err)
+	}
+	return rule, set, nil
+}
+
+// nextRun returns the first occurrence of the rule after t, or nil when the
+// rule has no occurrences left.
+func nextRun(rule string, t time.Time) (*time.Time, error) {
+	_, set, err := parseRule(rule, t)
+	if err != nil {
+		return nil, err
+	}
+	next := set.After(t, false)
+	if next.IsZero() {
+		return nil, nil
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// createSchedule creates a recurring schedule for a task or notification.
+func createSchedule(store ScheduleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var s schedule
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			return
+		}
+
+		if (s.Task == nil) == (s.Notification == nil) {
+			http.Error(w, "exactly one of task or notification is required", http.StatusBadRequest)
+			return
+		}
+		if s.Task != nil && s.Task.Type == "" {
+			http.Error(w, "task type is required", http.StatusBadRequest)
+			return
+		}
+		if s.Notification != nil {
+			if s.Notification.LocalTime != "" || s.Notification.SendAt != nil {
+				http.Error(w, "scheduled notifications can't recur", http.StatusBadRequest)
+				return
+			}
+			if err := validatePriority(s.Notification.Priority); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateVariants(s.Notification.Variants); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateTargets(*s.Notification); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if s.Notification.Origin != "" {
+				origin, err := normalizeOrigin(s.Notification.Origin)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				s.Notification.Origin = origin
+			}
+		}
+
+		now := time.Now()
+		rule, _, err := parseRule(s.Rule, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Rule = rule
+		if s.NextRun, err = nextRun(rule, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.NextRun == nil {
+			http.Error(w, "rule has no upcoming occurrences", http.StatusBadRequest)
+			return
+		}
+
+		s.Created, s.Updated = now, now
+		s, err = store.CreateSchedule(r.Context(), s)
+		if err != nil {
+			log.Printf("Error creating schedule: %v\n", err)
+			http.Error(w, "failed to store schedule", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusCreated, s)
+	}
+}
+
+// listSchedules lists all recurring schedules.
+func listSchedules(store ScheduleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schedules, err := store.ListSchedules(r.Context())
+		if err != nil {
+			http.Error(w, "failed to read schedules", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, schedules)
+	}
+}
+
+// deleteSchedule deletes a recurring schedule.
+func deleteSchedule(store ScheduleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid schedule id", http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DeleteSchedule(r.Context(), id); err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "schedule not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to delete schedule", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+var scheduleFailures = metrics.counter("schedule_failures_total",
+	"Due schedules that failed to run or advance to their next occurrence.")
+
+// runSchedules creates the task or notification of every due schedule and
+// advances it to its next occurrence. Occurrences missed while nothing was
+// running are coalesced into a single run. A schedule that fails is logged
+// and left due, so it is retried on the next run, without holding up the
+// schedules after it.
+func runSchedules(ctx context.Context, logger *slog.Logger, store Store) error {
+	now := time.Now()
+	due, err := store.DueSchedules(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range due {
+		next, err := runSchedule(ctx, store, s, now)
+		if err != nil {
+			scheduleFailures.inc()
+			logger.ErrorContext(ctx, "Error running schedule", slog.Int("id", s.ID), slog.Any("error", err))
+			continue
+		}
+		logger.InfoContext(ctx, "Ran schedule", slog.Int("id", s.ID), slog.Any("next_run", next))
+	}
+	return nil
+}
+
+// runSchedule creates the task or notification of a due schedule and
+// advances it to its next occurrence, which it returns.
+func runSchedule(ctx context.Context, store Store, s schedule, now time.Time) (*time.Time, error) {
+	// A rule that can't be advanced would run again on every tick
+	next, err := nextRun(s.Rule, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to advance schedule %d: %w", s.ID, err)
+	}
+
+	switch {
+	case s.Task != nil:
+		t := *s.Task
+		t.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+		t.Status = "pending"
+		t.Created, t.Updated = now, now
+		if t.Payload == nil {
+			t.Payload = json.RawMessage(`{}`)
+		}
+		if err := store.CreateTask(withActor(ctx, "scheduler", ""), t); err != nil {
+			return nil, fmt.Errorf("failed to run schedule %d: %w", s.ID, err)
+		}
+	case s.Notification != nil:
+		n := *s.Notification
+		n.ID = 0
+		n.Created, n.Updated = now, now
+		if _, err := store.CreateNotification(ctx, n); err != nil {
+			return nil, fmt.Errorf("failed to run schedule %d: %w", s.ID, err)
+		}
+	}
+
+	if err := store.SetScheduleNextRun(ctx, s.ID, next); err != nil {
+		return nil, fmt.Errorf("failed to advance schedule %d: %w", s.ID, err)
+	}
+	return next, nil
+}
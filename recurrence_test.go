@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNextRunRRule(t *testing.T) {
+	from := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{
+			name: "daily",
+			rule: "DTSTART:20261001T090000Z\nRRULE:FREQ=DAILY",
+			want: "2026-10-17T09:00:00Z",
+		},
+		{
+			name: "last weekday of the month",
+			rule: "DTSTART:20260101T170000Z\nRRULE:FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1",
+			want: "2026-10-30T17:00:00Z",
+		},
+		{
+			name: "across a year",
+			rule: "DTSTART:20250101T000000Z\nRRULE:FREQ=YEARLY",
+			want: "2027-01-01T00:00:00Z",
+		},
+		{
+			name: "excluded date",
+			rule: "DTSTART:20261001T090000Z\nRRULE:FREQ=DAILY\nEXDATE:20261017T090000Z",
+			want: "2026-10-18T09:00:00Z",
+		},
+		{
+			name: "added date",
+			rule: "DTSTART:20261001T090000Z\nRRULE:FREQ=WEEKLY\nRDATE:20261016T180000Z",
+			want: "2026-10-16T18:00:00Z",
+		},
+		{
+			name: "without DTSTART",
+			rule: "RRULE:FREQ=HOURLY",
+			want: "2026-10-16T13:00:00Z",
+		},
+		{
+			name: "until",
+			rule: "DTSTART:20261001T090000Z\nRRULE:FREQ=DAILY;UNTIL=20261018T090000Z",
+			want: "2026-10-17T09:00:00Z",
+		},
+		{
+			name: "until passed",
+			rule: "DTSTART:20261001T090000Z\nRRULE:FREQ=DAILY;UNTIL=20261010T090000Z",
+		},
+		{
+			name: "count used up",
+			rule: "DTSTART:20261001T090000Z\nRRULE:FREQ=DAILY;COUNT=5",
+		},
+		{
+			name: "cron",
+			rule: "0 */5 * * *",
+			want: "2026-10-16T15:00:00Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nextRun(tt.rule, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("nextRun = %s, want none once the rule is exhausted", got)
+				}
+				return
+			}
+			want, err := time.Parse(time.RFC3339, tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || !got.Equal(want) {
+				t.Errorf("nextRun = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextRunInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"DTSTART:20261001T090000Z\nEXDATE:20261017T090000Z",
+		"RRULE:FREQ=SOMETIMES",
+		"RRULE:FREQ=DAILY;COUNT=x",
+		"DTSTART:not-a-date\nRRULE:FREQ=DAILY",
+		"61 * * * *",
+	}
+	for _, rule := range tests {
+		if _, err := nextRun(rule, time.Now()); err == nil {
+			t.Errorf("nextRun(%q) succeeded, want an error", rule)
+		}
+	}
+}
+
+func TestRunSchedulesSkipsFailures(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	due := time.Now().Add(-time.Minute)
+	bad, err := store.CreateSchedule(ctx, schedule{Rule: "RRULE:FREQ=SOMETIMES", Task: &task{Type: "bad"}, NextRun: &due})
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := store.CreateSchedule(ctx, schedule{Rule: "@hourly", Task: &task{Type: "good"}, NextRun: &due})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runSchedules(ctx, discardLogger(), store); err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, tk := range store.tasks {
+		types = append(types, tk.Type)
+	}
+	if len(types) != 1 || types[0] != "good" {
+		t.Errorf("tasks created = %q, want only the good schedule's", types)
+	}
+	if next := store.schedules[good.ID].NextRun; next == nil || !next.After(time.Now()) {
+		t.Errorf("good schedule next run = %v, want it advanced", next)
+	}
+	if next := store.schedules[bad.ID].NextRun; next == nil || !next.Equal(due) {
+		t.Errorf("bad schedule next run = %v, want it left due", next)
+	}
+}
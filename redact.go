@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// redacted replaces the values of redacted fields.
+const redacted = "[REDACTED]"
+
+// redactor masks the values of fields whose names match any of its
+// patterns. Patterns are case-insensitive path.Match globs such as *email*.
+type redactor struct {
+	patterns []string
+}
+
+// newRedactor creates a redactor for the field name patterns.
+func newRedactor(patterns []string) redactor {
+	var r redactor
+	for _, p := range patterns {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			r.patterns = append(r.patterns, p)
+		}
+	}
+	return r
+}
+
+// enabled reports whether the redactor masks anything.
+func (r redactor) enabled() bool {
+	return len(r.patterns) > 0
+}
+
+// matches reports whether a field name is redacted.
+func (r redactor) matches(name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range r.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// value redacts a decoded JSON value.
+func (r redactor) value(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if r.matches(k) {
+				v[k] = redacted
+			} else {
+				v[k] = r.value(field)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = r.value(v[i])
+		}
+	}
+	return v
+}
+
+// json redacts a JSON document, returning anything that isn't JSON as text.
+func (r redactor) json(data []byte) []byte {
+	if !r.enabled() {
+		return data
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return []byte(r.text(string(data)))
+	}
+	out, err := json.Marshal(r.value(v))
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+var (
+	// jsonFieldPattern matches "name": value pairs embedded in text.
+	jsonFieldPattern = regexp.MustCompile(`"([^"\\]+)"(\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+	// keyValuePattern matches name=value pairs embedded in text.
+	keyValuePattern = regexp.MustCompile(`([A-Za-z0-9_.-]+)=([^\s&,;]+)`)
+)
+
+// text redacts JSON fields and name=value pairs embedded in free text such
+// as error messages.
+func (r redactor) text(s string) string {
+	if !r.enabled() {
+		return s
+	}
+	s = jsonFieldPattern.ReplaceAllStringFunc(s, func(m string) string {
+		parts := jsonFieldPattern.FindStringSubmatch(m)
+		if !r.matches(parts[1]) {
+			return m
+		}
+		return `"` + parts[1] + `"` + parts[2] + `"` + redacted + `"`
+	})
+	return keyValuePattern.ReplaceAllStringFunc(s, func(m string) string {
+		parts := keyValuePattern.FindStringSubmatch(m)
+		if !r.matches(parts[1]) {
+			return m
+		}
+		return parts[1] + "=" + redacted
+	})
+}
+
+// error redacts an error's message, keeping nil errors nil.
+func (r redactor) error(err error) error {
+	if err == nil || !r.enabled() {
+		return err
+	}
+	return errors.New(r.text(err.Error()))
+}
+
+// redactingHandler is a slog.Handler that redacts attributes before passing
+// records on, so payloads don't carry PII into the log pipeline.
+type redactingHandler struct {
+	slog.Handler
+	redactor redactor
+}
+
+// newRedactingHandler wraps a handler with redaction. Without patterns the
+// handler is returned as is.
+func newRedactingHandler(h slog.Handler, r redactor) slog.Handler {
+	if !r.enabled() {
+		return h
+	}
+	return &redactingHandler{Handler: h, redactor: r}
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redactedRecord := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redactedRecord.AddAttrs(h.attr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, redactedRecord)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = h.attr(a)
+	}
+	return &redactingHandler{Handler: h.Handler.WithAttrs(redactedAttrs), redactor: h.redactor}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{Handler: h.Handler.WithGroup(name), redactor: h.redactor}
+}
+
+// attr redacts a single attribute, descending into groups and structured
+// values.
+func (h *redactingHandler) attr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if h.redactor.matches(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		s := a.Value.String()
+		if strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+			return slog.String(a.Key, string(h.redactor.json([]byte(s))))
+		}
+		return slog.String(a.Key, h.redactor.text(s))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		attrs := make([]any, len(group))
+		for i, ga := range group {
+			attrs[i] = h.attr(ga)
+		}
+		return slog.Group(a.Key, attrs...)
+	case slog.KindAny:
+		v := a.Value.Any()
+		if err, ok := v.(error); ok {
+			return slog.String(a.Key, h.redactor.text(err.Error()))
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return a
+		}
+		return slog.Any(a.Key, json.RawMessage(h.redactor.json(data)))
+	}
+	return a
+}
+
+// redactingStore wraps a Store and redacts the error messages recorded
+// against failed tasks, notifications, and deliveries.
+type redactingStore struct {
+	Store
+	redactor redactor
+}
+
+// Unwrap returns the wrapped store.
+func (s *redactingStore) Unwrap() Store {
+	return s.Store
+}
+
+func (s *redactingStore) FailTask(ctx context.Context, id string, cause error) error {
+	return s.Store.FailTask(ctx, id, s.redactor.error(cause))
+}
+
+func (s *redactingStore) TimeOutTask(ctx context.Context, id string, cause error) error {
+	return s.Store.TimeOutTask(ctx, id, s.redactor.error(cause))
+}
+
+func (s *redactingStore) RetryTask(ctx context.Context, id string, runAt time.Time, cause error) error {
+	return s.Store.RetryTask(ctx, id, runAt, s.redactor.error(cause))
+}
+
+func (s *redactingStore) FailNotification(ctx context.Context, id int, cause error) error {
+	return s.Store.FailNotification(ctx, id, s.redactor.error(cause))
+}
+
+func (s *redactingStore) SetDeliveryFailures(ctx context.Context, id int, failures []deliveryFailure) error {
+	redactedFailures := make([]deliveryFailure, len(failures))
+	for i, f := range failures {
+		f.Error = s.redactor.text(f.Error)
+		redactedFailures[i] = f
+	}
+	return s.Store.SetDeliveryFailures(ctx, id, redactedFailures)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// encryptedColumn is a column holding values encrypted at rest. JSON
+// columns may hold them anywhere within the document.
+type encryptedColumn struct {
+	name string
+	json bool
+}
+
+// encryptedTable is a table with columns holding values encrypted at rest,
+// walked in order of its integer id.
+type encryptedTable struct {
+	name    string
+	columns []encryptedColumn
+}
+
+// encryptedTables lists every column encrypted at rest.
+var encryptedTables = []encryptedTable{
+	{name: "subscriptions", columns: []encryptedColumn{{name: "auth"}, {name: "p256dh"}}},
+	{name: "notifications", columns: []encryptedColumn{{name: "body"}, {name: "bodies", json: true}, {name: "variants", json: true}, {name: "content", json: true}}},
+	{name: "schedules", columns: []encryptedColumn{{name: "notification", json: true}}},
+	{name: "vapid_keys", columns: []encryptedColumn{{name: "private_key"}}},
+}
+
+// columnRewriter is implemented by stores that can rewrite the encrypted
+// columns of a table in batches.
+type columnRewriter interface {
+	// RewriteColumns passes the columns of up to limit rows with ids after
+	// the given one to rewrite, in id order, and stores the values it
+	// changes. It returns the last id read and how many rows were read and
+	// changed. NULL values are skipped.
+	RewriteColumns(ctx context.Context, table encryptedTable, after int64, limit int,
+		rewrite func(col encryptedColumn, value string) (string, bool, error)) (last int64, scanned, rewritten int, err error)
+}
+
+// rewriteRow passes the non-NULL values of a row's encrypted columns to
+// rewrite, replacing them in place, and reports whether any changed.
+func rewriteRow(table encryptedTable, values []*string, rewrite func(col encryptedColumn, value string) (string, bool, error)) (bool, error) {
+	var changed bool
+	for i, col := range table.columns {
+		if values[i] == nil {
+			continue
+		}
+		value, ok, err := rewrite(col, *values[i])
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", col.name, err)
+		}
+		if ok {
+			values[i], changed = &value, true
+		}
+	}
+	return changed, nil
+}
+
+var (
+	reencryptScanned = metrics.counter("reencrypt_rows_scanned_total",
+		"Rows checked for values encrypted with a previous key, by table.", "table")
+	reencryptRewritten = metrics.counter("reencrypt_rows_rewritten_total",
+		"Rows re-encrypted with the current key, by table.", "table")
+)
+
+// reencryptProgress is the progress of the latest re-encryption run on this
+// instance.
+type reencryptProgress struct {
+	Started   *time.Time           `json:"started,omitempty"`
+	Finished  *time.Time           `json:"finished,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	Tables    []reencryptTableStat `json:"tables"`
+	KeyID     string               `json:"key_id,omitempty"`
+	BatchSize int                  `json:"batch_size,omitempty"`
+}
+
+// reencryptTableStat is how far a re-encryption run got through a table.
+type reencryptTableStat struct {
+	Table     string `json:"table"`
+	LastID    int64  `json:"last_id"`
+	Scanned   int    `json:"scanned"`
+	Rewritten int    `json:"rewritten"`
+	Done      bool   `json:"done"`
+}
+
+// reencryption tracks the progress of the re-encryption job.
+var reencryption struct {
+	mu       sync.Mutex
+	progress reencryptProgress
+}
+
+// snapshot returns a copy of the progress safe to encode.
+func (p reencryptProgress) snapshot() reencryptProgress {
+	p.Tables = append([]reencryptTableStat{}, p.Tables...)
+	return p
+}
+
+// reencryptJob re-encrypts every value sealed with a previous encryption
+// key, or in the v1 format, with the current key, walking each encrypted
+// table in batches of batchSize rows so no transaction holds many locks or
+// runs long. Once a run finds nothing left to rewrite the previous keys can
+// be removed from the configuration.
+func reencryptJob(logger *slog.Logger, rewriter columnRewriter, cipher *bodyCipher, batchSize int) func(ctx context.Context) error {
+	rewrite := func(col encryptedColumn, value string) (string, bool, error) {
+		if col.json {
+			return resealJSON(cipher, value)
+		}
+		return cipher.reseal(value)
+	}
+
+	return func(ctx context.Context) error {
+		started := time.Now()
+		reencryption.mu.Lock()
+		reencryption.progress = reencryptProgress{Started: &started, KeyID: cipher.current, BatchSize: batchSize}
+		reencryption.mu.Unlock()
+
+		err := func() error {
+			for i, table := range encryptedTables {
+				reencryption.mu.Lock()
+				reencryption.progress.Tables = append(reencryption.progress.Tables, reencryptTableStat{Table: table.name})
+				reencryption.mu.Unlock()
+
+				var after int64
+				for {
+					last, scanned, rewritten, err := rewriter.RewriteColumns(ctx, table, after, batchSize, rewrite)
+					if err != nil {
+						return fmt.Errorf("failed to re-encrypt %s after id %d: %w", table.name, after, err)
+					}
+					reencryptScanned.add(float64(scanned), table.name)
+					reencryptRewritten.add(float64(rewritten), table.name)
+
+					reencryption.mu.Lock()
+					stat := &reencryption.progress.Tables[i]
+					stat.LastID = max(stat.LastID, last)
+					stat.Scanned += scanned
+					stat.Rewritten += rewritten
+					stat.Done = scanned < batchSize
+					done := *stat
+					reencryption.mu.Unlock()
+
+					if rewritten > 0 {
+						logger.InfoContext(ctx, "Re-encryption progress",
+							slog.String("table", table.name),
+							slog.Int64("last_id", done.LastID),
+							slog.Int("scanned", done.Scanned),
+							slog.Int("rewritten", done.Rewritten))
+					}
+					if done.Done {
+						break
+					}
+					after = last
+				}
+			}
+			return nil
+		}()
+
+		finished := time.Now()
+		reencryption.mu.Lock()
+		reencryption.progress.Finished = &finished
+		if err != nil {
+			reencryption.progress.Error = err.Error()
+		}
+		progress := reencryption.progress.snapshot()
+		reencryption.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+		var rewritten int
+		for _, t := range progress.Tables {
+			rewritten += t.Rewritten
+		}
+		if rewritten > 0 {
+			logger.InfoContext(ctx, "Re-encryption finished", slog.Int("rewritten", rewritten), slog.Duration("elapsed", finished.Sub(started)))
+		}
+		return nil
+	}
+}
+
+// resealJSON reseals every encrypted string within a JSON document.
+func resealJSON(cipher *bodyCipher, doc string) (string, bool, error) {
+	var v any
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		return doc, false, fmt.Errorf("invalid json: %w", err)
+	}
+	v, changed, err := resealValue(cipher, v)
+	if err != nil || !changed {
+		return doc, false, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return doc, false, err
+	}
+	return string(b), true, nil
+}
+
+// resealValue reseals the encrypted strings within a decoded JSON value.
+func resealValue(cipher *bodyCipher, v any) (any, bool, error) {
+	var changed bool
+	switch v := v.(type) {
+	case string:
+		return cipher.reseal(v)
+	case []any:
+		for i := range v {
+			value, ok, err := resealValue(cipher, v[i])
+			if err != nil {
+				return v, false, err
+			}
+			v[i], changed = value, changed || ok
+		}
+	case map[string]any:
+		for k := range v {
+			value, ok, err := resealValue(cipher, v[k])
+			if err != nil {
+				return v, false, err
+			}
+			v[k], changed = value, changed || ok
+		}
+	}
+	return v, changed, nil
+}
+
+// getReencryption reports the progress of the latest re-encryption run on
+// this instance.
+func getReencryption() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reencryption.mu.Lock()
+		progress := reencryption.progress.snapshot()
+		reencryption.mu.Unlock()
+		writeJSON(w, r, http.StatusOK, progress)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// localTimeLayout is the layout of a notification's local_time, a wall clock
+// time without a zone that is interpreted in each recipient's timezone.
+const localTimeLayout = "2006-01-02T15:04"
+
+// defaultTimezone is the timezone of subscriptions that don't specify one.
+const defaultTimezone = "UTC"
+
+// initialStatus returns the status a new notification is stored with.
+// Scheduled notifications wait for the scheduler instead of being queued.
+func initialStatus(n notification) string {
+	if n.LocalTime != "" || n.SendAt != nil {
+		return "scheduled"
+	}
+	return "pending"
+}
+
+// validateSchedule checks a notification's scheduling fields.
+func validateSchedule(n notification) error {
+	if n.LocalTime != "" && n.SendAt != nil {
+		return errors.New("local_time and send_at are mutually exclusive")
+	}
+	if n.LocalTime != "" {
+		if _, err := time.Parse(localTimeLayout, n.LocalTime); err != nil {
+			return fmt.Errorf("local_time must be formatted as %s", localTimeLayout)
+		}
+	}
+	if n.Timezone != "" {
+		if _, err := time.LoadLocation(n.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q", n.Timezone)
+		}
+	}
+	return nil
+}
+
+// subscriptionTimezone returns the timezone a subscription is scheduled in.
+func subscriptionTimezone(sub subscription) string {
+	if sub.Timezone == "" {
+		return defaultTimezone
+	}
+	return sub.Timezone
+}
+
+// expandWaves splits a notification scheduled at a local time into one
+// wave per timezone, each sent when that local time is reached there.
+func expandWaves(n notification, timezones []string) ([]notification, error) {
+	if len(timezones) == 0 {
+		timezones = []string{defaultTimezone}
+	}
+
+	var waves []notification
+	seen := map[string]bool{}
+	for _, tz := range timezones {
+		if tz == "" {
+			tz = defaultTimezone
+		}
+		if seen[tz] {
+			continue
+		}
+		seen[tz] = true
+
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", tz, err)
+		}
+		local, err := time.ParseInLocation(localTimeLayout, n.LocalTime, loc)
+		if err != nil {
+			return nil, err
+		}
+		sendAt := local.UTC()
+
+		now := time.Now()
+		waves = append(waves, notification{
+			Body:        n.Body,
+			Bodies:      n.Bodies,
+			Variants:    n.Variants,
+			Content:     n.Content,
+			DryRun:      n.DryRun,
+			Timezone:    tz,
+			Origin:      n.Origin,
+			SendAt:      &sendAt,
+			Traceparent: n.Traceparent,
+			Created:     now,
+			Updated:     now,
+		})
+	}
+	return waves, nil
+}
+
+// schedulerJob runs due recurring schedules, expands notifications scheduled
+// at a local time into per-timezone waves, and queues every scheduled
+// notification that is due.
+func schedulerJob(logger *slog.Logger, store Store) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if err := runSchedules(ctx, logger, store); err != nil {
+			return err
+		}
+
+		scheduled, err := store.ScheduledNotifications(ctx)
+		if err != nil {
+			return err
+		}
+		if len(scheduled) > 0 {
+			timezones, err := store.SubscriptionTimezones(ctx)
+			if err != nil {
+				return err
+			}
+			for _, n := range scheduled {
+				waves, err := expandWaves(n, timezones)
+				if err != nil {
+					return fmt.Errorf("failed to expand notification %d: %w", n.ID, err)
+				}
+				if err := store.ExpandNotification(ctx, n.ID, waves); err != nil {
+					return fmt.Errorf("failed to expand notification %d: %w", n.ID, err)
+				}
+				logger.InfoContext(ctx, "Expanded notification into timezone waves",
+					slog.Int("id", n.ID), slog.Int("waves", len(waves)))
+			}
+		}
+
+		released, err := store.ReleaseNotifications(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		if released > 0 {
+			logger.InfoContext(ctx, "Queued scheduled notifications", slog.Int64("notifications", released))
+		}
+		return nil
+	}
+}
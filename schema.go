@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// initSQL is the Postgres schema, applied at boot when AUTO_MIGRATE is set.
+//
+//go:embed init.sql
+var initSQL string
+
+// expectedColumns lists the tables and columns init.sql creates that the
+// Postgres store relies on.
+var expectedColumns = map[string][]string{
+	"subscriptions":           {"id", "endpoint", "auth", "p256dh", "locale", "timezone", "user_id", "origin", "snoozed_until", "vapid_public_key", "content_encoding", "schema_version", "tags", "created", "updated"},
+	"vapid_keys":              {"id", "public_key", "private_key", "created"},
+	"feature_flags":           {"name", "enabled", "tenants", "updated"},
+	"templates":               {"id", "name", "body", "created", "updated"},
+	"schedules":               {"id", "rule", "task", "notification", "next_run", "created", "updated"},
+	"notifications":           {"id", "body", "status", "bodies", "variants", "content", "dry_run", "priority", "endpoint", "targeted", "local_time", "timezone", "origin", "send_at", "processed_by", "claimed_by", "claimed_at", "traceparent", "last_error", "failed_at", "created", "updated"},
+	"notification_targets":    {"notification_id", "endpoint"},
+	"notification_failures":   {"notification_id", "endpoint", "attempts", "last_error", "created"},
+	"notification_deliveries": {"notification_id", "endpoint", "variant", "created"},
+	"tasks":                   {"id", "type", "tenant", "priority", "payload", "status", "attempts", "max_attempts", "timeout_seconds", "processed_by", "claimed_by", "claimed_at", "locked_by", "locked_until", "progress", "progress_message", "traceparent", "dedup_key", "dedup_until", "debounce_key", "run_at", "last_error", "failed_at", "sla_breached_at", "created", "updated"},
+	"task_events":             {"id", "task_id", "from_status", "to_status", "actor", "worker_id", "created"},
+	"rate_limits":             {"key", "tokens", "updated"},
+	"cron_runs":               {"name", "last_tick"},
+	"worker_heartbeats":       {"instance", "role", "started", "heartbeat"},
+	"maintenance":             {"id", "enabled", "reason", "updated"},
+}
+
+// expectedTrigger is a NOTIFY trigger workers depend on to hear about new
+// work.
+type expectedTrigger struct {
+	name     string
+	table    string
+	function string
+	channel  string
+}
+
+var expectedTriggers = []expectedTrigger{
+	{name: "task_created_trigger", table: "tasks", function: "notify_task_created", channel: tasksChannel},
+	{name: "notification_created_trigger", table: "notifications", function: "notify_notification_created", channel: notificationsChannel},
+}
+
+// errSchemaMismatch is returned when the database is missing part of the
+// schema.
+var errSchemaMismatch = errors.New("database schema mismatch")
+
+// VerifySchema checks that every table, column, trigger, and NOTIFY function
+// the store relies on exists, returning errSchemaMismatch naming each one
+// that doesn't. Without them the API would accept work that workers never
+// hear about.
+func (s *postgresStore) VerifySchema(ctx context.Context) error {
+	var problems []string
+
+	columns := map[string]map[string]bool{}
+	rows, err := s.pool.Query(ctx, `
+		SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema()`)
+	if err != nil {
+		return fmt.Errorf("failed to read columns: %w", err)
+	}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read columns: %w", err)
+		}
+		if columns[table] == nil {
+			columns[table] = map[string]bool{}
+		}
+		columns[table][column] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read columns: %w", err)
+	}
+
+	for table, names := range expectedColumns {
+		if columns[table] == nil {
+			problems = append(problems, fmt.Sprintf("table %s is missing", table))
+			continue
+		}
+		for _, name := range names {
+			if !columns[table][name] {
+				problems = append(problems, fmt.Sprintf("column %s.%s is missing", table, name))
+			}
+		}
+	}
+
+	for _, want := range expectedTriggers {
+		var function, source string
+		err := s.pool.QueryRow(ctx, `
+			SELECT p.proname, p.prosrc FROM pg_trigger t
+			JOIN pg_class c ON c.oid = t.tgrelid
+			JOIN pg_proc p ON p.oid = t.tgfoid
+			WHERE t.tgname = $1 AND c.relname = $2 AND c.relnamespace = to_regnamespace(current_schema())
+				AND t.tgenabled <> 'D'`,
+			want.name, want.table).Scan(&function, &source)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			problems = append(problems, fmt.Sprintf("trigger %s on %s is missing or disabled", want.name, want.table))
+		case err != nil:
+			return fmt.Errorf("failed to read triggers: %w", err)
+		case function != want.function:
+			problems = append(problems, fmt.Sprintf("trigger %s calls %s, expected %s", want.name, function, want.function))
+		case !strings.Contains(source, want.channel):
+			problems = append(problems, fmt.Sprintf("function %s doesn't notify %s", function, want.channel))
+		case !strings.Contains(source, "notify_envelope"):
+			problems = append(problems, fmt.Sprintf("function %s doesn't send through notify_envelope", function))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %s", errSchemaMismatch, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Migrate applies init.sql. Every statement in it is idempotent, so it
+// creates whatever is missing and leaves the rest untouched. Columns added to
+// tables that already exist are not created.
+func (s *postgresStore) Migrate(ctx context.Context) error {
+	if _, err := s.pool.Exec(ctx, initSQL); err != nil {
+		return fmt.Errorf("failed to apply schema: %w", err)
+	}
+	return nil
+}
+
+// prepareSchema verifies the database schema, applying init.sql first when
+// autoMigrate is set, and fails with a precise error if anything is still
+// missing.
+func prepareSchema(ctx context.Context, logger *slog.Logger, store *postgresStore, autoMigrate bool) error {
+	err := store.VerifySchema(ctx)
+	if err == nil || !errors.Is(err, errSchemaMismatch) || !autoMigrate {
+		return err
+	}
+
+	logger.WarnContext(ctx, "Applying schema", slog.Any("reason", err))
+	if err := store.Migrate(ctx); err != nil {
+		return err
+	}
+	return store.VerifySchema(ctx)
+}
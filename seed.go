@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// seed inserts sample tasks, notifications, and subscriptions so local
+// frontends and demos have data to work with. Seeded notifications are dry
+// runs because the seeded subscriptions do not point at real push services.
+func seed(ctx context.Context, logger *slog.Logger, store Store, wait connectWait) error {
+	if err := waitForConnection(ctx, store, wait); err != nil {
+		return fmt.Errorf("seed failed to connect to database: %w", err)
+	}
+
+	now := time.Now()
+
+	for i := 1; i <= 3; i++ {
+		var sub subscription
+		sub.Endpoint = fmt.Sprintf("https://push.example.com/seed/%d", i)
+		sub.Keys.Auth = "c2VlZC1hdXRoLXNlY3JldA"
+		sub.Keys.P256dh = "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM"
+		if _, err := store.CreateSubscription(ctx, sub); err != nil {
+			return fmt.Errorf("failed to seed subscription: %w", err)
+		}
+	}
+
+	for i, taskType := range []string{"default", "email", "report"} {
+		payload, _ := json.Marshal(map[string]string{"message": fmt.Sprintf("Seeded %s task", taskType)})
+		if err := store.CreateTask(ctx, task{
+			ID:      fmt.Sprintf("%d", now.UnixNano()+int64(i)),
+			Type:    taskType,
+			Payload: json.RawMessage(payload),
+			Status:  "pending",
+			Created: now,
+			Updated: now,
+		}); err != nil {
+			return fmt.Errorf("failed to seed task: %w", err)
+		}
+	}
+
+	for _, body := range []string{"Welcome to the demo", "Your report is ready", "Scheduled maintenance tonight"} {
+		if _, err := store.CreateNotification(ctx, notification{
+			Body:    body,
+			DryRun:  true,
+			Created: now,
+			Updated: now,
+		}); err != nil {
+			return fmt.Errorf("failed to seed notification: %w", err)
+		}
+	}
+
+	logger.InfoContext(ctx, "Seeded demo data",
+		slog.Int("subscriptions", 3), slog.Int("tasks", 3), slog.Int("notifications", 3))
+	return nil
+}
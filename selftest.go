@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// selftestTaskType is the type of the no-op tasks the self-test enqueues.
+const selftestTaskType = "selftest"
+
+// selftestPollInterval is how often the self-test checks on its task.
+const selftestPollInterval = 50 * time.Millisecond
+
+// schemaVerifier is implemented by stores that can check the database has
+// the tables and NOTIFY triggers they rely on.
+type schemaVerifier interface {
+	VerifySchema(ctx context.Context) error
+}
+
+// selftestStage is the result of one stage of the self-test.
+type selftestStage struct {
+	Name string `json:"name"`
+	// Status is ok, failed, or skipped when an earlier stage failed or the
+	// store doesn't have the stage.
+	Status  string  `json:"status"`
+	Seconds float64 `json:"seconds"`
+	Detail  string  `json:"detail,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// selftestReport is the result of a self-test run.
+type selftestReport struct {
+	OK     bool            `json:"ok"`
+	TaskID string          `json:"task_id,omitempty"`
+	Stages []selftestStage `json:"stages"`
+}
+
+// errSkipStage skips a self-test stage the store doesn't have.
+var errSkipStage = errors.New("stage skipped")
+
+// selftestRun runs the self-test stages in order, skipping the rest once
+// one fails.
+type selftestRun struct {
+	report selftestReport
+	failed bool
+}
+
+// stage runs a stage, recording its result and how long it took. A stage
+// returning errSkipStage is recorded as skipped without failing the run.
+func (s *selftestRun) stage(name string, fn func() (string, error)) {
+	if s.failed {
+		s.report.Stages = append(s.report.Stages, selftestStage{Name: name, Status: "skipped"})
+		return
+	}
+	started := time.Now()
+	detail, err := fn()
+	stage := selftestStage{Name: name, Status: "ok", Seconds: time.Since(started).Seconds(), Detail: detail}
+	switch {
+	case errors.Is(err, errSkipStage):
+		stage.Status = "skipped"
+	case err != nil:
+		stage.Status, stage.Error = "failed", err.Error()
+		s.failed = true
+	}
+	s.report.Stages = append(s.report.Stages, stage)
+}
+
+// selftest checks the task pipeline end to end: it pings the database,
+// checks the schema and NOTIFY triggers when the store can, enqueues a
+// no-op task, and waits up to timeout for a worker to pick it up and for its
+// handler to complete it, reporting each stage's result. It responds 200
+// when every stage passed and 503 otherwise.
+func selftest(store Store, m *maintenance, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := withActor(r.Context(), "selftest", "")
+		run := &selftestRun{}
+
+		run.stage("database", func() (string, error) {
+			return "", store.Ping(ctx)
+		})
+
+		run.stage("schema", func() (string, error) {
+			verifier, ok := unwrapStore(store).(schemaVerifier)
+			if !ok {
+				return "", errSkipStage
+			}
+			return "tables and NOTIFY triggers present", verifier.VerifySchema(ctx)
+		})
+
+		now := time.Now()
+		t := task{
+			ID:      fmt.Sprintf("%d", now.UnixNano()),
+			Type:    selftestTaskType,
+			Payload: json.RawMessage(`{}`),
+			Status:  "pending",
+			Created: now,
+			Updated: now,
+
+			Traceparent: traceparentFromContext(r.Context()),
+		}
+		run.stage("enqueue", func() (string, error) {
+			if err := store.CreateTask(ctx, t); err != nil {
+				return "", err
+			}
+			run.report.TaskID = t.ID
+			return "", nil
+		})
+
+		// Stage results come from the task's events, so they hold whichever
+		// instance's worker ran the task
+		deadline := time.Now().Add(timeout)
+		waitFor := func(done func(e taskEvent) bool) (taskEvent, error) {
+			for {
+				events, err := store.ListTaskEvents(ctx, t.ID)
+				if err != nil {
+					return taskEvent{}, fmt.Errorf("failed to read task events: %w", err)
+				}
+				for _, e := range events {
+					if done(e) {
+						return e, nil
+					}
+				}
+				if time.Now().After(deadline) {
+					return taskEvent{}, context.DeadlineExceeded
+				}
+				select {
+				case <-ctx.Done():
+					return taskEvent{}, ctx.Err()
+				case <-time.After(selftestPollInterval):
+				}
+			}
+		}
+
+		run.stage("notify", func() (string, error) {
+			e, err := waitFor(func(e taskEvent) bool { return e.To != "pending" })
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("no worker picked the task up within %s", timeout)
+				if m.isEnabled() {
+					err = fmt.Errorf("%w: workers are paused for maintenance", err)
+				}
+				return "", err
+			}
+			if err != nil {
+				return "", err
+			}
+			if e.WorkerID == nil {
+				return "picked up", nil
+			}
+			return "picked up by " + *e.WorkerID, nil
+		})
+
+		run.stage("process", func() (string, error) {
+			e, err := waitFor(func(e taskEvent) bool {
+				return e.To == "completed" || e.To == "failed" || e.To == "timed_out" || e.To == "cancelled"
+			})
+			if errors.Is(err, context.DeadlineExceeded) {
+				return "", fmt.Errorf("the task was not processed within %s", timeout)
+			}
+			if err != nil {
+				return "", err
+			}
+			if e.To != "completed" {
+				return "", fmt.Errorf("the task %s", strings.ReplaceAll(e.To, "_", " "))
+			}
+			return "completed", nil
+		})
+
+		run.report.OK = !run.failed
+		status := http.StatusOK
+		if run.failed {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, r, status, run.report)
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"log/slog"
 	"net/http"
-
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// newServer creates a new HTTP server with the specified database connection
-// pool. It sets up the server's routes and returns the server instance.
-func newServer(pool *pgxpool.Pool) http.Handler {
+// newServer creates a new HTTP server with the specified configuration and
+// store. It sets up the server's routes and returns the server instance.
+func newServer(cfg config, logger *slog.Logger, store Store, h *health, limiter rateLimiter, pushClient *http.Client, keys *vapidKeyring, csrf *csrfProtection, m *maintenance, flags *flagCache) http.Handler {
 	mux := http.NewServeMux()
-	addRoutes(mux, pool)
+	addRoutes(mux, cfg, logger, store, h, pushClient, keys, csrf, m, flags)
 	var handler http.Handler = mux
+	handler = maintenanceMiddleware(mux, m, cfg.MaintenanceRetryAfter, handler)
+	handler = csrf.middleware(handler)
+	handler = timeoutMiddleware(mux, cfg.requestTimeouts(), handler)
+	handler = serverTimingMiddleware(handler)
+	handler = tenantMiddleware(mux, cfg.RLSRole != "", handler)
+	handler = traceMiddleware(handler)
+	handler = rateLimitMiddleware(limiter, cfg.RateLimitAPI, cfg.RateLimitAPIBurst, handler)
 	handler = corsMiddleware(handler)
+	handler = securityHeadersMiddleware(cfg.securityHeaders(), handler)
 	return handler
 }
 
@@ -21,7 +28,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Tenant, X-CSRF-Token, traceparent")
+		w.Header().Set("Timing-Allow-Origin", "http://localhost:5173")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -33,12 +41,58 @@ func corsMiddleware(next http.Handler) http.Handler {
 }
 
 // addRoutes adds the specified routes to the mux.
-func addRoutes(mux *http.ServeMux, pool *pgxpool.Pool) {
-	mux.HandleFunc("GET /tasks", listTasks(pool))
-	mux.HandleFunc("POST /tasks", createTask(pool))
-
-	mux.HandleFunc("POST /subscriptions", createSubscription(pool))
-	mux.HandleFunc("GET /subscriptions", listSubscriptions(pool))
-	mux.HandleFunc("POST /notifications", createNotification(pool))
-	mux.HandleFunc("GET /notifications", listNotifications(pool))
+func addRoutes(mux *http.ServeMux, cfg config, logger *slog.Logger, store Store, h *health, pushClient *http.Client, keys *vapidKeyring, csrf *csrfProtection, m *maintenance, flags *flagCache) {
+	mux.HandleFunc("GET /healthz", healthz())
+	mux.HandleFunc("GET /readyz", readyz(h))
+	mux.HandleFunc("GET /metrics", metricsHandler(metrics))
+	mux.HandleFunc("GET /stats/latency", getLatencyStats())
+
+	mux.HandleFunc("GET /tasks", listTasks(store))
+	mux.HandleFunc("POST /tasks", createTask(cfg, store))
+	mux.HandleFunc("GET /tasks/{id}", getTask(store))
+	mux.HandleFunc("GET /tasks/{id}/events", listTaskEvents(store))
+	mux.HandleFunc("POST /tasks/{id}/cancel", cancelTask(store))
+
+	mux.HandleFunc("GET /vapid/keys", getVAPIDKeys(keys))
+	mux.HandleFunc("POST /subscriptions", createSubscription(cfg, store, keys))
+	mux.HandleFunc("GET /subscriptions", listSubscriptions(cfg, store))
+	mux.HandleFunc("GET /subscriptions/{id}", getSubscription(cfg, store))
+	mux.HandleFunc("POST /subscriptions/{id}/snooze", snoozeSubscription(cfg, store))
+	mux.HandleFunc("POST /notifications", createNotification(cfg, store))
+	mux.HandleFunc("POST /notifications/preview", previewNotification(store))
+	mux.HandleFunc("GET /notifications", listNotifications(store))
+	mux.HandleFunc("GET /notifications/{id}", getNotification(store))
+	mux.HandleFunc("GET /notifications/{id}/failures", listDeliveryFailures(store))
+	mux.HandleFunc("GET /notifications/{id}/deliveries", listDeliveries(store))
+
+	mux.HandleFunc("POST /templates", createTemplate(store))
+	mux.HandleFunc("GET /templates", listTemplates(store))
+	mux.HandleFunc("GET /templates/{id}", getTemplate(store))
+	mux.HandleFunc("PUT /templates/{id}", updateTemplate(store))
+	mux.HandleFunc("DELETE /templates/{id}", deleteTemplate(store))
+	mux.HandleFunc("POST /templates/{id}/preview", previewTemplate(store))
+
+	mux.HandleFunc("POST /schedules", createSchedule(store))
+	mux.HandleFunc("GET /schedules", listSchedules(store))
+	mux.HandleFunc("DELETE /schedules/{id}", deleteSchedule(store))
+
+	mux.HandleFunc("DELETE /users/{id}/data", deleteUserData(logger, store))
+
+	mux.HandleFunc("POST /ingest/{source}", ingest(cfg, store, flags))
+
+	mux.Handle("GET /demo/", demoPage())
+
+	mux.HandleFunc("GET /admin/csrf-token", csrfToken(csrf))
+	mux.HandleFunc("POST /admin/tasks/requeue", requeueTasks(store))
+	mux.HandleFunc("POST /admin/notifications/requeue", requeueNotifications(store))
+	mux.HandleFunc("POST /admin/purge", purge(store))
+	mux.HandleFunc("POST /admin/subscriptions/{id}/test", testSubscription(cfg, store, pushClient, keys))
+	mux.HandleFunc("POST /admin/vapid/rotate", rotateVAPIDKeys(keys))
+	mux.HandleFunc("GET /admin/reencryption", getReencryption())
+	mux.HandleFunc("GET /admin/maintenance", getMaintenance(m))
+	mux.HandleFunc("POST /admin/maintenance", setMaintenance(m))
+	mux.HandleFunc("POST /admin/selftest", selftest(store, m, cfg.SelftestTimeout))
+	mux.HandleFunc("GET /admin/flags", listFlags(store))
+	mux.HandleFunc("PUT /admin/flags/{name}", setFlag(store, flags))
+	mux.HandleFunc("DELETE /admin/flags/{name}", deleteFlag(store, flags))
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTiming accumulates the time a request spends in each phase, sent
+// back in the Server-Timing header so browser devtools show where API
+// latency goes without a tracing backend.
+type serverTiming struct {
+	mu     sync.Mutex
+	start  time.Time
+	names  []string
+	totals map[string]time.Duration
+	counts map[string]int
+}
+
+type serverTimingKey struct{}
+
+// addServerTiming adds d to the named phase of the request the context
+// belongs to. It does nothing outside a request.
+func addServerTiming(ctx context.Context, name string, d time.Duration) {
+	st, ok := ctx.Value(serverTimingKey{}).(*serverTiming)
+	if !ok {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.totals[name]; !ok {
+		st.names = append(st.names, name)
+	}
+	st.totals[name] += d
+	st.counts[name]++
+}
+
+// header formats the phases recorded so far and the total time.
+func (st *serverTiming) header() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	metrics := make([]string, 0, len(st.names)+1)
+	for _, name := range st.names {
+		metrics = append(metrics, fmt.Sprintf(`%s;dur=%.3f;desc="%d"`, name, milliseconds(st.totals[name]), st.counts[name]))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", milliseconds(time.Since(st.start))))
+	return strings.Join(metrics, ", ")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// serverTimingMiddleware times each request and sends a Server-Timing header
+// with the time spent in the database ("db", Postgres only), encoding the
+// response ("encode"), and in total. The header is written just before the
+// response body, so the status code is held back until then.
+func serverTimingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &serverTiming{start: time.Now(), totals: map[string]time.Duration{}, counts: map[string]int{}}
+		tw := &timingWriter{ResponseWriter: w, timing: st, status: http.StatusOK}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), serverTimingKey{}, st)))
+		tw.flushHeader()
+	})
+}
+
+// timingWriter adds the Server-Timing header when the response header is
+// written.
+type timingWriter struct {
+	http.ResponseWriter
+	timing  *serverTiming
+	status  int
+	written bool
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+	if !w.written {
+		w.status = status
+	}
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	w.flushHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingWriter) flushHeader() {
+	if w.written {
+		return
+	}
+	w.written = true
+	w.Header().Set("Server-Timing", w.timing.header())
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *timingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeJSON encodes v as the JSON response body with the specified status,
+// recording the encoding time for Server-Timing.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	start := time.Now()
+	body, err := json.Marshal(v)
+	addServerTiming(r.Context(), "encode", time.Since(start))
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
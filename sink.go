@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// lifecycleEvent describes a task or notification status change mirrored to
+// the event sink.
+type lifecycleEvent struct {
+	Entity   string    `json:"entity"`
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	Actor    string    `json:"actor"`
+	WorkerID string    `json:"worker_id,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// eventSink publishes lifecycle events to an external broker.
+type eventSink interface {
+	publish(ctx context.Context, subject string, data []byte) error
+	close()
+}
+
+// newEventSink creates the event sink selected by the configuration.
+func newEventSink(cfg config) (eventSink, error) {
+	switch cfg.EventSink {
+	case "nats":
+		nc, err := nats.Connect(cfg.EventSinkNatsURL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to nats: %w", err)
+		}
+		return &natsSink{conn: nc}, nil
+	default:
+		return nil, fmt.Errorf("unknown event sink %q", cfg.EventSink)
+	}
+}
+
+// natsSink publishes events as NATS messages.
+type natsSink struct {
+	conn *nats.Conn
+}
+
+func (s *natsSink) publish(ctx context.Context, subject string, data []byte) error {
+	return s.conn.Publish(subject, data)
+}
+
+func (s *natsSink) close() {
+	s.conn.Drain()
+}
+
+// publishingStore wraps a Store and mirrors every successful task and
+// notification status change to an event sink as
+// "<prefix>.<entity>.<status>". Publishing failures are logged and never fail
+// the underlying write.
+type publishingStore struct {
+	Store
+	sink   eventSink
+	prefix string
+	logger *slog.Logger
+}
+
+// Unwrap returns the wrapped store.
+func (s *publishingStore) Unwrap() Store {
+	return s.Store
+}
+
+// emit publishes a lifecycle event for an entity.
+func (s *publishingStore) emit(ctx context.Context, entity, id, status string, cause error) {
+	a := actorFromContext(ctx)
+	event := lifecycleEvent{
+		Entity:   entity,
+		ID:       id,
+		Status:   status,
+		Actor:    a.Name,
+		WorkerID: a.WorkerID,
+		Time:     time.Now(),
+	}
+	if cause != nil {
+		event.Error = cause.Error()
+	}
+
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = s.sink.publish(ctx, fmt.Sprintf("%s.%s.%s", s.prefix, entity, status), data)
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "Error publishing lifecycle event",
+			slog.String("entity", entity), slog.String("id", id), slog.Any("error", err))
+	}
+}
+
+func (s *publishingStore) CreateTask(ctx context.Context, t task) error {
+	if err := s.Store.CreateTask(ctx, t); err != nil {
+		return err
+	}
+	s.emit(ctx, "task", t.ID, t.Status, nil)
+	return nil
+}
+
+func (s *publishingStore) DebounceTask(ctx context.Context, t task) (string, error) {
+	id, err := s.Store.DebounceTask(ctx, t)
+	if err != nil {
+		return id, err
+	}
+	if id == t.ID {
+		s.emit(ctx, "task", t.ID, t.Status, nil)
+	}
+	return id, nil
+}
+
+func (s *publishingStore) LeaseTask(ctx context.Context, id string, until time.Time) (bool, error) {
+	leased, err := s.Store.LeaseTask(ctx, id, until)
+	if err != nil || !leased {
+		return leased, err
+	}
+	s.emit(ctx, "task", id, "processing", nil)
+	return true, nil
+}
+
+func (s *publishingStore) SetTaskStatus(ctx context.Context, id string, status string) error {
+	if err := s.Store.SetTaskStatus(ctx, id, status); err != nil {
+		return err
+	}
+	s.emit(ctx, "task", id, status, nil)
+	return nil
+}
+
+func (s *publishingStore) FailTask(ctx context.Context, id string, cause error) error {
+	if err := s.Store.FailTask(ctx, id, cause); err != nil {
+		return err
+	}
+	s.emit(ctx, "task", id, "failed", cause)
+	return nil
+}
+
+func (s *publishingStore) TimeOutTask(ctx context.Context, id string, cause error) error {
+	if err := s.Store.TimeOutTask(ctx, id, cause); err != nil {
+		return err
+	}
+	s.emit(ctx, "task", id, "timed_out", cause)
+	return nil
+}
+
+func (s *publishingStore) CancelTask(ctx context.Context, id string) error {
+	if err := s.Store.CancelTask(ctx, id); err != nil {
+		return err
+	}
+	s.emit(ctx, "task", id, "cancelled", nil)
+	return nil
+}
+
+func (s *publishingStore) RetryTask(ctx context.Context, id string, runAt time.Time, cause error) error {
+	if err := s.Store.RetryTask(ctx, id, runAt, cause); err != nil {
+		return err
+	}
+	s.emit(ctx, "task", id, "scheduled", cause)
+	return nil
+}
+
+func (s *publishingStore) CreateNotification(ctx context.Context, n notification) (int, error) {
+	id, err := s.Store.CreateNotification(ctx, n)
+	if err != nil {
+		return id, err
+	}
+	s.emit(ctx, "notification", fmt.Sprintf("%d", id), initialStatus(n), nil)
+	return id, nil
+}
+
+func (s *publishingStore) SetNotificationStatus(ctx context.Context, id int, status string) error {
+	if err := s.Store.SetNotificationStatus(ctx, id, status); err != nil {
+		return err
+	}
+	s.emit(ctx, "notification", fmt.Sprintf("%d", id), status, nil)
+	return nil
+}
+
+func (s *publishingStore) FailNotification(ctx context.Context, id int, cause error) error {
+	if err := s.Store.FailNotification(ctx, id, cause); err != nil {
+		return err
+	}
+	s.emit(ctx, "notification", fmt.Sprintf("%d", id), "failed", cause)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// slaBreaches counts tasks that did not complete within their type's SLA.
+var slaBreaches = metrics.counter("task_sla_breaches_total",
+	"Tasks that did not complete within their type's SLA, by type.", "type")
+
+// slaBreach is the body of task.sla_breached webhook events: the tasks of a
+// type newly found past their SLA.
+type slaBreach struct {
+	Type  string `json:"type"`
+	SLA   string `json:"sla"`
+	Tasks []task `json:"tasks"`
+}
+
+// slaJob marks every unfinished task that became ready to run longer ago
+// than its type's SLA as breached. Breaching tasks are counted, have their
+// priority raised by bump so they are picked up ahead of the rest, and are
+// reported to the alert webhook when one is configured. Each task is only
+// reported once.
+func slaJob(logger *slog.Logger, store TaskStore, slas map[string]time.Duration, bump int, alert webhook) func(ctx context.Context) error {
+	types := make([]string, 0, len(slas))
+	for taskType := range slas {
+		types = append(types, taskType)
+	}
+	sort.Strings(types)
+
+	return func(ctx context.Context) error {
+		now := time.Now()
+		var errs []error
+		for _, taskType := range types {
+			sla := slas[taskType]
+			breached, err := store.BreachTasks(ctx, taskType, now.Add(-sla), bump)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to check %s tasks against their sla: %w", taskType, err))
+				continue
+			}
+			if len(breached) == 0 {
+				continue
+			}
+
+			slaBreaches.add(float64(len(breached)), taskType)
+			logger.WarnContext(ctx, "Tasks breached their SLA",
+				slog.String("type", taskType), slog.Duration("sla", sla), slog.Int("tasks", len(breached)))
+			if alert.enabled() {
+				breach := slaBreach{Type: taskType, SLA: sla.String(), Tasks: breached}
+				if err := alert.send(ctx, "task.sla_breached", breach); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// slowQueries counts queries slower than SLOW_QUERY_THRESHOLD.
+var slowQueries = metrics.counter("pg_slow_queries_total",
+	"Queries that took longer than the slow query threshold.", "query", "channel", "handler")
+
+// queryScope names the channel and handler queries are made on behalf of, so
+// slow queries can be traced back to the work that issued them.
+type queryScope struct {
+	Channel string
+	Handler string
+}
+
+type queryScopeKey struct{}
+
+// withQueryScope returns a context attributing queries to the scope. Empty
+// fields keep the value of any enclosing scope.
+func withQueryScope(ctx context.Context, scope queryScope) context.Context {
+	parent := queryScopeFromContext(ctx)
+	if scope.Channel == "" {
+		scope.Channel = parent.Channel
+	}
+	if scope.Handler == "" {
+		scope.Handler = parent.Handler
+	}
+	return context.WithValue(ctx, queryScopeKey{}, scope)
+}
+
+// queryScopeFromContext returns the scope attached to the context.
+func queryScopeFromContext(ctx context.Context) queryScope {
+	scope, _ := ctx.Value(queryScopeKey{}).(queryScope)
+	return scope
+}
+
+// slowQueryTracer is a pgx tracer logging and counting every query that runs
+// longer than threshold, 0 disabling it. Every query's duration is also
+// added to the "db" Server-Timing phase of the request it ran for.
+type slowQueryTracer struct {
+	logger    *slog.Logger
+	threshold time.Duration
+}
+
+type queryStartKey struct{}
+
+// queryStart is what TraceQueryStart hands TraceQueryEnd through the context.
+type queryStart struct {
+	sql     string
+	started time.Time
+}
+
+func (t *slowQueryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, queryStart{sql: data.SQL, started: time.Now()})
+}
+
+func (t *slowQueryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(queryStart)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(start.started)
+	addServerTiming(ctx, "db", elapsed)
+	if t.threshold <= 0 || elapsed < t.threshold {
+		return
+	}
+
+	name := queryName(start.sql)
+	scope := queryScopeFromContext(ctx)
+	slowQueries.inc(name, scope.Channel, scope.Handler)
+	t.logger.WarnContext(ctx, "Slow query",
+		slog.String("query", name),
+		slog.Duration("duration", elapsed),
+		slog.String("actor", actorFromContext(ctx).Name),
+		slog.String("channel", scope.Channel),
+		slog.String("handler", scope.Handler),
+		slog.Any("error", data.Err))
+}
+
+// maxQueryNameLength bounds query names used in logs and metric labels.
+const maxQueryNameLength = 80
+
+// queryName identifies a query by its "-- name: X" comment when it has one,
+// and otherwise by its SQL with whitespace collapsed, truncated.
+func queryName(sql string) string {
+	if _, rest, ok := strings.Cut(sql, "-- name:"); ok {
+		if name, _, _ := strings.Cut(strings.TrimSpace(rest), "\n"); name != "" {
+			return strings.TrimSpace(name)
+		}
+	}
+	name := strings.Join(strings.Fields(sql), " ")
+	if len(name) > maxQueryNameLength {
+		name = name[:maxQueryNameLength] + "..."
+	}
+	return name
+}
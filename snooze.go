@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Notification priorities decide what happens to deliveries to snoozed
+// subscriptions: high priority breaks through, normal priority is deferred
+// until the snooze ends, and low priority is dropped.
+const (
+	priorityLow    = "low"
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+)
+
+// validatePriority checks a notification's priority. Empty means normal.
+func validatePriority(priority string) error {
+	switch priority {
+	case "", priorityLow, priorityNormal, priorityHigh:
+		return nil
+	default:
+		return fmt.Errorf("priority must be %s, %s, or %s", priorityLow, priorityNormal, priorityHigh)
+	}
+}
+
+// snoozeRequest is how long to mute a subscription for. Zero ends a snooze.
+type snoozeRequest struct {
+	Duration string `json:"duration"`
+}
+
+// snoozeSubscription temporarily mutes pushes to a subscription.
+func snoozeSubscription(cfg config, store SubscriptionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid subscription id", http.StatusBadRequest)
+			return
+		}
+
+		var req snoozeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration < 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+
+		var until *time.Time
+		if duration > 0 {
+			t := time.Now().Add(duration).UTC()
+			until = &t
+		}
+
+		sub, err := store.SnoozeSubscription(r.Context(), id, until)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "subscription not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to snooze subscription", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, newSubscriptionView(sub, showSubscriptionKeys(cfg, r)))
+	}
+}
+
+// applySnoozes returns the subscriptions a notification should be pushed to
+// now. Deliveries to snoozed subscriptions are deferred or dropped according
+// to the notification's priority. A deferred delivery is a notification for
+// just that subscription, scheduled for when its snooze ends.
+func applySnoozes(ctx context.Context, logger *slog.Logger, store NotificationStore, n notification, subs []subscription) ([]subscription, error) {
+	if n.Priority == priorityHigh {
+		return subs, nil
+	}
+
+	now := time.Now()
+	var awake []subscription
+	for _, sub := range subs {
+		if sub.SnoozedUntil == nil || !sub.SnoozedUntil.After(now) {
+			awake = append(awake, sub)
+			continue
+		}
+
+		if n.Priority == priorityLow {
+			logger.InfoContext(ctx, "Dropped delivery to snoozed subscription",
+				slog.Int("id", n.ID), slog.String("endpoint", sub.Endpoint))
+			continue
+		}
+
+		deferred := notification{
+			Body:     n.Body,
+			Bodies:   n.Bodies,
+			Variants: n.Variants,
+			Content:  n.Content,
+			DryRun:   n.DryRun,
+			Priority: n.Priority,
+			Endpoint: sub.Endpoint,
+			SendAt:   sub.SnoozedUntil,
+			Created:  now,
+			Updated:  now,
+		}
+		if _, err := store.CreateNotification(ctx, deferred); err != nil {
+			return nil, fmt.Errorf("failed to defer delivery: %w", err)
+		}
+		logger.InfoContext(ctx, "Deferred delivery to snoozed subscription",
+			slog.Int("id", n.ID), slog.String("endpoint", sub.Endpoint), slog.Time("until", *sub.SnoozedUntil))
+	}
+	return awake, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Channels the store notifies when new work is queued.
+const (
+	tasksChannel         = "tasks_channel"
+	notificationsChannel = "notifications_channel"
+)
+
+// channelPattern matches the channel names accepted for LISTEN: plain,
+// unquoted Postgres identifiers of at most 63 bytes.
+var channelPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// validateChannel rejects channel names that aren't plain identifiers, so a
+// channel taken from configuration can't smuggle SQL into LISTEN.
+func validateChannel(channel string) error {
+	if !channelPattern.MatchString(channel) {
+		return fmt.Errorf("invalid channel name %q", channel)
+	}
+	return nil
+}
+
+// errNotFound is returned by stores when a requested row does not exist.
+var errNotFound = errors.New("not found")
+
+// errTaskFinished is returned when cancelling a task that has already
+// finished.
+var errTaskFinished = errors.New("task already finished")
+
+// cancellableStatuses are the statuses of tasks that haven't finished yet,
+// which can still be cancelled.
+var cancellableStatuses = []string{"pending", "scheduled", "processing"}
+
+// Store persists tasks, subscriptions, and notifications and delivers
+// notifications when new work is queued.
+type Store interface {
+	TaskStore
+	SubscriptionStore
+	NotificationStore
+	TemplateStore
+	ScheduleStore
+	VAPIDKeyStore
+	FlagStore
+
+	// Ping verifies the backing storage is reachable.
+	Ping(ctx context.Context) error
+	// Listen subscribes to notifications published on the channel.
+	Listen(ctx context.Context, channel string) (Listener, error)
+	// Backlog returns the payloads of work still pending on the channel, most
+	// urgent first, so a worker can catch up on anything queued while it
+	// wasn't listening.
+	Backlog(ctx context.Context, channel string) ([]string, error)
+	// Backfill returns the payloads of the work on the channel matching the
+	// filter, most urgent first, as workers would be notified of it.
+	Backfill(ctx context.Context, channel string, filter backfillFilter) ([]string, error)
+	// Renotify moves the work on the channel matching the filter back to
+	// pending and notifies workers about it again.
+	Renotify(ctx context.Context, channel string, filter backfillFilter) (int64, error)
+	// DeleteUserData erases a user's subscriptions, the delivery receipts
+	// and failures recorded for them, notifications targeted at them, and
+	// tasks whose payload user_id references the user, all at once.
+	DeleteUserData(ctx context.Context, userID string) (userDataReport, error)
+}
+
+// TaskStore persists tasks. Creating or requeueing a task notifies
+// tasksChannel. Every status change is recorded as a taskEvent attributed to
+// the actor in the context.
+type TaskStore interface {
+	CreateTask(ctx context.Context, t task) error
+	ListTasks(ctx context.Context) ([]task, error)
+	// GetTask returns errNotFound when there is no such task.
+	GetTask(ctx context.Context, id string) (task, error)
+	SetTaskStatus(ctx context.Context, id string, status string) error
+	// LeaseTask moves a pending task to processing, leased to this instance
+	// until the given time, reporting false when the task isn't pending or
+	// another instance holds an unexpired lease on it. Once a lease expires
+	// the task can be leased again, so work of a crashed instance is taken
+	// over.
+	LeaseTask(ctx context.Context, id string, until time.Time) (bool, error)
+	// RenewLease extends the lease this instance holds on a processing task
+	// to the given time, reporting false when it no longer holds it.
+	RenewLease(ctx context.Context, id string, until time.Time) (bool, error)
+	FailTask(ctx context.Context, id string, cause error) error
+	// TimeOutTask marks a task whose handler ran out of time as timed_out
+	// and records the cause.
+	TimeOutTask(ctx context.Context, id string, cause error) error
+	// RetryTask records a failed attempt at a task and schedules it to run
+	// again at runAt.
+	RetryTask(ctx context.Context, id string, runAt time.Time, cause error) error
+	// SetTaskProgress records how far a processing task has got, as a
+	// percentage and a message. Tasks that aren't processing, or whose
+	// lease this instance no longer holds, are left alone. It doesn't
+	// touch updated, so reporting progress doesn't hold off the reaper.
+	SetTaskProgress(ctx context.Context, id string, percent int, message string) error
+	// CancelTask moves a task that hasn't finished to cancelled, releasing
+	// its lease. It returns errNotFound when there is no such task and
+	// errTaskFinished when it has already finished. The status of a
+	// cancelled task is final: the worker's own transitions leave it alone.
+	CancelTask(ctx context.Context, id string) error
+	RequeueTasks(ctx context.Context, filter taskFilter) (int64, error)
+	PurgeTasks(ctx context.Context, before time.Time) (int64, error)
+	// ReapTasks returns tasks processing since before to pending, unless
+	// their lease is still held.
+	ReapTasks(ctx context.Context, before time.Time) (int64, error)
+	// ReturnTasks moves the processing tasks leased to the instance back to
+	// pending, releasing their leases, and reports how many it moved.
+	ReturnTasks(ctx context.Context, instance string) (int64, error)
+	// DebounceTask creates a scheduled task, unless a task with the same
+	// type, tenant and debounce key is still scheduled, in which case that
+	// task takes the new payload and run_at instead. It returns the id of
+	// the task the enqueue landed in.
+	DebounceTask(ctx context.Context, t task) (string, error)
+	// ReleaseTasks queues the scheduled tasks due by now.
+	ReleaseTasks(ctx context.Context, now time.Time) (int64, error)
+	// NextTaskDue returns when the earliest scheduled task is due, or nil
+	// when none are scheduled.
+	NextTaskDue(ctx context.Context) (*time.Time, error)
+	ListTaskEvents(ctx context.Context, id string) ([]taskEvent, error)
+	// CountFailedTasks counts the tasks that failed since the given time by
+	// type.
+	CountFailedTasks(ctx context.Context, since time.Time) (map[string]int64, error)
+	// BreachTasks marks the unfinished tasks of a type that became ready to
+	// run before the given time as having breached their SLA, raising their
+	// priority by bump, and returns them. Tasks already marked are skipped.
+	BreachTasks(ctx context.Context, taskType string, before time.Time, bump int) ([]task, error)
+}
+
+// SubscriptionStore persists web push subscriptions.
+type SubscriptionStore interface {
+	// CreateSubscription stores a subscription and returns it with its
+	// assigned id and creation time.
+	CreateSubscription(ctx context.Context, sub subscription) (subscription, error)
+	ListSubscriptions(ctx context.Context) ([]subscription, error)
+	// FindSubscriptions returns up to filter.Limit subscriptions matching
+	// the filter with ids after filter.After, in id order.
+	FindSubscriptions(ctx context.Context, filter subscriptionFilter) ([]subscription, error)
+	GetSubscription(ctx context.Context, id int) (subscription, error)
+	// SnoozeSubscription mutes a subscription until the given time, or
+	// unmutes it when until is nil.
+	SnoozeSubscription(ctx context.Context, id int, until *time.Time) (subscription, error)
+	// SubscriptionTimezones returns the distinct timezones of every
+	// subscription.
+	SubscriptionTimezones(ctx context.Context) ([]string, error)
+}
+
+// NotificationStore persists notifications. Creating, requeueing, or
+// releasing a pending notification notifies notificationsChannel, while
+// scheduled notifications wait to be released. The delivery failures of a
+// notification are the subscriptions it has yet to reach.
+type NotificationStore interface {
+	// CreateNotification stores a notification and returns the id it was
+	// assigned.
+	CreateNotification(ctx context.Context, n notification) (int, error)
+	// ListNotifications returns the notifications matching the filter, in
+	// id order.
+	ListNotifications(ctx context.Context, filter notificationListFilter) ([]notification, error)
+	// GetNotification returns errNotFound when there is no such
+	// notification.
+	GetNotification(ctx context.Context, id int) (notification, error)
+	SetNotificationStatus(ctx context.Context, id int, status string) error
+	FailNotification(ctx context.Context, id int, cause error) error
+	RequeueNotifications(ctx context.Context, filter notificationFilter) (int64, error)
+	PurgeNotifications(ctx context.Context, before time.Time) (int64, error)
+	ListDeliveryFailures(ctx context.Context, id int) ([]deliveryFailure, error)
+	SetDeliveryFailures(ctx context.Context, id int, failures []deliveryFailure) error
+	RecordDeliveries(ctx context.Context, id int, deliveries []delivery) error
+	ListDeliveries(ctx context.Context, id int) ([]delivery, error)
+	// NotificationTargets returns the endpoints a targeted notification is
+	// limited to.
+	NotificationTargets(ctx context.Context, id int) ([]string, error)
+	// ScheduledNotifications returns the notifications scheduled at a local
+	// time that have yet to be expanded into timezone waves.
+	ScheduledNotifications(ctx context.Context) ([]notification, error)
+	// ExpandNotification stores the waves of a notification scheduled at a
+	// local time and marks it expanded.
+	ExpandNotification(ctx context.Context, id int, waves []notification) error
+	// DeferNotification schedules a notification to run again at the given
+	// time.
+	DeferNotification(ctx context.Context, id int, at time.Time) error
+	// ReleaseNotifications queues every scheduled notification due by now.
+	ReleaseNotifications(ctx context.Context, now time.Time) (int64, error)
+	// CountFailedNotifications counts the notifications that failed since
+	// the given time.
+	CountFailedNotifications(ctx context.Context, since time.Time) (int64, error)
+}
+
+// TemplateStore persists notification templates.
+type TemplateStore interface {
+	CreateTemplate(ctx context.Context, t notificationTemplate) (notificationTemplate, error)
+	ListTemplates(ctx context.Context) ([]notificationTemplate, error)
+	GetTemplate(ctx context.Context, id int) (notificationTemplate, error)
+	UpdateTemplate(ctx context.Context, t notificationTemplate) (notificationTemplate, error)
+	DeleteTemplate(ctx context.Context, id int) error
+}
+
+// VAPIDKeyStore persists the VAPID keypairs pushes are signed with.
+type VAPIDKeyStore interface {
+	// CreateVAPIDKey stores a keypair, doing nothing if its public key is
+	// already stored.
+	CreateVAPIDKey(ctx context.Context, k vapidKey) error
+	// ListVAPIDKeys returns every stored keypair, oldest first.
+	ListVAPIDKeys(ctx context.Context) ([]vapidKey, error)
+}
+
+// FlagStore persists feature flags.
+type FlagStore interface {
+	ListFlags(ctx context.Context) ([]featureFlag, error)
+	// SetFlag stores a flag, replacing the one with the same name.
+	SetFlag(ctx context.Context, f featureFlag) (featureFlag, error)
+	DeleteFlag(ctx context.Context, name string) error
+}
+
+// ScheduleStore persists recurring schedules.
+type ScheduleStore interface {
+	CreateSchedule(ctx context.Context, s schedule) (schedule, error)
+	ListSchedules(ctx context.Context) ([]schedule, error)
+	DeleteSchedule(ctx context.Context, id int) error
+	// DueSchedules returns the schedules whose next run is due by now.
+	DueSchedules(ctx context.Context, now time.Time) ([]schedule, error)
+	// SetScheduleNextRun sets when a schedule next runs, nil once it has no
+	// occurrences left.
+	SetScheduleNextRun(ctx context.Context, id int, next *time.Time) error
+}
+
+// taskClaimer claims pending tasks without waiting for a notification.
+// Stores shared between instances implement it so concurrent claimers each
+// get a different task.
+type taskClaimer interface {
+	// ClaimTask leases the most urgent task until the given time, moving it
+	// to processing, and returns it, reporting false when there is none.
+	// Tasks pending since before the given time, and processing tasks whose
+	// lease expired, can be claimed.
+	ClaimTask(ctx context.Context, before, until time.Time) (task, bool, error)
+}
+
+// unwrapStore returns the innermost store beneath any wrappers, so optional
+// capabilities of the backing store can be detected.
+func unwrapStore(store Store) Store {
+	for {
+		wrapper, ok := store.(interface{ Unwrap() Store })
+		if !ok {
+			return store
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+// Listener receives notifications published on a single channel.
+type Listener interface {
+	// WaitForNotification blocks until a notification arrives or the context
+	// is cancelled.
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+	// Ping checks the listener's connection is still alive.
+	Ping(ctx context.Context) error
+	// Close stops listening and releases any held resources.
+	Close()
+}
+
+// notificationFilter selects failed notifications. Empty fields match every
+// failed notification.
+type notificationFilter struct {
+	FailedAfter   *time.Time `json:"failed_after"`
+	ErrorContains string     `json:"error_contains"`
+}
+
+// notificationListFilter selects notifications to list. Empty fields match
+// every notification.
+type notificationListFilter struct {
+	Status string
+	// CreatedAfter and CreatedBefore bound when the notification was
+	// created, CreatedBefore exclusive.
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// matches reports whether a notification passes the filter.
+func (f notificationListFilter) matches(n notification) bool {
+	return (f.Status == "" || n.Status == f.Status) &&
+		(f.CreatedAfter == nil || !n.Created.Before(*f.CreatedAfter)) &&
+		(f.CreatedBefore == nil || n.Created.Before(*f.CreatedBefore))
+}
+
+// backfillFilter selects the work in a status to backfill. Empty fields
+// match everything in the status. Type only applies to tasks.
+type backfillFilter struct {
+	Status string
+	Type   string
+	// Since and Until bound when the work was created, Until exclusive.
+	Since *time.Time
+	Until *time.Time
+}
+
+// taskFilter selects failed tasks. Empty fields match every failed task.
+type taskFilter struct {
+	Type          string     `json:"type"`
+	FailedAfter   *time.Time `json:"failed_after"`
+	ErrorContains string     `json:"error_contains"`
+}
+
+// subscriptionFilter selects a page of subscriptions. Empty fields match
+// every subscription.
+type subscriptionFilter struct {
+	Tag    string
+	Origin string
+	// CreatedAfter and CreatedBefore bound when the subscription was
+	// created, CreatedBefore exclusive.
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// After is the id the page starts after, and Limit its size.
+	After int
+	Limit int
+}
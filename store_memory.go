@@ -0,0 +1,1276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// memoryStore is a Store that keeps everything in process memory. It mirrors
+// the Postgres triggers by publishing to listeners whenever work is queued,
+// so the API and workers run without a database.
+type memoryStore struct {
+	mu            sync.Mutex
+	tasks         map[string]task
+	subscriptions []memorySubscription
+	notifications []notification
+	statuses      map[int]string
+	failures      map[int][]deliveryFailure
+	deliveries    map[int][]delivery
+	targets       map[int][]string
+	templates     map[int]notificationTemplate
+	schedules     map[int]schedule
+	vapidKeys     []vapidKey
+	flags         map[string]featureFlag
+	taskEvents    []taskEvent
+	listeners     map[string][]*memoryListener
+
+	// Sequences mirroring the SERIAL id columns
+	subscriptionSeq int
+	notificationSeq int
+	templateSeq     int
+	scheduleSeq     int
+	vapidKeySeq     int
+	taskEventSeq    int64
+}
+
+// memorySubscription is a subscription with its assigned id.
+type memorySubscription struct {
+	id  int
+	sub subscription
+}
+
+var _ Store = (*memoryStore)(nil)
+
+// newMemoryStore creates an empty in-memory Store.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tasks:      map[string]task{},
+		statuses:   map[int]string{},
+		failures:   map[int][]deliveryFailure{},
+		deliveries: map[int][]delivery{},
+		targets:    map[int][]string{},
+		templates:  map[int]notificationTemplate{},
+		schedules:  map[int]schedule{},
+		flags:      map[string]featureFlag{},
+		listeners:  map[string][]*memoryListener{},
+	}
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Listen(ctx context.Context, channel string) (Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := &memoryListener{
+		store:         s,
+		channel:       channel,
+		notifications: make(chan *pgconn.Notification, 1024),
+	}
+	s.listeners[channel] = append(s.listeners[channel], l)
+	return l, nil
+}
+
+// publish delivers a payload to every listener on the channel. It must be
+// called without holding the store's lock.
+func (s *memoryStore) publish(channel string, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	listeners := append([]*memoryListener(nil), s.listeners[channel]...)
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		l.notifications <- &pgconn.Notification{Channel: channel, Payload: string(payload)}
+	}
+}
+
+// recordTaskEvent appends a status transition attributed to the actor in the
+// context. The caller must hold the store's lock.
+func (s *memoryStore) recordTaskEvent(ctx context.Context, id string, from *string, to string) {
+	a := actorFromContext(ctx)
+	e := taskEvent{TaskID: id, To: to, Actor: a.Name, Created: time.Now()}
+	if from != nil {
+		// Copy so later updates to the task don't rewrite history
+		status := *from
+		e.From = &status
+	}
+	if a.WorkerID != "" {
+		e.WorkerID = &a.WorkerID
+	}
+	s.taskEventSeq++
+	e.ID = s.taskEventSeq
+	s.taskEvents = append(s.taskEvents, e)
+}
+
+func (s *memoryStore) Backlog(ctx context.Context, channel string) ([]string, error) {
+	s.mu.Lock()
+	var pending []any
+	switch channel {
+	case tasksChannel:
+		var tasks []task
+		for _, t := range s.tasks {
+			if t.Status == "pending" {
+				tasks = append(tasks, t)
+			}
+		}
+		sortBacklog(tasks)
+		for _, t := range tasks {
+			pending = append(pending, t)
+		}
+	case notificationsChannel:
+		for _, n := range s.notifications {
+			if s.statuses[n.ID] == "pending" {
+				pending = append(pending, n)
+			}
+		}
+	default:
+		s.mu.Unlock()
+		return nil, fmt.Errorf("unknown channel %q", channel)
+	}
+	s.mu.Unlock()
+
+	var payloads []string
+	for _, v := range pending {
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, string(payload))
+	}
+	return payloads, nil
+}
+
+// backfillMatches reports whether work in the status, created at the time,
+// is selected by the filter.
+func backfillMatches(filter backfillFilter, status string, created time.Time) bool {
+	return status == filter.Status &&
+		(filter.Since == nil || !created.Before(*filter.Since)) &&
+		(filter.Until == nil || created.Before(*filter.Until))
+}
+
+// backfillTasks returns the tasks matching the filter, most urgent first.
+// The caller must hold the store's lock.
+func (s *memoryStore) backfillTasks(filter backfillFilter) []task {
+	var tasks []task
+	for _, t := range s.tasks {
+		if backfillMatches(filter, t.Status, t.Created) && (filter.Type == "" || t.Type == filter.Type) {
+			tasks = append(tasks, t)
+		}
+	}
+	sortBacklog(tasks)
+	return tasks
+}
+
+// backfillNotifications returns the notifications matching the filter, in
+// creation order. The caller must hold the store's lock.
+func (s *memoryStore) backfillNotifications(filter backfillFilter) []notification {
+	if filter.Type != "" {
+		return nil
+	}
+	var notifications []notification
+	for _, n := range s.notifications {
+		if backfillMatches(filter, s.statuses[n.ID], n.Created) {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications
+}
+
+func (s *memoryStore) Backfill(ctx context.Context, channel string, filter backfillFilter) ([]string, error) {
+	s.mu.Lock()
+	var matched []any
+	switch channel {
+	case tasksChannel:
+		for _, t := range s.backfillTasks(filter) {
+			matched = append(matched, t)
+		}
+	case notificationsChannel:
+		for _, n := range s.backfillNotifications(filter) {
+			matched = append(matched, n)
+		}
+	default:
+		s.mu.Unlock()
+		return nil, fmt.Errorf("unknown channel %q", channel)
+	}
+	s.mu.Unlock()
+
+	var payloads []string
+	for _, v := range matched {
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, string(payload))
+	}
+	return payloads, nil
+}
+
+func (s *memoryStore) Renotify(ctx context.Context, channel string, filter backfillFilter) (int64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	var renotified []any
+	switch channel {
+	case tasksChannel:
+		for _, t := range s.backfillTasks(filter) {
+			s.recordTaskEvent(ctx, t.ID, &t.Status, "pending")
+			t.Status, t.LastError, t.FailedAt, t.Updated = "pending", nil, nil, now
+			s.tasks[t.ID] = t
+			renotified = append(renotified, t)
+		}
+	case notificationsChannel:
+		for _, n := range s.backfillNotifications(filter) {
+			n.LastError, n.FailedAt, n.Updated = nil, nil, now
+			for i := range s.notifications {
+				if s.notifications[i].ID == n.ID {
+					s.notifications[i] = n
+				}
+			}
+			s.statuses[n.ID] = "pending"
+			renotified = append(renotified, n)
+		}
+	default:
+		s.mu.Unlock()
+		return 0, fmt.Errorf("unknown channel %q", channel)
+	}
+	s.mu.Unlock()
+
+	for _, v := range renotified {
+		s.publish(channel, v)
+	}
+	return int64(len(renotified)), nil
+}
+
+// sortBacklog orders tasks most urgent first: highest priority, then oldest.
+func sortBacklog(tasks []task) {
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].Priority != tasks[j].Priority {
+			return tasks[i].Priority > tasks[j].Priority
+		}
+		return tasks[i].Created.Before(tasks[j].Created)
+	})
+}
+
+func (s *memoryStore) CreateTask(ctx context.Context, t task) error {
+	if t.Status == "pending" && t.RunAt != nil && t.RunAt.After(time.Now()) {
+		t.Status = "scheduled"
+	}
+
+	s.mu.Lock()
+	if t.DedupKey != "" {
+		for _, existing := range s.tasks {
+			if existing.DedupKey == t.DedupKey && existing.DedupUntil != nil && existing.DedupUntil.After(t.Created) {
+				s.mu.Unlock()
+				return &duplicateTaskError{ID: existing.ID}
+			}
+		}
+	}
+	s.tasks[t.ID] = t
+	s.recordTaskEvent(ctx, t.ID, nil, t.Status)
+	s.mu.Unlock()
+
+	if t.Status == "pending" {
+		s.publish(tasksChannel, t)
+	}
+	return nil
+}
+
+func (s *memoryStore) DebounceTask(ctx context.Context, t task) (string, error) {
+	s.mu.Lock()
+	for id, existing := range s.tasks {
+		if existing.Status == "scheduled" && existing.Type == t.Type && existing.Tenant == t.Tenant && existing.DebounceKey == t.DebounceKey {
+			existing.Payload, existing.RunAt, existing.Updated = t.Payload, t.RunAt, t.Updated
+			s.tasks[id] = existing
+			s.mu.Unlock()
+			return id, nil
+		}
+	}
+	s.mu.Unlock()
+	return t.ID, s.CreateTask(ctx, t)
+}
+
+func (s *memoryStore) NextTaskDue(ctx context.Context) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next *time.Time
+	for _, t := range s.tasks {
+		if t.Status == "scheduled" && t.RunAt != nil && (next == nil || t.RunAt.Before(*next)) {
+			runAt := *t.RunAt
+			next = &runAt
+		}
+	}
+	return next, nil
+}
+
+func (s *memoryStore) ReleaseTasks(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	var released []task
+	for id, t := range s.tasks {
+		if t.Status != "scheduled" || t.RunAt == nil || t.RunAt.After(now) {
+			continue
+		}
+		s.recordTaskEvent(ctx, id, &t.Status, "pending")
+		t.Status, t.Updated = "pending", now
+		s.tasks[id] = t
+		released = append(released, t)
+	}
+	s.mu.Unlock()
+
+	sortBacklog(released)
+	for _, t := range released {
+		s.publish(tasksChannel, t)
+	}
+	return int64(len(released)), nil
+}
+
+func (s *memoryStore) ListTasks(ctx context.Context) ([]task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tasks []task
+	for _, t := range s.tasks {
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Created.Before(tasks[j].Created) })
+	return tasks, nil
+}
+
+func (s *memoryStore) GetTask(ctx context.Context, id string) (task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok {
+		return task{}, errNotFound
+	}
+	return t, nil
+}
+
+func (s *memoryStore) SetTaskStatus(ctx context.Context, id string, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tasks[id]; ok && t.Status != "cancelled" {
+		s.recordTaskEvent(ctx, id, &t.Status, status)
+		t.Status, t.Updated = status, time.Now()
+		s.tasks[id] = t
+	}
+	return nil
+}
+
+func (s *memoryStore) LeaseTask(ctx context.Context, id string, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	t, ok := s.tasks[id]
+	expired := t.Status == "processing" && t.LockedUntil != nil && t.LockedUntil.Before(now)
+	if !ok || (t.Status != "pending" && !expired) {
+		return false, nil
+	}
+	s.recordTaskEvent(ctx, id, &t.Status, "processing")
+	t.Status, t.Updated = "processing", now
+	t.Attempts++
+	if worker := actorFromContext(ctx).WorkerID; worker != "" {
+		t.ProcessedBy = worker
+	}
+	t.ClaimedBy, t.ClaimedAt = instanceID(), &t.Updated
+	t.LockedBy, t.LockedUntil = instanceID(), &until
+	t.Progress, t.ProgressMessage = 0, ""
+	s.tasks[id] = t
+	return true, nil
+}
+
+func (s *memoryStore) FailTask(ctx context.Context, id string, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tasks[id]; ok && t.Status != "cancelled" {
+		s.recordTaskEvent(ctx, id, &t.Status, "failed")
+		msg, now := cause.Error(), time.Now()
+		t.Status, t.LastError, t.FailedAt, t.Updated = "failed", &msg, &now, now
+		s.tasks[id] = t
+	}
+	return nil
+}
+
+func (s *memoryStore) TimeOutTask(ctx context.Context, id string, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tasks[id]; ok && t.Status != "cancelled" {
+		s.recordTaskEvent(ctx, id, &t.Status, "timed_out")
+		msg := cause.Error()
+		t.Status, t.LastError, t.Updated = "timed_out", &msg, time.Now()
+		s.tasks[id] = t
+	}
+	return nil
+}
+
+func (s *memoryStore) RenewLease(ctx context.Context, id string, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok || t.Status != "processing" || t.LockedBy != instanceID() {
+		return false, nil
+	}
+	t.LockedUntil = &until
+	s.tasks[id] = t
+	return true, nil
+}
+
+func (s *memoryStore) SetTaskProgress(ctx context.Context, id string, percent int, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tasks[id]; ok && t.Status == "processing" && t.LockedBy == instanceID() {
+		t.Progress, t.ProgressMessage = percent, message
+		s.tasks[id] = t
+	}
+	return nil
+}
+
+func (s *memoryStore) CancelTask(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok {
+		return errNotFound
+	}
+	if !slices.Contains(cancellableStatuses, t.Status) {
+		return errTaskFinished
+	}
+	s.recordTaskEvent(ctx, id, &t.Status, "cancelled")
+	t.Status, t.Updated = "cancelled", time.Now()
+	t.LockedBy, t.LockedUntil = "", nil
+	s.tasks[id] = t
+	return nil
+}
+
+func (s *memoryStore) RetryTask(ctx context.Context, id string, runAt time.Time, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tasks[id]; ok && t.Status != "cancelled" {
+		s.recordTaskEvent(ctx, id, &t.Status, "scheduled")
+		msg := cause.Error()
+		t.Status, t.RunAt, t.LastError, t.Updated = "scheduled", &runAt, &msg, time.Now()
+		s.tasks[id] = t
+	}
+	return nil
+}
+
+func (s *memoryStore) RequeueTasks(ctx context.Context, filter taskFilter) (int64, error) {
+	s.mu.Lock()
+	var requeued []task
+	for id, t := range s.tasks {
+		if t.Status != "failed" ||
+			(filter.Type != "" && t.Type != filter.Type) ||
+			(filter.FailedAfter != nil && (t.FailedAt == nil || t.FailedAt.Before(*filter.FailedAfter))) ||
+			(filter.ErrorContains != "" && (t.LastError == nil ||
+				!strings.Contains(strings.ToLower(*t.LastError), strings.ToLower(filter.ErrorContains)))) {
+			continue
+		}
+		s.recordTaskEvent(ctx, id, &t.Status, "pending")
+		t.Status, t.Attempts, t.LastError, t.FailedAt, t.Updated = "pending", 0, nil, nil, time.Now()
+		s.tasks[id] = t
+		requeued = append(requeued, t)
+	}
+	s.mu.Unlock()
+
+	sortBacklog(requeued)
+	for _, t := range requeued {
+		s.publish(tasksChannel, t)
+	}
+	return int64(len(requeued)), nil
+}
+
+func (s *memoryStore) ReapTasks(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	var reaped []task
+	now := time.Now()
+	for id, t := range s.tasks {
+		if t.Status != "processing" || !t.Updated.Before(before) || (t.LockedUntil != nil && !t.LockedUntil.Before(now)) {
+			continue
+		}
+		s.recordTaskEvent(ctx, id, &t.Status, "pending")
+		t.Status, t.Updated = "pending", time.Now()
+		s.tasks[id] = t
+		reaped = append(reaped, t)
+	}
+	s.mu.Unlock()
+
+	sortBacklog(reaped)
+	for _, t := range reaped {
+		s.publish(tasksChannel, t)
+	}
+	return int64(len(reaped)), nil
+}
+
+func (s *memoryStore) ReturnTasks(ctx context.Context, instance string) (int64, error) {
+	s.mu.Lock()
+	var returned []task
+	for id, t := range s.tasks {
+		if t.Status != "processing" || t.LockedBy != instance {
+			continue
+		}
+		s.recordTaskEvent(ctx, id, &t.Status, "pending")
+		t.Status, t.Updated, t.LockedBy, t.LockedUntil = "pending", time.Now(), "", nil
+		s.tasks[id] = t
+		returned = append(returned, t)
+	}
+	s.mu.Unlock()
+
+	sortBacklog(returned)
+	for _, t := range returned {
+		s.publish(tasksChannel, t)
+	}
+	return int64(len(returned)), nil
+}
+
+func (s *memoryStore) BreachTasks(ctx context.Context, taskType string, before time.Time, bump int) ([]task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var breached []task
+	for id, t := range s.tasks {
+		if t.Type != taskType || t.SLABreachedAt != nil || !taskReady(t).Before(before) {
+			continue
+		}
+		if t.Status != "pending" && t.Status != "scheduled" && t.Status != "processing" {
+			continue
+		}
+		t.SLABreachedAt = &now
+		t.Priority += bump
+		s.tasks[id] = t
+		breached = append(breached, t)
+	}
+	return breached, nil
+}
+
+func (s *memoryStore) CountFailedTasks(ctx context.Context, since time.Time) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := map[string]int64{}
+	for _, t := range s.tasks {
+		if t.Status == "failed" && t.FailedAt != nil && !t.FailedAt.Before(since) {
+			counts[t.Type]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *memoryStore) PurgeTasks(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, t := range s.tasks {
+		if t.Status == "completed" && t.Updated.Before(before) {
+			delete(s.tasks, id)
+			deleted++
+		}
+	}
+
+	// Cascade to the purged tasks' events
+	kept := s.taskEvents[:0]
+	for _, e := range s.taskEvents {
+		if _, ok := s.tasks[e.TaskID]; ok {
+			kept = append(kept, e)
+		}
+	}
+	s.taskEvents = kept
+	return deleted, nil
+}
+
+func (s *memoryStore) ListTaskEvents(ctx context.Context, id string) ([]taskEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[id]; !ok {
+		return nil, errNotFound
+	}
+
+	events := []taskEvent{}
+	for _, e := range s.taskEvents {
+		if e.TaskID == id {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStore) DeleteUserData(ctx context.Context, userID string) (userDataReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := userDataReport{UserID: userID}
+
+	endpoints := map[string]bool{}
+	keptSubs := s.subscriptions[:0]
+	for _, ms := range s.subscriptions {
+		if ms.sub.UserID == userID {
+			endpoints[ms.sub.Endpoint] = true
+			report.Subscriptions++
+			continue
+		}
+		keptSubs = append(keptSubs, ms)
+	}
+	s.subscriptions = keptSubs
+
+	for id, deliveries := range s.deliveries {
+		kept := deliveries[:0]
+		for _, d := range deliveries {
+			if endpoints[d.Endpoint] {
+				report.Deliveries++
+				continue
+			}
+			kept = append(kept, d)
+		}
+		s.deliveries[id] = kept
+	}
+	for id, failures := range s.failures {
+		kept := failures[:0]
+		for _, f := range failures {
+			if endpoints[f.Endpoint] {
+				report.Failures++
+				continue
+			}
+			kept = append(kept, f)
+		}
+		s.failures[id] = kept
+	}
+	for id, targets := range s.targets {
+		kept := targets[:0]
+		for _, endpoint := range targets {
+			if endpoints[endpoint] {
+				report.Targets++
+				continue
+			}
+			kept = append(kept, endpoint)
+		}
+		s.targets[id] = kept
+	}
+
+	keptNots := s.notifications[:0]
+	for _, n := range s.notifications {
+		if n.Endpoint != "" && endpoints[n.Endpoint] {
+			delete(s.statuses, n.ID)
+			delete(s.failures, n.ID)
+			delete(s.deliveries, n.ID)
+			delete(s.targets, n.ID)
+			report.Notifications++
+			continue
+		}
+		keptNots = append(keptNots, n)
+	}
+	s.notifications = keptNots
+
+	for id, t := range s.tasks {
+		if payloadUserID(t.Payload) == userID {
+			delete(s.tasks, id)
+			report.Tasks++
+		}
+	}
+
+	// Cascade to the deleted tasks' events
+	kept := s.taskEvents[:0]
+	for _, e := range s.taskEvents {
+		if _, ok := s.tasks[e.TaskID]; ok {
+			kept = append(kept, e)
+		}
+	}
+	s.taskEvents = kept
+
+	report.Completed = time.Now()
+	return report, nil
+}
+
+// payloadUserID returns the user_id a task payload references, if any.
+func payloadUserID(payload any) string {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	var ref struct {
+		UserID string `json:"user_id"`
+	}
+	json.Unmarshal(data, &ref)
+	return ref.UserID
+}
+
+func (s *memoryStore) CreateSubscription(ctx context.Context, sub subscription) (subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscriptionSeq++
+	sub.ID = s.subscriptionSeq
+	sub.Created = time.Now()
+	s.subscriptions = append(s.subscriptions, memorySubscription{id: s.subscriptionSeq, sub: sub})
+	return sub, nil
+}
+
+func (s *memoryStore) ListSubscriptions(ctx context.Context) ([]subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var subs []subscription
+	for _, ms := range s.subscriptions {
+		subs = append(subs, ms.sub)
+	}
+	return subs, nil
+}
+
+func (s *memoryStore) FindSubscriptions(ctx context.Context, filter subscriptionFilter) ([]subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := []subscription{}
+	for _, ms := range s.subscriptions {
+		if len(subs) == filter.Limit {
+			break
+		}
+		if ms.id > filter.After && filter.matches(ms.sub) {
+			subs = append(subs, ms.sub)
+		}
+	}
+	return subs, nil
+}
+
+func (s *memoryStore) GetSubscription(ctx context.Context, id int) (subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ms := range s.subscriptions {
+		if ms.id == id {
+			return ms.sub, nil
+		}
+	}
+	return subscription{}, errNotFound
+}
+
+func (s *memoryStore) SnoozeSubscription(ctx context.Context, id int, until *time.Time) (subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.subscriptions {
+		if s.subscriptions[i].id == id {
+			s.subscriptions[i].sub.SnoozedUntil = until
+			return s.subscriptions[i].sub, nil
+		}
+	}
+	return subscription{}, errNotFound
+}
+
+func (s *memoryStore) SubscriptionTimezones(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	var timezones []string
+	for _, ms := range s.subscriptions {
+		if !seen[ms.sub.Timezone] {
+			seen[ms.sub.Timezone] = true
+			timezones = append(timezones, ms.sub.Timezone)
+		}
+	}
+	sort.Strings(timezones)
+	return timezones, nil
+}
+
+func (s *memoryStore) CreateTemplate(ctx context.Context, t notificationTemplate) (notificationTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.templateSeq++
+	t.ID = s.templateSeq
+	s.templates[t.ID] = t
+	return t, nil
+}
+
+func (s *memoryStore) ListTemplates(ctx context.Context) ([]notificationTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	templates := []notificationTemplate{}
+	for _, t := range s.templates {
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].ID < templates[j].ID })
+	return templates, nil
+}
+
+func (s *memoryStore) GetTemplate(ctx context.Context, id int) (notificationTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.templates[id]
+	if !ok {
+		return t, errNotFound
+	}
+	return t, nil
+}
+
+func (s *memoryStore) UpdateTemplate(ctx context.Context, t notificationTemplate) (notificationTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.templates[t.ID]
+	if !ok {
+		return t, errNotFound
+	}
+	t.Created = existing.Created
+	s.templates[t.ID] = t
+	return t, nil
+}
+
+func (s *memoryStore) DeleteTemplate(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.templates[id]; !ok {
+		return errNotFound
+	}
+	delete(s.templates, id)
+	return nil
+}
+
+func (s *memoryStore) ListFlags(ctx context.Context) ([]featureFlag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flags := []featureFlag{}
+	for _, f := range s.flags {
+		flags = append(flags, f)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags, nil
+}
+
+func (s *memoryStore) SetFlag(ctx context.Context, f featureFlag) (featureFlag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	f.Updated = &now
+	s.flags[f.Name] = f
+	return f, nil
+}
+
+func (s *memoryStore) DeleteFlag(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.flags[name]; !ok {
+		return errNotFound
+	}
+	delete(s.flags, name)
+	return nil
+}
+
+func (s *memoryStore) CreateVAPIDKey(ctx context.Context, k vapidKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.vapidKeys {
+		if existing.PublicKey == k.PublicKey {
+			return nil
+		}
+	}
+	s.vapidKeySeq++
+	k.ID = s.vapidKeySeq
+	s.vapidKeys = append(s.vapidKeys, k)
+	return nil
+}
+
+func (s *memoryStore) ListVAPIDKeys(ctx context.Context) ([]vapidKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := append([]vapidKey{}, s.vapidKeys...)
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys, nil
+}
+
+func (s *memoryStore) CreateSchedule(ctx context.Context, sc schedule) (schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scheduleSeq++
+	sc.ID = s.scheduleSeq
+	s.schedules[sc.ID] = sc
+	return sc, nil
+}
+
+func (s *memoryStore) ListSchedules(ctx context.Context) ([]schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules := []schedule{}
+	for _, sc := range s.schedules {
+		schedules = append(schedules, sc)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return schedules, nil
+}
+
+func (s *memoryStore) DeleteSchedule(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[id]; !ok {
+		return errNotFound
+	}
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *memoryStore) DueSchedules(ctx context.Context, now time.Time) ([]schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []schedule
+	for _, sc := range s.schedules {
+		if sc.NextRun != nil && !sc.NextRun.After(now) {
+			due = append(due, sc)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRun.Before(*due[j].NextRun) })
+	return due, nil
+}
+
+func (s *memoryStore) SetScheduleNextRun(ctx context.Context, id int, next *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sc, ok := s.schedules[id]; ok {
+		sc.NextRun, sc.Updated = next, time.Now()
+		s.schedules[id] = sc
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateNotification(ctx context.Context, n notification) (int, error) {
+	s.mu.Lock()
+	s.notificationSeq++
+	n.ID = s.notificationSeq
+	if len(n.Targets) > 0 {
+		s.targets[n.ID] = append([]string(nil), n.Targets...)
+		n.Targets, n.Targeted = nil, true
+	}
+	s.notifications = append(s.notifications, n)
+	status := initialStatus(n)
+	s.statuses[n.ID] = status
+	s.mu.Unlock()
+
+	if status == "pending" {
+		s.publish(notificationsChannel, n)
+	}
+	return n.ID, nil
+}
+
+func (s *memoryStore) ListNotifications(ctx context.Context, filter notificationListFilter) ([]notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notifications := []notification{}
+	for _, n := range s.notifications {
+		n.Status = s.statuses[n.ID]
+		if filter.matches(n) {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications, nil
+}
+
+func (s *memoryStore) GetNotification(ctx context.Context, id int) (notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, n := range s.notifications {
+		if n.ID == id {
+			n.Status = s.statuses[id]
+			return n, nil
+		}
+	}
+	return notification{}, errNotFound
+}
+
+func (s *memoryStore) SetNotificationStatus(ctx context.Context, id int, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.statuses[id]; ok {
+		s.statuses[id] = status
+		s.touchNotification(id)
+		if status == "processing" {
+			worker, now := actorFromContext(ctx).WorkerID, time.Now()
+			for i := range s.notifications {
+				if s.notifications[i].ID == id {
+					if worker != "" {
+						s.notifications[i].ProcessedBy = worker
+					}
+					s.notifications[i].ClaimedBy, s.notifications[i].ClaimedAt = instanceID(), &now
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) FailNotification(ctx context.Context, id int, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.notifications {
+		if s.notifications[i].ID == id {
+			msg, now := cause.Error(), time.Now()
+			s.notifications[i].LastError, s.notifications[i].FailedAt = &msg, &now
+			s.statuses[id] = "failed"
+			s.notifications[i].Updated = now
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ScheduledNotifications(ctx context.Context) ([]notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var nots []notification
+	for _, n := range s.notifications {
+		if s.statuses[n.ID] == "scheduled" && n.LocalTime != "" {
+			nots = append(nots, n)
+		}
+	}
+	return nots, nil
+}
+
+func (s *memoryStore) ExpandNotification(ctx context.Context, id int, waves []notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only the first expansion of a notification wins
+	if s.statuses[id] != "scheduled" {
+		return nil
+	}
+	s.statuses[id] = "expanded"
+	s.touchNotification(id)
+
+	for _, n := range waves {
+		s.notificationSeq++
+		n.ID = s.notificationSeq
+		s.notifications = append(s.notifications, n)
+		s.statuses[n.ID] = "scheduled"
+	}
+	return nil
+}
+
+func (s *memoryStore) DeferNotification(ctx context.Context, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.notifications {
+		if s.notifications[i].ID == id {
+			s.notifications[i].SendAt = &at
+			s.notifications[i].Updated = time.Now()
+			s.statuses[id] = "scheduled"
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ReleaseNotifications(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	var released []notification
+	for i, n := range s.notifications {
+		if s.statuses[n.ID] != "scheduled" || n.SendAt == nil || n.SendAt.After(now) {
+			continue
+		}
+		n.Updated = now
+		s.notifications[i] = n
+		s.statuses[n.ID] = "pending"
+		released = append(released, n)
+	}
+	s.mu.Unlock()
+
+	for _, n := range released {
+		s.publish(notificationsChannel, n)
+	}
+	return int64(len(released)), nil
+}
+
+func (s *memoryStore) RequeueNotifications(ctx context.Context, filter notificationFilter) (int64, error) {
+	s.mu.Lock()
+	var requeued []notification
+	for i, n := range s.notifications {
+		if s.statuses[n.ID] != "failed" ||
+			(filter.FailedAfter != nil && (n.FailedAt == nil || n.FailedAt.Before(*filter.FailedAfter))) ||
+			(filter.ErrorContains != "" && (n.LastError == nil ||
+				!strings.Contains(strings.ToLower(*n.LastError), strings.ToLower(filter.ErrorContains)))) {
+			continue
+		}
+		n.LastError, n.FailedAt, n.Updated = nil, nil, time.Now()
+		s.notifications[i] = n
+		s.statuses[n.ID] = "pending"
+		requeued = append(requeued, n)
+	}
+	s.mu.Unlock()
+
+	for _, n := range requeued {
+		s.publish(notificationsChannel, n)
+	}
+	return int64(len(requeued)), nil
+}
+
+func (s *memoryStore) ListDeliveryFailures(ctx context.Context, id int) ([]deliveryFailure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.statuses[id]; !ok {
+		return nil, errNotFound
+	}
+	return append([]deliveryFailure{}, s.failures[id]...), nil
+}
+
+func (s *memoryStore) SetDeliveryFailures(ctx context.Context, id int, failures []deliveryFailure) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(failures) == 0 {
+		delete(s.failures, id)
+		return nil
+	}
+	s.failures[id] = append([]deliveryFailure(nil), failures...)
+	return nil
+}
+
+func (s *memoryStore) RecordDeliveries(ctx context.Context, id int, deliveries []delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Replace receipts for endpoints reached again by a replay
+	for _, d := range deliveries {
+		recorded := s.deliveries[id]
+		for i := range recorded {
+			if recorded[i].Endpoint == d.Endpoint {
+				recorded = append(recorded[:i], recorded[i+1:]...)
+				break
+			}
+		}
+		s.deliveries[id] = append(recorded, d)
+	}
+	return nil
+}
+
+func (s *memoryStore) NotificationTargets(ctx context.Context, id int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.targets[id]...), nil
+}
+
+func (s *memoryStore) ListDeliveries(ctx context.Context, id int) ([]delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.statuses[id]; !ok {
+		return nil, errNotFound
+	}
+	return append([]delivery{}, s.deliveries[id]...), nil
+}
+
+// touchNotification sets a notification's updated time to now. The caller
+// must hold the store's lock.
+func (s *memoryStore) touchNotification(id int) {
+	for i := range s.notifications {
+		if s.notifications[i].ID == id {
+			s.notifications[i].Updated = time.Now()
+		}
+	}
+}
+
+func (s *memoryStore) CountFailedNotifications(ctx context.Context, since time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int64
+	for _, n := range s.notifications {
+		if s.statuses[n.ID] == "failed" && n.FailedAt != nil && !n.FailedAt.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) PurgeNotifications(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.notifications[:0]
+	var deleted int64
+	for _, n := range s.notifications {
+		if s.statuses[n.ID] == "completed" && n.Updated.Before(before) {
+			delete(s.statuses, n.ID)
+			delete(s.failures, n.ID)
+			delete(s.deliveries, n.ID)
+			delete(s.targets, n.ID)
+			deleted++
+			continue
+		}
+		kept = append(kept, n)
+	}
+	s.notifications = kept
+	return deleted, nil
+}
+
+// memoryListener receives notifications published by a memoryStore.
+type memoryListener struct {
+	store         *memoryStore
+	channel       string
+	notifications chan *pgconn.Notification
+}
+
+func (l *memoryListener) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	select {
+	case n := <-l.notifications:
+		return n, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *memoryListener) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (l *memoryListener) Close() {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	listeners := l.store.listeners[l.channel]
+	for i, other := range listeners {
+		if other == l {
+			l.store.listeners[l.channel] = append(listeners[:i], listeners[i+1:]...)
+			return
+		}
+	}
+}
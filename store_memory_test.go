@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestTask returns a task of the test type in the status.
+func newTestTask(id, status string) task {
+	now := time.Now()
+	return task{ID: id, Type: "test", Payload: map[string]any{}, Status: status, Created: now, Updated: now}
+}
+
+// leasedTo returns the task leased to the instance until the time.
+func leasedTo(t task, instance string, until time.Time) task {
+	t.Status, t.LockedBy, t.LockedUntil = "processing", instance, &until
+	t.Attempts = 1
+	return t
+}
+
+func TestMemoryStoreLeaseTask(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	tests := []struct {
+		name         string
+		task         task
+		leased       bool
+		wantAttempts int
+	}{
+		{name: "pending", task: newTestTask("t", "pending"), leased: true, wantAttempts: 1},
+		{name: "held elsewhere", task: leasedTo(newTestTask("t", "pending"), "other", future)},
+		{name: "expired elsewhere", task: leasedTo(newTestTask("t", "pending"), "other", past), leased: true, wantAttempts: 2},
+		{name: "scheduled", task: newTestTask("t", "scheduled")},
+		{name: "completed", task: newTestTask("t", "completed")},
+		{name: "cancelled", task: newTestTask("t", "cancelled")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			store.tasks[tt.task.ID] = tt.task
+
+			until := time.Now().Add(time.Hour)
+			leased, err := store.LeaseTask(ctx, tt.task.ID, until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if leased != tt.leased {
+				t.Fatalf("LeaseTask = %v, want %v", leased, tt.leased)
+			}
+
+			got, err := store.GetTask(ctx, tt.task.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.leased {
+				if got.Status != tt.task.Status || got.LockedBy != tt.task.LockedBy {
+					t.Errorf("task = %s locked by %q, want it left %s locked by %q",
+						got.Status, got.LockedBy, tt.task.Status, tt.task.LockedBy)
+				}
+				return
+			}
+			if got.Status != "processing" || got.LockedBy != instanceID() || !got.LockedUntil.Equal(until) {
+				t.Errorf("task = %s locked by %q until %v, want processing locked by %q until %v",
+					got.Status, got.LockedBy, got.LockedUntil, instanceID(), until)
+			}
+			if got.Attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got.Attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreLeaseTaskOnce(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	store.tasks["t"] = newTestTask("t", "pending")
+
+	until := time.Now().Add(time.Hour)
+	if leased, err := store.LeaseTask(ctx, "t", until); err != nil || !leased {
+		t.Fatalf("first LeaseTask = %v, %v, want true", leased, err)
+	}
+	if leased, err := store.LeaseTask(ctx, "t", until); err != nil || leased {
+		t.Fatalf("second LeaseTask = %v, %v, want false while the lease is held", leased, err)
+	}
+}
+
+func TestMemoryStoreRenewLease(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	store.tasks["t"] = leasedTo(newTestTask("t", "pending"), instanceID(), time.Now().Add(time.Minute))
+
+	until := time.Now().Add(time.Hour)
+	renewed, err := store.RenewLease(ctx, "t", until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed {
+		t.Fatal("RenewLease = false, want true for the instance's own lease")
+	}
+	got, err := store.GetTask(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LockedUntil.Equal(until) {
+		t.Errorf("locked until %v, want %v", got.LockedUntil, until)
+	}
+}
+
+func TestMemoryStoreTakenOverLease(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	store.tasks["t"] = leasedTo(newTestTask("t", "pending"), "other", time.Now().Add(time.Minute))
+
+	renewed, err := store.RenewLease(ctx, "t", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed {
+		t.Error("RenewLease = true, want false for a lease held by another instance")
+	}
+}
+
+func TestMemoryStoreCancelTask(t *testing.T) {
+	tests := []struct {
+		status string
+		want   error
+	}{
+		{status: "pending"},
+		{status: "scheduled"},
+		{status: "processing"},
+		{status: "completed", want: errTaskFinished},
+		{status: "failed", want: errTaskFinished},
+		{status: "timed_out", want: errTaskFinished},
+		{status: "cancelled", want: errTaskFinished},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			tk := newTestTask("t", tt.status)
+			if tt.status == "processing" {
+				tk = leasedTo(tk, instanceID(), time.Now().Add(time.Minute))
+			}
+			store.tasks[tk.ID] = tk
+
+			err := store.CancelTask(ctx, tk.ID)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("CancelTask = %v, want %v", err, tt.want)
+			}
+
+			got, err := store.GetTask(ctx, tk.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil {
+				if got.Status != tt.status {
+					t.Errorf("status = %s, want it left %s", got.Status, tt.status)
+				}
+				return
+			}
+			if got.Status != "cancelled" || got.LockedBy != "" || got.LockedUntil != nil {
+				t.Errorf("task = %s locked by %q until %v, want cancelled and unlocked",
+					got.Status, got.LockedBy, got.LockedUntil)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreCancelTaskNotFound(t *testing.T) {
+	store := newMemoryStore()
+	if err := store.CancelTask(context.Background(), "missing"); !errors.Is(err, errNotFound) {
+		t.Fatalf("CancelTask = %v, want %v", err, errNotFound)
+	}
+}
+
+func TestMemoryStoreCancelledTaskStaysCancelled(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	store.tasks["t"] = leasedTo(newTestTask("t", "pending"), instanceID(), time.Now().Add(time.Minute))
+	if err := store.CancelTask(ctx, "t"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker finishing the task after it was cancelled leaves it cancelled
+	if err := store.SetTaskStatus(ctx, "t", "completed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FailTask(ctx, "t", errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetTask(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "cancelled" {
+		t.Errorf("status = %s, want cancelled", got.Status)
+	}
+}
+
+func TestMemoryStoreSetTaskProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		task task
+		want int
+	}{
+		{name: "leased here", task: leasedTo(newTestTask("t", "pending"), instanceID(), time.Now().Add(time.Minute)), want: 50},
+		{name: "leased elsewhere", task: leasedTo(newTestTask("t", "pending"), "other", time.Now().Add(time.Minute))},
+		{name: "pending", task: newTestTask("t", "pending")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			store.tasks[tt.task.ID] = tt.task
+
+			if err := store.SetTaskProgress(ctx, tt.task.ID, 50, "half way"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.GetTask(ctx, tt.task.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Progress != tt.want {
+				t.Errorf("progress = %d, want %d", got.Progress, tt.want)
+			}
+			if !got.Updated.Equal(tt.task.Updated) {
+				t.Errorf("updated = %v, want it left at %v", got.Updated, tt.task.Updated)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreReapTasks(t *testing.T) {
+	stale := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name   string
+		task   task
+		reaped bool
+	}{
+		{name: "renewed lease", task: leasedTo(newTestTask("t", "pending"), instanceID(), time.Now().Add(time.Minute))},
+		{name: "expired lease", task: leasedTo(newTestTask("t", "pending"), instanceID(), time.Now().Add(-time.Minute)), reaped: true},
+		{name: "unleased", task: newTestTask("t", "processing"), reaped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			tt.task.Updated = stale
+			store.tasks[tt.task.ID] = tt.task
+
+			n, err := store.ReapTasks(ctx, time.Now().Add(-time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.GetTask(ctx, tt.task.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "processing"
+			if tt.reaped {
+				want = "pending"
+			}
+			if (n == 1) != tt.reaped || got.Status != want {
+				t.Errorf("reaped %d, task %s, want it %s", n, got.Status, want)
+			}
+		})
+	}
+}
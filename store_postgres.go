@@ -0,0 +1,1432 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresStore is a Store backed by Postgres. New work is announced by the
+// NOTIFY triggers created in init.sql.
+type postgresStore struct {
+	pool *pgxpool.Pool
+
+	// rlsRole is the role tenant-scoped queries switch to, so the
+	// row-level security policies in init.sql apply. Empty disables it.
+	rlsRole string
+}
+
+var _ Store = (*postgresStore)(nil)
+
+// newPostgresStore creates a Store using the specified connection pool.
+// When rlsRole is set, queries made on behalf of a tenant run as that role.
+func newPostgresStore(pool *pgxpool.Pool, rlsRole string) *postgresStore {
+	return &postgresStore{pool: pool, rlsRole: rlsRole}
+}
+
+// pgQuerier is the query interface shared by the pool and transactions.
+type pgQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// scoped runs fn against the pool, or, when the context carries a tenant
+// and RLS is configured, inside a transaction that has switched to the RLS
+// role and set app.tenant, so Postgres itself hides other tenants' rows.
+func (s *postgresStore) scoped(ctx context.Context, fn func(q pgQuerier) error) error {
+	if _, ok := tenantFromContext(ctx); !ok || s.rlsRole == "" {
+		return fn(s.pool)
+	}
+	return s.scopedTx(ctx, fn)
+}
+
+// scopedTx is scoped, but always runs fn inside a transaction.
+func (s *postgresStore) scopedTx(ctx context.Context, fn func(q pgQuerier) error) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if tenant, ok := tenantFromContext(ctx); ok && s.rlsRole != "" {
+		if _, err := tx.Exec(ctx, "SET LOCAL ROLE "+pgx.Identifier{s.rlsRole}.Sanitize()); err != nil {
+			return fmt.Errorf("failed to assume role %q: %w", s.rlsRole, err)
+		}
+		if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant', $1, true)", tenant); err != nil {
+			return fmt.Errorf("failed to set tenant: %w", err)
+		}
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+func (s *postgresStore) Listen(ctx context.Context, channel string) (Listener, error) {
+	if err := validateChannel(channel); err != nil {
+		return nil, err
+	}
+
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+
+	// Quoted, the name matches pg_notify's case-sensitive channel exactly
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("failed to start listening: %w", err)
+	}
+
+	return &postgresListener{conn: conn}, nil
+}
+
+func (s *postgresStore) Backlog(ctx context.Context, channel string) ([]string, error) {
+	var query string
+	switch channel {
+	case tasksChannel:
+		query = "SELECT " + taskPayloadSQL + " FROM tasks WHERE status = 'pending' ORDER BY priority DESC, created"
+	case notificationsChannel:
+		query = "SELECT " + notificationPayloadSQL + " FROM notifications WHERE status = 'pending' ORDER BY created"
+	default:
+		return nil, fmt.Errorf("unknown channel %q", channel)
+	}
+
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payloads []string
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, rows.Err()
+}
+
+func (s *postgresStore) Backfill(ctx context.Context, channel string, filter backfillFilter) ([]string, error) {
+	var query string
+	switch channel {
+	case tasksChannel:
+		query = "SELECT " + taskPayloadSQL + ` FROM tasks
+			WHERE status = $1 AND ($2 = '' OR type = $2)
+				AND ($3::timestamptz IS NULL OR created >= $3) AND ($4::timestamptz IS NULL OR created < $4)
+			ORDER BY priority DESC, created`
+	case notificationsChannel:
+		query = "SELECT " + notificationPayloadSQL + ` FROM notifications
+			WHERE status = $1 AND $2 = ''
+				AND ($3::timestamptz IS NULL OR created >= $3) AND ($4::timestamptz IS NULL OR created < $4)
+			ORDER BY created`
+	default:
+		return nil, fmt.Errorf("unknown channel %q", channel)
+	}
+
+	rows, err := s.pool.Query(ctx, query, filter.Status, filter.Type, filter.Since, filter.Until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payloads []string
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, rows.Err()
+}
+
+// FetchPayload returns the payload of a row whose NOTIFY payload was too
+// large to send or arrived damaged.
+func (s *postgresStore) FetchPayload(ctx context.Context, channel, id string) (string, error) {
+	var row pgx.Row
+	switch channel {
+	case tasksChannel:
+		row = s.pool.QueryRow(ctx, "SELECT "+taskPayloadSQL+" FROM tasks WHERE id = $1", id)
+	case notificationsChannel:
+		nid, err := strconv.Atoi(id)
+		if err != nil {
+			return "", fmt.Errorf("invalid notification id %q", id)
+		}
+		row = s.pool.QueryRow(ctx, "SELECT "+notificationPayloadSQL+" FROM notifications WHERE id = $1", nid)
+	default:
+		return "", fmt.Errorf("unknown channel %q", channel)
+	}
+
+	var payload string
+	if err := row.Scan(&payload); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errNotFound
+		}
+		return "", err
+	}
+	return payload, nil
+}
+
+func (s *postgresStore) Renotify(ctx context.Context, channel string, filter backfillFilter) (int64, error) {
+	a := actorFromContext(ctx)
+	var tag pgconn.CommandTag
+	var err error
+	switch channel {
+	case tasksChannel:
+		tag, err = s.pool.Exec(ctx, `
+			WITH renotified AS (
+				UPDATE tasks
+				SET status = 'pending', last_error = NULL, failed_at = NULL, updated = $5
+				WHERE status = $1 AND ($2 = '' OR type = $2)
+					AND ($3::timestamptz IS NULL OR created >= $3) AND ($4::timestamptz IS NULL OR created < $4)
+				RETURNING id, type, tenant, priority, payload, status, attempts, max_attempts, timeout_seconds, traceparent, run_at, created, updated
+			), events AS (
+				INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+				SELECT id, $1, status, $6, NULLIF($7, ''), $5 FROM renotified
+			)
+			SELECT `+notifyTaskSQL+` FROM renotified ORDER BY priority DESC, created`,
+			filter.Status, filter.Type, filter.Since, filter.Until, time.Now(), a.Name, a.WorkerID)
+	case notificationsChannel:
+		tag, err = s.pool.Exec(ctx, `
+			WITH renotified AS (
+				UPDATE notifications
+				SET status = 'pending', last_error = NULL, failed_at = NULL, updated = $5
+				WHERE status = $1 AND $2 = ''
+					AND ($3::timestamptz IS NULL OR created >= $3) AND ($4::timestamptz IS NULL OR created < $4)
+				RETURNING id, body, bodies, variants, content, status, dry_run, priority, endpoint, targeted, timezone, origin, traceparent, created, updated
+			)
+			SELECT `+notifyNotificationSQL+` FROM renotified ORDER BY created`,
+			filter.Status, filter.Type, filter.Since, filter.Until, time.Now())
+	default:
+		return 0, fmt.Errorf("unknown channel %q", channel)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *postgresStore) DeleteUserData(ctx context.Context, userID string) (userDataReport, error) {
+	report := userDataReport{UserID: userID}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Everything keyed by endpoint goes before the subscriptions themselves
+	const endpoints = "SELECT endpoint FROM subscriptions WHERE user_id = $1"
+	steps := []struct {
+		count *int64
+		query string
+	}{
+		{&report.Deliveries, "DELETE FROM notification_deliveries WHERE endpoint IN (" + endpoints + ")"},
+		{&report.Failures, "DELETE FROM notification_failures WHERE endpoint IN (" + endpoints + ")"},
+		{&report.Notifications, "DELETE FROM notifications WHERE endpoint <> '' AND endpoint IN (" + endpoints + ")"},
+		{&report.Targets, "DELETE FROM notification_targets WHERE endpoint IN (" + endpoints + ")"},
+		{&report.Subscriptions, "DELETE FROM subscriptions WHERE user_id = $1"},
+		{&report.Tasks, "DELETE FROM tasks WHERE payload->>'user_id' = $1"},
+	}
+	for _, step := range steps {
+		tag, err := tx.Exec(ctx, step.query, userID)
+		if err != nil {
+			return report, err
+		}
+		*step.count = tag.RowsAffected()
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return report, err
+	}
+	report.Completed = time.Now()
+	return report, nil
+}
+
+func (s *postgresStore) CreateTask(ctx context.Context, t task) error {
+	a := actorFromContext(ctx)
+	// The event is inserted in a statement of its own, once the task is
+	// visible to the task_events row-level security policy
+	insert := func(q pgQuerier) error {
+		if _, err := q.Exec(ctx, `
+			INSERT INTO tasks (id, type, tenant, priority, payload, status, max_attempts, timeout_seconds, traceparent, dedup_key, dedup_until, debounce_key, run_at, created, updated)
+			VALUES ($1, $2, $3, $4, $5, $6, $14, $15, $9, $10, $11, $12, $13, $7, $8)`,
+			t.ID, t.Type, t.Tenant, t.Priority, t.Payload, t.Status, t.Created, t.Updated, t.Traceparent, t.DedupKey, t.DedupUntil, t.DebounceKey, t.RunAt, t.MaxAttempts, t.TimeoutSeconds); err != nil {
+			return err
+		}
+		_, err := q.Exec(ctx,
+			"INSERT INTO task_events (task_id, to_status, actor, worker_id, created) VALUES ($1, $2, $3, NULLIF($4, ''), $5)",
+			t.ID, t.Status, a.Name, a.WorkerID, t.Created)
+		return err
+	}
+	if t.DedupKey == "" {
+		return s.scopedTx(ctx, insert)
+	}
+
+	return s.scopedTx(ctx, func(q pgQuerier) error {
+		// Serialize creators of the same key so only one wins the window
+		if _, err := q.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", t.DedupKey); err != nil {
+			return err
+		}
+		var existing string
+		err := q.QueryRow(ctx, "SELECT id FROM tasks WHERE dedup_key = $1 AND dedup_until > $2 ORDER BY created DESC LIMIT 1",
+			t.DedupKey, t.Created).Scan(&existing)
+		if err == nil {
+			return &duplicateTaskError{ID: existing}
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		return insert(q)
+	})
+}
+
+func (s *postgresStore) ListTasks(ctx context.Context) ([]task, error) {
+	var tasks []task
+	err := s.scoped(ctx, func(q pgQuerier) error {
+		rows, err := q.Query(ctx, "SELECT "+taskRow.columns()+" FROM tasks")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		tasks, err = taskRow.collect(rows)
+		return err
+	})
+	return tasks, err
+}
+
+func (s *postgresStore) GetTask(ctx context.Context, id string) (task, error) {
+	var t task
+	err := s.scoped(ctx, func(q pgQuerier) error {
+		var err error
+		t, err = taskRow.scan(q.QueryRow(ctx, "SELECT "+taskRow.columns()+" FROM tasks WHERE id = $1", id))
+		return err
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, errNotFound
+	}
+	return t, err
+}
+
+func (s *postgresStore) SetTaskStatus(ctx context.Context, id string, status string) error {
+	return s.transitionTask(ctx, id, status, "")
+}
+
+// LeaseTask row locks the task while checking it can be leased, so of the
+// instances racing for the same notification only the first to commit
+// leases it; the others wait for the lock and then see its lease.
+func (s *postgresStore) LeaseTask(ctx context.Context, id string, until time.Time) (bool, error) {
+	a := actorFromContext(ctx)
+	tag, err := s.pool.Exec(ctx, `
+		WITH previous AS (
+			SELECT id, status FROM tasks
+			WHERE id = $1 AND (status = 'pending' OR (status = 'processing' AND locked_until < $4))
+			FOR UPDATE
+		), leased AS (
+			UPDATE tasks SET status = 'processing', updated = $4, attempts = tasks.attempts + 1,
+				processed_by = CASE WHEN $3 <> '' THEN $3 ELSE processed_by END,
+				claimed_by = $5, claimed_at = $4, locked_by = $5, locked_until = $6,
+				progress = 0, progress_message = ''
+			FROM previous WHERE tasks.id = previous.id
+			RETURNING tasks.id, previous.status AS from_status
+		)
+		INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+		SELECT id, from_status, 'processing', $2, NULLIF($3, ''), $4 FROM leased`,
+		id, a.Name, a.WorkerID, time.Now(), instanceID(), until)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *postgresStore) FailTask(ctx context.Context, id string, cause error) error {
+	return s.transitionTask(ctx, id, "failed", "last_error = $6, failed_at = $5", cause.Error())
+}
+
+func (s *postgresStore) TimeOutTask(ctx context.Context, id string, cause error) error {
+	return s.transitionTask(ctx, id, "timed_out", "last_error = $6", cause.Error())
+}
+
+func (s *postgresStore) RetryTask(ctx context.Context, id string, runAt time.Time, cause error) error {
+	return s.transitionTask(ctx, id, "scheduled", "run_at = $6, last_error = $7", runAt, cause.Error())
+}
+
+func (s *postgresStore) RenewLease(ctx context.Context, id string, until time.Time) (bool, error) {
+	tag, err := s.pool.Exec(ctx,
+		"UPDATE tasks SET locked_until = $3 WHERE id = $1 AND status = 'processing' AND locked_by = $2",
+		id, instanceID(), until)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *postgresStore) SetTaskProgress(ctx context.Context, id string, percent int, message string) error {
+	_, err := s.pool.Exec(ctx,
+		"UPDATE tasks SET progress = $2, progress_message = $3 WHERE id = $1 AND status = 'processing' AND locked_by = $4",
+		id, percent, message, instanceID())
+	return err
+}
+
+// CancelTask row locks the task while checking it hasn't finished, so a
+// worker finishing it at the same time either goes first or leaves it
+// cancelled. It runs scoped to the tenant in the context, so a tenant can
+// only cancel its own tasks.
+func (s *postgresStore) CancelTask(ctx context.Context, id string) error {
+	return s.scopedTx(ctx, func(q pgQuerier) error {
+		var from string
+		err := q.QueryRow(ctx, "SELECT status FROM tasks WHERE id = $1 FOR UPDATE", id).Scan(&from)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(cancellableStatuses, from) {
+			return errTaskFinished
+		}
+
+		a, now := actorFromContext(ctx), time.Now()
+		if _, err := q.Exec(ctx,
+			"UPDATE tasks SET status = 'cancelled', updated = $2, locked_by = '', locked_until = NULL WHERE id = $1",
+			id, now); err != nil {
+			return err
+		}
+		_, err = q.Exec(ctx, `
+			INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+			VALUES ($1, $2, 'cancelled', $3, NULLIF($4, ''), $5)`,
+			id, from, a.Name, a.WorkerID, now)
+		return err
+	})
+}
+
+// transitionTask moves a task to a new status, applying any extra
+// assignments, and records the transition in task_events. Cancelled tasks
+// are left as they are. Extra arguments are bound from $6 onwards; $5 is
+// the transition time.
+func (s *postgresStore) transitionTask(ctx context.Context, id string, status string, set string, args ...any) error {
+	if set != "" {
+		set = ", " + set
+	}
+	a := actorFromContext(ctx)
+	_, err := s.pool.Exec(ctx, fmt.Sprintf(`
+		WITH previous AS (
+			SELECT id, status FROM tasks WHERE id = $1 AND status <> 'cancelled' FOR UPDATE
+		), changed AS (
+			UPDATE tasks SET status = $2, updated = $5%s
+			FROM previous WHERE tasks.id = previous.id
+			RETURNING tasks.id, previous.status AS from_status
+		)
+		INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+		SELECT id, from_status, $2, $3, NULLIF($4, ''), $5 FROM changed`, set),
+		append([]any{id, status, a.Name, a.WorkerID, time.Now()}, args...)...)
+	return err
+}
+
+func (s *postgresStore) RequeueTasks(ctx context.Context, filter taskFilter) (int64, error) {
+	a := actorFromContext(ctx)
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Reset matching tasks and notify the worker in the same transaction so
+	// the notifications are only delivered if the update commits
+	tag, err := tx.Exec(ctx, `
+		WITH requeued AS (
+			UPDATE tasks
+			SET status = 'pending', attempts = 0, last_error = NULL, failed_at = NULL, updated = $4
+			WHERE status = 'failed'
+				AND ($1 = '' OR type = $1)
+				AND ($2::timestamptz IS NULL OR failed_at >= $2)
+				AND ($3 = '' OR last_error ILIKE '%' || $3 || '%')
+			RETURNING id, type, tenant, priority, payload, status, attempts, max_attempts, timeout_seconds, traceparent, run_at, created, updated
+		)
+		, events AS (
+			INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+			SELECT id, 'failed', status, $5, NULLIF($6, ''), $4 FROM requeued
+		)
+		SELECT `+notifyTaskSQL+` FROM requeued ORDER BY priority DESC, created`,
+		filter.Type, filter.FailedAfter, filter.ErrorContains, time.Now(), a.Name, a.WorkerID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// taskPayloadSQL builds the same payload as the task_created_trigger for rows
+// selected by the surrounding query.
+const taskPayloadSQL = `json_build_object(
+	'id', id,
+	'type', type,
+	'tenant', tenant,
+	'priority', priority,
+	'payload', payload,
+	'status', status,
+	'attempts', attempts,
+	'max_attempts', max_attempts,
+	'timeout_seconds', timeout_seconds,
+	'traceparent', traceparent,
+	'run_at', run_at,
+	'created', created,
+	'updated', updated
+)::text`
+
+// notifyTaskSQL notifies tasksChannel about rows selected by the surrounding
+// query.
+const notifyTaskSQL = `notify_envelope('tasks_channel', ` + taskPayloadSQL + `)`
+
+// notificationPayloadSQL builds the same payload as the
+// notification_created_trigger for rows selected by the surrounding query.
+const notificationPayloadSQL = `json_build_object(
+	'id', id,
+	'body', body,
+	'bodies', bodies,
+	'variants', variants,
+	'content', content,
+	'status', status,
+	'dry_run', dry_run,
+	'priority', priority,
+	'endpoint', endpoint,
+	'targeted', targeted,
+	'timezone', timezone,
+	'origin', origin,
+	'traceparent', traceparent,
+	'created', created,
+	'updated', updated
+)::text`
+
+// notifyNotificationSQL notifies notificationsChannel about rows selected by
+// the surrounding query.
+const notifyNotificationSQL = `notify_envelope('notifications_channel', ` + notificationPayloadSQL + `)`
+
+func (s *postgresStore) ReapTasks(ctx context.Context, before time.Time) (int64, error) {
+	a := actorFromContext(ctx)
+	tag, err := s.pool.Exec(ctx, `
+		WITH reaped AS (
+			UPDATE tasks SET status = 'pending', updated = $2
+			WHERE status = 'processing' AND updated < $1 AND (locked_until IS NULL OR locked_until < $2)
+			RETURNING id, type, tenant, priority, payload, status, attempts, max_attempts, timeout_seconds, traceparent, run_at, created, updated
+		), events AS (
+			INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+			SELECT id, 'processing', status, $3, NULLIF($4, ''), $2 FROM reaped
+		)
+		SELECT `+notifyTaskSQL+` FROM reaped ORDER BY priority DESC, created`,
+		before, time.Now(), a.Name, a.WorkerID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *postgresStore) ReturnTasks(ctx context.Context, instance string) (int64, error) {
+	a := actorFromContext(ctx)
+	tag, err := s.pool.Exec(ctx, `
+		WITH returned AS (
+			UPDATE tasks SET status = 'pending', updated = $2, locked_by = '', locked_until = NULL
+			WHERE status = 'processing' AND locked_by = $1
+			RETURNING id, type, tenant, priority, payload, status, attempts, max_attempts, timeout_seconds, traceparent, run_at, created, updated
+		), events AS (
+			INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+			SELECT id, 'processing', status, $3, NULLIF($4, ''), $2 FROM returned
+		)
+		SELECT `+notifyTaskSQL+` FROM returned ORDER BY priority DESC, created`,
+		instance, time.Now(), a.Name, a.WorkerID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *postgresStore) BreachTasks(ctx context.Context, taskType string, before time.Time, bump int) ([]task, error) {
+	rows, err := s.pool.Query(ctx, `
+		UPDATE tasks SET sla_breached_at = $3, priority = priority + $4
+		WHERE type = $1 AND sla_breached_at IS NULL AND status IN ('pending', 'scheduled', 'processing')
+			AND GREATEST(created, COALESCE(run_at, created)) < $2
+		RETURNING `+taskRow.columns(),
+		taskType, before, time.Now(), bump)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return taskRow.collect(rows)
+}
+
+func (s *postgresStore) DebounceTask(ctx context.Context, t task) (string, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize enqueuers of the same key so they all land in one task
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))",
+		t.Type+"\x00"+t.Tenant+"\x00"+t.DebounceKey); err != nil {
+		return "", err
+	}
+	var id string
+	err = tx.QueryRow(ctx, `
+		UPDATE tasks SET payload = $4, run_at = $5, updated = $6
+		WHERE status = 'scheduled' AND type = $1 AND tenant = $2 AND debounce_key = $3
+		RETURNING id`,
+		t.Type, t.Tenant, t.DebounceKey, t.Payload, t.RunAt, t.Updated).Scan(&id)
+	if err == nil {
+		return id, tx.Commit(ctx)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	a := actorFromContext(ctx)
+	if _, err := tx.Exec(ctx, `
+		WITH created AS (
+			INSERT INTO tasks (id, type, tenant, priority, payload, status, max_attempts, timeout_seconds, traceparent, debounce_key, run_at, created, updated)
+			VALUES ($1, $2, $3, $4, $5, $6, $14, $15, $11, $12, $13, $7, $8)
+			RETURNING id, status, created
+		)
+		INSERT INTO task_events (task_id, to_status, actor, worker_id, created)
+		SELECT id, status, $9, NULLIF($10, ''), created FROM created`,
+		t.ID, t.Type, t.Tenant, t.Priority, t.Payload, t.Status, t.Created, t.Updated, a.Name, a.WorkerID, t.Traceparent, t.DebounceKey, t.RunAt, t.MaxAttempts, t.TimeoutSeconds); err != nil {
+		return "", err
+	}
+	return t.ID, tx.Commit(ctx)
+}
+
+func (s *postgresStore) ReleaseTasks(ctx context.Context, now time.Time) (int64, error) {
+	a := actorFromContext(ctx)
+	tag, err := s.pool.Exec(ctx, `
+		WITH released AS (
+			UPDATE tasks SET status = 'pending', updated = $1
+			WHERE status = 'scheduled' AND run_at <= $1
+			RETURNING id, type, tenant, priority, payload, status, attempts, max_attempts, timeout_seconds, traceparent, run_at, created, updated
+		), events AS (
+			INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+			SELECT id, 'scheduled', status, $2, NULLIF($3, ''), $1 FROM released
+		)
+		SELECT `+notifyTaskSQL+` FROM released ORDER BY priority DESC, created`,
+		now, a.Name, a.WorkerID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *postgresStore) NextTaskDue(ctx context.Context) (*time.Time, error) {
+	var next *time.Time
+	err := s.pool.QueryRow(ctx, "SELECT min(run_at) FROM tasks WHERE status = 'scheduled'").Scan(&next)
+	return next, err
+}
+
+func (s *postgresStore) PurgeTasks(ctx context.Context, before time.Time) (int64, error) {
+	return s.purge(ctx, "tasks", before)
+}
+
+// ClaimTask skips tasks locked by other claimers, so concurrent workers each
+// claim a different task instead of queueing behind one another.
+func (s *postgresStore) ClaimTask(ctx context.Context, before, until time.Time) (task, bool, error) {
+	a := actorFromContext(ctx)
+	t, err := taskRow.scan(s.pool.QueryRow(ctx, `
+		-- name: claim_task
+		WITH candidate AS (
+			SELECT id AS candidate_id, status AS from_status FROM tasks
+			WHERE (status = 'pending' AND updated < $5) OR (status = 'processing' AND locked_until < $1)
+			ORDER BY priority DESC, created
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		), claimed AS (
+			UPDATE tasks SET status = 'processing', updated = $1, attempts = attempts + 1,
+				processed_by = CASE WHEN $3 <> '' THEN $3 ELSE processed_by END,
+				claimed_by = $4, claimed_at = $1, locked_by = $4, locked_until = $6,
+				progress = 0, progress_message = ''
+			FROM candidate WHERE id = candidate_id
+			RETURNING from_status, `+taskRow.columns()+`
+		), events AS (
+			INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+			SELECT id, from_status, status, $2, NULLIF($3, ''), $1 FROM claimed
+		)
+		SELECT `+taskRow.columns()+` FROM claimed`,
+		time.Now(), a.Name, a.WorkerID, instanceID(), before, until))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return task{}, false, nil
+	}
+	if err != nil {
+		return task{}, false, err
+	}
+	return t, true, nil
+}
+
+func (s *postgresStore) CountFailedTasks(ctx context.Context, since time.Time) (map[string]int64, error) {
+	rows, err := s.pool.Query(ctx,
+		"SELECT type, count(*) FROM tasks WHERE status = 'failed' AND failed_at >= $1 GROUP BY type", since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var taskType string
+		var count int64
+		if err := rows.Scan(&taskType, &count); err != nil {
+			return nil, err
+		}
+		counts[taskType] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *postgresStore) ListTaskEvents(ctx context.Context, id string) ([]taskEvent, error) {
+	var events []taskEvent
+	err := s.scoped(ctx, func(q pgQuerier) error {
+		var exists bool
+		if err := q.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM tasks WHERE id = $1)", id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return errNotFound
+		}
+
+		rows, err := q.Query(ctx,
+			"SELECT "+taskEventRow.columns()+" FROM task_events WHERE task_id = $1 ORDER BY id", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		events, err = taskEventRow.collect(rows)
+		return err
+	})
+	return events, err
+}
+
+func (s *postgresStore) CreateSubscription(ctx context.Context, sub subscription) (subscription, error) {
+	now := time.Now()
+	return subscriptionRow.scan(s.pool.QueryRow(ctx,
+		"INSERT INTO subscriptions (endpoint, auth, p256dh, locale, timezone, user_id, origin, vapid_public_key, content_encoding, schema_version, tags, created, updated) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING "+subscriptionRow.columns(),
+		sub.Endpoint, sub.Keys.Auth, sub.Keys.P256dh, sub.Locale, sub.Timezone, sub.UserID, sub.Origin, sub.VAPIDPublicKey, sub.ContentEncoding, sub.SchemaVersion, tagsOrEmpty(sub.Tags), now, now))
+}
+
+func (s *postgresStore) ListSubscriptions(ctx context.Context) ([]subscription, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+subscriptionRow.columns()+" FROM subscriptions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return subscriptionRow.collect(rows)
+}
+
+func (s *postgresStore) FindSubscriptions(ctx context.Context, filter subscriptionFilter) ([]subscription, error) {
+	rows, err := s.pool.Query(ctx,
+		"SELECT "+subscriptionRow.columns()+" FROM subscriptions"+
+			" WHERE id > $1 AND ($2::text = '' OR origin = $2) AND ($3::text = '' OR tags ? $3)"+
+			" AND ($4::timestamptz IS NULL OR created >= $4) AND ($5::timestamptz IS NULL OR created < $5)"+
+			" ORDER BY id LIMIT $6",
+		filter.After, filter.Origin, filter.Tag, filter.CreatedAfter, filter.CreatedBefore, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return subscriptionRow.collect(rows)
+}
+
+func (s *postgresStore) GetSubscription(ctx context.Context, id int) (subscription, error) {
+	sub, err := subscriptionRow.scan(s.pool.QueryRow(ctx,
+		"SELECT "+subscriptionRow.columns()+" FROM subscriptions WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return sub, errNotFound
+	}
+	return sub, err
+}
+
+func (s *postgresStore) SnoozeSubscription(ctx context.Context, id int, until *time.Time) (subscription, error) {
+	sub, err := subscriptionRow.scan(s.pool.QueryRow(ctx,
+		"UPDATE subscriptions SET snoozed_until = $2, updated = $3 WHERE id = $1 RETURNING "+subscriptionRow.columns(),
+		id, until, time.Now()))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return sub, errNotFound
+	}
+	return sub, err
+}
+
+func (s *postgresStore) SubscriptionTimezones(ctx context.Context) ([]string, error) {
+	rows, err := s.pool.Query(ctx, "SELECT DISTINCT timezone FROM subscriptions ORDER BY timezone")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var timezones []string
+	for rows.Next() {
+		var tz string
+		if err := rows.Scan(&tz); err != nil {
+			return nil, err
+		}
+		timezones = append(timezones, tz)
+	}
+	return timezones, rows.Err()
+}
+
+func (s *postgresStore) CreateTemplate(ctx context.Context, t notificationTemplate) (notificationTemplate, error) {
+	err := s.pool.QueryRow(ctx,
+		"INSERT INTO templates (name, body, created, updated) VALUES ($1, $2, $3, $4) RETURNING id",
+		t.Name, t.Body, t.Created, t.Updated).Scan(&t.ID)
+	return t, err
+}
+
+func (s *postgresStore) ListTemplates(ctx context.Context) ([]notificationTemplate, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+templateRow.columns()+" FROM templates ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return templateRow.collect(rows)
+}
+
+func (s *postgresStore) GetTemplate(ctx context.Context, id int) (notificationTemplate, error) {
+	t, err := templateRow.scan(s.pool.QueryRow(ctx,
+		"SELECT "+templateRow.columns()+" FROM templates WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, errNotFound
+	}
+	return t, err
+}
+
+func (s *postgresStore) UpdateTemplate(ctx context.Context, t notificationTemplate) (notificationTemplate, error) {
+	err := s.pool.QueryRow(ctx,
+		"UPDATE templates SET name = $2, body = $3, updated = $4 WHERE id = $1 RETURNING created",
+		t.ID, t.Name, t.Body, t.Updated).Scan(&t.Created)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, errNotFound
+	}
+	return t, err
+}
+
+func (s *postgresStore) DeleteTemplate(ctx context.Context, id int) error {
+	tag, err := s.pool.Exec(ctx, "DELETE FROM templates WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) ListFlags(ctx context.Context) ([]featureFlag, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+flagRow.columns()+" FROM feature_flags ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return flagRow.collect(rows)
+}
+
+func (s *postgresStore) SetFlag(ctx context.Context, f featureFlag) (featureFlag, error) {
+	return flagRow.scan(s.pool.QueryRow(ctx, `
+		INSERT INTO feature_flags (name, enabled, tenants, updated) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled, tenants = EXCLUDED.tenants, updated = EXCLUDED.updated
+		RETURNING `+flagRow.columns(),
+		f.Name, f.Enabled, f.Tenants, time.Now()))
+}
+
+func (s *postgresStore) DeleteFlag(ctx context.Context, name string) error {
+	tag, err := s.pool.Exec(ctx, "DELETE FROM feature_flags WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) CreateVAPIDKey(ctx context.Context, k vapidKey) error {
+	_, err := s.pool.Exec(ctx,
+		"INSERT INTO vapid_keys (public_key, private_key, created) VALUES ($1, $2, $3) ON CONFLICT (public_key) DO NOTHING",
+		k.PublicKey, k.PrivateKey, k.Created)
+	return err
+}
+
+func (s *postgresStore) ListVAPIDKeys(ctx context.Context) ([]vapidKey, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+vapidKeyRow.columns()+" FROM vapid_keys ORDER BY created, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return vapidKeyRow.collect(rows)
+}
+
+func (s *postgresStore) RewriteColumns(ctx context.Context, table encryptedTable, after int64, limit int,
+	rewrite func(col encryptedColumn, value string) (string, bool, error)) (int64, int, int, error) {
+	selects := make([]string, len(table.columns))
+	sets := make([]string, len(table.columns))
+	for i, col := range table.columns {
+		selects[i] = col.name + "::text"
+		sets[i] = fmt.Sprintf("%s = $%d", col.name, i+2)
+		if col.json {
+			sets[i] = fmt.Sprintf("%s = $%d::text::jsonb", col.name, i+2)
+		}
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return after, 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		"SELECT id, "+strings.Join(selects, ", ")+" FROM "+table.name+" WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE",
+		after, limit)
+	if err != nil {
+		return after, 0, 0, err
+	}
+	type row struct {
+		id     int64
+		values []*string
+	}
+	var batch []row
+	for rows.Next() {
+		r := row{values: make([]*string, len(table.columns))}
+		dest := []any{&r.id}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return after, 0, 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return after, 0, 0, err
+	}
+
+	last, rewritten := after, 0
+	for _, r := range batch {
+		last = r.id
+		changed, err := rewriteRow(table, r.values, rewrite)
+		if err != nil {
+			return after, 0, 0, fmt.Errorf("row %d: %w", r.id, err)
+		}
+		if !changed {
+			continue
+		}
+		args := []any{r.id}
+		for _, v := range r.values {
+			args = append(args, v)
+		}
+		if _, err := tx.Exec(ctx, "UPDATE "+table.name+" SET "+strings.Join(sets, ", ")+" WHERE id = $1", args...); err != nil {
+			return after, 0, 0, err
+		}
+		rewritten++
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return after, 0, 0, err
+	}
+	return last, len(batch), rewritten, nil
+}
+
+func (s *postgresStore) CreateSchedule(ctx context.Context, sc schedule) (schedule, error) {
+	err := s.pool.QueryRow(ctx, `
+		INSERT INTO schedules (rule, task, notification, next_run, created, updated)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		sc.Rule, sc.Task, sc.Notification, sc.NextRun, sc.Created, sc.Updated).Scan(&sc.ID)
+	return sc, err
+}
+
+func (s *postgresStore) ListSchedules(ctx context.Context) ([]schedule, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+scheduleRow.columns()+" FROM schedules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scheduleRow.collect(rows)
+}
+
+func (s *postgresStore) DeleteSchedule(ctx context.Context, id int) error {
+	tag, err := s.pool.Exec(ctx, "DELETE FROM schedules WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) DueSchedules(ctx context.Context, now time.Time) ([]schedule, error) {
+	rows, err := s.pool.Query(ctx,
+		"SELECT "+scheduleRow.columns()+" FROM schedules WHERE next_run <= $1 ORDER BY next_run", now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scheduleRow.collect(rows)
+}
+
+func (s *postgresStore) SetScheduleNextRun(ctx context.Context, id int, next *time.Time) error {
+	_, err := s.pool.Exec(ctx, "UPDATE schedules SET next_run = $2, updated = $3 WHERE id = $1", id, next, time.Now())
+	return err
+}
+
+func (s *postgresStore) CreateNotification(ctx context.Context, n notification) (int, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The notification and its targets commit together, and workers only
+	// hear about it once they have
+	var id int
+	err = tx.QueryRow(ctx,
+		`INSERT INTO notifications (body, bodies, variants, content, status, dry_run, priority, endpoint, targeted, local_time, timezone, origin, send_at, traceparent, created, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) RETURNING id`,
+		n.Body, bodiesOrEmpty(n.Bodies), variantsOrEmpty(n.Variants), n.Content, initialStatus(n), n.DryRun,
+		n.Priority, n.Endpoint, len(n.Targets) > 0, n.LocalTime, n.Timezone, n.Origin, n.SendAt, n.Traceparent, n.Created, n.Updated).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	if len(n.Targets) > 0 {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO notification_targets (notification_id, endpoint)
+			SELECT $1, endpoint FROM unnest($2::text[]) AS endpoint
+			ON CONFLICT DO NOTHING`, id, n.Targets); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit(ctx)
+}
+
+func (s *postgresStore) NotificationTargets(ctx context.Context, id int) ([]string, error) {
+	rows, err := s.pool.Query(ctx, "SELECT endpoint FROM notification_targets WHERE notification_id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (s *postgresStore) ListNotifications(ctx context.Context, filter notificationListFilter) ([]notification, error) {
+	rows, err := s.pool.Query(ctx,
+		"SELECT "+notificationRow.columns()+" FROM notifications"+
+			" WHERE ($1::text = '' OR status = $1)"+
+			" AND ($2::timestamptz IS NULL OR created >= $2) AND ($3::timestamptz IS NULL OR created < $3)"+
+			" ORDER BY id",
+		filter.Status, filter.CreatedAfter, filter.CreatedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return notificationRow.collect(rows)
+}
+
+func (s *postgresStore) GetNotification(ctx context.Context, id int) (notification, error) {
+	n, err := notificationRow.scan(s.pool.QueryRow(ctx,
+		"SELECT "+notificationRow.columns()+" FROM notifications WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return n, errNotFound
+	}
+	return n, err
+}
+
+func (s *postgresStore) SetNotificationStatus(ctx context.Context, id int, status string) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE notifications SET status = $2, updated = $3,
+			processed_by = CASE WHEN $2 = 'processing' AND $4 <> '' THEN $4 ELSE processed_by END,
+			claimed_by = CASE WHEN $2 = 'processing' THEN $5 ELSE claimed_by END,
+			claimed_at = CASE WHEN $2 = 'processing' THEN $3 ELSE claimed_at END
+		WHERE id = $1`, id, status, time.Now(), actorFromContext(ctx).WorkerID, instanceID())
+	return err
+}
+
+func (s *postgresStore) FailNotification(ctx context.Context, id int, cause error) error {
+	_, err := s.pool.Exec(ctx,
+		"UPDATE notifications SET status = 'failed', last_error = $2, failed_at = $3, updated = $3 WHERE id = $1",
+		id, cause.Error(), time.Now())
+	return err
+}
+
+func (s *postgresStore) ScheduledNotifications(ctx context.Context) ([]notification, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+notificationRow.columns()+
+		" FROM notifications WHERE status = 'scheduled' AND local_time <> '' ORDER BY created")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return notificationRow.collect(rows)
+}
+
+func (s *postgresStore) ExpandNotification(ctx context.Context, id int, waves []notification) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Only the first expansion of a notification wins
+	tag, err := tx.Exec(ctx,
+		"UPDATE notifications SET status = 'expanded', updated = $2 WHERE id = $1 AND status = 'scheduled'",
+		id, time.Now())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	for _, n := range waves {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO notifications (body, bodies, variants, content, status, dry_run, priority, timezone, origin, send_at, traceparent, created, updated)
+			VALUES ($1, $2, $3, $4, 'scheduled', $5, $6, $7, $8, $9, $10, $11, $12)`,
+			n.Body, bodiesOrEmpty(n.Bodies), variantsOrEmpty(n.Variants), n.Content, n.DryRun, n.Priority, n.Timezone, n.Origin, n.SendAt, n.Traceparent, n.Created, n.Updated); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) DeferNotification(ctx context.Context, id int, at time.Time) error {
+	_, err := s.pool.Exec(ctx,
+		"UPDATE notifications SET status = 'scheduled', send_at = $2, updated = $3 WHERE id = $1",
+		id, at, time.Now())
+	return err
+}
+
+func (s *postgresStore) ReleaseNotifications(ctx context.Context, now time.Time) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `
+		WITH released AS (
+			UPDATE notifications
+			SET status = 'pending', updated = $1
+			WHERE status = 'scheduled' AND send_at <= $1
+			RETURNING id, body, bodies, variants, content, status, dry_run, priority, endpoint, targeted, timezone, origin, traceparent, created, updated
+		)
+		SELECT `+notifyNotificationSQL+` FROM released ORDER BY created`,
+		now)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *postgresStore) CountFailedNotifications(ctx context.Context, since time.Time) (int64, error) {
+	var count int64
+	err := s.pool.QueryRow(ctx,
+		"SELECT count(*) FROM notifications WHERE status = 'failed' AND failed_at >= $1", since).Scan(&count)
+	return count, err
+}
+
+func (s *postgresStore) RequeueNotifications(ctx context.Context, filter notificationFilter) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `
+		WITH requeued AS (
+			UPDATE notifications
+			SET status = 'pending', last_error = NULL, failed_at = NULL, updated = $3
+			WHERE status = 'failed'
+				AND ($1::timestamptz IS NULL OR failed_at >= $1)
+				AND ($2 = '' OR last_error ILIKE '%' || $2 || '%')
+			RETURNING id, body, bodies, variants, content, status, dry_run, priority, endpoint, targeted, timezone, origin, traceparent, created, updated
+		)
+		SELECT `+notifyNotificationSQL+` FROM requeued ORDER BY created`,
+		filter.FailedAfter, filter.ErrorContains, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *postgresStore) ListDeliveryFailures(ctx context.Context, id int) ([]deliveryFailure, error) {
+	var exists bool
+	if err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM notifications WHERE id = $1)", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errNotFound
+	}
+
+	rows, err := s.pool.Query(ctx,
+		"SELECT "+deliveryFailureRow.columns()+" FROM notification_failures WHERE notification_id = $1 ORDER BY endpoint", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return deliveryFailureRow.collect(rows)
+}
+
+func (s *postgresStore) SetDeliveryFailures(ctx context.Context, id int, failures []deliveryFailure) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM notification_failures WHERE notification_id = $1", id); err != nil {
+		return err
+	}
+	for _, f := range failures {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO notification_failures (notification_id, endpoint, attempts, last_error, created)
+			VALUES ($1, $2, $3, $4, $5)`,
+			id, f.Endpoint, f.Attempts, f.Error, f.Created); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStore) RecordDeliveries(ctx context.Context, id int, deliveries []delivery) error {
+	batch := &pgx.Batch{}
+	for _, d := range deliveries {
+		batch.Queue(`
+			INSERT INTO notification_deliveries (notification_id, endpoint, variant, created)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (notification_id, endpoint) DO UPDATE SET variant = $3, created = $4`,
+			id, d.Endpoint, d.Variant, d.Created)
+	}
+	return s.pool.SendBatch(ctx, batch).Close()
+}
+
+func (s *postgresStore) ListDeliveries(ctx context.Context, id int) ([]delivery, error) {
+	var exists bool
+	if err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM notifications WHERE id = $1)", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errNotFound
+	}
+
+	rows, err := s.pool.Query(ctx,
+		"SELECT "+deliveryRow.columns()+" FROM notification_deliveries WHERE notification_id = $1 ORDER BY created", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return deliveryRow.collect(rows)
+}
+
+func (s *postgresStore) PurgeNotifications(ctx context.Context, before time.Time) (int64, error) {
+	return s.purge(ctx, "notifications", before)
+}
+
+// TakeToken takes a token from a bucket shared by every instance. The refill
+// and take happen in a single statement so concurrent callers can't
+// overdraw the bucket.
+func (s *postgresStore) TakeToken(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	rows, err := s.pool.Query(ctx, `
+		INSERT INTO rate_limits (key, tokens, updated)
+		VALUES ($1, $3 - 1, clock_timestamp())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = LEAST($3, rate_limits.tokens + EXTRACT(EPOCH FROM clock_timestamp() - rate_limits.updated) * $2) - 1,
+			updated = clock_timestamp()
+		WHERE LEAST($3, rate_limits.tokens + EXTRACT(EPOCH FROM clock_timestamp() - rate_limits.updated) * $2) >= 1
+		RETURNING tokens`,
+		key, rate, float64(burst))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	taken := rows.Next()
+	return taken, rows.Err()
+}
+
+// ClaimTick runs fn at most once per job and tick across every instance.
+// A transaction-scoped advisory lock serializes instances while cron_runs
+// records the last tick that ran, so an instance whose clock or schedule
+// lags can't repeat a tick another instance already completed.
+func (s *postgresStore) ClaimTick(ctx context.Context, job string, tick time.Time, fn func(ctx context.Context) error) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock(hashtext($1))", "cron:"+job).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+
+	var ran bool
+	if err := tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM cron_runs WHERE name = $1 AND last_tick >= $2)", job, tick).Scan(&ran); err != nil {
+		return false, err
+	}
+	if ran {
+		return false, nil
+	}
+
+	if err := fn(ctx); err != nil {
+		return true, err
+	}
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO cron_runs (name, last_tick) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET last_tick = EXCLUDED.last_tick`, job, tick); err != nil {
+		return true, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// Heartbeat records the instance's heartbeat with the database's clock, so
+// instances with drifting clocks still agree on how stale one is.
+func (s *postgresStore) Heartbeat(ctx context.Context, instance, role string) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO worker_heartbeats (instance, role, started, heartbeat) VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT (instance) DO UPDATE SET role = EXCLUDED.role, heartbeat = EXCLUDED.heartbeat`,
+		instance, role)
+	return err
+}
+
+func (s *postgresStore) HeartbeatAge(ctx context.Context, role string) (time.Duration, bool, error) {
+	var age *float64
+	if err := s.pool.QueryRow(ctx,
+		"SELECT EXTRACT(EPOCH FROM NOW() - MAX(heartbeat))::float8 FROM worker_heartbeats WHERE role = $1", role).Scan(&age); err != nil {
+		return 0, false, err
+	}
+	if age == nil {
+		return 0, false, nil
+	}
+	return time.Duration(*age * float64(time.Second)), true, nil
+}
+
+func (s *postgresStore) GetMaintenance(ctx context.Context) (maintenanceState, error) {
+	var m maintenanceState
+	err := s.pool.QueryRow(ctx, "SELECT enabled, reason, updated FROM maintenance").Scan(&m.Enabled, &m.Reason, &m.Updated)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, nil
+	}
+	return m, err
+}
+
+func (s *postgresStore) SetMaintenance(ctx context.Context, enabled bool, reason string) (maintenanceState, error) {
+	var m maintenanceState
+	err := s.pool.QueryRow(ctx, `
+		INSERT INTO maintenance (enabled, reason, updated) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET enabled = EXCLUDED.enabled, reason = EXCLUDED.reason, updated = EXCLUDED.updated
+		RETURNING enabled, reason, updated`,
+		enabled, reason, time.Now()).Scan(&m.Enabled, &m.Reason, &m.Updated)
+	return m, err
+}
+
+// ReleaseZombies compares heartbeats with the database's clock, like
+// HeartbeatAge. Claims are also aged by it, so a claim made just before its
+// instance's first heartbeat isn't mistaken for a zombie.
+func (s *postgresStore) ReleaseZombies(ctx context.Context, timeout time.Duration) (int64, int64, error) {
+	a := actorFromContext(ctx)
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Reset the claims and notify the workers in the same transaction so
+	// the notifications are only delivered if the update commits
+	tasks, err := tx.Exec(ctx, `
+		WITH released AS (
+			UPDATE tasks SET status = 'pending', updated = $2
+			WHERE status = 'processing' AND claimed_by <> ''
+				AND claimed_at < NOW() - $1::float8 * interval '1 second'
+				AND NOT EXISTS (
+					SELECT 1 FROM worker_heartbeats
+					WHERE instance = tasks.claimed_by AND heartbeat >= NOW() - $1::float8 * interval '1 second'
+				)
+			RETURNING id, type, tenant, priority, payload, status, attempts, max_attempts, timeout_seconds, traceparent, run_at, created, updated
+		), events AS (
+			INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created)
+			SELECT id, 'processing', status, $3, NULLIF($4, ''), $2 FROM released
+		)
+		SELECT `+notifyTaskSQL+` FROM released ORDER BY priority DESC, created`,
+		timeout.Seconds(), time.Now(), a.Name, a.WorkerID)
+	if err != nil {
+		return 0, 0, err
+	}
+	notifications, err := tx.Exec(ctx, `
+		WITH released AS (
+			UPDATE notifications SET status = 'pending', updated = $2
+			WHERE status = 'processing' AND claimed_by <> ''
+				AND claimed_at < NOW() - $1::float8 * interval '1 second'
+				AND NOT EXISTS (
+					SELECT 1 FROM worker_heartbeats
+					WHERE instance = notifications.claimed_by AND heartbeat >= NOW() - $1::float8 * interval '1 second'
+				)
+			RETURNING id, body, bodies, variants, content, status, dry_run, priority, endpoint, targeted, timezone, origin, traceparent, created, updated
+		)
+		SELECT `+notifyNotificationSQL+` FROM released ORDER BY created`,
+		timeout.Seconds(), time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+	return tasks.RowsAffected(), notifications.RowsAffected(), tx.Commit(ctx)
+}
+
+// purgeBatchSize is the maximum number of rows deleted per statement, keeping
+// each delete's locks short.
+const purgeBatchSize = 1000
+
+// purge deletes completed rows from the table that were last updated before
+// the cutoff, in batches.
+func (s *postgresStore) purge(ctx context.Context, table string, before time.Time) (int64, error) {
+	var deleted int64
+	for {
+		tag, err := s.pool.Exec(ctx, fmt.Sprintf(`
+			DELETE FROM %[1]s
+			WHERE id IN (
+				SELECT id FROM %[1]s
+				WHERE status = 'completed' AND updated < $1
+				LIMIT $2
+			)`, table),
+			before, purgeBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += tag.RowsAffected()
+		if tag.RowsAffected() < purgeBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// postgresListener holds a dedicated connection that has issued LISTEN.
+type postgresListener struct {
+	conn *pgxpool.Conn
+}
+
+func (l *postgresListener) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	return l.conn.Conn().WaitForNotification(ctx)
+}
+
+// Ping runs a query on the listening connection. A connection that fails or
+// times out is closed, so it is discarded rather than returned to the pool.
+func (l *postgresListener) Ping(ctx context.Context) error {
+	_, err := l.conn.Exec(ctx, "SELECT 1")
+	return err
+}
+
+func (l *postgresListener) Close() {
+	l.conn.Release()
+}
@@ -0,0 +1,1660 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema mirrors init.sql for SQLite. Instead of NOTIFY, triggers append
+// to an events table that listeners poll.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    endpoint TEXT NOT NULL,
+    auth TEXT NOT NULL,
+    p256dh TEXT NOT NULL,
+    locale TEXT NOT NULL DEFAULT '',
+    timezone TEXT NOT NULL DEFAULT '',
+    user_id TEXT NOT NULL DEFAULT '',
+    origin TEXT NOT NULL DEFAULT '',
+    snoozed_until TIMESTAMP,
+    vapid_public_key TEXT NOT NULL DEFAULT '',
+    content_encoding TEXT NOT NULL DEFAULT '',
+    schema_version INTEGER NOT NULL DEFAULT 1,
+    tags TEXT NOT NULL DEFAULT '[]',
+    created TIMESTAMP NOT NULL,
+    updated TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user_id ON subscriptions(user_id);
+
+CREATE TABLE IF NOT EXISTS vapid_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_key TEXT NOT NULL UNIQUE,
+    private_key TEXT NOT NULL,
+    created TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS feature_flags (
+    name TEXT PRIMARY KEY,
+    enabled BOOLEAN NOT NULL,
+    tenants TEXT NOT NULL DEFAULT '{}',
+    updated TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS templates (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created TIMESTAMP NOT NULL,
+    updated TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS schedules (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    rule TEXT NOT NULL,
+    task TEXT,
+    notification TEXT,
+    next_run TIMESTAMP,
+    created TIMESTAMP NOT NULL,
+    updated TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_schedules_next_run ON schedules(next_run);
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    body TEXT NOT NULL,
+    status TEXT NOT NULL,
+    bodies TEXT NOT NULL DEFAULT '{}',
+    variants TEXT NOT NULL DEFAULT '[]',
+    content TEXT NOT NULL DEFAULT '{}',
+    dry_run BOOLEAN NOT NULL DEFAULT FALSE,
+    priority TEXT NOT NULL DEFAULT '',
+    endpoint TEXT NOT NULL DEFAULT '',
+    targeted BOOLEAN NOT NULL DEFAULT FALSE,
+    local_time TEXT NOT NULL DEFAULT '',
+    timezone TEXT NOT NULL DEFAULT '',
+    origin TEXT NOT NULL DEFAULT '',
+    send_at TIMESTAMP,
+    processed_by TEXT NOT NULL DEFAULT '',
+    claimed_by TEXT NOT NULL DEFAULT '',
+    claimed_at TIMESTAMP,
+    traceparent TEXT NOT NULL DEFAULT '',
+    last_error TEXT,
+    failed_at TIMESTAMP,
+    created TIMESTAMP NOT NULL,
+    updated TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_scheduled ON notifications(status, send_at);
+
+CREATE TABLE IF NOT EXISTS notification_targets (
+    notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL,
+    PRIMARY KEY (notification_id, endpoint)
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_targets_endpoint ON notification_targets(endpoint);
+
+CREATE TABLE IF NOT EXISTS notification_failures (
+    notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+    created TIMESTAMP NOT NULL,
+    PRIMARY KEY (notification_id, endpoint)
+);
+
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    notification_id INTEGER NOT NULL REFERENCES notifications(id) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL,
+    variant TEXT NOT NULL DEFAULT '',
+    created TIMESTAMP NOT NULL,
+    PRIMARY KEY (notification_id, endpoint)
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    tenant TEXT NOT NULL DEFAULT '',
+    priority INTEGER NOT NULL DEFAULT 0,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 0,
+    timeout_seconds INTEGER NOT NULL DEFAULT 0,
+    processed_by TEXT NOT NULL DEFAULT '',
+    claimed_by TEXT NOT NULL DEFAULT '',
+    claimed_at TIMESTAMP,
+    locked_by TEXT NOT NULL DEFAULT '',
+    locked_until TIMESTAMP,
+    progress INTEGER NOT NULL DEFAULT 0,
+    progress_message TEXT NOT NULL DEFAULT '',
+    traceparent TEXT NOT NULL DEFAULT '',
+    dedup_key TEXT NOT NULL DEFAULT '',
+    dedup_until TIMESTAMP,
+    debounce_key TEXT NOT NULL DEFAULT '',
+    run_at TIMESTAMP,
+    last_error TEXT,
+    failed_at TIMESTAMP,
+    sla_breached_at TIMESTAMP,
+    created TIMESTAMP NOT NULL,
+    updated TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status);
+CREATE INDEX IF NOT EXISTS idx_tasks_backlog ON tasks(status, priority DESC, created);
+CREATE INDEX IF NOT EXISTS idx_tasks_dedup ON tasks(dedup_key, dedup_until) WHERE dedup_key <> '';
+CREATE INDEX IF NOT EXISTS idx_tasks_due ON tasks(run_at) WHERE status = 'scheduled';
+CREATE INDEX IF NOT EXISTS idx_tasks_lease ON tasks(locked_until) WHERE status = 'processing';
+CREATE INDEX IF NOT EXISTS idx_tasks_sla ON tasks(type, created)
+    WHERE sla_breached_at IS NULL AND status IN ('pending', 'scheduled', 'processing');
+
+CREATE TABLE IF NOT EXISTS task_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task_id TEXT NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    from_status TEXT,
+    to_status TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    worker_id TEXT,
+    created TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_events_task_id ON task_events(task_id);
+
+CREATE TABLE IF NOT EXISTS events (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    channel TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER IF NOT EXISTS task_scheduled_trigger
+    AFTER INSERT ON tasks
+    WHEN NEW.status = 'pending' AND julianday(NEW.run_at) > julianday('now')
+BEGIN
+    UPDATE tasks SET status = 'scheduled' WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS task_created_trigger
+    AFTER INSERT ON tasks
+    WHEN NEW.status = 'pending' AND (NEW.run_at IS NULL OR julianday(NEW.run_at) <= julianday('now'))
+BEGIN
+    INSERT INTO events (channel, payload) VALUES ('tasks_channel', json_object(
+        'id', NEW.id,
+        'type', NEW.type,
+        'tenant', NEW.tenant,
+        'priority', NEW.priority,
+        'payload', json(NEW.payload),
+        'status', NEW.status,
+        'attempts', NEW.attempts,
+        'max_attempts', NEW.max_attempts,
+        'timeout_seconds', NEW.timeout_seconds,
+        'traceparent', NEW.traceparent,
+        'run_at', strftime('%Y-%m-%dT%H:%M:%fZ', NEW.run_at),
+        'created', strftime('%Y-%m-%dT%H:%M:%fZ', NEW.created),
+        'updated', strftime('%Y-%m-%dT%H:%M:%fZ', NEW.updated)
+    ));
+END;
+
+CREATE TRIGGER IF NOT EXISTS notification_created_trigger
+    AFTER INSERT ON notifications
+    WHEN NEW.status = 'pending'
+BEGIN
+    INSERT INTO events (channel, payload) VALUES ('notifications_channel', json_object(
+        'id', NEW.id,
+        'body', NEW.body,
+        'bodies', json(NEW.bodies),
+        'variants', json(NEW.variants),
+        'content', json(NEW.content),
+        'status', NEW.status,
+        'dry_run', json(CASE WHEN NEW.dry_run THEN 'true' ELSE 'false' END),
+        'priority', NEW.priority,
+        'endpoint', NEW.endpoint,
+        'targeted', json(CASE WHEN NEW.targeted THEN 'true' ELSE 'false' END),
+        'timezone', NEW.timezone,
+        'origin', NEW.origin,
+        'traceparent', NEW.traceparent,
+        'created', strftime('%Y-%m-%dT%H:%M:%fZ', NEW.created),
+        'updated', strftime('%Y-%m-%dT%H:%M:%fZ', NEW.updated)
+    ));
+END;
+`
+
+// eventRetention is how long polled events are kept before being pruned.
+const eventRetention = time.Hour
+
+// SQLite stores JSON as text, so rows with JSON columns are read with
+// mappers decoding it.
+var (
+	sqliteTaskRow         = taskRow.withTextJSON()
+	sqliteScheduleRow     = scheduleRow.withTextJSON()
+	sqliteNotificationRow = notificationRow.withTextJSON()
+	sqliteSubscriptionRow = subscriptionRow.withTextJSON()
+	sqliteFlagRow         = flagRow.withTextJSON()
+)
+
+// sqliteStore is a Store backed by SQLite for single-node deployments. New
+// work is discovered by polling the events table rather than LISTEN/NOTIFY.
+type sqliteStore struct {
+	db           *sql.DB
+	pollInterval time.Duration
+}
+
+var _ Store = (*sqliteStore)(nil)
+
+// newSQLiteStore opens the SQLite database at dsn and creates the schema if
+// it does not exist.
+func newSQLiteStore(ctx context.Context, dsn string, pollInterval time.Duration) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sqlite database: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create sqlite schema: %w", err)
+	}
+
+	return &sqliteStore{db: db, pollInterval: pollInterval}, nil
+}
+
+// Close closes the underlying database.
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) Listen(ctx context.Context, channel string) (Listener, error) {
+	// Like LISTEN, only events published after this point are delivered
+	var seq int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(seq), 0) FROM events").Scan(&seq); err != nil {
+		return nil, fmt.Errorf("failed to start listening: %w", err)
+	}
+
+	return &sqliteListener{store: s, channel: channel, seq: seq}, nil
+}
+
+// sqliteTaskPayload builds the same payload as the task_created_trigger for
+// rows selected by the surrounding query.
+const sqliteTaskPayload = `json_object(
+	'id', id,
+	'type', type,
+	'tenant', tenant,
+	'priority', priority,
+	'payload', json(payload),
+	'status', status,
+	'attempts', attempts,
+	'max_attempts', max_attempts,
+	'timeout_seconds', timeout_seconds,
+	'traceparent', traceparent,
+	'run_at', strftime('%Y-%m-%dT%H:%M:%fZ', run_at),
+	'created', strftime('%Y-%m-%dT%H:%M:%fZ', created),
+	'updated', strftime('%Y-%m-%dT%H:%M:%fZ', updated)
+)`
+
+// sqliteNotificationPayload builds the same payload as the
+// notification_created_trigger for rows selected by the surrounding query.
+const sqliteNotificationPayload = `json_object(
+	'id', id,
+	'body', body,
+	'bodies', json(bodies),
+	'variants', json(variants),
+	'content', json(content),
+	'status', status,
+	'dry_run', json(CASE WHEN dry_run THEN 'true' ELSE 'false' END),
+	'priority', priority,
+	'endpoint', endpoint,
+	'targeted', json(CASE WHEN targeted THEN 'true' ELSE 'false' END),
+	'timezone', timezone,
+	'origin', origin,
+	'traceparent', traceparent,
+	'created', strftime('%Y-%m-%dT%H:%M:%fZ', created),
+	'updated', strftime('%Y-%m-%dT%H:%M:%fZ', updated)
+)`
+
+func (s *sqliteStore) Backlog(ctx context.Context, channel string) ([]string, error) {
+	var query string
+	switch channel {
+	case tasksChannel:
+		query = "SELECT " + sqliteTaskPayload + " FROM tasks WHERE status = 'pending' ORDER BY priority DESC, created"
+	case notificationsChannel:
+		query = "SELECT " + sqliteNotificationPayload + " FROM notifications WHERE status = 'pending' ORDER BY created"
+	default:
+		return nil, fmt.Errorf("unknown channel %q", channel)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payloads []string
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, rows.Err()
+}
+
+// sqliteBackfillWhere builds the conditions selecting the work to backfill,
+// beyond its status.
+func sqliteBackfillWhere(filter backfillFilter) (string, []any) {
+	var where string
+	var args []any
+	if filter.Type != "" {
+		where += " AND type = ?"
+		args = append(args, filter.Type)
+	}
+	if filter.Since != nil {
+		where += " AND julianday(created) >= julianday(?)"
+		args = append(args, filter.Since.UTC())
+	}
+	if filter.Until != nil {
+		where += " AND julianday(created) < julianday(?)"
+		args = append(args, filter.Until.UTC())
+	}
+	return where, args
+}
+
+func (s *sqliteStore) Backfill(ctx context.Context, channel string, filter backfillFilter) ([]string, error) {
+	where, args := sqliteBackfillWhere(filter)
+	var query string
+	switch channel {
+	case tasksChannel:
+		query = "SELECT " + sqliteTaskPayload + " FROM tasks WHERE status = ?" + where + " ORDER BY priority DESC, created"
+	case notificationsChannel:
+		if filter.Type != "" {
+			return nil, nil
+		}
+		query = "SELECT " + sqliteNotificationPayload + " FROM notifications WHERE status = ?" + where + " ORDER BY created"
+	default:
+		return nil, fmt.Errorf("unknown channel %q", channel)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, append([]any{filter.Status}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payloads []string
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, rows.Err()
+}
+
+func (s *sqliteStore) Renotify(ctx context.Context, channel string, filter backfillFilter) (int64, error) {
+	where, args := sqliteBackfillWhere(filter)
+	switch channel {
+	case tasksChannel:
+		return s.resetTasks(ctx, filter.Status, where, args, ", last_error = NULL, failed_at = NULL")
+	case notificationsChannel:
+		if filter.Type != "" {
+			return 0, nil
+		}
+	default:
+		return 0, fmt.Errorf("unknown channel %q", channel)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Reset matching notifications and publish an event for each of them in
+	// the same transaction so the worker only sees committed work
+	rows, err := tx.QueryContext(ctx,
+		"UPDATE notifications SET status = 'pending', last_error = NULL, failed_at = NULL, updated = ? WHERE status = ?"+where+" RETURNING id",
+		append([]any{time.Now(), filter.Status}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO events (channel, payload) SELECT ?, "+sqliteNotificationPayload+" FROM notifications WHERE id = ?",
+			notificationsChannel, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+func (s *sqliteStore) CreateTask(ctx context.Context, t task) error {
+	payload, err := json.Marshal(t.Payload)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if t.DedupKey != "" {
+		var existing string
+		err := tx.QueryRowContext(ctx, "SELECT id FROM tasks WHERE dedup_key = ? AND dedup_until > ? ORDER BY created DESC LIMIT 1",
+			t.DedupKey, t.Created).Scan(&existing)
+		if err == nil {
+			return &duplicateTaskError{ID: existing}
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO tasks (id, type, tenant, priority, payload, status, max_attempts, timeout_seconds, traceparent, dedup_key, dedup_until, debounce_key, run_at, created, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		t.ID, t.Type, t.Tenant, t.Priority, string(payload), t.Status, t.MaxAttempts, t.TimeoutSeconds, t.Traceparent, t.DedupKey, t.DedupUntil, t.DebounceKey, t.RunAt, t.Created, t.Updated); err != nil {
+		return err
+	}
+	if err := recordSQLiteTaskEvent(ctx, tx, t.ID, nil, t.Status); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) ListTasks(ctx context.Context) ([]task, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteTaskRow.columns()+" FROM tasks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteTaskRow.collect(rows)
+}
+
+func (s *sqliteStore) GetTask(ctx context.Context, id string) (task, error) {
+	t, err := sqliteTaskRow.scan(s.db.QueryRowContext(ctx,
+		"SELECT "+sqliteTaskRow.columns()+" FROM tasks WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, errNotFound
+	}
+	return t, err
+}
+
+func (s *sqliteStore) SetTaskStatus(ctx context.Context, id string, status string) error {
+	return s.transitionTask(ctx, id, status, "")
+}
+
+func (s *sqliteStore) LeaseTask(ctx context.Context, id string, until time.Time) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM tasks WHERE id = ?", id).Scan(&from)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	now, worker := time.Now().UTC(), actorFromContext(ctx).WorkerID
+	res, err := tx.ExecContext(ctx, `
+		UPDATE tasks SET status = 'processing', updated = ?1, attempts = attempts + 1,
+			processed_by = CASE WHEN ?2 <> '' THEN ?2 ELSE processed_by END,
+			claimed_by = ?3, claimed_at = ?1, locked_by = ?3, locked_until = ?4,
+			progress = 0, progress_message = ''
+		WHERE id = ?5 AND (status = 'pending' OR (status = 'processing' AND locked_until < ?1))`,
+		now, worker, instanceID(), until.UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := recordSQLiteTaskEvent(ctx, tx, id, &from, "processing"); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqliteStore) FailTask(ctx context.Context, id string, cause error) error {
+	return s.transitionTask(ctx, id, "failed", "last_error = ?, failed_at = ?", cause.Error(), time.Now())
+}
+
+func (s *sqliteStore) TimeOutTask(ctx context.Context, id string, cause error) error {
+	return s.transitionTask(ctx, id, "timed_out", "last_error = ?", cause.Error())
+}
+
+func (s *sqliteStore) RetryTask(ctx context.Context, id string, runAt time.Time, cause error) error {
+	return s.transitionTask(ctx, id, "scheduled", "run_at = ?, last_error = ?", runAt.UTC(), cause.Error())
+}
+
+func (s *sqliteStore) RenewLease(ctx context.Context, id string, until time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE tasks SET locked_until = ? WHERE id = ? AND status = 'processing' AND locked_by = ?",
+		until.UTC(), id, instanceID())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStore) SetTaskProgress(ctx context.Context, id string, percent int, message string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE tasks SET progress = ?, progress_message = ? WHERE id = ? AND status = 'processing' AND locked_by = ?",
+		percent, message, id, instanceID())
+	return err
+}
+
+func (s *sqliteStore) CancelTask(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM tasks WHERE id = ?", id).Scan(&from)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(cancellableStatuses, from) {
+		return errTaskFinished
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE tasks SET status = 'cancelled', updated = ?, locked_by = '', locked_until = NULL WHERE id = ?",
+		time.Now(), id); err != nil {
+		return err
+	}
+	if err := recordSQLiteTaskEvent(ctx, tx, id, &from, "cancelled"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// transitionTask moves a task to a new status, applying any extra
+// assignments bound to args, and records the transition in task_events.
+// Cancelled tasks are left as they are.
+func (s *sqliteStore) transitionTask(ctx context.Context, id string, status string, set string, args ...any) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM tasks WHERE id = ?", id).Scan(&from)
+	if errors.Is(err, sql.ErrNoRows) || from == "cancelled" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if set != "" {
+		set = ", " + set
+	}
+	if _, err := tx.ExecContext(ctx,
+		fmt.Sprintf("UPDATE tasks SET status = ?, updated = ?%s WHERE id = ?", set),
+		append(append([]any{status, time.Now()}, args...), id)...); err != nil {
+		return err
+	}
+	if err := recordSQLiteTaskEvent(ctx, tx, id, &from, status); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordSQLiteTaskEvent records a status transition attributed to the actor
+// in the context.
+func recordSQLiteTaskEvent(ctx context.Context, tx *sql.Tx, id string, from *string, to string) error {
+	a := actorFromContext(ctx)
+	var workerID *string
+	if a.WorkerID != "" {
+		workerID = &a.WorkerID
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO task_events (task_id, from_status, to_status, actor, worker_id, created) VALUES (?, ?, ?, ?, ?, ?)",
+		id, from, to, a.Name, workerID, time.Now())
+	return err
+}
+
+func (s *sqliteStore) ListTaskEvents(ctx context.Context, id string) ([]taskEvent, error) {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM tasks WHERE id = ?)", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+taskEventRow.columns()+" FROM task_events WHERE task_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return taskEventRow.collect(rows)
+}
+
+func (s *sqliteStore) RequeueTasks(ctx context.Context, filter taskFilter) (int64, error) {
+	var where string
+	var args []any
+	if filter.Type != "" {
+		where += " AND type = ?"
+		args = append(args, filter.Type)
+	}
+	if filter.FailedAfter != nil {
+		where += " AND failed_at >= ?"
+		args = append(args, *filter.FailedAfter)
+	}
+	if filter.ErrorContains != "" {
+		where += " AND instr(lower(last_error), ?) > 0"
+		args = append(args, strings.ToLower(filter.ErrorContains))
+	}
+	return s.resetTasks(ctx, "failed", where, args, ", attempts = 0, last_error = NULL, failed_at = NULL")
+}
+
+func (s *sqliteStore) DebounceTask(ctx context.Context, t task) (string, error) {
+	payload, err := json.Marshal(t.Payload)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	err = s.db.QueryRowContext(ctx, `
+		UPDATE tasks SET payload = ?, run_at = ?, updated = ?
+		WHERE status = 'scheduled' AND type = ? AND tenant = ? AND debounce_key = ?
+		RETURNING id`,
+		string(payload), t.RunAt, t.Updated, t.Type, t.Tenant, t.DebounceKey).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return t.ID, s.CreateTask(ctx, t)
+}
+
+func (s *sqliteStore) ReleaseTasks(ctx context.Context, now time.Time) (int64, error) {
+	return s.resetTasks(ctx, "scheduled", " AND run_at <= ?", []any{now.UTC()}, "")
+}
+
+func (s *sqliteStore) NextTaskDue(ctx context.Context) (*time.Time, error) {
+	var next *time.Time
+	err := s.db.QueryRowContext(ctx, "SELECT run_at FROM tasks WHERE status = 'scheduled' ORDER BY run_at LIMIT 1").Scan(&next)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return next, err
+}
+
+func (s *sqliteStore) BreachTasks(ctx context.Context, taskType string, before time.Time, bump int) ([]task, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE tasks SET sla_breached_at = ?, priority = priority + ?
+		WHERE type = ? AND sla_breached_at IS NULL AND status IN ('pending', 'scheduled', 'processing')
+			AND max(julianday(created), julianday(COALESCE(run_at, created))) < julianday(?)
+		RETURNING `+sqliteTaskRow.columns(),
+		time.Now().UTC(), bump, taskType, before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteTaskRow.collect(rows)
+}
+
+func (s *sqliteStore) ReapTasks(ctx context.Context, before time.Time) (int64, error) {
+	return s.resetTasks(ctx, "processing", " AND updated < ? AND (locked_until IS NULL OR locked_until < ?)",
+		[]any{before, time.Now().UTC()}, "")
+}
+
+func (s *sqliteStore) ReturnTasks(ctx context.Context, instance string) (int64, error) {
+	return s.resetTasks(ctx, "processing", " AND locked_by = ?", []any{instance}, ", locked_by = '', locked_until = NULL")
+}
+
+// resetTasks moves tasks in the from status matching the extra where clause
+// back to pending, applying any extra assignments, and publishes an event for
+// each of them in the same transaction so the worker only sees committed
+// work.
+func (s *sqliteStore) resetTasks(ctx context.Context, from string, where string, args []any, set string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT "+sqliteTaskRow.columns()+" FROM tasks WHERE status = ?"+where+
+			" ORDER BY priority DESC, created",
+		append([]any{from}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	reset, err := sqliteTaskRow.collect(rows)
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, t := range reset {
+		t.Status, t.Updated = "pending", now
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE tasks SET status = 'pending', updated = ?"+set+" WHERE id = ?",
+			now, t.ID); err != nil {
+			return 0, err
+		}
+		if err := recordSQLiteTaskEvent(ctx, tx, t.ID, &from, t.Status); err != nil {
+			return 0, err
+		}
+		payload, err := json.Marshal(t)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO events (channel, payload) VALUES (?, ?)", tasksChannel, string(payload)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(reset)), nil
+}
+
+func (s *sqliteStore) CountFailedTasks(ctx context.Context, since time.Time) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT type, count(*) FROM tasks WHERE status = 'failed' AND failed_at >= ? GROUP BY type", since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var taskType string
+		var count int64
+		if err := rows.Scan(&taskType, &count); err != nil {
+			return nil, err
+		}
+		counts[taskType] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *sqliteStore) PurgeTasks(ctx context.Context, before time.Time) (int64, error) {
+	// Foreign keys are not enforced by default, so cascade by hand
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM task_events WHERE task_id IN (
+			SELECT id FROM tasks WHERE status = 'completed' AND updated < ?
+		)`, before); err != nil {
+		return 0, err
+	}
+	return s.purge(ctx, "tasks", before)
+}
+
+func (s *sqliteStore) DeleteUserData(ctx context.Context, userID string) (userDataReport, error) {
+	report := userDataReport{UserID: userID}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	// Everything keyed by endpoint goes before the subscriptions themselves
+	const endpoints = "SELECT endpoint FROM subscriptions WHERE user_id = ?"
+	steps := []struct {
+		count *int64
+		query string
+	}{
+		{&report.Deliveries, "DELETE FROM notification_deliveries WHERE endpoint IN (" + endpoints + ")"},
+		{&report.Failures, "DELETE FROM notification_failures WHERE endpoint IN (" + endpoints + ")"},
+		{&report.Notifications, "DELETE FROM notifications WHERE endpoint <> '' AND endpoint IN (" + endpoints + ")"},
+		{&report.Targets, "DELETE FROM notification_targets WHERE endpoint IN (" + endpoints + ")"},
+		{&report.Subscriptions, "DELETE FROM subscriptions WHERE user_id = ?"},
+		{&report.Tasks, "DELETE FROM tasks WHERE json_extract(payload, '$.user_id') = ?"},
+	}
+	for _, step := range steps {
+		result, err := tx.ExecContext(ctx, step.query, userID)
+		if err != nil {
+			return report, err
+		}
+		if *step.count, err = result.RowsAffected(); err != nil {
+			return report, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	report.Completed = time.Now()
+	return report, nil
+}
+
+func (s *sqliteStore) CreateSubscription(ctx context.Context, sub subscription) (subscription, error) {
+	tags, err := json.Marshal(tagsOrEmpty(sub.Tags))
+	if err != nil {
+		return sub, err
+	}
+	now := time.Now()
+	return sqliteSubscriptionRow.scan(s.db.QueryRowContext(ctx,
+		"INSERT INTO subscriptions (endpoint, auth, p256dh, locale, timezone, user_id, origin, vapid_public_key, content_encoding, schema_version, tags, created, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING "+sqliteSubscriptionRow.columns(),
+		sub.Endpoint, sub.Keys.Auth, sub.Keys.P256dh, sub.Locale, sub.Timezone, sub.UserID, sub.Origin, sub.VAPIDPublicKey, sub.ContentEncoding, sub.SchemaVersion, string(tags), now, now))
+}
+
+func (s *sqliteStore) ListSubscriptions(ctx context.Context) ([]subscription, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteSubscriptionRow.columns()+" FROM subscriptions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteSubscriptionRow.collect(rows)
+}
+
+func (s *sqliteStore) FindSubscriptions(ctx context.Context, filter subscriptionFilter) ([]subscription, error) {
+	query := "SELECT " + sqliteSubscriptionRow.columns() + " FROM subscriptions WHERE id > ?"
+	args := []any{filter.After}
+	if filter.Origin != "" {
+		query += " AND origin = ?"
+		args = append(args, filter.Origin)
+	}
+	if filter.Tag != "" {
+		query += " AND EXISTS (SELECT 1 FROM json_each(tags) WHERE value = ?)"
+		args = append(args, filter.Tag)
+	}
+	if filter.CreatedAfter != nil {
+		query += " AND julianday(created) >= julianday(?)"
+		args = append(args, filter.CreatedAfter.UTC())
+	}
+	if filter.CreatedBefore != nil {
+		query += " AND julianday(created) < julianday(?)"
+		args = append(args, filter.CreatedBefore.UTC())
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY id LIMIT ?", append(args, filter.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteSubscriptionRow.collect(rows)
+}
+
+func (s *sqliteStore) GetSubscription(ctx context.Context, id int) (subscription, error) {
+	sub, err := sqliteSubscriptionRow.scan(s.db.QueryRowContext(ctx,
+		"SELECT "+sqliteSubscriptionRow.columns()+" FROM subscriptions WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub, errNotFound
+	}
+	return sub, err
+}
+
+func (s *sqliteStore) SnoozeSubscription(ctx context.Context, id int, until *time.Time) (subscription, error) {
+	sub, err := sqliteSubscriptionRow.scan(s.db.QueryRowContext(ctx,
+		"UPDATE subscriptions SET snoozed_until = ?, updated = ? WHERE id = ? RETURNING "+sqliteSubscriptionRow.columns(),
+		until, time.Now(), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub, errNotFound
+	}
+	return sub, err
+}
+
+func (s *sqliteStore) SubscriptionTimezones(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT timezone FROM subscriptions ORDER BY timezone")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var timezones []string
+	for rows.Next() {
+		var tz string
+		if err := rows.Scan(&tz); err != nil {
+			return nil, err
+		}
+		timezones = append(timezones, tz)
+	}
+	return timezones, rows.Err()
+}
+
+func (s *sqliteStore) CreateTemplate(ctx context.Context, t notificationTemplate) (notificationTemplate, error) {
+	result, err := s.db.ExecContext(ctx,
+		"INSERT INTO templates (name, body, created, updated) VALUES (?, ?, ?, ?)",
+		t.Name, t.Body, t.Created, t.Updated)
+	if err != nil {
+		return t, err
+	}
+	id, err := result.LastInsertId()
+	t.ID = int(id)
+	return t, err
+}
+
+func (s *sqliteStore) ListTemplates(ctx context.Context) ([]notificationTemplate, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+templateRow.columns()+" FROM templates ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return templateRow.collect(rows)
+}
+
+func (s *sqliteStore) GetTemplate(ctx context.Context, id int) (notificationTemplate, error) {
+	t, err := templateRow.scan(s.db.QueryRowContext(ctx,
+		"SELECT "+templateRow.columns()+" FROM templates WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, errNotFound
+	}
+	return t, err
+}
+
+func (s *sqliteStore) UpdateTemplate(ctx context.Context, t notificationTemplate) (notificationTemplate, error) {
+	err := s.db.QueryRowContext(ctx,
+		"UPDATE templates SET name = ?, body = ?, updated = ? WHERE id = ? RETURNING created",
+		t.Name, t.Body, t.Updated, t.ID).Scan(&t.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, errNotFound
+	}
+	return t, err
+}
+
+func (s *sqliteStore) ListFlags(ctx context.Context) ([]featureFlag, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteFlagRow.columns()+" FROM feature_flags ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteFlagRow.collect(rows)
+}
+
+func (s *sqliteStore) SetFlag(ctx context.Context, f featureFlag) (featureFlag, error) {
+	tenants, err := json.Marshal(f.Tenants)
+	if err != nil {
+		return f, err
+	}
+	return sqliteFlagRow.scan(s.db.QueryRowContext(ctx, `
+		INSERT INTO feature_flags (name, enabled, tenants, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET enabled = excluded.enabled, tenants = excluded.tenants, updated = excluded.updated
+		RETURNING `+sqliteFlagRow.columns(),
+		f.Name, f.Enabled, string(tenants), time.Now()))
+}
+
+func (s *sqliteStore) DeleteFlag(ctx context.Context, name string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM feature_flags WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeleteTemplate(ctx context.Context, id int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM templates WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) CreateVAPIDKey(ctx context.Context, k vapidKey) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO vapid_keys (public_key, private_key, created) VALUES (?, ?, ?) ON CONFLICT (public_key) DO NOTHING",
+		k.PublicKey, k.PrivateKey, k.Created)
+	return err
+}
+
+func (s *sqliteStore) ListVAPIDKeys(ctx context.Context) ([]vapidKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+vapidKeyRow.columns()+" FROM vapid_keys ORDER BY created, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return vapidKeyRow.collect(rows)
+}
+
+func (s *sqliteStore) RewriteColumns(ctx context.Context, table encryptedTable, after int64, limit int,
+	rewrite func(col encryptedColumn, value string) (string, bool, error)) (int64, int, int, error) {
+	names := make([]string, len(table.columns))
+	sets := make([]string, len(table.columns))
+	for i, col := range table.columns {
+		names[i] = col.name
+		sets[i] = col.name + " = ?"
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return after, 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id, "+strings.Join(names, ", ")+" FROM "+table.name+" WHERE id > ? ORDER BY id LIMIT ?",
+		after, limit)
+	if err != nil {
+		return after, 0, 0, err
+	}
+	type row struct {
+		id     int64
+		values []*string
+	}
+	var batch []row
+	for rows.Next() {
+		r := row{values: make([]*string, len(table.columns))}
+		dest := []any{&r.id}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return after, 0, 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return after, 0, 0, err
+	}
+
+	last, rewritten := after, 0
+	for _, r := range batch {
+		last = r.id
+		changed, err := rewriteRow(table, r.values, rewrite)
+		if err != nil {
+			return after, 0, 0, fmt.Errorf("row %d: %w", r.id, err)
+		}
+		if !changed {
+			continue
+		}
+		args := make([]any, 0, len(r.values)+1)
+		for _, v := range r.values {
+			args = append(args, v)
+		}
+		args = append(args, r.id)
+		if _, err := tx.ExecContext(ctx, "UPDATE "+table.name+" SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+			return after, 0, 0, err
+		}
+		rewritten++
+	}
+	if err := tx.Commit(); err != nil {
+		return after, 0, 0, err
+	}
+	return last, len(batch), rewritten, nil
+}
+
+// nullableJSON encodes v as JSON text, or NULL when v is nil.
+func nullableJSON[T any](v *T) (*string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+func (s *sqliteStore) CreateSchedule(ctx context.Context, sc schedule) (schedule, error) {
+	t, err := nullableJSON(sc.Task)
+	if err != nil {
+		return sc, err
+	}
+	n, err := nullableJSON(sc.Notification)
+	if err != nil {
+		return sc, err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		"INSERT INTO schedules (rule, task, notification, next_run, created, updated) VALUES (?, ?, ?, ?, ?, ?)",
+		sc.Rule, t, n, sc.NextRun, sc.Created, sc.Updated)
+	if err != nil {
+		return sc, err
+	}
+	id, err := result.LastInsertId()
+	sc.ID = int(id)
+	return sc, err
+}
+
+func (s *sqliteStore) ListSchedules(ctx context.Context) ([]schedule, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteScheduleRow.columns()+" FROM schedules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteScheduleRow.collect(rows)
+}
+
+func (s *sqliteStore) DeleteSchedule(ctx context.Context, id int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM schedules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) DueSchedules(ctx context.Context, now time.Time) ([]schedule, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+sqliteScheduleRow.columns()+" FROM schedules WHERE next_run <= ? ORDER BY next_run", now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteScheduleRow.collect(rows)
+}
+
+func (s *sqliteStore) SetScheduleNextRun(ctx context.Context, id int, next *time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE schedules SET next_run = ?, updated = ? WHERE id = ?", next, time.Now(), id)
+	return err
+}
+
+func (s *sqliteStore) CreateNotification(ctx context.Context, n notification) (int, error) {
+	bodies, err := json.Marshal(bodiesOrEmpty(n.Bodies))
+	if err != nil {
+		return 0, err
+	}
+	variants, err := json.Marshal(variantsOrEmpty(n.Variants))
+	if err != nil {
+		return 0, err
+	}
+	content, err := json.Marshal(n.Content)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The notification and its targets commit together, and so does the
+	// event announcing it to workers
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO notifications (body, bodies, variants, content, status, dry_run, priority, endpoint, targeted, local_time, timezone, origin, send_at, traceparent, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		n.Body, string(bodies), string(variants), string(content), initialStatus(n), n.DryRun,
+		n.Priority, n.Endpoint, len(n.Targets) > 0, n.LocalTime, n.Timezone, n.Origin, n.SendAt, n.Traceparent, n.Created, n.Updated)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, endpoint := range n.Targets {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT OR IGNORE INTO notification_targets (notification_id, endpoint) VALUES (?, ?)", id, endpoint); err != nil {
+			return 0, err
+		}
+	}
+	return int(id), tx.Commit()
+}
+
+func (s *sqliteStore) NotificationTargets(ctx context.Context, id int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT endpoint FROM notification_targets WHERE notification_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []string
+	for rows.Next() {
+		var endpoint string
+		if err := rows.Scan(&endpoint); err != nil {
+			return nil, err
+		}
+		targets = append(targets, endpoint)
+	}
+	return targets, rows.Err()
+}
+
+func (s *sqliteStore) ListNotifications(ctx context.Context, filter notificationListFilter) ([]notification, error) {
+	query := "SELECT " + sqliteNotificationRow.columns() + " FROM notifications WHERE 1 = 1"
+	var args []any
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.CreatedAfter != nil {
+		query += " AND julianday(created) >= julianday(?)"
+		args = append(args, filter.CreatedAfter.UTC())
+	}
+	if filter.CreatedBefore != nil {
+		query += " AND julianday(created) < julianday(?)"
+		args = append(args, filter.CreatedBefore.UTC())
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteNotificationRow.collect(rows)
+}
+
+func (s *sqliteStore) GetNotification(ctx context.Context, id int) (notification, error) {
+	n, err := sqliteNotificationRow.scan(s.db.QueryRowContext(ctx,
+		"SELECT "+sqliteNotificationRow.columns()+" FROM notifications WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return n, errNotFound
+	}
+	return n, err
+}
+
+func (s *sqliteStore) SetNotificationStatus(ctx context.Context, id int, status string) error {
+	worker := actorFromContext(ctx).WorkerID
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE notifications SET status = ?1, updated = ?2,
+			processed_by = CASE WHEN ?1 = 'processing' AND ?3 <> '' THEN ?3 ELSE processed_by END,
+			claimed_by = CASE WHEN ?1 = 'processing' THEN ?5 ELSE claimed_by END,
+			claimed_at = CASE WHEN ?1 = 'processing' THEN ?2 ELSE claimed_at END
+		WHERE id = ?4`, status, time.Now(), worker, id, instanceID())
+	return err
+}
+
+func (s *sqliteStore) FailNotification(ctx context.Context, id int, cause error) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE notifications SET status = 'failed', last_error = ?, failed_at = ?, updated = ? WHERE id = ?",
+		cause.Error(), time.Now(), time.Now(), id)
+	return err
+}
+
+func (s *sqliteStore) ScheduledNotifications(ctx context.Context) ([]notification, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteNotificationRow.columns()+
+		" FROM notifications WHERE status = 'scheduled' AND local_time <> '' ORDER BY created")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqliteNotificationRow.collect(rows)
+}
+
+func (s *sqliteStore) ExpandNotification(ctx context.Context, id int, waves []notification) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the first expansion of a notification wins
+	result, err := tx.ExecContext(ctx,
+		"UPDATE notifications SET status = 'expanded', updated = ? WHERE id = ? AND status = 'scheduled'",
+		time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return err
+	}
+
+	for _, n := range waves {
+		bodies, err := json.Marshal(bodiesOrEmpty(n.Bodies))
+		if err != nil {
+			return err
+		}
+		variants, err := json.Marshal(variantsOrEmpty(n.Variants))
+		if err != nil {
+			return err
+		}
+		content, err := json.Marshal(n.Content)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO notifications (body, bodies, variants, content, status, dry_run, priority, timezone, origin, send_at, traceparent, created, updated)
+			VALUES (?, ?, ?, ?, 'scheduled', ?, ?, ?, ?, ?, ?, ?, ?)`,
+			n.Body, string(bodies), string(variants), string(content), n.DryRun, n.Priority, n.Timezone, n.Origin, n.SendAt, n.Traceparent, n.Created, n.Updated); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) CountFailedNotifications(ctx context.Context, since time.Time) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT count(*) FROM notifications WHERE status = 'failed' AND failed_at >= ?", since).Scan(&count)
+	return count, err
+}
+
+func (s *sqliteStore) DeferNotification(ctx context.Context, id int, at time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE notifications SET status = 'scheduled', send_at = ?, updated = ? WHERE id = ?",
+		at.UTC(), time.Now(), id)
+	return err
+}
+
+func (s *sqliteStore) ReleaseNotifications(ctx context.Context, now time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Queue due notifications and publish an event for each of them in the
+	// same transaction so the worker only sees committed work
+	rows, err := tx.QueryContext(ctx,
+		"UPDATE notifications SET status = 'pending', updated = ? WHERE status = 'scheduled' AND send_at <= ? RETURNING id",
+		now, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO events (channel, payload) SELECT ?, "+sqliteNotificationPayload+" FROM notifications WHERE id = ?",
+			notificationsChannel, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+func (s *sqliteStore) RequeueNotifications(ctx context.Context, filter notificationFilter) (int64, error) {
+	where := "status = 'failed'"
+	args := []any{time.Now()}
+	if filter.FailedAfter != nil {
+		where += " AND failed_at >= ?"
+		args = append(args, *filter.FailedAfter)
+	}
+	if filter.ErrorContains != "" {
+		where += " AND instr(lower(last_error), ?) > 0"
+		args = append(args, strings.ToLower(filter.ErrorContains))
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Reset matching notifications and publish an event for each of them in
+	// the same transaction so the worker only sees committed work
+	rows, err := tx.QueryContext(ctx,
+		"UPDATE notifications SET status = 'pending', last_error = NULL, failed_at = NULL, updated = ? WHERE "+where+" RETURNING id",
+		args...)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO events (channel, payload) SELECT ?, "+sqliteNotificationPayload+" FROM notifications WHERE id = ?",
+			notificationsChannel, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+func (s *sqliteStore) ListDeliveryFailures(ctx context.Context, id int) ([]deliveryFailure, error) {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM notifications WHERE id = ?)", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deliveryFailureRow.columns()+" FROM notification_failures WHERE notification_id = ? ORDER BY endpoint", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return deliveryFailureRow.collect(rows)
+}
+
+func (s *sqliteStore) SetDeliveryFailures(ctx context.Context, id int, failures []deliveryFailure) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM notification_failures WHERE notification_id = ?", id); err != nil {
+		return err
+	}
+	for _, f := range failures {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO notification_failures (notification_id, endpoint, attempts, last_error, created)
+			VALUES (?, ?, ?, ?, ?)`,
+			id, f.Endpoint, f.Attempts, f.Error, f.Created); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) RecordDeliveries(ctx context.Context, id int, deliveries []delivery) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range deliveries {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO notification_deliveries (notification_id, endpoint, variant, created)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (notification_id, endpoint) DO UPDATE SET variant = excluded.variant, created = excluded.created`,
+			id, d.Endpoint, d.Variant, d.Created); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) ListDeliveries(ctx context.Context, id int) ([]delivery, error) {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM notifications WHERE id = ?)", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deliveryRow.columns()+" FROM notification_deliveries WHERE notification_id = ? ORDER BY created", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return deliveryRow.collect(rows)
+}
+
+func (s *sqliteStore) PurgeNotifications(ctx context.Context, before time.Time) (int64, error) {
+	// Foreign keys are not enforced by default, so cascade by hand
+	for _, table := range []string{"notification_deliveries", "notification_targets"} {
+		if _, err := s.db.ExecContext(ctx, `
+			DELETE FROM `+table+` WHERE notification_id IN (
+				SELECT id FROM notifications WHERE status = 'completed' AND updated < ?
+			)`, before); err != nil {
+			return 0, err
+		}
+	}
+	return s.purge(ctx, "notifications", before)
+}
+
+// purge deletes completed rows from the table that were last updated before
+// the cutoff, in batches.
+func (s *sqliteStore) purge(ctx context.Context, table string, before time.Time) (int64, error) {
+	var deleted int64
+	for {
+		result, err := s.db.ExecContext(ctx, fmt.Sprintf(`
+			DELETE FROM %[1]s
+			WHERE id IN (
+				SELECT id FROM %[1]s
+				WHERE status = 'completed' AND updated < ?
+				LIMIT ?
+			)`, table),
+			before, purgeBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += affected
+		if affected < purgeBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// sqliteListener polls the events table for a single channel.
+type sqliteListener struct {
+	store   *sqliteStore
+	channel string
+	seq     int64
+	pending []*pgconn.Notification
+}
+
+func (l *sqliteListener) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	for len(l.pending) == 0 {
+		if err := l.poll(ctx); err != nil {
+			return nil, err
+		}
+		if len(l.pending) > 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.store.pollInterval):
+		}
+	}
+
+	notification := l.pending[0]
+	l.pending = l.pending[1:]
+	return notification, nil
+}
+
+// poll loads events published since the last one seen and prunes events
+// older than the retention window.
+func (l *sqliteListener) poll(ctx context.Context) error {
+	rows, err := l.store.db.QueryContext(ctx,
+		"SELECT seq, payload FROM events WHERE channel = ? AND seq > ? ORDER BY seq LIMIT 100",
+		l.channel, l.seq)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&l.seq, &payload); err != nil {
+			return err
+		}
+		l.pending = append(l.pending, &pgconn.Notification{Channel: l.channel, Payload: payload})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = l.store.db.ExecContext(ctx,
+		"DELETE FROM events WHERE created < ?", time.Now().Add(-eventRetention).UTC().Format(time.DateTime))
+	return err
+}
+
+func (l *sqliteListener) Ping(ctx context.Context) error {
+	return l.store.db.PingContext(ctx)
+}
+
+func (l *sqliteListener) Close() {}
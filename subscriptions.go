@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+// Subscription list page sizes.
+const (
+	defaultSubscriptionPage = 100
+	maxSubscriptionPage     = 1000
+)
+
+// maxSubscriptionTags is how many tags a subscription may carry.
+const maxSubscriptionTags = 32
+
+// tagsOrEmpty returns the tags, or an empty list when there are none, so
+// they store as an empty JSON array rather than null.
+func tagsOrEmpty(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+// validateTags checks a subscription's tags are non-blank, and few enough.
+func validateTags(tags []string) error {
+	if len(tags) > maxSubscriptionTags {
+		return fmt.Errorf("at most %d tags are allowed", maxSubscriptionTags)
+	}
+	for _, tag := range tags {
+		if strings.TrimSpace(tag) == "" {
+			return errors.New("tags must not be blank")
+		}
+	}
+	return nil
+}
+
+// matches reports whether a subscription passes the filter, ignoring the
+// page bounds.
+func (f subscriptionFilter) matches(sub subscription) bool {
+	return (f.Origin == "" || sub.Origin == f.Origin) &&
+		(f.Tag == "" || slices.Contains(sub.Tags, f.Tag)) &&
+		(f.CreatedAfter == nil || !sub.Created.Before(*f.CreatedAfter)) &&
+		(f.CreatedBefore == nil || sub.Created.Before(*f.CreatedBefore))
+}
+
+// parseSubscriptionFilter reads a subscription filter from the tag, origin,
+// created_after, created_before, after and limit query parameters.
+func parseSubscriptionFilter(query url.Values) (subscriptionFilter, error) {
+	filter := subscriptionFilter{Tag: query.Get("tag"), Limit: defaultSubscriptionPage}
+	if origin := query.Get("origin"); origin != "" {
+		normalized, err := normalizeOrigin(origin)
+		if err != nil {
+			return filter, err
+		}
+		filter.Origin = normalized
+	}
+	var err error
+	if filter.CreatedAfter, filter.CreatedBefore, err = parseCreatedRange(query); err != nil {
+		return filter, err
+	}
+	if v := query.Get("after"); v != "" {
+		after, err := strconv.Atoi(v)
+		if err != nil || after < 0 {
+			return filter, errors.New("after must be a subscription id")
+		}
+		filter.After = after
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxSubscriptionPage {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxSubscriptionPage)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// subscriptionView is a subscription as returned by the API. Its push keys
+// are left out unless the caller is allowed to see them.
+type subscriptionView struct {
+	subscription
+	Keys *webpush.Keys `json:"keys,omitempty"`
+}
+
+// newSubscriptionView returns the subscription with its keys only when
+// showKeys is set.
+func newSubscriptionView(sub subscription, showKeys bool) subscriptionView {
+	view := subscriptionView{subscription: sub}
+	if showKeys {
+		view.Keys = &sub.Keys
+	}
+	return view
+}
+
+// showSubscriptionKeys reports whether a request may see subscription push
+// keys: it must ask for them with include_keys=true and carry the
+// configured SUBSCRIPTION_KEYS_TOKEN as a bearer token. With no token
+// configured keys are never returned.
+func showSubscriptionKeys(cfg config, r *http.Request) bool {
+	if cfg.SubscriptionKeysToken == "" || r.URL.Query().Get("include_keys") != "true" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.SubscriptionKeysToken)) == 1
+}
+
+// listSubscriptions lists a page of subscriptions, optionally filtered by
+// tag, origin and creation time. A full page links to the next one.
+func listSubscriptions(cfg config, store SubscriptionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseSubscriptionFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		subs, err := store.FindSubscriptions(r.Context(), filter)
+		if err != nil {
+			http.Error(w, "failed to read subscriptions", http.StatusInternalServerError)
+			return
+		}
+
+		if len(subs) == filter.Limit {
+			next := r.URL.Query()
+			next.Set("after", strconv.Itoa(subs[len(subs)-1].ID))
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+		}
+
+		showKeys := showSubscriptionKeys(cfg, r)
+		views := make([]subscriptionView, len(subs))
+		for i, sub := range subs {
+			views[i] = newSubscriptionView(sub, showKeys)
+		}
+		writeJSON(w, r, http.StatusOK, views)
+	}
+}
+
+// getSubscription returns a single subscription.
+func getSubscription(cfg config, store SubscriptionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid subscription id", http.StatusBadRequest)
+			return
+		}
+
+		sub, err := store.GetSubscription(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "subscription not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to read subscription", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, newSubscriptionView(sub, showSubscriptionKeys(cfg, r)))
+	}
+}
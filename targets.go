@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// maxTargets caps the explicit target list of a single notification.
+const maxTargets = 100000
+
+// validateTargets checks a notification's explicit target list. Targets are
+// stored with the notification in one transaction, so a broadcast to
+// thousands of subscriptions is either created whole or not at all.
+func validateTargets(n notification) error {
+	if len(n.Targets) == 0 {
+		return nil
+	}
+	if len(n.Targets) > maxTargets {
+		return errors.New("too many targets")
+	}
+	if n.Endpoint != "" {
+		return errors.New("targets and endpoint are mutually exclusive")
+	}
+	if n.LocalTime != "" {
+		return errors.New("targets and local_time are mutually exclusive")
+	}
+	for _, endpoint := range n.Targets {
+		if endpoint == "" {
+			return errors.New("targets must be subscription endpoints")
+		}
+	}
+	return nil
+}
+
+// normalizeOrigin returns a web origin in its serialized form, lowercase
+// scheme://host[:port] with no path, so an origin sent by a browser and one
+// written by hand compare equal.
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return "", errors.New("origin must be scheme://host[:port]")
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// targetSubscriptions narrows the subscriptions to those a notification
+// reaches: a timezone wave only reaches its timezone, a notification for
+// one frontend only its origin, one for an endpoint only that subscription,
+// and one with a target list only the targets.
+func targetSubscriptions(n notification, subscriptions []subscription, targets []string) []subscription {
+	var reached []subscription
+	for _, sub := range subscriptions {
+		switch {
+		case n.Timezone != "" && subscriptionTimezone(sub) != n.Timezone:
+		case n.Origin != "" && sub.Origin != n.Origin:
+		case n.Endpoint != "" && sub.Endpoint != n.Endpoint:
+		default:
+			reached = append(reached, sub)
+		}
+	}
+	if n.Targeted {
+		reached = filterTargets(reached, targets)
+	}
+	return reached
+}
+
+// countRecipients returns how many subscriptions a notification would be
+// pushed to, across every wave of a notification at a local time, before
+// snoozes are applied.
+func countRecipients(ctx context.Context, store SubscriptionStore, n notification) (int, error) {
+	subscriptions, err := store.ListSubscriptions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if n.LocalTime != "" {
+		n.Timezone = ""
+	}
+	n.Targeted = len(n.Targets) > 0
+	return len(targetSubscriptions(n, subscriptions, n.Targets)), nil
+}
+
+// filterTargets returns the subscriptions whose endpoint is a target.
+func filterTargets(subscriptions []subscription, targets []string) []subscription {
+	set := make(map[string]bool, len(targets))
+	for _, endpoint := range targets {
+		set[endpoint] = true
+	}
+	var targeted []subscription
+	for _, sub := range subscriptions {
+		if set[sub.Endpoint] {
+			targeted = append(targeted, sub)
+		}
+	}
+	return targeted
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// TaskHandler processes a single task. Returning an error wrapped with
+// permanent fails the task without further retries.
+type TaskHandler func(ctx context.Context, t task) error
+
+// RetryPolicy controls how a task type is retried when its handler fails.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times the handler runs before the task
+	// fails. Values below 1 mean a single attempt.
+	MaxAttempts int
+	// Backoff decides how long to wait before each retry.
+	Backoff Backoff
+	// Retryable reports whether an error is worth retrying. When nil every
+	// error not wrapped with permanent is retried.
+	Retryable func(err error) bool
+}
+
+// defaultRetryPolicy applies to task types registered without a policy.
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     exponentialBackoff{Base: time.Second, Max: time.Minute},
+}
+
+// retryable reports whether the policy retries the error.
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return !errors.As(err, new(*permanentError))
+}
+
+// delay returns how long to wait before the retry attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	if p.Backoff == nil {
+		return 0
+	}
+	return p.Backoff.Delay(attempt)
+}
+
+// permanentError marks an error as terminal so it is never retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent wraps err so the task fails without further retries.
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// errNoHandler fails tasks of a type no handler is registered for.
+var errNoHandler = errors.New("no handler registered for task type")
+
+// taskRegistry maps task types to their handlers and retry policies.
+type taskRegistry struct {
+	handlers map[string]registeredHandler
+	fallback registeredHandler
+	// policy applies to handlers registered without their own
+	policy RetryPolicy
+}
+
+type registeredHandler struct {
+	handle TaskHandler
+	policy RetryPolicy
+}
+
+// newTaskRegistry creates a registry whose unregistered task types are
+// handled by fallback, and whose handlers registered without a policy use
+// the specified retry policy.
+func newTaskRegistry(fallback TaskHandler, policy RetryPolicy) *taskRegistry {
+	return &taskRegistry{
+		handlers: map[string]registeredHandler{},
+		fallback: registeredHandler{handle: fallback, policy: policy},
+		policy:   policy,
+	}
+}
+
+// Register handles tasks of the specified type with fn, retrying failures
+// according to policy.
+func (r *taskRegistry) Register(taskType string, fn TaskHandler, policy RetryPolicy) {
+	r.handlers[taskType] = registeredHandler{handle: fn, policy: policy}
+}
+
+// RegisterHandler handles tasks of the specified type with fn, retrying
+// failures according to the registry's default policy.
+func (r *taskRegistry) RegisterHandler(taskType string, fn TaskHandler) {
+	r.Register(taskType, fn, r.policy)
+}
+
+// failUnregistered fails a task of a type no handler is registered for,
+// without retrying it.
+func failUnregistered(ctx context.Context, t task) error {
+	return permanent(fmt.Errorf("%w %q", errNoHandler, t.Type))
+}
+
+// wrap replaces every handler, the fallback included, with fn applied to it.
+func (r *taskRegistry) wrap(fn func(TaskHandler) TaskHandler) {
+	for taskType, h := range r.handlers {
+		h.handle = fn(h.handle)
+		r.handlers[taskType] = h
+	}
+	r.fallback.handle = fn(r.fallback.handle)
+}
+
+// lookup returns the handler registered for the task type.
+func (r *taskRegistry) lookup(taskType string) registeredHandler {
+	if h, ok := r.handlers[taskType]; ok {
+		return h
+	}
+	return r.fallback
+}
+
+// taskHandlers returns the registry of built-in task handlers. Types
+// registered without their own policy use the specified one. Tasks of
+// unregistered types fail, or are only logged when logUnregistered is set.
+func taskHandlers(logger *slog.Logger, policy RetryPolicy, logUnregistered bool) *taskRegistry {
+	logTask := func(ctx context.Context, t task) error {
+		logger.InfoContext(ctx, "Processing task", slog.Any("task", t))
+		return nil
+	}
+
+	fallback := failUnregistered
+	if logUnregistered {
+		fallback = logTask
+	}
+	r := newTaskRegistry(fallback, policy)
+	r.RegisterHandler("default", logTask)
+	r.Register(canaryTaskType, handleCanary(logger), RetryPolicy{MaxAttempts: 1})
+	noop := func(ctx context.Context, t task) error { return nil }
+	r.Register(loadgenTaskType, noop, RetryPolicy{MaxAttempts: 1})
+	r.Register(benchTaskType, noop, RetryPolicy{MaxAttempts: 1})
+	r.Register(selftestTaskType, noop, RetryPolicy{MaxAttempts: 1})
+	return r
+}
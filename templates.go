@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// renderTemplate renders a template body with the variables. Referencing a
+// variable that wasn't supplied is an error.
+func renderTemplate(body string, variables map[string]any) (string, error) {
+	tmpl, err := template.New("body").Option("missingkey=error").Parse(body)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, variables); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// validateTemplate checks that a template is named and its body parses.
+func validateTemplate(t notificationTemplate) error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if t.Body == "" {
+		return errors.New("body is required")
+	}
+	if _, err := template.New("body").Parse(t.Body); err != nil {
+		return err
+	}
+	return nil
+}
+
+// templateID parses the template id from the request path.
+func templateID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid template id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// createTemplate creates a new notification template.
+func createTemplate(store TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t notificationTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			return
+		}
+		if err := validateTemplate(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		t.Created, t.Updated = now, now
+		t, err := store.CreateTemplate(r.Context(), t)
+		if err != nil {
+			log.Printf("Error creating template: %v\n", err)
+			http.Error(w, "failed to store template", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusCreated, t)
+	}
+}
+
+// listTemplates lists all notification templates.
+func listTemplates(store TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		templates, err := store.ListTemplates(r.Context())
+		if err != nil {
+			http.Error(w, "failed to read templates", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, templates)
+	}
+}
+
+// getTemplate returns a single notification template.
+func getTemplate(store TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := templateID(w, r)
+		if !ok {
+			return
+		}
+
+		t, err := store.GetTemplate(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "template not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to read template", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, t)
+	}
+}
+
+// updateTemplate replaces the name and body of a notification template.
+func updateTemplate(store TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := templateID(w, r)
+		if !ok {
+			return
+		}
+
+		var t notificationTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "failed to decode request", http.StatusBadRequest)
+			return
+		}
+		if err := validateTemplate(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		t.ID, t.Updated = id, time.Now()
+		t, err := store.UpdateTemplate(r.Context(), t)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "template not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error updating template: %v\n", err)
+			http.Error(w, "failed to update template", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, t)
+	}
+}
+
+// deleteTemplate deletes a notification template.
+func deleteTemplate(store TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := templateID(w, r)
+		if !ok {
+			return
+		}
+
+		if err := store.DeleteTemplate(r.Context(), id); err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "template not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error deleting template: %v\n", err)
+			http.Error(w, "failed to delete template", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// previewRequest supplies the sample variables a template is rendered with.
+type previewRequest struct {
+	Variables map[string]any `json:"variables"`
+}
+
+// previewTemplate renders a notification template with sample variables
+// without sending anything.
+func previewTemplate(store TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := templateID(w, r)
+		if !ok {
+			return
+		}
+
+		var req previewRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "failed to decode request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		t, err := store.GetTemplate(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				http.Error(w, "template not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to read template", http.StatusInternalServerError)
+			return
+		}
+
+		body, err := renderTemplate(t.Body, req.Variables)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, map[string]string{"body": body})
+	}
+}
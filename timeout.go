@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// requestTimeouts are the deadlines requests must finish by.
+type requestTimeouts struct {
+	// Default applies to routes without their own timeout.
+	Default time.Duration
+	// Routes maps route patterns, as registered in addRoutes, to their
+	// timeout. 0 disables the timeout for a route.
+	Routes map[string]time.Duration
+}
+
+// timeout returns the timeout for the route pattern.
+func (t requestTimeouts) timeout(pattern string) time.Duration {
+	if d, ok := t.Routes[pattern]; ok {
+		return d
+	}
+	return t.Default
+}
+
+// timeoutMiddleware enforces the deadline of the route each request matches
+// in mux, cancelling the request context and responding 503 when it is
+// exceeded.
+func timeoutMiddleware(mux *http.ServeMux, timeouts requestTimeouts, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		d := timeouts.timeout(pattern)
+		if d <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.TimeoutHandler(next, d, "request timed out").ServeHTTP(w, r)
+	})
+}
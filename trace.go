@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// traceContext is a W3C trace context. It is carried from the API request
+// that enqueued work, through the traceparent column and NOTIFY payload, to
+// the worker that processes it and the push services it calls, so a single
+// trace covers the whole path.
+type traceContext struct {
+	TraceID string
+	SpanID  string
+	Flags   string
+}
+
+// parseTraceparent parses a traceparent header value, reporting false if it
+// is malformed.
+func parseTraceparent(s string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	tc := traceContext{TraceID: parts[1], SpanID: parts[2], Flags: parts[3]}
+	if parts[0] == "ff" || !isHex(parts[0], 2) || !isHex(tc.TraceID, 32) || !isHex(tc.SpanID, 16) || !isHex(tc.Flags, 2) ||
+		tc.TraceID == strings.Repeat("0", 32) || tc.SpanID == strings.Repeat("0", 16) {
+		return traceContext{}, false
+	}
+	return tc, true
+}
+
+// newTrace starts a trace with a random trace id.
+func newTrace() traceContext {
+	return traceContext{TraceID: randomHex(16), SpanID: randomHex(8), Flags: "01"}
+}
+
+// child returns a span within the same trace.
+func (tc traceContext) child() traceContext {
+	tc.SpanID = randomHex(8)
+	return tc
+}
+
+// String formats the context as a traceparent header value.
+func (tc traceContext) String() string {
+	if tc.TraceID == "" {
+		return ""
+	}
+	return "00-" + tc.TraceID + "-" + tc.SpanID + "-" + tc.Flags
+}
+
+type traceKey struct{}
+
+// withTrace returns a context carrying the trace context.
+func withTrace(ctx context.Context, tc traceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+// traceFromContext returns the trace context attached to the context, if
+// any.
+func traceFromContext(ctx context.Context) (traceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(traceContext)
+	return tc, ok
+}
+
+// traceparentFromContext returns the traceparent for work enqueued under
+// the context, or "" outside a trace.
+func traceparentFromContext(ctx context.Context) string {
+	tc, _ := traceFromContext(ctx)
+	return tc.String()
+}
+
+// resumeTrace continues the trace recorded with a task or notification in a
+// new span, starting a fresh trace when none was recorded.
+func resumeTrace(ctx context.Context, traceparent string) context.Context {
+	if tc, ok := parseTraceparent(traceparent); ok {
+		return withTrace(ctx, tc.child())
+	}
+	return withTrace(ctx, newTrace())
+}
+
+// traceMiddleware continues the trace named in each request's traceparent
+// header in a new span, or starts one, and echoes it on the response.
+func traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if ok {
+			tc = tc.child()
+		} else {
+			tc = newTrace()
+		}
+		w.Header().Set("traceparent", tc.String())
+		next.ServeHTTP(w, r.WithContext(withTrace(r.Context(), tc)))
+	})
+}
+
+// tracingTransport adds the traceparent header of the request's context to
+// outgoing requests.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if traceparent := traceparentFromContext(req.Context()); traceparent != "" && req.Header.Get("traceparent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("traceparent", traceparent)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// traceHandler is a slog.Handler adding the trace and span ids from the
+// context to every record.
+type traceHandler struct {
+	slog.Handler
+}
+
+// newTraceHandler wraps a handler with trace correlation.
+func newTraceHandler(h slog.Handler) slog.Handler {
+	return &traceHandler{Handler: h}
+}
+
+func (h *traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	if tc, ok := traceFromContext(ctx); ok {
+		record = record.Clone()
+		record.AddAttrs(slog.String("trace_id", tc.TraceID), slog.String("span_id", tc.SpanID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &traceHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *traceHandler) WithGroup(name string) slog.Handler {
+	return &traceHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+// vapidKeyringTTL is how long a keyring trusts the keys it loaded, so a
+// rotation on one instance reaches the others within it.
+const vapidKeyringTTL = 30 * time.Second
+
+// vapidKeyring holds the VAPID keypairs pushes are signed with. The newest
+// stored keypair is current: it is served to clients creating
+// subscriptions. The one before it stays previous for the transition
+// window after a rotation, so subscriptions created with it keep receiving
+// pushes until clients have resubscribed with the current key.
+type vapidKeyring struct {
+	store      VAPIDKeyStore
+	transition time.Duration
+
+	mu     sync.Mutex
+	keys   []vapidKey
+	loaded time.Time
+}
+
+// newVAPIDKeyring creates a keyring over the store, first storing the
+// configured keypairs it doesn't have yet, the previous one before the
+// current one. Setting a new current keypair and moving the old one to
+// previous therefore rotates keys at the next deploy.
+func newVAPIDKeyring(ctx context.Context, store VAPIDKeyStore, cfg config) (*vapidKeyring, error) {
+	k := &vapidKeyring{store: store, transition: cfg.VapidTransition}
+	now := time.Now()
+	configured := []vapidKey{
+		{PublicKey: cfg.VapidPreviousPublicKey, PrivateKey: cfg.VapidPreviousPrivateKey, Created: now.Add(-time.Second)},
+		{PublicKey: cfg.VapidPublicKey, PrivateKey: cfg.VapidPrivateKey, Created: now},
+	}
+
+	stored, err := store.ListVAPIDKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vapid keys: %w", err)
+	}
+	for _, key := range configured {
+		if key.PublicKey == "" || key.PrivateKey == "" || containsVAPIDKey(stored, key.PublicKey) {
+			continue
+		}
+		if err := store.CreateVAPIDKey(ctx, key); err != nil {
+			return nil, fmt.Errorf("failed to store vapid key: %w", err)
+		}
+	}
+	if err := k.reload(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// reload reads the keypairs from the store.
+func (k *vapidKeyring) reload(ctx context.Context) error {
+	keys, err := k.store.ListVAPIDKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list vapid keys: %w", err)
+	}
+	k.mu.Lock()
+	k.keys, k.loaded = keys, time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+// active returns the current keypair and, during its transition window, the
+// previous one. Both are zero when no keypair is configured.
+func (k *vapidKeyring) active(ctx context.Context) (current vapidKey, previous *vapidKey, err error) {
+	k.mu.Lock()
+	stale := time.Since(k.loaded) > vapidKeyringTTL
+	k.mu.Unlock()
+	if stale {
+		if err := k.reload(ctx); err != nil {
+			return current, nil, err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) == 0 {
+		return current, nil, nil
+	}
+	current = k.keys[len(k.keys)-1]
+	if len(k.keys) > 1 && time.Since(current.Created) < k.transition {
+		prev := k.keys[len(k.keys)-2]
+		previous = &prev
+	}
+	return current, previous, nil
+}
+
+// signingKey returns the keypair to sign pushes to a subscription created
+// with the public key. Subscriptions that predate recorded keys were created
+// with the oldest active keypair. Once a subscription's keypair is past its
+// transition window pushes are signed with the current one, and push
+// services reject them until the client resubscribes.
+func (k *vapidKeyring) signingKey(ctx context.Context, publicKey string) (vapidKey, error) {
+	current, previous, err := k.active(ctx)
+	if err != nil {
+		return current, err
+	}
+	if previous != nil && (publicKey == previous.PublicKey || publicKey == "") {
+		return *previous, nil
+	}
+	return current, nil
+}
+
+// rotate generates a new current keypair, demoting the current one to
+// previous for the transition window.
+func (k *vapidKeyring) rotate(ctx context.Context) (vapidKey, error) {
+	privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		return vapidKey{}, fmt.Errorf("failed to generate vapid keys: %w", err)
+	}
+	key := vapidKey{PublicKey: publicKey, PrivateKey: privateKey, Created: time.Now()}
+	if err := k.store.CreateVAPIDKey(ctx, key); err != nil {
+		return key, fmt.Errorf("failed to store vapid key: %w", err)
+	}
+	return key, k.reload(ctx)
+}
+
+func containsVAPIDKey(keys []vapidKey, publicKey string) bool {
+	for _, k := range keys {
+		if k.PublicKey == publicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// vapidKeysResponse is the application server keys clients subscribe with.
+type vapidKeysResponse struct {
+	PublicKey         string `json:"public_key"`
+	PreviousPublicKey string `json:"previous_public_key,omitempty"`
+}
+
+// newVAPIDKeysResponse describes the active keypairs.
+func newVAPIDKeysResponse(current vapidKey, previous *vapidKey) vapidKeysResponse {
+	response := vapidKeysResponse{PublicKey: current.PublicKey}
+	if previous != nil {
+		response.PreviousPublicKey = previous.PublicKey
+	}
+	return response
+}
+
+// getVAPIDKeys returns the public key new subscriptions should use, along
+// with the previous key during a transition window so clients can tell
+// their subscription needs renewing.
+func getVAPIDKeys(keys *vapidKeyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current, previous, err := keys.active(r.Context())
+		if err != nil {
+			http.Error(w, "failed to read vapid keys", http.StatusInternalServerError)
+			return
+		}
+		if current.PublicKey == "" {
+			http.Error(w, "no vapid key configured", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, newVAPIDKeysResponse(current, previous))
+	}
+}
+
+// rotateVAPIDKeys generates a new current keypair, keeping the old one as
+// previous for the transition window.
+func rotateVAPIDKeys(keys *vapidKeyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := keys.rotate(r.Context())
+		if err != nil {
+			log.Printf("Error rotating vapid keys: %v\n", err)
+			http.Error(w, "failed to rotate vapid keys", http.StatusInternalServerError)
+			return
+		}
+		_, previous, err := keys.active(r.Context())
+		if err != nil {
+			http.Error(w, "failed to read vapid keys", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Rotated vapid keys, new public key %s\n", key.PublicKey)
+		writeJSON(w, r, http.StatusOK, newVAPIDKeysResponse(key, previous))
+	}
+}
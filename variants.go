@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// variantsOrEmpty returns the variants, or an empty list instead of nil so
+// they are stored as a JSON array.
+func variantsOrEmpty(variants []variant) []variant {
+	if variants == nil {
+		return []variant{}
+	}
+	return variants
+}
+
+// validateVariants checks that every variant is named uniquely, has a body,
+// and that at least one of them can be picked.
+func validateVariants(variants []variant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	names := map[string]bool{}
+	total := 0
+	for _, v := range variants {
+		switch {
+		case v.Name == "":
+			return errors.New("variant name is required")
+		case names[v.Name]:
+			return fmt.Errorf("variant %q is defined more than once", v.Name)
+		case v.Body == "":
+			return fmt.Errorf("variant %q has no body", v.Name)
+		case v.Weight < 0:
+			return fmt.Errorf("variant %q has a negative weight", v.Name)
+		}
+		names[v.Name] = true
+		total += v.Weight
+	}
+	if total == 0 {
+		return errors.New("variant weights must not all be zero")
+	}
+	return nil
+}
+
+// pickVariant assigns a subscription one of the notification's variants in
+// proportion to their weights. The same subscription always gets the same
+// variant of a notification, so replays are consistent. It returns nil when
+// the notification has no variants.
+func pickVariant(n notification, endpoint string) *variant {
+	total := 0
+	for _, v := range n.Variants {
+		total += v.Weight
+	}
+	if total == 0 {
+		return nil
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d:%s", n.ID, endpoint)
+	point := int(h.Sum32() % uint32(total))
+	for i, v := range n.Variants {
+		if point < v.Weight {
+			return &n.Variants[i]
+		}
+		point -= v.Weight
+	}
+	return nil
+}
@@ -3,60 +3,245 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"time"
 
-	"github.com/SherClockHolmes/webpush-go"
 	"github.com/jackc/pgx/v5/pgconn"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type NotificationProcessor func(ctx context.Context, notification *pgconn.Notification) error
 
-// worker returns a function that starts a worker process to handle notifications
-// from the specified channel.
-const (
-	maxRetries    = 5
-	retryInterval = 5 * time.Second
-)
+// connectWait is how long to wait for the database to accept connections
+// before giving up, which can take a while after a cold start.
+type connectWait struct {
+	// attempts is how many times to try, zero to keep trying until the
+	// context is cancelled
+	attempts int
+	backoff  Backoff
+}
+
+// workerOptions configures how a worker dispatches notifications.
+type workerOptions struct {
+	scaling scaleConfig
+	// weights are the tenant dispatch weights, nil for even turns
+	weights map[string]int
+	limit   rateLimit
+	// connect is how long to wait for the database before listening
+	connect connectWait
+	// backoff spaces out reconnection attempts after losing the database
+	backoff Backoff
+	// retry is the default retry policy for work on the channel
+	retry RetryPolicy
+	// health is told while the worker is degraded, nil to not report it
+	health *health
+	// keepalive is how long the listener may sit idle before its connection
+	// is checked, zero to never check it
+	keepalive time.Duration
+	// keepaliveTimeout bounds the check
+	keepaliveTimeout time.Duration
+	// failover holds a standby's work back while it is passive, nil to
+	// always process work
+	failover *failover
+	// maintenance holds work back while the service is in maintenance
+	// mode, nil to always process work
+	maintenance *maintenance
+	// poll is how often to claim tasks left pending for longer than it,
+	// whose notifications were missed, zero to rely on notifications alone
+	poll time.Duration
+	// lease is how long tasks polled for are leased to the instance
+	lease time.Duration
+	// drain is how long processors may keep running once the worker stops
+	drain time.Duration
+	// batch gathers notifications arriving in a burst into batches
+	batch batchConfig
+}
 
-func waitForConnection(ctx context.Context, pool *pgxpool.Pool) error {
-	for i := 0; i < maxRetries; i++ {
-		if err := pool.Ping(ctx); err == nil {
+// returnUnfinishedTasks moves the tasks this instance still holds leases on
+// once its task worker has stopped, those its processors were interrupted
+// in and those claimed but never started, back to pending for another
+// instance to run.
+func returnUnfinishedTasks(ctx context.Context, logger *slog.Logger, store TaskStore) {
+	ctx, cancel := context.WithTimeout(withActor(context.WithoutCancel(ctx), "worker", ""), 5*time.Second)
+	defer cancel()
+	returned, err := store.ReturnTasks(ctx, instanceID())
+	if err != nil {
+		logger.ErrorContext(ctx, "Error returning unfinished tasks", slog.Any("error", err))
+		return
+	}
+	if returned > 0 {
+		logger.WarnContext(ctx, "Returned unfinished tasks to pending", slog.Int64("tasks", returned))
+	}
+}
+
+// drainProcessors waits for the processors to finish once the worker stops,
+// up to the timeout, then cancels the work still running and waits for the
+// processors to give up on it.
+func drainProcessors(ctx context.Context, logger *slog.Logger, channel string, done <-chan struct{}, cancel context.CancelFunc, timeout time.Duration) {
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	logger.WarnContext(ctx, "Worker drain timed out, interrupting processors",
+		slog.String("channel", channel), slog.Duration("timeout", timeout))
+	cancel()
+	<-done
+}
+
+func waitForConnection(ctx context.Context, store Store, wait connectWait) error {
+	for attempt := 1; wait.attempts <= 0 || attempt <= wait.attempts; attempt++ {
+		if err := store.Ping(ctx); err == nil {
 			return nil
 		}
 
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(retryInterval):
-			fmt.Fprintf(os.Stderr, "waiting for database connection (attempt %d/%d)\n", i+1, maxRetries)
+		case <-time.After(wait.backoff.Delay(attempt)):
+			if wait.attempts > 0 {
+				fmt.Fprintf(os.Stderr, "waiting for database connection (attempt %d/%d)\n", attempt, wait.attempts)
+			} else {
+				fmt.Fprintf(os.Stderr, "waiting for database connection (attempt %d)\n", attempt)
+			}
 		}
 	}
-	return fmt.Errorf("failed to connect to database after %d attempts", maxRetries)
+	return fmt.Errorf("failed to connect to database after %d attempts", wait.attempts)
 }
 
-func worker(pool *pgxpool.Pool, logger *slog.Logger, channelName string) func(ctx context.Context, processor NotificationProcessor) error {
+// worker returns a function that starts a worker process to handle notifications
+// from the specified channel.
+func worker(store Store, logger *slog.Logger, channelName string, opts workerOptions) func(ctx context.Context, processor NotificationProcessor) error {
 	return func(ctx context.Context, processor NotificationProcessor) error {
+		if err := validateChannel(channelName); err != nil {
+			return err
+		}
+
 		// Wait for database connection
-		if err := waitForConnection(ctx, pool); err != nil {
+		if err := waitForConnection(ctx, store, opts.connect); err != nil {
 			return fmt.Errorf("worker failed to connect to database: %w", err)
 		}
 
-		// Listen for notifications
-		conn, err := pool.Acquire(ctx)
+		// Attribute status changes made by processors to this worker
+		hostname, _ := os.Hostname()
+		ctx = withActor(ctx, "worker", fmt.Sprintf("%s/%s", hostname, channelName))
+		ctx = withQueryScope(ctx, queryScope{Channel: channelName})
+
+		// Listen for notifications, catching up on work queued while nothing
+		// was listening, most urgent first
+		listener, backlog, err := listenWithBacklog(ctx, store, channelName)
 		if err != nil {
-			return fmt.Errorf("failed to acquire connection: %w", err)
+			return err
+		}
+		defer func() {
+			if listener != nil {
+				listener.Close()
+			}
+		}()
+
+		// Dispatch notifications to an autoscaling set of processors, taking
+		// turns between tenants so none of them starves the rest
+		scaler := newAutoscaler(opts.scaling, logger, channelName, processor)
+		queue := newFairQueue(opts.weights)
+
+		// A passive standby drops what it hears, leaving it to the primary,
+		// and so does every worker during maintenance, leaving it pending
+		// until maintenance ends
+		paused := func() bool {
+			return !opts.failover.isActive() || opts.maintenance.isEnabled()
+		}
+		enqueue := func(notification *pgconn.Notification) {
+			if !paused() {
+				queue.push(notification)
+			}
+		}
+		for _, payload := range backlog {
+			enqueue(&pgconn.Notification{Channel: channelName, Payload: payload})
+		}
+		// Processors outlive the worker's context by up to the drain timeout,
+		// so shutting down lets them finish what they are running
+		work, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+		defer cancelWork()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			scaler.run(ctx, work)
+		}()
+		defer drainProcessors(ctx, logger, channelName, done, cancelWork, opts.drain)
+		go func() {
+			for {
+				// Notifications arriving in a burst share a read of the
+				// subscriptions, but are each handed to a processor
+				batch, ok := gatherBatch(ctx, queue, opts.batch)
+				if !ok {
+					return
+				}
+				if paused() {
+					continue
+				}
+				for range batch {
+					if err := opts.limit.wait(ctx, logger); err != nil {
+						return
+					}
+				}
+				batchSizes.observe(float64(len(batch)), channelName)
+				if !scaler.submit(ctx, batch) {
+					return
+				}
+			}
+		}()
+
+		// A standby taking over catches up on the work the primary left, and
+		// every worker catches up on the work queued during maintenance
+		catchUp := func(reason string) {
+			if paused() {
+				return
+			}
+			backlog, err := store.Backlog(ctx, channelName)
+			if err != nil {
+				logger.ErrorContext(ctx, "Error reading backlog on "+reason, slog.String("channel", channelName), slog.Any("error", err))
+				return
+			}
+			for _, payload := range backlog {
+				enqueue(&pgconn.Notification{Channel: channelName, Payload: payload})
+			}
+		}
+		if opts.failover != nil {
+			go func() {
+				_, changed := opts.failover.state()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-changed:
+					}
+					_, changed = opts.failover.state()
+					catchUp("takeover")
+				}
+			}()
+		}
+		if opts.maintenance != nil {
+			go func() {
+				_, changed := opts.maintenance.state()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-changed:
+					}
+					_, changed = opts.maintenance.state()
+					catchUp("resuming after maintenance")
+				}
+			}()
 		}
-		defer conn.Release()
 
-		// Start listening
-		if _, err := conn.Exec(ctx, fmt.Sprintf("LISTEN %s", channelName)); err != nil {
-			return fmt.Errorf("failed to start listening: %w", err)
+		// Notifications only speed things up: tasks whose notification was
+		// missed are claimed by polling once they have waited a full interval
+		if claimer, ok := unwrapStore(store).(taskClaimer); ok && opts.poll > 0 {
+			go pollTasks(ctx, logger, claimer, channelName, opts.poll, opts.lease, paused, queue)
 		}
 
 		for {
@@ -64,104 +249,486 @@ func worker(pool *pgxpool.Pool, logger *slog.Logger, channelName string) func(ct
 			case <-ctx.Done():
 				return nil
 			default:
-				notification, err := conn.Conn().WaitForNotification(ctx)
+				notification, err := waitWithKeepalive(ctx, listener, channelName, opts.keepalive, opts.keepaliveTimeout)
 				if err != nil {
 					if ctx.Err() != nil {
 						// Context cancelled, exit cleanly
 						return nil
 					}
-					// Log error and continue
-					fmt.Fprintf(os.Stderr, "error waiting for notification: %s\n", err)
+
+					// The database or the listening connection is gone,
+					// wait it out and listen again
+					listener.Close()
+					var backlog []string
+					listener, backlog, err = relisten(ctx, logger, store, channelName, opts, err)
+					if err != nil {
+						return nil
+					}
+					for _, payload := range backlog {
+						enqueue(&pgconn.Notification{Channel: channelName, Payload: payload})
+					}
 					continue
 				}
 
-				// Process notification
-				if err := processor(ctx, notification); err != nil {
-					// Log processing error and continue
-					fmt.Fprintf(os.Stderr, "error processing notification: %s\n", err)
+				// Payloads too large for NOTIFY, or damaged on the way, are
+				// fetched from their rows
+				notification, err = resolveNotification(ctx, store, notification)
+				if err != nil {
+					logger.ErrorContext(ctx, "Error reading notification payload", slog.String("channel", channelName), slog.Any("error", err))
+					continue
 				}
+
+				// Queue the notification for the processors
+				enqueue(notification)
 			}
 		}
 	}
 }
 
-// processTask processes a task received from the database.
-func processTask(logger *slog.Logger, pool *pgxpool.Pool) NotificationProcessor {
+// errTaskCancelled is the cause of a handler's context being cancelled
+// because its task was cancelled.
+var errTaskCancelled = errors.New("task cancelled")
+
+var tasksLeasedElsewhere = metrics.counter("tasks_leased_elsewhere_total",
+	"Task notifications skipped because another instance holds the task's lease or it is no longer pending.")
+
+// processTask processes a task received from the store with the handler
+// registered for its type, retrying failures according to the handler's
+// retry policy. The task is first leased to the instance for lease, or its
+// timeout if longer, so of the instances notified about it only one runs it,
+// and the lease is renewed for as long as the handler runs. Handlers run
+// within the task's own timeout, or timeout when it doesn't set one: once it
+// passes their context is cancelled and the task is marked timed_out. A
+// timeout of 0 lets handlers run for as long as they like. A handler that
+// panics fails the task without retrying it. While a handler runs the task
+// is checked every cancelCheck, and once it has been cancelled the handler's
+// context is cancelled and the task abandoned. When the callback webhook is
+// configured it is told about every completed, failed or timed out task
+// whose tenant has the task_callbacks flag.
+func processTask(logger *slog.Logger, store TaskStore, registry *taskRegistry, timeout, lease, cancelCheck time.Duration, callback webhook, flags *flagCache) NotificationProcessor {
 	return func(ctx context.Context, notification *pgconn.Notification) error {
 		var t task
 		if err := json.Unmarshal([]byte(notification.Payload), &t); err != nil {
 			return fmt.Errorf("failed to unmarshal task: %w", err)
 		}
+		// Scheduled tasks wait for the due task poller to queue them
+		if t.Status == "scheduled" {
+			return nil
+		}
+		ctx = withQueryScope(ctx, queryScope{Handler: t.Type})
+		limit := timeout
+		if t.TimeoutSeconds > 0 {
+			limit = time.Duration(t.TimeoutSeconds) * time.Second
+		}
 
-		// Update task status
-		if _, err := pool.Exec(ctx, "UPDATE tasks SET status = 'processing' WHERE id = $1", t.ID); err != nil {
-			return fmt.Errorf("failed to update task status: %w", err)
+		// Lease the task, or extend the lease the poller claimed it with,
+		// which may have run out while it was queued. Another instance may
+		// have won it, or it may be done already
+		if t.Status != "processing" {
+			leased, err := store.LeaseTask(ctx, t.ID, time.Now().Add(max(lease, limit)))
+			if err != nil {
+				return fmt.Errorf("failed to lease task: %w", err)
+			}
+			if !leased {
+				tasksLeasedElsewhere.inc()
+				logger.DebugContext(ctx, "Task is leased elsewhere or no longer pending", slog.String("task", t.ID))
+				return nil
+			}
+			t.Attempts++
+		} else {
+			renewed, err := store.RenewLease(ctx, t.ID, time.Now().Add(max(lease, limit)))
+			if err != nil {
+				return fmt.Errorf("failed to extend task lease: %w", err)
+			}
+			if !renewed {
+				tasksLeasedElsewhere.inc()
+				logger.DebugContext(ctx, "Claimed task was taken over or finished while queued", slog.String("task", t.ID))
+				return nil
+			}
 		}
 
-		// Process the task here
-		// For now, just log it
-		logger.InfoContext(ctx, "Processing task", slog.Any("task", t))
+		// A panicking handler fails the task outright, as another attempt
+		// would most likely panic too. The panic carries on to the recovery
+		// middleware, which logs its stack and keeps the worker running.
+		defer func() {
+			if v := recover(); v != nil {
+				err := fmt.Errorf("task panicked: %v", v)
+				if err := failTask(context.WithoutCancel(ctx), store, t.ID, err); err != nil {
+					logger.ErrorContext(ctx, "Error failing panicked task", slog.String("task", t.ID), slog.Any("error", err))
+				} else {
+					t.Status = "failed"
+					sendTaskCallback(context.WithoutCancel(ctx), logger, callback, flags, "task.failed", t)
+				}
+				panic(v)
+			}
+		}()
+		ready := taskReady(t)
+		taskStartLatency.observe(time.Since(ready).Seconds(), t.Type)
+
+		// Run the handler within the task's timeout, if it has one
+		handlerCtx := ctx
+		if limit > 0 {
+			var cancel context.CancelFunc
+			handlerCtx, cancel = context.WithTimeout(ctx, limit)
+			defer cancel()
+		}
+		handlerCtx, abandon := context.WithCancelCause(withProgress(handlerCtx, store, t.ID))
+		defer abandon(nil)
+		if cancelCheck > 0 {
+			go watchCancel(handlerCtx, logger, store, t.ID, cancelCheck, abandon)
+		}
+		if lease > 0 {
+			go renewLease(handlerCtx, logger, store, t.ID, lease)
+		}
+		h := registry.lookup(t.Type)
+		err := h.handle(handlerCtx, t)
+		if errors.Is(context.Cause(handlerCtx), errTaskCancelled) {
+			logger.InfoContext(ctx, "Task cancelled while running", slog.String("task", t.ID))
+			return nil
+		}
+		// A handler that returns successfully as the deadline passes has
+		// still done its work, so only a failure counts as a timeout.
+		if err != nil && errors.Is(handlerCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			err = fmt.Errorf("task timed out after %s: %w", limit, context.DeadlineExceeded)
+			if err := store.TimeOutTask(ctx, t.ID, err); err != nil {
+				return fmt.Errorf("failed to record task timeout: %w", err)
+			}
+			t.Status = "timed_out"
+			sendTaskCallback(ctx, logger, callback, flags, "task.timed_out", t)
+			return err
+		}
+
+		// Work interrupted by shutdown is returned to pending once the
+		// worker stops
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// A failed attempt is scheduled to run again after the policy's
+		// backoff, until the task runs out of attempts
+		if err != nil {
+			maxAttempts := t.MaxAttempts
+			if maxAttempts < 1 {
+				maxAttempts = h.policy.MaxAttempts
+			}
+			if t.Attempts >= maxAttempts || !h.policy.retryable(err) {
+				err = fmt.Errorf("task failed after %d attempt(s): %w", t.Attempts, err)
+				if err := failTask(ctx, store, t.ID, err); err != nil {
+					return err
+				}
+				t.Status = "failed"
+				sendTaskCallback(ctx, logger, callback, flags, "task.failed", t)
+				return err
+			}
+
+			delay := h.policy.delay(t.Attempts)
+			logger.WarnContext(ctx, "Retrying task",
+				slog.String("task", t.ID), slog.Int("attempt", t.Attempts), slog.Duration("delay", delay), slog.Any("error", err))
+			if err := store.RetryTask(ctx, t.ID, time.Now().Add(delay), err); err != nil {
+				return fmt.Errorf("failed to reschedule task: %w", err)
+			}
+			return nil
+		}
 
 		// Update task status
-		if _, err := pool.Exec(ctx, "UPDATE tasks SET status = 'completed' WHERE id = $1", t.ID); err != nil {
-			return fmt.Errorf("failed to update task status: %w", err)
+		if err := store.SetTaskStatus(ctx, t.ID, "completed"); err != nil {
+			err = fmt.Errorf("failed to update task status: %w", err)
+			if err := failTask(ctx, store, t.ID, err); err != nil {
+				return err
+			}
+			t.Status = "failed"
+			sendTaskCallback(ctx, logger, callback, flags, "task.failed", t)
+			return err
 		}
+		taskCompleteLatency.observe(time.Since(ready).Seconds(), t.Type)
 
+		// Callbacks are only sent once the transition is recorded, with the
+		// status it recorded
+		t.Status = "completed"
+		sendTaskCallback(ctx, logger, callback, flags, "task.completed", t)
 		return nil
 	}
 }
 
-func processNotification(cfg config, logger *slog.Logger, pool *pgxpool.Pool, client *http.Client) NotificationProcessor {
+// renewLease extends the lease on a running task to lease from now, a third
+// of the way through each lease, until the context is done. Tasks claimed
+// by the poller, and tasks whose handler may outlast the lease, would
+// otherwise be taken over by another instance while they still run.
+func renewLease(ctx context.Context, logger *slog.Logger, store TaskStore, id string, lease time.Duration) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		renewed, err := store.RenewLease(ctx, id, time.Now().Add(lease))
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.WarnContext(ctx, "Error renewing task lease", slog.String("task", id), slog.Any("error", err))
+			}
+			continue
+		}
+		if !renewed {
+			logger.WarnContext(ctx, "Task lease lost while running", slog.String("task", id))
+			return
+		}
+	}
+}
+
+// watchCancel checks on a running task every interval until the context is
+// done, cancelling it with errTaskCancelled once the task has been
+// cancelled.
+func watchCancel(ctx context.Context, logger *slog.Logger, store TaskStore, id string, interval time.Duration, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t, err := store.GetTask(ctx, id)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.WarnContext(ctx, "Error checking for task cancellation", slog.String("task", id), slog.Any("error", err))
+			}
+			continue
+		}
+		if t.Status == "cancelled" {
+			cancel(errTaskCancelled)
+			return
+		}
+	}
+}
+
+// sendTaskCallback notifies the callback webhook about a task. Delivery
+// failures are logged rather than failing the task.
+func sendTaskCallback(ctx context.Context, logger *slog.Logger, callback webhook, flags *flagCache, event string, t task) {
+	if !callback.enabled() || !flags.enabled(ctx, flagTaskCallbacks, t.Tenant) {
+		return
+	}
+	if err := callback.send(ctx, event, t); err != nil {
+		logger.ErrorContext(ctx, "Error sending task callback",
+			slog.String("event", event), slog.String("task", t.ID), slog.Any("error", err))
+	}
+}
+
+// failTask marks a task as failed and records the cause so it can be surfaced
+// through the API.
+func failTask(ctx context.Context, store TaskStore, id string, cause error) error {
+	if err := store.FailTask(ctx, id, cause); err != nil {
+		return fmt.Errorf("failed to record task failure: %w", err)
+	}
+	return nil
+}
+
+// failNotification marks a notification as failed and records the cause so it
+// can be surfaced through the API.
+func failNotification(ctx context.Context, store NotificationStore, id int, cause error) error {
+	if err := store.FailNotification(ctx, id, cause); err != nil {
+		return fmt.Errorf("failed to record notification failure: %w", err)
+	}
+	return nil
+}
+
+// processNotification broadcasts a notification to every subscription
+// through the bulkhead, retrying failed deliveries according to the retry
+// policy. Subscriptions still failing once the policy gives up are recorded
+// as delivery failures and the notification fails, leaving it in the
+// dead-letter state until it is requeued. A requeued notification is only
+// sent to the subscriptions it failed to reach. Pushes the push rate limit
+// couldn't fit in before the deadline overflow into a deferred run of the
+// notification instead.
+func processNotification(cfg config, logger *slog.Logger, store Store, client *http.Client, keys *vapidKeyring, pushes *bulkhead, limit rateLimit, policy RetryPolicy, cipher *bodyCipher) NotificationProcessor {
 	return func(ctx context.Context, pgnotification *pgconn.Notification) error {
 		var n notification
 		if err := json.Unmarshal([]byte(pgnotification.Payload), &n); err != nil {
 			return fmt.Errorf("failed to unmarshal notification: %w", err)
 		}
 
+		// Content encrypted at rest is only ever decrypted here, at send time
+		n, err := cipher.decrypt(n)
+		if err != nil {
+			err = fmt.Errorf("failed to decrypt notification: %w", err)
+			return errors.Join(err, failNotification(ctx, store, n.ID, err))
+		}
+
 		// Update notification status
-		if _, err := pool.Exec(ctx, "UPDATE notifications SET status = 'processing' WHERE id = $1", n.ID); err != nil {
+		if err := store.SetNotificationStatus(ctx, n.ID, "processing"); err != nil {
 			return fmt.Errorf("failed to update notification status: %w", err)
 		}
 
-		var subscriptions []webpush.Subscription
-		// Retrieve all subscriptions
-		rows, err := pool.Query(ctx, "SELECT endpoint, auth, p256dh FROM subscriptions")
+		// A panic fails the notification rather than leaving it processing,
+		// then carries on to the recovery middleware.
+		defer func() {
+			if v := recover(); v != nil {
+				err := fmt.Errorf("notification panicked: %v", v)
+				if err := failNotification(context.WithoutCancel(ctx), store, n.ID, err); err != nil {
+					logger.ErrorContext(ctx, "Error failing panicked notification", slog.Int("id", n.ID), slog.Any("error", err))
+				}
+				panic(v)
+			}
+		}()
+
+		// Retrieve all subscriptions, once for the whole batch
+		subscriptions, err := batchSubscriptions(ctx, store)
 		if err != nil {
-			return fmt.Errorf("failed to retrieve subscriptions: %w", err)
+			err = fmt.Errorf("failed to retrieve subscriptions: %w", err)
+			return errors.Join(err, failNotification(ctx, store, n.ID, err))
 		}
-		defer rows.Close()
 
-		for rows.Next() {
-			var s webpush.Subscription
-			if err := rows.Scan(&s.Endpoint, &s.Keys.Auth, &s.Keys.P256dh); err != nil {
-				return fmt.Errorf("failed to scan subscription: %w", err)
+		// A notification with a target list only reaches those subscriptions
+		var targets []string
+		if n.Targeted {
+			targets, err = store.NotificationTargets(ctx, n.ID)
+			if err != nil {
+				err = fmt.Errorf("failed to retrieve notification targets: %w", err)
+				return errors.Join(err, failNotification(ctx, store, n.ID, err))
 			}
-			subscriptions = append(subscriptions, s)
 		}
+		subscriptions = targetSubscriptions(n, subscriptions, targets)
 
-		for _, sub := range subscriptions {
-			response, err := webpush.SendNotification([]byte(pgnotification.Payload), &sub, &webpush.Options{
-				Subscriber:      "https://pager.com",
-				VAPIDPublicKey:  cfg.VapidPublicKey,
-				VAPIDPrivateKey: cfg.VapidPrivateKey,
-			})
-			if err != nil {
-				if _, err := pool.Exec(ctx, "UPDATE notifications SET status = 'failed' WHERE id = $1", n.ID); err != nil {
-					return fmt.Errorf("failed to update notification status: %w", err)
+		// Only retry the subscriptions a previous broadcast failed to reach
+		undelivered, err := store.ListDeliveryFailures(ctx, n.ID)
+		if err != nil {
+			err = fmt.Errorf("failed to retrieve delivery failures: %w", err)
+			return errors.Join(err, failNotification(ctx, store, n.ID, err))
+		}
+		if len(undelivered) > 0 {
+			endpoints := map[string]bool{}
+			for _, f := range undelivered {
+				endpoints[f.Endpoint] = true
+			}
+			var remaining []subscription
+			for _, sub := range subscriptions {
+				if endpoints[sub.Endpoint] {
+					remaining = append(remaining, sub)
 				}
-				return fmt.Errorf("failed to send notification: %w", err)
 			}
+			subscriptions = remaining
+		}
 
-			defer response.Body.Close()
-			body, err := io.ReadAll(response.Body)
+		// Hold back deliveries to snoozed subscriptions
+		subscriptions, err = applySnoozes(ctx, logger, store, n, subscriptions)
+		if err != nil {
+			return errors.Join(err, failNotification(ctx, store, n.ID, err))
+		}
+
+		// In dry run mode log what would have been sent instead of pushing
+		if n.DryRun || cfg.NotificationsDryRun {
+			for _, sub := range subscriptions {
+				payload, err := personalizedPayload(n, sub)
+				if err != nil {
+					err = fmt.Errorf("failed to build payload: %w", err)
+					return errors.Join(err, failNotification(ctx, store, n.ID, err))
+				}
+				logger.InfoContext(ctx, "Dry run: notification not sent",
+					slog.Int("id", n.ID),
+					slog.String("endpoint", sub.Endpoint),
+					slog.String("payload", string(payload)))
+			}
+			subscriptions = nil
+		}
+
+		// The whole broadcast, retries included, must finish by the deadline
+		broadcastCtx, cancel := context.WithCancel(ctx)
+		if cfg.NotificationDeadline > 0 {
+			broadcastCtx, cancel = context.WithTimeout(ctx, cfg.NotificationDeadline)
+		}
+		defer cancel()
+
+		// Push to every subscription at once, isolated per push service,
+		// each receiving its assigned variant or localized body
+		send := func(ctx context.Context, sub subscription) error {
+			payload, err := personalizedPayload(n, sub)
 			if err != nil {
-				return fmt.Errorf("failed to read vapid response body: %w", err)
+				return permanent(fmt.Errorf("failed to build payload: %w", err))
+			}
+			if err := limit.wait(ctx, logger); err != nil {
+				return fmt.Errorf("%w: %v", errThrottled, err)
 			}
-			logger.InfoContext(ctx, "Notification sent", slog.Any("status", response.Status), slog.Any("body", string(body)))
+			return sendPush(ctx, cfg, logger, client, keys, payload, sub)
+		}
+
+		failures := map[string]deliveryFailure{}
+		overflow := map[string]bool{}
+		var deliveries []delivery
+		for attempt := 1; len(subscriptions) > 0; attempt++ {
+			errs := pushes.broadcast(broadcastCtx, subscriptions, send)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			var retry []subscription
+			for i, sub := range subscriptions {
+				delete(overflow, sub.Endpoint)
+				if errs[i] == nil {
+					delete(failures, sub.Endpoint)
+					d := delivery{Endpoint: sub.Endpoint, Created: time.Now()}
+					if v := pickVariant(n, sub.Endpoint); v != nil {
+						d.Variant = v.Name
+					}
+					deliveries = append(deliveries, d)
+					continue
+				}
+				failures[sub.Endpoint] = deliveryFailure{
+					Endpoint: sub.Endpoint, Attempts: attempt, Error: errs[i].Error(), Created: time.Now(),
+				}
+				if errors.Is(errs[i], errThrottled) {
+					overflow[sub.Endpoint] = true
+				}
+				if policy.retryable(errs[i]) {
+					retry = append(retry, sub)
+				}
+			}
+
+			if len(retry) == 0 || attempt >= policy.MaxAttempts {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-broadcastCtx.Done():
+				// Out of time, everyone not yet reached stays undelivered
+				retry = nil
+			case <-time.After(policy.delay(attempt)):
+			}
+			subscriptions = retry
+		}
+
+		// Record who was reached, and who is still unreached, clearing
+		// anything a replay delivered
+		if err := store.RecordDeliveries(ctx, n.ID, deliveries); err != nil {
+			return fmt.Errorf("failed to record deliveries: %w", err)
+		}
+		var remaining []deliveryFailure
+		for _, f := range failures {
+			remaining = append(remaining, f)
+		}
+		if err := store.SetDeliveryFailures(ctx, n.ID, remaining); err != nil {
+			return fmt.Errorf("failed to record delivery failures: %w", err)
+		}
+
+		// Pushes held back by the push rate limit are queued for a later
+		// run that only reaches the subscriptions still unreached
+		if len(overflow) > 0 {
+			at := time.Now().Add(cfg.PushOverflowDelay)
+			if err := store.DeferNotification(ctx, n.ID, at); err != nil {
+				return fmt.Errorf("failed to defer notification: %w", err)
+			}
+			logger.WarnContext(ctx, "Push rate limit reached, deferring overflow",
+				slog.Int("id", n.ID), slog.Int("overflow", len(overflow)), slog.Time("until", at))
+			return nil
+		}
+		if len(remaining) > 0 {
+			err := fmt.Errorf("failed to deliver notification to %d subscription(s)", len(remaining))
+			return errors.Join(err, failNotification(ctx, store, n.ID, err))
 		}
 
 		// Update notification status
-		if _, err := pool.Exec(ctx, "UPDATE notifications SET status = 'completed' WHERE id = $1", n.ID); err != nil {
+		if err := store.SetNotificationStatus(ctx, n.ID, "completed"); err != nil {
 			return fmt.Errorf("failed to update notification status: %w", err)
 		}
 
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// discardLogger returns a logger that writes nowhere.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(io.Discard, nil))
+}
+
+// taskCallback is a task callback webhook event.
+type taskCallback struct {
+	Event string `json:"event"`
+	Data  task   `json:"data"`
+}
+
+// callbackRecorder is a task callback webhook endpoint recording the events
+// it receives.
+type callbackRecorder struct {
+	mu     sync.Mutex
+	events []taskCallback
+}
+
+func (c *callbackRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var event taskCallback
+	json.NewDecoder(r.Body).Decode(&event)
+	c.mu.Lock()
+	c.events = append(c.events, event)
+	c.mu.Unlock()
+}
+
+// taskNotification returns the notification a worker receives for the task.
+func taskNotification(t *testing.T, tk task) *pgconn.Notification {
+	t.Helper()
+	payload, err := json.Marshal(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pgconn.Notification{Channel: tasksChannel, Payload: string(payload)}
+}
+
+func TestProcessTaskPanic(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	tk := newTestTask("t", "pending")
+	if err := store.CreateTask(ctx, tk); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &callbackRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	logger := discardLogger()
+	registry := newTaskRegistry(func(ctx context.Context, t task) error {
+		panic("boom")
+	}, RetryPolicy{MaxAttempts: 3})
+	process := chainProcessor(
+		processTask(logger, store, registry, 0, 0, 0, webhook{URL: server.URL, Client: server.Client()}, nil),
+		recoverProcessor(logger, tasksChannel))
+
+	err := process(ctx, taskNotification(t, tk))
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("process = %v, want the panic as an error", err)
+	}
+
+	// The task fails outright rather than being retried
+	got, err := store.GetTask(ctx, tk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "failed" || got.Attempts != 1 {
+		t.Errorf("task = %s after %d attempt(s), want failed after 1", got.Status, got.Attempts)
+	}
+	if got.LastError == nil || !strings.Contains(*got.LastError, "task panicked: boom") {
+		t.Errorf("last error = %v, want the panic", got.LastError)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.events) != 1 {
+		t.Fatalf("callbacks = %d, want 1", len(recorder.events))
+	}
+	if event := recorder.events[0]; event.Event != "task.failed" || event.Data.Status != "failed" {
+		t.Errorf("callback = %s for a %s task, want task.failed for a failed one", event.Event, event.Data.Status)
+	}
+}
+
+func TestProcessTaskLeasedElsewhere(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	tk := newTestTask("t", "pending")
+	if err := store.CreateTask(ctx, tk); err != nil {
+		t.Fatal(err)
+	}
+
+	ran := 0
+	registry := newTaskRegistry(func(ctx context.Context, t task) error {
+		ran++
+		return nil
+	}, RetryPolicy{MaxAttempts: 1})
+	process := processTask(discardLogger(), store, registry, 0, 0, 0, webhook{}, nil)
+
+	// Each instance notified about the task tries to lease it, but only the
+	// first to do so runs it
+	for range 2 {
+		if err := process(ctx, taskNotification(t, tk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ran != 1 {
+		t.Errorf("handler ran %d time(s), want 1", ran)
+	}
+	got, err := store.GetTask(ctx, tk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "completed" || got.Attempts != 1 {
+		t.Errorf("task = %s after %d attempt(s), want completed after 1", got.Status, got.Attempts)
+	}
+}
+
+func TestProcessTaskClaimTakenOver(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	claimed := leasedTo(newTestTask("t", "pending"), instanceID(), time.Now().Add(-time.Minute))
+
+	// Another instance takes the task over while the claim waits in the
+	// queue with its lease run out
+	store.tasks[claimed.ID] = leasedTo(newTestTask("t", "pending"), "other", time.Now().Add(time.Minute))
+
+	ran := 0
+	registry := newTaskRegistry(func(ctx context.Context, t task) error {
+		ran++
+		return nil
+	}, RetryPolicy{MaxAttempts: 1})
+	process := processTask(discardLogger(), store, registry, 0, time.Minute, 0, webhook{}, nil)
+	if err := process(ctx, taskNotification(t, claimed)); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 0 {
+		t.Errorf("handler ran %d time(s), want 0 for a task taken over", ran)
+	}
+
+	// A claim still held has its lease extended and runs
+	store.tasks[claimed.ID] = claimed
+	if err := process(ctx, taskNotification(t, claimed)); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 1 {
+		t.Errorf("handler ran %d time(s), want 1 for a claim still held", ran)
+	}
+}
+
+func TestProcessTaskCallbacks(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler TaskHandler
+		want    string
+	}{
+		{name: "completed", handler: func(ctx context.Context, t task) error { return nil }, want: "completed"},
+		{name: "failed", handler: func(ctx context.Context, t task) error { return errors.New("boom") }, want: "failed"},
+		{name: "timed out", handler: func(ctx context.Context, t task) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, want: "timed_out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemoryStore()
+			tk := newTestTask("t", "pending")
+			if err := store.CreateTask(ctx, tk); err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := &callbackRecorder{}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+
+			registry := newTaskRegistry(tt.handler, RetryPolicy{MaxAttempts: 1})
+			process := processTask(discardLogger(), store, registry, 50*time.Millisecond, 0, 0,
+				webhook{URL: server.URL, Client: server.Client()}, nil)
+			process(ctx, taskNotification(t, tk))
+
+			got, err := store.GetTask(ctx, tk.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.want {
+				t.Errorf("status = %s, want %s", got.Status, tt.want)
+			}
+
+			// The callback carries the status the task was moved to
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			if len(recorder.events) != 1 {
+				t.Fatalf("callbacks = %d, want 1", len(recorder.events))
+			}
+			if event := recorder.events[0]; event.Event != "task."+tt.want || event.Data.Status != tt.want {
+				t.Errorf("callback = %s for a %s task, want task.%s for a %s one",
+					event.Event, event.Data.Status, tt.want, tt.want)
+			}
+		})
+	}
+}
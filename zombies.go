@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+var zombiesReleased = metrics.counter("zombie_claims_released_total",
+	"Claims released because the instance holding them stopped heartbeating, by table.", "table")
+
+// zombieJob returns tasks and notifications left in processing by an
+// instance that hasn't heartbeated for the timeout to pending, so a live
+// instance picks them up again. Unlike the reaper it doesn't need to guess
+// how long work may take: a claim is only released once its owner is gone.
+func zombieJob(logger *slog.Logger, store heartbeatStore, timeout time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		tasks, notifications, err := store.ReleaseZombies(withActor(ctx, "zombie-release", ""), timeout)
+		if err != nil {
+			return err
+		}
+		zombiesReleased.add(float64(tasks), "tasks")
+		zombiesReleased.add(float64(notifications), "notifications")
+		if tasks > 0 || notifications > 0 {
+			logger.WarnContext(ctx, "Released claims of instances that stopped heartbeating",
+				slog.Int64("tasks", tasks), slog.Int64("notifications", notifications))
+		}
+		return nil
+	}
+}